@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// accessKey is the context key of the access log entry of a request.
+type accessKey struct{}
+
+// accessEntry defines attributes added to the access log record of a request while it is handled.
+type accessEntry struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// accessLog is a middleware that emits one structured log record per request once it has been handled, with the
+// method, path, status, duration, bytes read and written, client address, and (redacted) parameters. The request ID
+// and client identity are added by the context handler.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		body := &countingReader{ReadCloser: r.Body}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		r.Body = body
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessKey{}, entry)))
+
+		// Collect record
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", ww.Status()),
+			slog.Duration("duration", time.Since(start)),
+			slog.Uint64("bytes_in", body.n.Load()),
+			slog.Int("bytes_out", ww.BytesWritten()),
+			slog.String("address", r.RemoteAddr),
+		}
+
+		if params := redactParameters(r.URL.Query()); params != nil {
+			attrs = append(attrs, slog.Any("parameters", params))
+		}
+
+		entry.mu.Lock()
+		attrs = append(attrs, entry.attrs...)
+		entry.mu.Unlock()
+
+		// Log by severity of the status
+		level := slog.LevelInfo
+
+		switch {
+		case ww.Status() >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case ww.Status() >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		slog.LogAttrs(r.Context(), level, "Request handled", attrs...)
+	})
+}
+
+// logAccess adds attributes to the access log record of the request, e.g. what is only learned by later middlewares.
+func logAccess(ctx context.Context, attrs ...slog.Attr) {
+	entry, _ := ctx.Value(accessKey{}).(*accessEntry)
+	if entry == nil {
+		return
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.attrs = append(entry.attrs, attrs...)
+}
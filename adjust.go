@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	maxGamma    = 10.0  // maxGamma is the largest supported gamma correction.
+	maxModulate = 200.0 // maxModulate is the largest supported modulation in percent.
+)
+
+// modulateOptions defines a modulation of brightness, saturation, and hue, in percent of the original values.
+type modulateOptions struct {
+	Brightness float64 `json:"brightness"` // Brightness is the brightness in percent, where 100 is unchanged.
+	Saturation float64 `json:"saturation"` // Saturation is the saturation in percent, where 100 is unchanged.
+	Hue        float64 `json:"hue"`        // Hue is the hue rotation in percent, where 100 is unchanged.
+}
+
+// adjustOptions defines the automatic contrast stretching, and the brightness, contrast, and gamma adjustments.
+type adjustOptions struct {
+	AutoLevel  bool             `json:"auto_level,omitempty"` // AutoLevel stretches each channel to the full range.
+	Normalize  bool             `json:"normalize,omitempty"`  // Normalize stretches the intensity, ignoring outliers.
+	Brightness float64          `json:"brightness,omitempty"` // Brightness changes the brightness, from -100 to 100.
+	Contrast   float64          `json:"contrast,omitempty"`   // Contrast changes the contrast, from -100 to 100.
+	Gamma      float64          `json:"gamma,omitempty"`      // Gamma is the gamma correction, or 0 if unchanged.
+	Modulate   *modulateOptions `json:"modulate,omitempty"`   // Modulate changes brightness, saturation, and hue.
+}
+
+// parseAdjustOptions parses the contrast stretching, brightness, contrast, and gamma URL parameters. It returns nil if
+// none of them are set.
+func parseAdjustOptions(query url.Values) (*adjustOptions, *apiError) {
+	opts := &adjustOptions{}
+	set := false
+
+	// Parse contrast stretching
+	flags := []struct {
+		name string
+		dst  *bool
+	}{
+		{name: "auto-level", dst: &opts.AutoLevel},
+		{name: "normalize", dst: &opts.Normalize},
+	}
+
+	for _, f := range flags {
+		b, aerr := parseBoolQuery(query, f.name)
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		*f.dst = b
+		set = set || b
+	}
+
+	// Parse brightness and contrast
+	params := []struct {
+		name string
+		dst  *float64
+	}{
+		{name: "brightness", dst: &opts.Brightness},
+		{name: "contrast", dst: &opts.Contrast},
+	}
+
+	for _, p := range params {
+		if v := query.Get(p.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if (err != nil) || !((f >= -100) && (f <= 100)) {
+				return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+p.name+" parameter", err)
+			}
+
+			*p.dst = f
+			set = true
+		}
+	}
+
+	// Parse gamma correction
+	if v := query.Get("gamma"); v != "" {
+		g, err := strconv.ParseFloat(v, 64)
+		if (err != nil) || !((g > 0) && (g <= maxGamma)) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid gamma parameter", err)
+		}
+
+		opts.Gamma = g
+		set = true
+	}
+
+	// Parse modulation
+	if v := query.Get("modulate"); v != "" {
+		m, err := parseModulate(v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid modulate parameter", err)
+		}
+
+		opts.Modulate = m
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// parseModulate parses a modulation given as "BRIGHTNESS[,SATURATION[,HUE]]" in percent, e.g. "120,90". Missing values
+// default to 100, i.e. unchanged.
+func parseModulate(v string) (*modulateOptions, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("too many values in %q", v)
+	}
+
+	values := []float64{100, 100, 100}
+
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse value: %w", err)
+		}
+
+		if !((f >= 0) && (f <= maxModulate)) {
+			return nil, fmt.Errorf("value %g out of range", f)
+		}
+
+		values[i] = f
+	}
+
+	return &modulateOptions{Brightness: values[0], Saturation: values[1], Hue: values[2]}, nil
+}
+
+// applyAdjustOptions stretches contrast, adjusts brightness and contrast, corrects gamma, and modulates the image, in
+// that order, so manual adjustments fine-tune the stretched page.
+func applyAdjustOptions(mw *imagick.MagickWand, opts *adjustOptions) error {
+	// Stretch contrast
+	if opts.AutoLevel {
+		err := mw.AutoLevelImage()
+		if err != nil {
+			return fmt.Errorf("auto-level image: %w", err)
+		}
+	}
+
+	if opts.Normalize {
+		err := mw.NormalizeImage()
+		if err != nil {
+			return fmt.Errorf("normalize image: %w", err)
+		}
+	}
+
+	// Adjust brightness and contrast
+	if (opts.Brightness != 0) || (opts.Contrast != 0) {
+		err := mw.BrightnessContrastImage(opts.Brightness, opts.Contrast)
+		if err != nil {
+			return fmt.Errorf("adjust brightness and contrast: %w", err)
+		}
+	}
+
+	// Correct gamma
+	if opts.Gamma > 0 {
+		err := mw.GammaImage(opts.Gamma)
+		if err != nil {
+			return fmt.Errorf("correct gamma: %w", err)
+		}
+	}
+
+	// Modulate
+	if opts.Modulate != nil {
+		err := mw.ModulateImage(opts.Modulate.Brightness, opts.Modulate.Saturation, opts.Modulate.Hue)
+		if err != nil {
+			return fmt.Errorf("modulate image: %w", err)
+		}
+	}
+
+	return nil
+}
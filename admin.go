@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// blockProfileRate is the rate of blocking events sampled for the block profile, one per that many nanoseconds blocked.
+const blockProfileRate = 10_000
+
+// mutexProfileFraction is the fraction of mutex contention events sampled for the mutex profile, one in that many.
+const mutexProfileFraction = 100
+
+// newAdminServer creates the server of the admin listener, which serves health, readiness, metrics, and usage off the
+// public port, the admin endpoints if a token is given, and the profiling endpoints if enabled. It returns nil if no
+// address is given, in which case health, readiness, and usage stay on the public port.
+func newAdminServer(addr, token string, state *serverState, enablePprof bool) (*http.Server, error) {
+	if addr == "" {
+		if enablePprof {
+			return nil, errors.New("profiling requires the admin listener")
+		}
+
+		return nil, nil
+	}
+
+	router := chi.NewRouter()
+
+	// Trailing slashes are kept, since the profiling index links relative to /debug/pprof/
+	router.Use(requestID)
+	router.Use(accessLog)
+	router.Use(middleware.NoCache)
+	router.Use(middleware.Recoverer)
+
+	router.NotFound(notFoundHandler())
+	router.MethodNotAllowed(methodNotAllowedHandler())
+
+	router.Get("/health", healthHandler())
+	router.Get("/readyz", readyzHandler(state.life))
+	router.Get("/metrics", metricsHandler(state.metrics))
+	router.Get("/usage", usageHandler(state.meter, true))
+
+	if token != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(adminAuth(token))
+
+			r.Post("/admin/drain", drainHandler(state.life, true))
+			r.Post("/admin/undrain", drainHandler(state.life, false))
+		})
+	}
+
+	if enablePprof {
+		mountProfiler(router)
+	}
+
+	return &http.Server{Addr: addr, Handler: router}, nil
+}
+
+// adminAuth returns a middleware that rejects requests without the admin token as bearer token.
+func adminAuth(token string) func(http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+				slog.ErrorContext(r.Context(), "Admin request rejected")
+				renderError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "invalid admin token")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// mountProfiler mounts the handlers of net/http/pprof below /debug/pprof/, and enables sampling of blocking and mutex
+// contention events so the block and mutex profiles are not empty.
+func mountProfiler(router chi.Router) {
+	runtime.SetBlockProfileRate(blockProfileRate)
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+
+	router.Get("/debug/pprof", http.RedirectHandler("/debug/pprof/", http.StatusMovedPermanently).ServeHTTP)
+	router.Get("/debug/pprof/*", pprof.Index)
+	router.Get("/debug/pprof/cmdline", pprof.Cmdline)
+	router.Get("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.Get("/debug/pprof/trace", pprof.Trace)
+}
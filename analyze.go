@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"github.com/go-chi/render"
+)
+
+const (
+	maxAnalyzeColors = 16  // maxAnalyzeColors is the largest supported number of dominant colors.
+	maxAnalyzeBins   = 256 // maxAnalyzeBins is the largest supported number of histogram bins per channel.
+	analyzeSample    = 128 // analyzeSample is the size pages are shrunk to before finding dominant colors.
+)
+
+// analyzeOptions defines the options of an analysis.
+type analyzeOptions struct {
+	Colors    uint // Colors is the number of dominant colors to find.
+	Bins      uint // Bins is the number of histogram bins per channel.
+	Histogram bool // Histogram includes the histogram in the response.
+}
+
+// channelStats defines a statistic of every color channel.
+type channelStats struct {
+	Red   float64 `json:"red"`   // Red is the statistic of the red channel.
+	Green float64 `json:"green"` // Green is the statistic of the green channel.
+	Blue  float64 `json:"blue"`  // Blue is the statistic of the blue channel.
+}
+
+// channelHistogram defines the pixel counts per bin of every color channel.
+type channelHistogram struct {
+	Red   []uint `json:"red"`   // Red are the pixel counts of the red channel.
+	Green []uint `json:"green"` // Green are the pixel counts of the green channel.
+	Blue  []uint `json:"blue"`  // Blue are the pixel counts of the blue channel.
+}
+
+// dominantColor defines a color that covers a share of the page.
+type dominantColor struct {
+	Color    string  `json:"color"`    // Color is the color as "#RRGGBB".
+	Fraction float64 `json:"fraction"` // Fraction is the share of the page covered by the color, from 0 to 1.
+}
+
+// analyzePage defines the analysis of a single page.
+type analyzePage struct {
+	Page      int               `json:"page"`                // Page is the zero-based index of the page.
+	Width     uint              `json:"width"`               // Width is the width of the page in pixels.
+	Height    uint              `json:"height"`              // Height is the height of the page in pixels.
+	Mean      channelStats      `json:"mean"`                // Mean is the mean of every channel, from 0 to 1.
+	StdDev    channelStats      `json:"stddev"`              // StdDev is the standard deviation of every channel.
+	Dominant  []dominantColor   `json:"dominant"`            // Dominant lists the dominant colors, most common first.
+	Histogram *channelHistogram `json:"histogram,omitempty"` // Histogram counts the pixels per bin and channel.
+}
+
+// analyzeResponse defines the response of an analysis.
+type analyzeResponse struct {
+	Pages []analyzePage `json:"pages"` // Pages are the analyses of all pages, in order.
+}
+
+// parseAnalyzeOptions parses the analysis URL parameters.
+func parseAnalyzeOptions(query url.Values) (*analyzeOptions, *apiError) {
+	invalid := func(name string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	opts := &analyzeOptions{Colors: 5, Bins: 32, Histogram: true}
+
+	// Parse number of dominant colors
+	if v := query.Get("colors"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (c < 1) || (c > maxAnalyzeColors) {
+			return nil, invalid("colors", err)
+		}
+
+		opts.Colors = uint(c)
+	}
+
+	// Parse histogram
+	if v := query.Get("bins"); v != "" {
+		b, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (b < 1) || (b > maxAnalyzeBins) {
+			return nil, invalid("bins", err)
+		}
+
+		opts.Bins = uint(b)
+	}
+
+	var aerr *apiError
+
+	opts.Histogram, aerr = parseBoolQuery(query, "histogram")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return opts, nil
+}
+
+// analyzeHandler responds with the dominant colors, channel statistics, and histogram of every page of an image.
+func analyzeHandler(policies []*policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options
+		opts, aerr := parseConvertOptions(r)
+
+		var ao *analyzeOptions
+		if aerr == nil {
+			ao, aerr = parseAnalyzeOptions(r.URL.Query())
+		}
+
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body
+		in, aerr := readInput(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Read image
+		mw, aerr := readWand(r.Context(), in, opts)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read image", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		defer releaseWand(mw)
+
+		// Enforce page limit
+		pages := int(mw.GetNumberImages())
+
+		if (pol.MaxPages > 0) && (uint(pages) > pol.MaxPages) {
+			slog.ErrorContext(r.Context(), "Page limit exceeded", slog.Int("pages", pages), slog.Uint64("limit", uint64(pol.MaxPages)))
+			renderError(w, r, http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded")
+			return
+		}
+
+		// Analyze all pages
+		res := analyzeResponse{Pages: make([]analyzePage, 0, pages)}
+
+		for page := 0; page < pages; page++ {
+			mw.SetIteratorIndex(page)
+
+			ap, err := analyzeWandPage(mw.GetImage(), page, opts, ao)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to analyze page", slog.Int("page", page), slog.Any("error", err))
+				renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to analyze page")
+				return
+			}
+
+			res.Pages = append(res.Pages, ap)
+		}
+
+		// We're good
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, res)
+	}
+}
+
+// analyzeWandPage flattens and analyzes the page. The given wand is destroyed.
+func analyzeWandPage(mwi *imagick.MagickWand, page int, opts convertOptions, ao *analyzeOptions) (analyzePage, error) {
+	defer mwi.Destroy()
+
+	// Flatten page
+	err := prepareAlpha(mwi, opts)
+	if err != nil {
+		return analyzePage{}, fmt.Errorf("prepare alpha channel: %w", err)
+	}
+
+	mwm := mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+	defer mwm.Destroy()
+
+	ap := analyzePage{Page: page, Width: mwm.GetImageWidth(), Height: mwm.GetImageHeight()}
+
+	// Compute statistics and histogram
+	pixels, err := mwm.ExportImagePixels(0, 0, ap.Width, ap.Height, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		return analyzePage{}, fmt.Errorf("export pixels: %w", err)
+	}
+
+	rgb, _ := pixels.([]byte)
+	ap.Mean, ap.StdDev = channelStatistics(rgb)
+
+	if ao.Histogram {
+		h := countHistogram(rgb, ao.Bins)
+		ap.Histogram = &h
+	}
+
+	// Find dominant colors
+	ap.Dominant, err = dominantColors(mwm, ao.Colors)
+	if err != nil {
+		return analyzePage{}, err
+	}
+
+	return ap, nil
+}
+
+// channelStatistics computes the mean and standard deviation of every channel of interleaved RGB pixels, from 0 to 1.
+func channelStatistics(rgb []byte) (channelStats, channelStats) {
+	var sum, sumSq [3]float64
+
+	for i, v := range rgb {
+		f := float64(v) / 255.0
+		sum[i%3] += f
+		sumSq[i%3] += f * f
+	}
+
+	n := float64(len(rgb) / 3)
+	if n == 0 {
+		return channelStats{}, channelStats{}
+	}
+
+	var mean, std [3]float64
+
+	for c := range sum {
+		mean[c] = sum[c] / n
+		std[c] = math.Sqrt(math.Max(0, sumSq[c]/n-mean[c]*mean[c]))
+	}
+
+	return channelStats{Red: mean[0], Green: mean[1], Blue: mean[2]},
+		channelStats{Red: std[0], Green: std[1], Blue: std[2]}
+}
+
+// countHistogram counts the interleaved RGB pixels per bin and channel.
+func countHistogram(rgb []byte, bins uint) channelHistogram {
+	counts := [3][]uint{make([]uint, bins), make([]uint, bins), make([]uint, bins)}
+
+	for i, v := range rgb {
+		counts[i%3][uint(v)*bins/256]++
+	}
+
+	return channelHistogram{Red: counts[0], Green: counts[1], Blue: counts[2]}
+}
+
+// dominantColors reduces a shrunk copy of the page to the given number of colors and returns them, most common first.
+func dominantColors(mw *imagick.MagickWand, colors uint) ([]dominantColor, error) {
+	mws := mw.Clone()
+	defer mws.Destroy()
+
+	// Shrink page
+	width, height := mws.GetImageWidth(), mws.GetImageHeight()
+	scale := min(1.0, float64(analyzeSample)/float64(max(width, height)))
+
+	err := mws.ThumbnailImage(max(1, uint(float64(width)*scale)), max(1, uint(float64(height)*scale)))
+	if err != nil {
+		return nil, fmt.Errorf("shrink page: %w", err)
+	}
+
+	// Reduce colors
+	err = imagick.QuantizeImage(mws, colors, imagick.COLORSPACE_SRGB)
+	if err != nil {
+		return nil, fmt.Errorf("quantize page: %w", err)
+	}
+
+	_, pws := mws.GetImageHistogram()
+
+	// Collect colors by coverage
+	var total float64
+
+	result := make([]dominantColor, 0, len(pws))
+	counts := make(map[string]float64, len(pws))
+
+	for _, pw := range pws {
+		color := fmt.Sprintf("#%02x%02x%02x", channelByte(pw.GetRed()), channelByte(pw.GetGreen()), channelByte(pw.GetBlue()))
+		count := float64(pw.GetColorCount())
+		pw.Destroy()
+
+		if _, ok := counts[color]; !ok {
+			result = append(result, dominantColor{Color: color})
+		}
+
+		counts[color] += count
+		total += count
+	}
+
+	for i := range result {
+		result[i].Fraction = counts[result[i].Color] / total
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Fraction > result[j].Fraction })
+
+	return result, nil
+}
+
+// channelByte converts a normalized channel value to a byte.
+func channelByte(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, v)) * 255.0))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// animateMediaTypeMap defines the supported animation formats and their media types.
+var animateMediaTypeMap = map[string]string{
+	"GIF":  "image/gif",
+	"WEBP": "image/webp",
+}
+
+const (
+	animateFrameFormat = "PNG"  // animateFrameFormat is the lossless format frames are encoded in before assembly.
+	maxAnimateDelay    = 60000  // maxAnimateDelay is the longest supported frame delay in milliseconds.
+	maxAnimateLoop     = 0xffff // maxAnimateLoop is the largest supported number of loops.
+)
+
+// animateOptions defines how pages are assembled into a single animated image.
+type animateOptions struct {
+	Format string `json:"format"` // Format is the animation format, either "GIF" or "WEBP".
+	Delay  uint   `json:"delay"`  // Delay is the time each frame is shown, in milliseconds.
+	Loop   uint   `json:"loop"`   // Loop is the number of times the animation is played, or 0 to play it forever.
+}
+
+// parseAnimateOptions parses the animation URL parameters. It returns nil if pages are not animated.
+func parseAnimateOptions(query url.Values) (*animateOptions, *apiError) {
+	v := strings.ToUpper(query.Get("animate"))
+	if v == "" {
+		return nil, nil
+	}
+
+	if _, ok := animateMediaTypeMap[v]; !ok {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid animate parameter", nil)
+	}
+
+	opts := &animateOptions{Format: v, Delay: 1000}
+
+	// Parse frame delay
+	if v := query.Get("animate-delay"); v != "" {
+		d, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (d < 10) || (d > maxAnimateDelay) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid animate-delay parameter", err)
+		}
+
+		opts.Delay = uint(d)
+	}
+
+	// Parse number of loops
+	if v := query.Get("animate-loop"); v != "" {
+		l, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (l > maxAnimateLoop) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid animate-loop parameter", err)
+		}
+
+		opts.Loop = uint(l)
+	}
+
+	return opts, nil
+}
+
+// renderAnimation assembles the converted pages into an animation and responds with it.
+func renderAnimation(w http.ResponseWriter, r *http.Request, results []pageResult, opts *animateOptions) {
+	out, err := assembleAnimation(results, opts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to assemble animation", slog.Any("error", err))
+		renderError(w, r, http.StatusInternalServerError, errorCodeEncodeFailed, "failed to assemble animation")
+		return
+	}
+
+	setChecksumHeaders(w, out)
+	w.Header().Set("Content-Type", animateMediaTypeMap[opts.Format])
+	w.WriteHeader(http.StatusOK)
+	w.Write(out) //nolint:errcheck
+}
+
+// assembleAnimation assembles the converted pages, in order, into a single animated image.
+func assembleAnimation(results []pageResult, opts *animateOptions) ([]byte, error) {
+	mw := acquireWand()
+	defer releaseWand(mw)
+
+	for _, res := range results {
+		// Read frame
+		err := mw.ReadImageBlob(res.out)
+		if err != nil {
+			return nil, fmt.Errorf("read frame: %w", err)
+		}
+
+		// Set frame timing, in ticks of 10 milliseconds
+		err = mw.SetImageDelay(opts.Delay / 10)
+		if err != nil {
+			return nil, fmt.Errorf("set frame delay: %w", err)
+		}
+
+		err = mw.SetImageDispose(imagick.DISPOSE_BACKGROUND)
+		if err != nil {
+			return nil, fmt.Errorf("set frame disposal: %w", err)
+		}
+
+		err = mw.SetImageFormat(opts.Format)
+		if err != nil {
+			return nil, fmt.Errorf("set frame format: %w", err)
+		}
+	}
+
+	// Encode animation
+	mw.ResetIterator()
+
+	err := mw.SetImageIterations(opts.Loop)
+	if err != nil {
+		return nil, fmt.Errorf("set loops: %w", err)
+	}
+
+	err = mw.SetFormat(opts.Format)
+	if err != nil {
+		return nil, fmt.Errorf("set animation format: %w", err)
+	}
+
+	return mw.GetImagesBlob()
+}
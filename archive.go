@@ -0,0 +1,392 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// zipMethodType defines how Zip archive entries are compressed.
+type zipMethodType string
+
+const (
+	zipMethodTypeAuto    zipMethodType = "AUTO"    // zipMethodTypeAuto stores compressed formats and deflates others.
+	zipMethodTypeDeflate zipMethodType = "DEFLATE" // zipMethodTypeDeflate deflates all entries.
+	zipMethodTypeStore   zipMethodType = "STORE"   // zipMethodTypeStore stores all entries uncompressed.
+)
+
+// compressedFormats defines the output formats that are already compressed, so deflating them again gains nothing.
+var compressedFormats = map[string]bool{
+	"J2K":  true,
+	"JP2":  true,
+	"JPEG": true,
+	"JXL":  true,
+	"PNG":  true,
+	"WEBP": true,
+}
+
+// parseZipMethod parses the configured Zip method.
+func parseZipMethod(v string) (zipMethodType, error) {
+	m := zipMethodType(strings.ToUpper(v))
+	if (m != zipMethodTypeAuto) && (m != zipMethodTypeDeflate) && (m != zipMethodTypeStore) {
+		return "", fmt.Errorf("invalid zip method %q", v)
+	}
+
+	return m, nil
+}
+
+// zipMethod returns the compression method for entries of the given output format.
+func zipMethod(format string) uint16 {
+	m, _ := parseZipMethod(config().GetString("zip-method"))
+
+	switch m {
+	case zipMethodTypeStore:
+		return zip.Store
+
+	case zipMethodTypeDeflate:
+		return zip.Deflate
+
+	case zipMethodTypeAuto:
+		if compressedFormats[format] {
+			return zip.Store
+		}
+	}
+
+	return zip.Deflate
+}
+
+// unicodePathExtraID is the ID of the Info-ZIP Unicode Path extra field.
+const unicodePathExtraID = 0x7075
+
+// entryNamer hands out unique entry names within a Zip archive. Names are compared case-insensitively, since archives
+// are often extracted onto case-insensitive file systems.
+type entryNamer struct {
+	used map[string]bool
+}
+
+// newEntryNamer creates a new entry namer with the given names already taken.
+func newEntryNamer(reserved ...string) *entryNamer {
+	n := &entryNamer{used: map[string]bool{}}
+	for _, name := range reserved {
+		n.used[strings.ToLower(name)] = true
+	}
+
+	return n
+}
+
+// unique returns the given name, or the name with a numeric suffix (e.g. "0000-1.jpg") if it is already taken.
+func (n *entryNamer) unique(name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; n.used[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+
+	n.used[strings.ToLower(candidate)] = true
+
+	return candidate
+}
+
+// writeEntry writes a new Zip archive entry, encrypted with AES-256 if a password is given. Non-ASCII names are flagged
+// as UTF-8 and additionally carry an Info-ZIP Unicode Path extra field for extraction tools that ignore the flag.
+func writeEntry(zw *zip.Writer, name string, method uint16, data []byte, password string) error {
+	fh := &zip.FileHeader{Name: name, Method: method}
+
+	if !isASCII(name) && utf8.ValidString(name) {
+		fh.Flags |= 0x800
+
+		extra := make([]byte, 9, 9+len(name))
+		binary.LittleEndian.PutUint16(extra[0:], unicodePathExtraID)
+		binary.LittleEndian.PutUint16(extra[2:], uint16(5+len(name)))
+		extra[4] = 1 // version
+		binary.LittleEndian.PutUint32(extra[5:], crc32.ChecksumIEEE([]byte(name)))
+
+		fh.Extra = append(extra, name...)
+	}
+
+	// Write plain entry
+	if password == "" {
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return fmt.Errorf("create entry: %w", err)
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return fmt.Errorf("write entry: %w", err)
+		}
+
+		return nil
+	}
+
+	// Write encrypted entry, whose sizes must be known up front
+	raw, extra, err := encryptEntry(password, method, data)
+	if err != nil {
+		return fmt.Errorf("encrypt entry: %w", err)
+	}
+
+	fh.Method, fh.Flags, fh.Extra = aesMethod, fh.Flags|0x1, append(fh.Extra, extra...)
+	fh.CreatorVersion, fh.ReaderVersion = aesVersion, aesVersion
+	fh.CompressedSize64, fh.UncompressedSize64 = uint64(len(raw)), uint64(len(data))
+
+	w, err := zw.CreateRaw(fh)
+	if err != nil {
+		return fmt.Errorf("create entry: %w", err)
+	}
+
+	_, err = w.Write(raw)
+	if err != nil {
+		return fmt.Errorf("write entry: %w", err)
+	}
+
+	return nil
+}
+
+// attachArchivePassword attaches the password of the Zip archive supplied as multipart part to the options, overriding
+// the X-Archive-Password header.
+func attachArchivePassword(opts *convertOptions, in *input) *apiError {
+	if in.archivePassword != "" {
+		opts.ArchivePassword = in.archivePassword
+	}
+
+	return checkArchivePassword(*opts)
+}
+
+// checkArchivePassword fails if the options carry an archive password, but the output is not a Zip archive, which
+// would otherwise be sent unencrypted.
+func checkArchivePassword(opts convertOptions) *apiError {
+	if (opts.ArchivePassword != "") && !opts.zipResponse() {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "archive password requires a Zip archive", nil)
+	}
+
+	return nil
+}
+
+// singleFile returns true if the output is a single file (an animation, or a PDF/A or searchable PDF document) instead
+// of a Zip archive.
+func (o convertOptions) singleFile() bool {
+	return (o.Animate != nil) || o.PDFA || ((o.OCR != nil) && (o.OCR.Mode == ocrModePDF))
+}
+
+// zipResponse returns true if the response is a Zip archive, or the description of a stored one.
+func (o convertOptions) zipResponse() bool {
+	return !o.singleFile() && (o.Store || (o.Response == "") || (o.Response == zipMediaType))
+}
+
+// isASCII returns true if the string only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// archiveWriter defines a Zip archive, or a tar archive if negotiated, that output images are written into. Large
+// archives are spilled to a temporary file.
+type archiveWriter struct {
+	buf           *spool             // buf holds the archive.
+	zw            *zip.Writer        // zw writes the Zip archive into the buffer.
+	tw            *tar.Writer        // tw writes the tar archive into the buffer instead, if negotiated.
+	namer         *entryNamer        // namer hands out unique entry names.
+	entryNameTmpl *template.Template // entryNameTmpl names entries, unless the options carry a filename template.
+	opts          convertOptions     // opts are the conversion options.
+}
+
+// newArchiveWriter creates a new, empty Zip archive.
+func newArchiveWriter(entryNameTmpl *template.Template, opts convertOptions) *archiveWriter {
+	aw := &archiveWriter{buf: newSpool(), namer: newEntryNamer(), entryNameTmpl: entryNameTmpl, opts: opts}
+	if opts.Manifest {
+		aw.namer = newEntryNamer(manifestName)
+	}
+
+	if opts.Response == tarMediaType {
+		aw.tw = tar.NewWriter(aw.buf)
+		return aw
+	}
+
+	aw.zw = zip.NewWriter(aw.buf)
+	aw.zw.RegisterCompressor(zip.Deflate, func(o io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(o, flate.BestSpeed)
+	})
+
+	return aw
+}
+
+// write writes a single entry into the archive. Entries of Zip archives are compressed with the given method, and
+// encrypted if the options carry a password, while entries of tar archives are written as is.
+func (aw *archiveWriter) write(name string, method uint16, data []byte) error {
+	if aw.tw == nil {
+		return writeEntry(aw.zw, name, method, data, aw.opts.ArchivePassword)
+	}
+
+	err := aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("create entry: %w", err)
+	}
+
+	_, err = aw.tw.Write(data)
+	if err != nil {
+		return fmt.Errorf("write entry: %w", err)
+	}
+
+	return nil
+}
+
+// writeArchive writes all pages, in order, and the manifest (if requested) into a new Zip archive, encrypting all
+// entries if the options carry a password. The manifest is completed with an entry for every page. Large archives are
+// spilled to a temporary file until the context is done.
+func writeArchive(
+	ctx context.Context, results []pageResult, man *manifest, basename string, entryNameTmpl *template.Template,
+	opts convertOptions,
+) ([]byte, *apiError) {
+	aw := newArchiveWriter(entryNameTmpl, opts)
+
+	pages, aerr := aw.writePages(results, basename, "", opts)
+	if aerr != nil {
+		aw.discard()
+		return nil, aerr
+	}
+
+	man.Pages = append(man.Pages, pages...)
+
+	return aw.close(ctx, man)
+}
+
+// writePages writes all pages, in order, into the given folder of the archive (or its root, if empty), and returns
+// their manifest entries. The pages are named according to the given options, which may differ from those of the
+// archive for individual documents.
+func (aw *archiveWriter) writePages(
+	results []pageResult, basename, folder string, opts convertOptions,
+) ([]manifestPage, *apiError) {
+	pages := make([]manifestPage, 0, len(results))
+
+	for _, res := range results {
+		// Name Zip archive entry
+		name, err := pageName(aw.entryNameTmpl, opts, res, basename)
+		if err != nil {
+			return nil, archiveError("failed to name Zip archive entry", err)
+		}
+
+		if folder != "" {
+			name = folder + "/" + name
+		}
+
+		// Write image into Zip archive
+		name = aw.namer.unique(name)
+
+		err = aw.write(name, zipMethod(res.data.Format), res.out)
+		if err != nil {
+			return nil, archiveError("failed to write image into Zip archive", err)
+		}
+
+		page := newManifestPage(name, res)
+
+		// Write recognized text into Zip archive
+		if res.text != nil {
+			page.Text = aw.namer.unique(strings.TrimSuffix(name, path.Ext(name)) + "." + ocrModeExtensionMap[opts.OCR.Mode])
+			page.TextSHA256 = sha256Hex(res.text)
+
+			err := aw.write(page.Text, zipMethod(""), res.text)
+			if err != nil {
+				return nil, archiveError("failed to write text into Zip archive", err)
+			}
+		}
+
+		pages = append(pages, page)
+	}
+
+	return pages, nil
+}
+
+// pageName names the output image of a page after the filename template of the options, or the entry name template
+// otherwise. Renditions are named within a folder of their width.
+func pageName(entryNameTmpl *template.Template, opts convertOptions, res pageResult, basename string) (string, error) {
+	res.data.Basename = basename
+
+	var (
+		name string
+		err  error
+	)
+
+	if opts.FilenameTemplate != "" {
+		name, err = expandFilenameTemplate(opts.FilenameTemplate, res.data)
+	} else {
+		name, err = entryName(entryNameTmpl, res.data)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if res.data.Size > 0 {
+		name = fmt.Sprintf("%d/%s", res.data.Size, name)
+	}
+
+	return name, nil
+}
+
+// close writes the manifest into the archive (if requested), and returns the complete archive. The archive is
+// discarded if it cannot be completed.
+func (aw *archiveWriter) close(ctx context.Context, man *manifest) ([]byte, *apiError) {
+	// Write manifest into archive
+	if aw.opts.Manifest {
+		err := aw.writeManifest(man)
+		if err != nil {
+			aw.discard()
+			return nil, archiveError("failed to write manifest into archive", err)
+		}
+	}
+
+	// Close archive
+	var err error
+
+	if aw.tw != nil {
+		err = aw.tw.Close()
+	} else {
+		err = aw.zw.Close()
+	}
+
+	if err != nil {
+		aw.discard()
+		return nil, archiveError("failed to close archive", err)
+	}
+
+	archive, _, err := aw.buf.finish(ctx)
+	if err != nil {
+		return nil, archiveError("failed to spill archive to disk", err)
+	}
+
+	return archive, nil
+}
+
+// discard removes the temporary file of the archive, if any, after a failed write.
+func (aw *archiveWriter) discard() {
+	aw.buf.discard()
+}
+
+// archiveError returns the API error of a failed archive write.
+func archiveError(message string, err error) *apiError {
+	return newAPIError(http.StatusInternalServerError, errorCodeArchiveFailed, message, err)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/spf13/cobra"
+)
+
+// auditKey is the context key of the audit record of a request.
+type auditKey struct{}
+
+// CmdAudit defines the command to work with audit logs.
+var CmdAudit = &cobra.Command{
+	Use:   "audit",
+	Short: "Work with audit logs",
+	Args:  cobra.NoArgs,
+}
+
+// CmdAuditVerify defines the command to verify the hash chain of an audit log.
+var CmdAuditVerify = &cobra.Command{
+	Use:   "verify <file>",
+	Short: "Verify the hash chain of an audit log",
+	Long: "Verify that no record of the audit log has been modified, removed, or inserted, using the configured " +
+		"audit secret if any. The first broken record is reported.",
+	Args: cobra.ExactArgs(1),
+	RunE: runAuditVerify,
+}
+
+// Initialize command options
+func init() {
+	CmdAudit.AddCommand(CmdAuditVerify)
+	CmdMain.AddCommand(CmdAudit)
+}
+
+// auditClient defines the identity of the client of an audited request.
+type auditClient struct {
+	Key     string `json:"key,omitempty"`    // Key is the key the request was signed with, if any.
+	CN      string `json:"cn,omitempty"`     // CN is the common name of the client certificate, if any.
+	Address string `json:"address"`          // Address is the remote address of the client.
+	Tenant  string `json:"tenant,omitempty"` // Tenant is the value of the tenant header, if any.
+}
+
+// auditRecord defines a single record of the audit log. Each record carries the hash of its predecessor, and its own
+// hash covers that link, so modifying, removing, or inserting records breaks the chain.
+type auditRecord struct {
+	Time        time.Time           `json:"time"`                   // Time is the time the request was completed.
+	RequestID   string              `json:"request_id"`             // RequestID identifies the request in the logs.
+	Client      auditClient         `json:"client"`                 // Client is the identity of the client.
+	Method      string              `json:"method"`                 // Method is the HTTP method of the request.
+	Path        string              `json:"path"`                   // Path is the URL path of the request.
+	Parameters  map[string][]string `json:"parameters,omitempty"`   // Parameters are the URL parameters, redacted.
+	InputSHA256 string              `json:"input_sha256,omitempty"` // InputSHA256 is the digest of the input image.
+	InputSize   int                 `json:"input_size,omitempty"`   // InputSize is the size of the input image in bytes.
+	Pages       uint64              `json:"pages"`                  // Pages is the number of input pages read.
+	Status      int                 `json:"status"`                 // Status is the HTTP status of the response.
+	Error       errorCode           `json:"error,omitempty"`        // Error is the error code of the response, if any.
+	Prev        string              `json:"prev"`                   // Prev is the hash of the previous record.
+	Hash        string              `json:"hash"`                   // Hash is the hash of this record.
+}
+
+// requestAudit defines what is learned about a request while it is handled.
+type requestAudit struct {
+	mu    sync.Mutex
+	input []byte    // input is the digest of the input image.
+	size  int       // size is the size of the input image in bytes.
+	code  errorCode // code is the error code of the response, if any.
+
+	pages atomic.Uint64 // pages is the number of input pages read.
+}
+
+// auditLog defines an append-only audit log of all requests, written as hash-chained JSON lines.
+type auditLog struct {
+	secret       []byte // secret keys the hashes of the chain, if set.
+	tenantHeader string // tenantHeader is the request header naming the tenant.
+
+	mu   sync.Mutex
+	w    io.Writer // w is the file records are appended to.
+	prev string    // prev is the hash of the last record written.
+}
+
+// newAuditLog opens the audit log at the given path, or standard output for "-", and continues its hash chain. It
+// returns nil if no path is given.
+func newAuditLog(path string, secret []byte, tenantHeader string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	a := &auditLog{secret: secret, tenantHeader: tenantHeader, w: os.Stdout}
+
+	if path == "-" {
+		return a, nil
+	}
+
+	// Continue chain of existing log
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+
+	a.prev, err = lastAuditHash(f)
+	if err != nil {
+		f.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	a.w = f
+
+	return a, nil
+}
+
+// lastAuditHash returns the hash of the last record of the audit log, or empty if the log is empty.
+func lastAuditHash(r io.Reader) (string, error) {
+	var last string
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<24)
+
+	for sc.Scan() {
+		var rec auditRecord
+
+		err := json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return "", fmt.Errorf("parse audit log: %w", err)
+		}
+
+		last = rec.Hash
+	}
+
+	if err := sc.Err(); err != nil {
+		return "", fmt.Errorf("read audit log: %w", err)
+	}
+
+	return last, nil
+}
+
+// record is a middleware that appends a record of the request to the audit log once it has been handled.
+func (a *auditLog) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ra := &requestAudit{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), auditKey{}, ra)))
+
+		// Collect record
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+
+		rec := auditRecord{
+			Time:      time.Now().UTC(),
+			RequestID: middleware.GetReqID(r.Context()),
+			Client: auditClient{
+				Key:     signatureKey(r.Context()),
+				CN:      clientCN(r.Context()),
+				Address: r.RemoteAddr,
+				Tenant:  r.Header.Get(a.tenantHeader),
+			},
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Parameters: redactParameters(r.URL.Query()),
+			InputSize:  ra.size,
+			Pages:      ra.pages.Load(),
+			Status:     ww.Status(),
+			Error:      ra.code,
+		}
+
+		if ra.input != nil {
+			rec.InputSHA256 = hex.EncodeToString(ra.input)
+		}
+
+		err := a.write(&rec)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write audit record", slog.Any("error", err))
+		}
+	})
+}
+
+// write links the record to the chain and appends it to the log.
+func (a *auditLog) write(rec *auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Prev = a.prev
+
+	sum, err := auditHash(a.newHash(), rec)
+	if err != nil {
+		return err
+	}
+
+	rec.Hash = sum
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode audit record: %w", err)
+	}
+
+	_, err = a.w.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("write audit record: %w", err)
+	}
+
+	a.prev = rec.Hash
+
+	return nil
+}
+
+// newHash returns the hash of the chain, which is keyed by the secret if set.
+func (a *auditLog) newHash() hash.Hash {
+	if len(a.secret) > 0 {
+		return hmac.New(sha256.New, a.secret)
+	}
+
+	return sha256.New()
+}
+
+// auditHash returns the hex-encoded hash of the record, which covers all of its fields but the hash itself.
+func auditHash(h hash.Hash, rec *auditRecord) (string, error) {
+	unhashed := *rec
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", fmt.Errorf("encode audit record: %w", err)
+	}
+
+	h.Write(data) //nolint:errcheck
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// redactParameters returns a copy of the URL parameters with the values of sensitive parameters masked, as well as
+// sensitive query parameters embedded in values (e.g. the signature of a presigned URL).
+func redactParameters(query map[string][]string) map[string][]string {
+	if len(query) == 0 {
+		return nil
+	}
+
+	redacted := make(map[string][]string, len(query))
+
+	for k, v := range query {
+		if isSensitiveParam(k) {
+			redacted[k] = []string{redactedValue}
+			continue
+		}
+
+		redacted[k] = make([]string, len(v))
+
+		for i := range v {
+			redacted[k][i] = redactQuery(v[i], isSensitiveParam)
+		}
+	}
+
+	return redacted
+}
+
+// auditInput records the digest and size of the input image in the audit record of the request.
+func auditInput(ctx context.Context, data []byte) {
+	ra, _ := ctx.Value(auditKey{}).(*requestAudit)
+	if ra == nil {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.input, ra.size = sum[:], len(data)
+}
+
+// auditPages records the number of input pages read in the audit record of the request.
+func auditPages(ctx context.Context, pages uint) {
+	if ra, _ := ctx.Value(auditKey{}).(*requestAudit); ra != nil {
+		ra.pages.Add(uint64(pages))
+	}
+}
+
+// auditError records the error code of the response in the audit record of the request.
+func auditError(ctx context.Context, code errorCode) {
+	ra, _ := ctx.Value(auditKey{}).(*requestAudit)
+	if ra == nil {
+		return
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.code = code
+}
+
+// runAuditVerify is called when the audit verify command is used.
+func runAuditVerify(_ *cobra.Command, args []string) error {
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	a := &auditLog{secret: []byte(config().GetString("audit-secret"))}
+
+	n, err := a.verify(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d records verified\n", n)
+
+	return nil
+}
+
+// verify verifies the hash chain of the audit log and returns the number of records.
+func (a *auditLog) verify(r io.Reader) (int, error) {
+	var (
+		prev string
+		n    int
+	)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<24)
+
+	for sc.Scan() {
+		n++
+
+		var rec auditRecord
+
+		err := json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return 0, fmt.Errorf("parse record %d: %w", n, err)
+		}
+
+		if rec.Prev != prev {
+			return 0, fmt.Errorf("record %d does not link to its predecessor", n)
+		}
+
+		sum, err := auditHash(a.newHash(), &rec)
+		if err != nil {
+			return 0, err
+		}
+
+		if !hmac.Equal([]byte(sum), []byte(rec.Hash)) {
+			return 0, fmt.Errorf("record %d has been modified", n)
+		}
+
+		prev = rec.Hash
+	}
+
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("read audit log: %w", err)
+	}
+
+	if n == 0 {
+		return 0, errors.New("audit log is empty")
+	}
+
+	return n, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"github.com/go-chi/render"
+)
+
+// zbarNoSymbols is the exit code of zbarimg if no barcode was found in any image.
+const zbarNoSymbols = 4
+
+// barcodeBounds defines the bounding box of a barcode.
+type barcodeBounds struct {
+	X      int `json:"x"`      // X is the left edge of the barcode in pixels.
+	Y      int `json:"y"`      // Y is the top edge of the barcode in pixels.
+	Width  int `json:"width"`  // Width is the width of the barcode in pixels.
+	Height int `json:"height"` // Height is the height of the barcode in pixels.
+}
+
+// barcode defines a barcode found on a page.
+type barcode struct {
+	Type   string         `json:"type"`             // Type is the symbology, e.g. "QR-Code" or "EAN-13".
+	Value  string         `json:"value"`            // Value is the decoded content of the barcode.
+	Bounds *barcodeBounds `json:"bounds,omitempty"` // Bounds is the bounding box, if reported by zbar.
+}
+
+// barcodePage defines the barcodes found on a single page.
+type barcodePage struct {
+	Page     int       `json:"page"`     // Page is the zero-based index of the page.
+	Width    uint      `json:"width"`    // Width is the width of the scanned page in pixels.
+	Height   uint      `json:"height"`   // Height is the height of the scanned page in pixels.
+	Barcodes []barcode `json:"barcodes"` // Barcodes are all barcodes found on the page.
+}
+
+// barcodesResponse defines the response of a barcode scan.
+type barcodesResponse struct {
+	Pages []barcodePage `json:"pages"` // Pages are the barcodes of all pages, in order.
+}
+
+// zbarResult defines the XML output of zbarimg.
+type zbarResult struct {
+	Sources []struct {
+		Href  string `xml:"href,attr"`
+		Index []struct {
+			Symbols []struct {
+				Type    string `xml:"type,attr"`
+				Polygon struct {
+					Points string `xml:"points,attr"`
+				} `xml:"polygon"`
+				Data struct {
+					Format string `xml:"format,attr"`
+					Value  string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"symbol"`
+		} `xml:"index"`
+	} `xml:"source"`
+}
+
+// barcodesHandler responds with the values, types, and bounding boxes of all barcodes and QR codes on every page.
+func barcodesHandler(policies []*policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options
+		opts, aerr := parseConvertOptions(r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body
+		in, aerr := readInput(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Read image
+		mw, aerr := readWand(r.Context(), in, opts)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read image", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		defer releaseWand(mw)
+
+		// Enforce page limit
+		pages := int(mw.GetNumberImages())
+
+		if (pol.MaxPages > 0) && (uint(pages) > pol.MaxPages) {
+			slog.ErrorContext(r.Context(), "Page limit exceeded", slog.Int("pages", pages), slog.Uint64("limit", uint64(pol.MaxPages)))
+			renderError(w, r, http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded")
+			return
+		}
+
+		// Scan all pages
+		res, err := scanBarcodes(r.Context(), mw, pages, opts)
+		if errors.Is(err, exec.ErrNotFound) {
+			slog.ErrorContext(r.Context(), "Barcode scanner not available", slog.Any("error", err))
+			renderError(w, r, http.StatusNotImplemented, errorCodeZbarUnavailable, "barcode scanning is not available")
+			return
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to scan barcodes", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to scan barcodes")
+			return
+		}
+
+		// We're good
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, res)
+	}
+}
+
+// scanBarcodes flattens all pages into PNG files and has a single zbarimg process scan them.
+func scanBarcodes(ctx context.Context, mw *imagick.MagickWand, pages int, opts convertOptions) (*barcodesResponse, error) {
+	res := &barcodesResponse{Pages: make([]barcodePage, 0, pages)}
+
+	// Write all pages
+	dir, err := os.MkdirTemp("", "magick-server-barcodes-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	files := make([]string, 0, pages)
+	index := make(map[string]int, pages)
+
+	for page := 0; page < pages; page++ {
+		mw.SetIteratorIndex(page)
+
+		bp, out, err := flattenBarcodePage(mw.GetImage(), page, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, fmt.Sprintf("%04d.png", page))
+
+		err = os.WriteFile(name, out, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("write page: %w", err)
+		}
+
+		files = append(files, name)
+		index[name] = page
+		res.Pages = append(res.Pages, bp)
+	}
+
+	// Scan pages, zbarimg fails with a dedicated exit code if there are no barcodes at all
+	out, err := runCommand(ctx, config().GetString("zbarimg"), append([]string{"--xml", "--quiet"}, files...), nil)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == zbarNoSymbols) {
+		return res, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect barcodes
+	var zr zbarResult
+
+	err = xml.Unmarshal(out, &zr)
+	if err != nil {
+		return nil, fmt.Errorf("parse zbarimg output: %w", err)
+	}
+
+	for _, src := range zr.Sources {
+		page, ok := index[src.Href]
+		if !ok {
+			continue
+		}
+
+		for _, idx := range src.Index {
+			for _, sym := range idx.Symbols {
+				b := barcode{Type: sym.Type, Value: sym.Data.Value, Bounds: polygonBounds(sym.Polygon.Points)}
+
+				if sym.Data.Format == "base64" {
+					v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sym.Data.Value))
+					if err != nil {
+						return nil, fmt.Errorf("decode barcode value: %w", err)
+					}
+
+					b.Value = string(v)
+				}
+
+				res.Pages[page].Barcodes = append(res.Pages[page].Barcodes, b)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// flattenBarcodePage flattens the page and encodes it as PNG. The given wand is destroyed.
+func flattenBarcodePage(mwi *imagick.MagickWand, page int, opts convertOptions) (barcodePage, []byte, error) {
+	defer mwi.Destroy()
+
+	err := prepareAlpha(mwi, opts)
+	if err != nil {
+		return barcodePage{}, nil, fmt.Errorf("prepare alpha channel: %w", err)
+	}
+
+	mwm := mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+	defer mwm.Destroy()
+
+	err = mwm.SetImageFormat("PNG")
+	if err != nil {
+		return barcodePage{}, nil, fmt.Errorf("set output format: %w", err)
+	}
+
+	out, err := mwm.GetImageBlob()
+	if err != nil {
+		return barcodePage{}, nil, fmt.Errorf("encode page: %w", err)
+	}
+
+	bp := barcodePage{Page: page, Width: mwm.GetImageWidth(), Height: mwm.GetImageHeight(), Barcodes: []barcode{}}
+
+	return bp, out, nil
+}
+
+// polygonBounds returns the bounding box of a polygon given by zbar as "+x,+y" points, or nil if there are none.
+func polygonBounds(points string) *barcodeBounds {
+	var x0, y0, x1, y1 int
+
+	fields := strings.Fields(points)
+
+	for i, f := range fields {
+		var x, y int
+
+		_, err := fmt.Sscanf(f, "%d,%d", &x, &y)
+		if err != nil {
+			return nil
+		}
+
+		if i == 0 {
+			x0, y0, x1, y1 = x, y, x, y
+		}
+
+		x0, y0, x1, y1 = min(x0, x), min(y0, y), max(x1, x), max(y1, y)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return &barcodeBounds{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// batchMode is the value of the "mode" parameter that converts every document of an archive input.
+const batchMode = "batch"
+
+// errTooManyDocuments is returned if a batch input holds more than --batch-max-documents documents.
+var errTooManyDocuments = errors.New("too many documents")
+
+// parseBatchMode parses the "mode" parameter, and returns true if the input is an archive of documents that are
+// converted one by one. Batch inputs always produce a Zip archive.
+func parseBatchMode(r *http.Request, opts convertOptions) (bool, *apiError) {
+	switch r.URL.Query().Get("mode") {
+	case "":
+		return false, nil
+	case batchMode:
+		if opts.singleFile() {
+			return false, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "batch mode requires a Zip archive", nil)
+		}
+
+		return true, nil
+	}
+
+	return false, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid mode", nil)
+}
+
+// isZip returns true if the data starts like a Zip archive, which may be empty.
+func isZip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06"))
+}
+
+// isTar returns true if the data starts like a POSIX tar archive.
+func isTar(head []byte) bool {
+	return (len(head) >= 262) && (string(head[257:262]) == "ustar")
+}
+
+// checkArchive rejects batch inputs whose first chunk reveals that they are neither a Zip nor a tar archive.
+func checkArchive(head []byte) *apiError {
+	if !isZip(head) && !isTar(head) {
+		return newAPIError(http.StatusUnsupportedMediaType, errorCodeUnsupportedMedia, "batch input must be a Zip or tar archive", nil)
+	}
+
+	return nil
+}
+
+// readArchiveInput reads the request body like readInput, but expects a Zip or tar archive of documents.
+func readArchiveInput(w http.ResponseWriter, r *http.Request) (*input, *apiError) {
+	return readBody(w, r, checkArchive)
+}
+
+// skipArchiveEntry returns true if the archive entry is not a document, but metadata of the tool that created the
+// archive, such as ".DS_Store" files or "__MACOSX" folders.
+func skipArchiveEntry(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "__MACOSX/")
+}
+
+// walkArchive calls the function with the name and content of every regular file of the Zip or tar archive, in order.
+func walkArchive(data []byte, fn func(name string, rd io.Reader) error) error {
+	// Walk Zip archive
+	if isZip(data) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("open Zip archive: %w", err)
+		}
+
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() || skipArchiveEntry(f.Name) {
+				continue
+			}
+
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("open %s: %w", f.Name, err)
+			}
+
+			err = fn(f.Name, rc)
+			rc.Close() //nolint:errcheck
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Walk tar archive
+	tr := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("read tar archive: %w", err)
+		}
+
+		if (hdr.Typeflag != tar.TypeReg) || skipArchiveEntry(hdr.Name) {
+			continue
+		}
+
+		err = fn(hdr.Name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// batchConverter defines the conversion of all documents of a batch input, or all files of a multipart request, into
+// a single Zip archive.
+type batchConverter struct {
+	in       *input         // in is the input, whose parts and password apply to every document.
+	opts     convertOptions // opts are the conversion options, which apply to every document without overrides.
+	images   imageEngine    // images converts the documents.
+	engine   *ocrEngine     // engine recognizes text, if requested.
+	maxPages uint           // maxPages is the maximum number of pages of each document, or 0 if it is unlimited.
+	aw       *archiveWriter // aw writes the output images.
+	folders  *entryNamer    // folders hands out unique folder names.
+	man      *manifest      // man lists all documents.
+}
+
+// newBatchConverter creates a converter of the input into a Zip archive with a folder per document. The manifest is
+// always written.
+func newBatchConverter(
+	in *input, opts convertOptions, images imageEngine, engine *ocrEngine, maxPages uint, entryNameTmpl *template.Template,
+) *batchConverter {
+	opts.Manifest = true
+
+	return &batchConverter{
+		in:       in,
+		opts:     opts,
+		images:   images,
+		engine:   engine,
+		maxPages: maxPages,
+		aw:       newArchiveWriter(entryNameTmpl, opts),
+		folders:  newEntryNamer(manifestName),
+		man:      &manifest{Parameters: opts, Documents: []manifestDocument{}},
+	}
+}
+
+// convertArchive converts every document of the Zip or tar archive input, in order, and returns a Zip archive with a
+// folder per document, named after the document. Documents that fail to convert are noted in the manifest instead of
+// failing the whole batch.
+func (bc *batchConverter) convertArchive(ctx context.Context) ([]byte, *apiError) {
+	if len(bc.in.extra) > 0 {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "batch mode requires a single file", nil)
+	}
+
+	maxDocuments := config().GetInt("batch-max-documents")
+
+	err := walkArchive(bc.in.data, func(name string, rd io.Reader) error {
+		if (maxDocuments > 0) && (len(bc.man.Documents) >= maxDocuments) {
+			return errTooManyDocuments
+		}
+
+		return bc.convert(ctx, name, rd)
+	})
+
+	switch {
+	case errors.Is(err, errTooManyDocuments):
+		err = newAPIError(http.StatusUnprocessableEntity, errorCodeTooManyDocuments, "too many documents", nil)
+	case (err == nil) && (len(bc.man.Documents) == 0):
+		err = newAPIError(http.StatusBadRequest, errorCodeMissingFile, "archive contains no documents", nil)
+	}
+
+	return bc.finish(ctx, err)
+}
+
+// convertFiles converts every "file" part of the multipart request, in order, and returns a Zip archive with a folder
+// per file, named after its filename. The options part may override parameters of individual files; all overrides are
+// validated before any file is converted. Files that fail to convert are noted in the manifest instead of failing the
+// whole request.
+func (bc *batchConverter) convertFiles(
+	r *http.Request, policies []*policy, watermark []byte, profiles map[string][]byte,
+) ([]byte, *apiError) {
+	if bc.opts.singleFile() {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "multiple files require a Zip archive", nil)
+	}
+
+	if aerr := checkImageResponse(bc.opts, len(bc.in.extra)+1); aerr != nil {
+		return nil, aerr
+	}
+
+	files := append([]*input{bc.in}, bc.in.extra...)
+
+	overrides, aerr := parseFileOverrides(bc.in, len(files))
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	// Parse options of every file with overrides
+	opts := make([]convertOptions, len(files))
+	maxPages := make([]uint, len(files))
+	params := make([]*convertOptions, len(files))
+
+	for i := range files {
+		opts[i], maxPages[i] = bc.opts, bc.maxPages
+
+		if (i < len(overrides)) && (len(overrides[i]) > 0) {
+			opts[i], maxPages[i], aerr = fileOptions(r, bc.in, overrides[i], policies, watermark, profiles, bc.engine)
+			if aerr != nil {
+				return nil, aerr
+			}
+
+			opts[i].Manifest = true
+			params[i] = &opts[i]
+		}
+	}
+
+	// Convert every file
+	var err error
+
+	for i, f := range files {
+		doc := &input{data: f.data, path: f.path, filename: f.filename, parts: bc.in.parts, password: bc.in.password}
+
+		err = bc.write(r.Context(), f.filename, doc, opts[i], maxPages[i], params[i])
+		if err != nil {
+			break
+		}
+	}
+
+	return bc.finish(r.Context(), err)
+}
+
+// finish returns the complete Zip archive, or the error that failed the conversion, in which case the archive is
+// discarded.
+func (bc *batchConverter) finish(ctx context.Context, err error) ([]byte, *apiError) {
+	var aerr *apiError
+
+	switch {
+	case errors.As(err, &aerr):
+	case err != nil:
+		aerr = newAPIError(http.StatusUnprocessableEntity, errorCodeDecodeFailed, "failed to read archive", err)
+	}
+
+	if aerr != nil {
+		bc.aw.discard()
+		return nil, aerr
+	}
+
+	failed := 0
+
+	for _, doc := range bc.man.Documents {
+		if doc.Error != nil {
+			failed++
+		}
+	}
+
+	slog.InfoContext(ctx, "Converted batch", slog.Int("documents", len(bc.man.Documents)), slog.Int("failed", failed))
+
+	return bc.aw.close(ctx, bc.man)
+}
+
+// convert reads a single document of the archive input, bound by --max-body-size, and writes its output images into
+// the archive. Only failures of the archive itself, or of the request, are returned.
+func (bc *batchConverter) convert(ctx context.Context, name string, rd io.Reader) error {
+	// Release the document once it is converted, instead of once the request is done
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if limit := config().GetInt64("max-body-size"); limit > 0 {
+		rd = http.MaxBytesReader(nil, io.NopCloser(rd), limit)
+	}
+
+	data, file, aerr := readImage(ctx, rd)
+	if aerr != nil {
+		return bc.fail(ctx, name, aerr)
+	}
+
+	doc := &input{data: data, path: file, filename: name, parts: bc.in.parts, password: bc.in.password}
+
+	return bc.write(ctx, name, doc, bc.opts, bc.maxPages, nil)
+}
+
+// write converts all pages of a single document, and writes its output images into a folder of the archive named
+// after the document. The parameters of documents with overrides are noted in the manifest. Only failures of the
+// archive itself, or of the request, are returned.
+func (bc *batchConverter) write(
+	ctx context.Context, name string, in *input, opts convertOptions, maxPages uint, params *convertOptions,
+) error {
+	results, report, aerr := bc.images.convert(ctx, in, opts, maxPages)
+	if (aerr == nil) && (opts.OCR != nil) {
+		err := recognizePages(ctx, bc.engine, results, opts)
+		if err != nil {
+			aerr = newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to recognize text", err)
+		}
+	}
+
+	if aerr != nil {
+		return bc.fail(ctx, name, aerr)
+	}
+
+	doc := manifestDocument{Name: name, Parameters: params, Input: report}
+	doc.Folder = bc.folders.unique(uploadBasename(name))
+
+	doc.Pages, aerr = bc.aw.writePages(results, uploadBasename(name), doc.Folder, opts)
+	if aerr != nil {
+		return aerr
+	}
+
+	bc.man.Documents = append(bc.man.Documents, doc)
+
+	return nil
+}
+
+// fail notes the document that failed to convert in the manifest, unless the request itself failed.
+func (bc *batchConverter) fail(ctx context.Context, name string, aerr *apiError) error {
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+
+	slog.WarnContext(ctx, "Failed to convert document", slog.String("document", name), slog.Any("error", aerr))
+
+	bc.man.Documents = append(bc.man.Documents, manifestDocument{
+		Name:  name,
+		Error: &errorResponse{Code: aerr.code, Message: aerr.message},
+	})
+
+	return nil
+}
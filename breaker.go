@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// circuitState defines the state of a circuit breaker.
+type circuitState string
+
+const (
+	circuitClosed   circuitState = "CLOSED"    // circuitClosed lets all requests through.
+	circuitOpen     circuitState = "OPEN"      // circuitOpen fails requests fast.
+	circuitHalfOpen circuitState = "HALF_OPEN" // circuitHalfOpen lets a single trial request through.
+)
+
+// breaker defines a circuit breaker for a delegate. After --breaker-threshold consecutive transient failures it opens,
+// so requests relying on the delegate fail fast instead of piling up. After --breaker-cooldown it lets a single trial
+// request through, which closes it again on success, or keeps it open for another cooldown on failure.
+type breaker struct {
+	name string // name is the name of the delegate.
+
+	mu       sync.Mutex
+	state    circuitState // state is the state of the breaker.
+	failures int          // failures is the number of consecutive transient failures.
+	opened   time.Time    // opened is the time the breaker was last opened.
+}
+
+// ghostscriptBreaker is the circuit breaker of Ghostscript, which renders PDF and PostScript inputs.
+var ghostscriptBreaker = &breaker{name: "ghostscript", state: circuitClosed}
+
+// usesGhostscript returns true if the input is rendered by Ghostscript.
+func usesGhostscript(data []byte) bool {
+	format := sniffFormat(data[:min(len(data), sniffLength)])
+	return (format == "PDF") || (format == "PS")
+}
+
+// allow returns true if a request may use the delegate. Once the cooldown has passed, a single trial request is
+// allowed until its outcome is recorded.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true
+
+	case circuitOpen:
+		if time.Since(b.opened) < config().GetDuration("breaker-cooldown") {
+			return false
+		}
+
+		b.state = circuitHalfOpen
+
+		return true
+
+	case circuitHalfOpen:
+		return false
+	}
+
+	return false
+}
+
+// record records the outcome of a request that was allowed to use the delegate. Only transient failures count, since
+// permanent ones, e.g. corrupt inputs, say nothing about the health of the delegate.
+func (b *breaker) record(err error) {
+	transient := isTransient(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !transient {
+		if b.state != circuitClosed {
+			slog.Info("Closed circuit breaker", slog.String("delegate", b.name))
+		}
+
+		b.state, b.failures = circuitClosed, 0
+
+		return
+	}
+
+	b.failures++
+
+	threshold := config().GetInt("breaker-threshold")
+	if (b.state == circuitHalfOpen) || ((threshold > 0) && (b.failures >= threshold)) {
+		if b.state != circuitOpen {
+			slog.Error("Opened circuit breaker", slog.String("delegate", b.name), slog.Int("failures", b.failures))
+		}
+
+		b.state, b.opened = circuitOpen, time.Now()
+	}
+}
+
+// status returns the state of the breaker.
+func (b *breaker) status() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
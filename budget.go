@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// defaultBudgetLadder defines the degradation steps used if a page exceeds its time budget.
+var defaultBudgetLadder = []string{"150:75", "72:60"}
+
+// budgetStep defines a single degradation step.
+type budgetStep struct {
+	density float64 // density is the maximum density of the page in DPI.
+	quality uint    // quality is the maximum compression quality.
+}
+
+// pageDegradation defines how a page was degraded to meet its time budget.
+type pageDegradation struct {
+	Attempts int     `json:"attempts"` // Attempts is the number of conversions started for the page.
+	Density  float64 `json:"density"`  // Density is the density the page was finally converted at.
+	Quality  uint    `json:"quality"`  // Quality is the compression quality the page was finally converted with.
+}
+
+// parseBudgetLadder parses the degradation steps, each given as "density:quality".
+func parseBudgetLadder(values []string) ([]budgetStep, error) {
+	steps := make([]budgetStep, 0, len(values))
+
+	for _, v := range values {
+		d, q, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid budget step %q", v)
+		}
+
+		density, err := strconv.ParseFloat(d, 64)
+		if (err != nil) || !(density > 0) || math.IsInf(density, 0) {
+			return nil, fmt.Errorf("invalid density of budget step %q", v)
+		}
+
+		quality, err := strconv.ParseUint(q, 10, 64)
+		if (err != nil) || (quality > 100) {
+			return nil, fmt.Errorf("invalid quality of budget step %q", v)
+		}
+
+		steps = append(steps, budgetStep{density: density, quality: uint(quality)})
+	}
+
+	return steps, nil
+}
+
+// attemptResult defines the outcome of a single conversion attempt.
+type attemptResult struct {
+	res []pageResult // res are the results of the attempt.
+	err error        // err is the error of the attempt.
+}
+
+// attemptsKey is the context key of the wait group that tracks running conversion attempts.
+type attemptsKey struct{}
+
+// withAttempts returns a copy of the context that tracks all conversion attempts started with it in the given wait
+// group, so the slot they run in can be held until abandoned attempts have exited as well.
+func withAttempts(ctx context.Context, wg *sync.WaitGroup) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, wg)
+}
+
+// trackAttempt registers a running conversion attempt with the wait group of the context, if any. It returns a
+// function that must be called once the attempt has exited.
+func trackAttempt(ctx context.Context) func() {
+	wg, _ := ctx.Value(attemptsKey{}).(*sync.WaitGroup)
+	if wg == nil {
+		return func() {}
+	}
+
+	wg.Add(1)
+
+	return wg.Done
+}
+
+// convertPageWithBudget converts a single page within the configured time budget. If an attempt exceeds the budget,
+// it is abandoned (but keeps running in the background until ImageMagick returns) and the page is converted again at
+// the next, lower step of the degradation ladder. The last step is never abandoned. All attempts are tracked in the
+// context, so abandoned ones keep holding their page worker and conversion slot until they exit.
+func convertPageWithBudget(
+	ctx context.Context, mwi *imagick.MagickWand, page, pages int, opts convertOptions,
+) ([]pageResult, error) {
+	budget := config().GetDuration("page-budget")
+	ladder, _ := parseBudgetLadder(config().GetStringSlice("page-budget-ladder"))
+
+	if budget <= 0 {
+		return convertPage(mwi, page, pages, opts)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Convert a copy of the page, so an abandoned attempt cannot interfere with the next one
+		mwa := mwi.Clone()
+		done := make(chan attemptResult, 1)
+		exited := trackAttempt(ctx)
+
+		go func(opts convertOptions) {
+			defer exited()
+			defer mwa.Destroy()
+			defer measureCPU(ctx)()
+
+			if attempt > 0 {
+				var err error
+
+				opts, err = degradePage(mwa, opts, ladder[attempt-1])
+				if err != nil {
+					done <- attemptResult{err: newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to degrade page", err)}
+					return
+				}
+			}
+
+			res, err := convertPage(mwa, page, pages, opts)
+			if (err == nil) && (attempt > 0) {
+				for i := range res {
+					res[i].degraded = &pageDegradation{Attempts: attempt + 1, Density: opts.Density, Quality: opts.Quality}
+				}
+			}
+
+			done <- attemptResult{res: res, err: err}
+		}(opts)
+
+		// Wait for the last step without limit
+		if attempt == len(ladder) {
+			r := <-done
+			return r.res, r.err
+		}
+
+		// Wait for any other step until the budget is exceeded
+		select {
+		case r := <-done:
+			return r.res, r.err
+		case <-time.After(budget):
+		}
+	}
+}
+
+// degradePage resamples the page to the density of the given step, and returns the options adapted to that step.
+func degradePage(mw *imagick.MagickWand, opts convertOptions, step budgetStep) (convertOptions, error) {
+	opts.Quality = min(opts.Quality, step.quality)
+
+	if step.density >= opts.Density {
+		return opts, nil
+	}
+
+	// Resample page
+	factor := step.density / opts.Density
+
+	err := imagick.ResampleImage(mw, step.density, step.density, imagick.FILTER_LANCZOS)
+	if err != nil {
+		return opts, fmt.Errorf("resample image: %w", err)
+	}
+
+	// Scale pixel-based options
+	if opts.Crop != nil {
+		crop := *opts.Crop
+		crop.Width = max(1, uint(float64(crop.Width)*factor))
+		crop.Height = max(1, uint(float64(crop.Height)*factor))
+		crop.X = int(float64(crop.X) * factor)
+		crop.Y = int(float64(crop.Y) * factor)
+		opts.Crop = &crop
+	}
+
+	if opts.Filter != nil {
+		filter := *opts.Filter
+		filter.Blur = scaleKernel(filter.Blur, factor)
+		filter.Sharpen = scaleKernel(filter.Sharpen, factor)
+		opts.Filter = &filter
+	}
+
+	opts.Density = step.density
+
+	return opts, nil
+}
+
+// scaleKernel returns a copy of the kernel scaled by the given factor, or nil if no kernel is given.
+func scaleKernel(k *kernelOptions, factor float64) *kernelOptions {
+	if k == nil {
+		return nil
+	}
+
+	return &kernelOptions{Radius: k.Radius * factor, Sigma: k.Sigma * factor}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// addressFilter defines which client addresses may reach the server.
+type addressFilter struct {
+	allow []netip.Prefix // allow are the ranges clients must be in, if any.
+	deny  []netip.Prefix // deny are the ranges clients must not be in.
+}
+
+// newAddressFilter parses the allowed and denied address ranges. It returns nil if there are none.
+func newAddressFilter(allow, deny []string) (*addressFilter, error) {
+	if (len(allow) == 0) && (len(deny) == 0) {
+		return nil, nil
+	}
+
+	parse := func(cidrs []string) ([]netip.Prefix, error) {
+		prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+		for _, c := range cidrs {
+			p, err := netip.ParsePrefix(c)
+			if err != nil {
+				return nil, fmt.Errorf("parse CIDR %q: %w", c, err)
+			}
+
+			prefixes = append(prefixes, p.Masked())
+		}
+
+		return prefixes, nil
+	}
+
+	allowed, err := parse(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := parse(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &addressFilter{allow: allowed, deny: denied}, nil
+}
+
+// allows returns true if the address is in none of the denied ranges, and in one of the allowed ranges if any.
+func (f *addressFilter) allows(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filter is a middleware that rejects requests from addresses that are not allowed. It checks the address of the
+// connection, so it has to run before the remote address is replaced by forwarding headers.
+func (f *addressFilter) filter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		addr, err := netip.ParseAddr(host)
+		if (err != nil) || !f.allows(addr) {
+			slog.ErrorContext(r.Context(), "Request rejected by address", slog.String("address", r.RemoteAddr))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodeAddressDenied, "address not allowed", nil))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
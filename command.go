@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// maxCommandError is the maximum length of the standard error of a failed command included in its error.
+const maxCommandError = 512
+
+// runCommand runs an external program and returns its standard output. If the program fails, the (truncated) standard
+// error is included in the error. The program is killed if the context is canceled.
+func runCommand(ctx context.Context, name string, args []string, stdin []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if cmd.ProcessState != nil {
+		countCPUTime(ctx, cmd.ProcessState.UserTime()+cmd.ProcessState.SystemTime())
+	}
+
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxCommandError {
+			msg = msg[:maxCommandError] + "..."
+		}
+
+		return nil, fmt.Errorf("run %s: %w: %s", name, err, msg)
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"github.com/go-chi/render"
+)
+
+// compareReferencePart is the name of the multipart part holding the image compared against.
+const compareReferencePart = "reference"
+
+// ssimWindow is the edge length of the square windows the structural similarity is computed over.
+const ssimWindow = 8
+
+// compareOptions defines the options of a comparison.
+type compareOptions struct {
+	Page int  // Page is the zero-based index of the page compared in both images.
+	Diff bool // Diff responds with a visual diff image instead of the metrics.
+}
+
+// compareResponse defines the difference metrics of two images.
+type compareResponse struct {
+	Page   int      `json:"page"`   // Page is the zero-based index of the compared page.
+	Width  uint     `json:"width"`  // Width is the width of both images in pixels.
+	Height uint     `json:"height"` // Height is the height of both images in pixels.
+	RMSE   float64  `json:"rmse"`   // RMSE is the normalized root mean squared error, from 0 (identical) to 1.
+	PSNR   *float64 `json:"psnr"`   // PSNR is the peak signal-to-noise ratio in dB, or nil if the images are identical.
+	SSIM   float64  `json:"ssim"`   // SSIM is the mean structural similarity, from 1 (identical) down to -1.
+}
+
+// parseCompareOptions parses the comparison URL parameters.
+func parseCompareOptions(query url.Values) (*compareOptions, *apiError) {
+	opts := &compareOptions{}
+
+	// Parse page
+	if v := query.Get("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if (err != nil) || (p < 0) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid page parameter", err)
+		}
+
+		opts.Page = p
+	}
+
+	// Parse diff
+	var aerr *apiError
+
+	opts.Diff, aerr = parseBoolQuery(query, "diff")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return opts, nil
+}
+
+// compareHandler compares an image with a reference image and responds with difference metrics, or a diff image.
+func compareHandler(policies []*policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options
+		opts, aerr := parseConvertOptions(r)
+
+		var co *compareOptions
+		if aerr == nil {
+			co, aerr = parseCompareOptions(r.URL.Query())
+		}
+
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body
+		in, aerr := readInput(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Read both pages
+		mwa, mwb, aerr := readComparedPages(r.Context(), in, opts, co, pol)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read images", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		defer mwa.Destroy()
+		defer mwb.Destroy()
+
+		// Compare pages
+		res, err := comparePages(mwa, mwb, co.Page)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to compare images", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to compare images")
+			return
+		}
+
+		if !co.Diff {
+			render.Status(r, http.StatusOK)
+			render.JSON(w, r, res)
+
+			return
+		}
+
+		// Render diff image
+		out, err := diffPages(mwa, mwb)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to render diff image", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to render diff image")
+			return
+		}
+
+		// We're good
+		w.Header().Set("Content-Type", formatMediaTypeMap["PNG"])
+		w.Header().Set("X-Compare-RMSE", strconv.FormatFloat(res.RMSE, 'g', -1, 64))
+		w.Header().Set("X-Compare-SSIM", strconv.FormatFloat(res.SSIM, 'g', -1, 64))
+
+		if res.PSNR != nil {
+			w.Header().Set("X-Compare-PSNR", strconv.FormatFloat(*res.PSNR, 'g', -1, 64))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(out) //nolint:errcheck
+	}
+}
+
+// readComparedPages decodes the image and the reference image, and returns the flattened pages to compare.
+func readComparedPages(
+	ctx context.Context, in *input, opts convertOptions, co *compareOptions, pol policyResult,
+) (*imagick.MagickWand, *imagick.MagickWand, *apiError) {
+	// Check reference image
+	ref, ok := in.parts[compareReferencePart]
+	if !ok {
+		return nil, nil, newAPIError(http.StatusBadRequest, errorCodeMissingFile, "missing reference part", nil)
+	}
+
+	ref, _, aerr := readImage(ctx, bytes.NewReader(ref))
+	if aerr != nil {
+		return nil, nil, aerr
+	}
+
+	// Read both pages
+	mwa, aerr := readComparedPage(ctx, in, opts, co.Page, pol)
+	if aerr != nil {
+		return nil, nil, aerr
+	}
+
+	mwb, aerr := readComparedPage(ctx, &input{data: ref, password: in.password}, opts, co.Page, pol)
+	if aerr != nil {
+		mwa.Destroy()
+		return nil, nil, aerr
+	}
+
+	// Check dimensions
+	if (mwa.GetImageWidth() != mwb.GetImageWidth()) || (mwa.GetImageHeight() != mwb.GetImageHeight()) {
+		mwa.Destroy()
+		mwb.Destroy()
+
+		return nil, nil, newAPIError(http.StatusUnprocessableEntity, errorCodeSizeMismatch, "images differ in size", nil)
+	}
+
+	return mwa, mwb, nil
+}
+
+// readComparedPage decodes the image and returns the given page, flattened.
+func readComparedPage(ctx context.Context, in *input, opts convertOptions, page int, pol policyResult) (*imagick.MagickWand, *apiError) {
+	mw, aerr := readWand(ctx, in, opts)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	defer releaseWand(mw)
+
+	// Enforce page limit
+	pages := int(mw.GetNumberImages())
+
+	if (pol.MaxPages > 0) && (uint(pages) > pol.MaxPages) {
+		return nil, newAPIError(http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded", nil)
+	}
+
+	if page >= pages {
+		return nil, newAPIError(http.StatusNotFound, errorCodeNotFound, "page not found", nil)
+	}
+
+	// Flatten page
+	mw.SetIteratorIndex(page)
+
+	mwi := mw.GetImage()
+	defer mwi.Destroy()
+
+	err := prepareAlpha(mwi, opts)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to prepare alpha channel", err)
+	}
+
+	return mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN), nil
+}
+
+// comparePages computes the difference metrics of two pages of equal size.
+func comparePages(mwa, mwb *imagick.MagickWand, page int) (*compareResponse, error) {
+	res := &compareResponse{Page: page, Width: mwa.GetImageWidth(), Height: mwa.GetImageHeight()}
+
+	// Compute pixel metrics
+	rmse, err := mwa.GetImageDistortion(mwb, imagick.METRIC_ROOT_MEAN_SQUARED_ERROR)
+	if err != nil {
+		return nil, fmt.Errorf("compute RMSE: %w", err)
+	}
+
+	psnr, err := mwa.GetImageDistortion(mwb, imagick.METRIC_PEAK_SIGNAL_TO_NOISE_RATIO)
+	if err != nil {
+		return nil, fmt.Errorf("compute PSNR: %w", err)
+	}
+
+	res.RMSE = rmse
+
+	if !math.IsInf(psnr, 0) && !math.IsNaN(psnr) && (rmse > 0) {
+		res.PSNR = &psnr
+	}
+
+	// Compute structural similarity on intensities
+	x, err := exportIntensities(mwa)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := exportIntensities(mwb)
+	if err != nil {
+		return nil, err
+	}
+
+	res.SSIM = meanSSIM(x, y, int(res.Width), int(res.Height))
+
+	return res, nil
+}
+
+// exportIntensities returns the intensities of all pixels, from 0 to 1, row by row.
+func exportIntensities(mw *imagick.MagickWand) ([]float32, error) {
+	pixels, err := mw.ExportImagePixels(0, 0, mw.GetImageWidth(), mw.GetImageHeight(), "I", imagick.PIXEL_FLOAT)
+	if err != nil {
+		return nil, fmt.Errorf("export pixels: %w", err)
+	}
+
+	values, _ := pixels.([]float32)
+
+	return values, nil
+}
+
+// meanSSIM computes the mean structural similarity of two images over non-overlapping square windows.
+func meanSSIM(x, y []float32, width, height int) float64 {
+	var (
+		sum     float64
+		windows int
+	)
+
+	for y0 := 0; y0 < height; y0 += ssimWindow {
+		for x0 := 0; x0 < width; x0 += ssimWindow {
+			sum += windowSSIM(x, y, width, x0, y0, min(x0+ssimWindow, width), min(y0+ssimWindow, height))
+			windows++
+		}
+	}
+
+	if windows == 0 {
+		return 1.0
+	}
+
+	return sum / float64(windows)
+}
+
+// windowSSIM computes the structural similarity of two images within the window [x0, x1) × [y0, y1).
+func windowSSIM(x, y []float32, width, x0, y0, x1, y1 int) float64 {
+	const (
+		c1 = 0.01 * 0.01 // c1 stabilizes the luminance term for a dynamic range of 1.
+		c2 = 0.03 * 0.03 // c2 stabilizes the contrast term for a dynamic range of 1.
+	)
+
+	var sx, sy, sxx, syy, sxy float64
+
+	for row := y0; row < y1; row++ {
+		for col := x0; col < x1; col++ {
+			a, b := float64(x[row*width+col]), float64(y[row*width+col])
+
+			sx, sy = sx+a, sy+b
+			sxx, syy, sxy = sxx+a*a, syy+b*b, sxy+a*b
+		}
+	}
+
+	n := float64((x1 - x0) * (y1 - y0))
+	mx, my := sx/n, sy/n
+	vx, vy, cov := sxx/n-mx*mx, syy/n-my*my, sxy/n-mx*my
+
+	return ((2*mx*my + c1) * (2*cov + c2)) / ((mx*mx + my*my + c1) * (vx + vy + c2))
+}
+
+// diffPages renders a PNG image highlighting the pixels that differ between two pages.
+func diffPages(mwa, mwb *imagick.MagickWand) ([]byte, error) {
+	diff, _ := mwa.CompareImages(mwb, imagick.METRIC_ABSOLUTE_ERROR)
+	if diff == nil {
+		return nil, fmt.Errorf("compare images: %w", mwa.GetLastError())
+	}
+
+	defer diff.Destroy()
+
+	err := diff.SetImageFormat("PNG")
+	if err != nil {
+		return nil, fmt.Errorf("set output format: %w", err)
+	}
+
+	return diff.GetImageBlob()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// CmdConfig defines the command to inspect the configuration.
+var CmdConfig = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+	Args:  cobra.NoArgs,
+}
+
+// CmdConfigDump defines the command to print the effective configuration.
+var CmdConfigDump = &cobra.Command{
+	Use:   "dump [flags]",
+	Short: "Print the effective configuration",
+	Long: "Print the fully resolved configuration, merged from flags, the configuration file, and environment " +
+		"variables, with sensitive values masked. Every option is annotated with its description.",
+	Args: cobra.NoArgs,
+	RunE: runConfigDump,
+}
+
+// Initialize command options
+func init() {
+	CmdConfigDump.Flags().String("format", "yaml", "output format, either yaml or env")
+
+	CmdConfig.AddCommand(CmdConfigDump)
+	CmdMain.AddCommand(CmdConfig)
+}
+
+// runConfigDump is called when the config dump command is used.
+func runConfigDump(cmd *cobra.Command, _ []string) error {
+	format, _ := cmd.Flags().GetString("format")
+
+	switch strings.ToLower(format) {
+	case "yaml":
+		return dumpYAML()
+	case "env":
+		return dumpEnv()
+	}
+
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// dumpYAML prints the effective configuration as a YAML configuration file.
+func dumpYAML() error {
+	settings := viper.AllSettings()
+
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	// Build document, annotating each option with the usage of its flag
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, k := range keys {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: k}
+		if f := CmdMain.Flags().Lookup(k); f != nil {
+			key.HeadComment = f.Usage
+		}
+
+		value := &yaml.Node{}
+
+		err := value.Encode(maskSetting(k, settings[k]))
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", k, err)
+		}
+
+		doc.Content = append(doc.Content, key, value)
+	}
+
+	// Write document
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+
+	err := enc.Encode(doc)
+	if err != nil {
+		return fmt.Errorf("write configuration: %w", err)
+	}
+
+	return enc.Close()
+}
+
+// dumpEnv prints all supported environment variables with their effective values.
+func dumpEnv() error {
+	var sb strings.Builder
+
+	CmdMain.Flags().VisitAll(func(f *pflag.Flag) {
+		value := viper.Get(f.Name)
+		if s, ok := value.([]string); ok {
+			value = strings.Join(s, " ")
+		}
+
+		fmt.Fprintf(&sb, "# %s (default %q)\n", f.Usage, f.DefValue)
+		fmt.Fprintf(&sb, "%s=%s\n\n", envName(f.Name), shellQuote(fmt.Sprint(maskSetting(f.Name, value))))
+	})
+
+	_, err := fmt.Fprint(os.Stdout, strings.TrimSuffix(sb.String(), "\n"))
+	if err != nil {
+		return fmt.Errorf("write configuration: %w", err)
+	}
+
+	return nil
+}
+
+// envName returns the environment variable of the given option.
+func envName(key string) string {
+	return "MAGICK_SERVER_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// shellQuote quotes the given value for use in shell scripts and env files, if needed.
+func shellQuote(value string) string {
+	if !strings.ContainsAny(value, " \t\n\"'$`\\{}[]|&;<>()*?#~") {
+		return value
+	}
+
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// isSensitiveKey returns true if the given option holds a sensitive value, i.e. if its name contains one of the
+// keys redacted from logs.
+func isSensitiveKey(key string) bool {
+	key = normalizeRedactKey(key)
+
+	for _, k := range config().GetStringSlice("log-redact-keys") {
+		if strings.Contains(key, normalizeRedactKey(k)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maskSetting masks the value of sensitive options, descending into nested settings.
+func maskSetting(key string, value any) any {
+	if isSensitiveKey(key) && (value != nil) && (fmt.Sprint(value) != "") {
+		return redactedValue
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		masked := make(map[string]any, len(v))
+		for k, e := range v {
+			masked[k] = maskSetting(k, e)
+		}
+
+		return masked
+
+	case []any:
+		masked := make([]any, 0, len(v))
+		for _, e := range v {
+			masked = append(masked, maskSetting("", e))
+		}
+
+		return masked
+	}
+
+	return value
+}
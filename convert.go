@@ -0,0 +1,1006 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// formatExtensionMap defines the supported output formats and their file extensions.
+var formatExtensionMap = map[string]string{
+	"J2K":  "j2k",  // JPEG 2000 codestream, if supported by ImageMagick
+	"JP2":  "jp2",  // JPEG 2000, if supported by ImageMagick
+	"JPEG": "jpg",  // JPEG File Interchange Format
+	"JXL":  "jxl",  // JPEG XL, if supported by ImageMagick
+	"PNG":  "png",  // Portable Network Graphics
+	"TIFF": "tiff", // Tagged Image File Format
+	"WEBP": "webp", // WebP
+}
+
+// formatMediaTypeMap defines the media types of the supported output formats.
+var formatMediaTypeMap = map[string]string{
+	"J2K":  "image/x-jp2-codestream",
+	"JP2":  "image/jp2",
+	"JPEG": "image/jpeg",
+	"JXL":  "image/jxl",
+	"PNG":  "image/png",
+	"TIFF": "image/tiff",
+	"WEBP": "image/webp",
+}
+
+const (
+	backgroundTransparent = "transparent" // backgroundTransparent keeps transparent areas transparent.
+	backgroundDefault     = "#ffffff"     // backgroundDefault is used for output formats without alpha.
+)
+
+// layoutType defines the output layout to enforce.
+type layoutType string
+
+const (
+	layoutTypeLandscape layoutType = "LANDSCAPE" // layoutTypeLandscape forces a landscape layout.
+	layoutTypePortrait  layoutType = "PORTRAIT"  // layoutTypePortrait forces a portrait layout.
+	layoutTypeKeep      layoutType = "KEEP"      // layoutTypeKeep keeps the original layout.
+)
+
+// alphaMode defines how transparency is handled when flattening.
+type alphaMode string
+
+const (
+	alphaModeKeep       alphaMode = "KEEP"       // alphaModeKeep retains transparency.
+	alphaModeRemove     alphaMode = "REMOVE"     // alphaModeRemove drops the alpha channel without compositing.
+	alphaModeBackground alphaMode = "BACKGROUND" // alphaModeBackground flattens onto the background color.
+)
+
+// convertOptions defines the options of a conversion.
+type convertOptions struct {
+	Density float64    `json:"density"`           // Density is the rendering resolution in DPI.
+	Quality uint       `json:"quality"`           // Quality is the compression quality of the output images.
+	Format  string     `json:"format"`            // Format is the (first) output format.
+	Formats []string   `json:"formats,omitempty"` // Formats are all output formats if more than one is requested.
+	Layout  layoutType `json:"layout"`            // Layout is the output layout to enforce.
+
+	Alpha      alphaMode `json:"alpha"`                // Alpha defines how transparency is handled.
+	Background string    `json:"background,omitempty"` // Background is the color layers are flattened onto.
+
+	SVG    *svgOptions   `json:"svg,omitempty"`   // SVG is the size SVG inputs are rasterized at.
+	RAW    *rawOptions   `json:"raw,omitempty"`   // RAW is how RAW camera files are developed.
+	DICOM  *dicomOptions `json:"dicom,omitempty"` // DICOM is the window DICOM inputs are rendered with.
+	Layers layersMode    `json:"layers"`          // Layers defines how the layers of PSD and XCF inputs are turned into pages.
+
+	Split     *splitOptions     `json:"split,omitempty"`     // Split splits each page into two output images.
+	Flip      bool              `json:"flip,omitempty"`      // Flip mirrors each page vertically.
+	Flop      bool              `json:"flop,omitempty"`      // Flop mirrors each page horizontally.
+	Rotate    *rotateOptions    `json:"rotate,omitempty"`    // Rotate is the rotation of each page.
+	Crop      *cropOptions      `json:"crop,omitempty"`      // Crop is the region extracted from each page.
+	Filter    *filterOptions    `json:"filter,omitempty"`    // Filter are the noise reduction, blur, and sharpen options.
+	Adjust    *adjustOptions    `json:"adjust,omitempty"`    // Adjust are the brightness, contrast, and gamma options.
+	Tone      *toneOptions      `json:"tone,omitempty"`      // Tone are the grayscale and bitonal conversion options.
+	Watermark *watermarkOptions `json:"watermark,omitempty"` // Watermark are the watermark overlay options.
+	Text      *textOptions      `json:"text,omitempty"`      // Text are the text annotation options.
+	Profile   *profileOptions   `json:"profile,omitempty"`   // Profile is the target ICC profile.
+
+	KeepColorspace bool           `json:"keep_colorspace,omitempty"` // KeepColorspace retains the colorspace of the source pages.
+	Metadata       metadataMode   `json:"metadata"`                  // Metadata defines how metadata is carried over.
+	Fields         *fieldsOptions `json:"fields,omitempty"`          // Fields are the metadata fields written into each output image.
+
+	JPEG *jpegOptions `json:"jpeg,omitempty"` // JPEG are the JPEG-specific encoding options.
+	PNG  *pngOptions  `json:"png,omitempty"`  // PNG are the PNG-specific encoding options.
+	JXL  *jxlOptions  `json:"jxl,omitempty"`  // JXL are the JPEG XL-specific encoding options.
+	JP2  *jp2Options  `json:"jp2,omitempty"`  // JP2 are the JPEG 2000-specific encoding options.
+
+	Sizes   []uint          `json:"sizes,omitempty"`   // Sizes are the widths of the renditions of each page.
+	Animate *animateOptions `json:"animate,omitempty"` // Animate assembles all pages into an animation.
+	PDFA    bool            `json:"pdfa,omitempty"`    // PDFA assembles all pages into a PDF/A document.
+	OCR     *ocrOptions     `json:"ocr,omitempty"`     // OCR recognizes the text of all pages.
+
+	FilenameTemplate string `json:"filename_template,omitempty"` // FilenameTemplate overrides the entry name template.
+	Manifest         bool   `json:"-"`                           // Manifest adds a manifest entry to the Zip archive.
+	Report           bool   `json:"-"`                           // Report adds a sanitization report to the manifest.
+	Store            bool   `json:"-"`                           // Store stores the Zip archive for later download.
+	ArchivePassword  string `json:"-"`                           // ArchivePassword encrypts the Zip archive entries.
+	Response         string `json:"-"`                           // Response is the negotiated media type of the response.
+}
+
+// pageResult defines the outcome of converting a single page.
+type pageResult struct {
+	out      []byte           // out is the encoded output image.
+	data     entryNameData    // data is the metadata used to name the Zip archive entry.
+	degraded *pageDegradation // degraded is set if the page was degraded to meet its time budget.
+	text     []byte           // text is the text recognized in the output image, if requested.
+}
+
+// parseConvertOptions parses the conversion options from the URL parameters of the request.
+func parseConvertOptions(r *http.Request) (convertOptions, *apiError) {
+	opts := convertOptions{
+		Density: 300.0,
+		Quality: 85,
+		Format:  "JPEG",
+		Layout:  layoutTypeKeep,
+		Alpha:   alphaModeBackground,
+	}
+
+	// Parse density
+	if v := r.URL.Query().Get("density"); v != "" {
+		d, err := strconv.ParseFloat(v, 64)
+		if (err != nil) || math.IsNaN(d) || math.IsInf(d, 0) {
+			return opts, newAPIError(http.StatusBadRequest, errorCodeInvalidDensity, "invalid density", err)
+		}
+
+		opts.Density = d
+	}
+
+	// Parse compression quality
+	if v := r.URL.Query().Get("quality"); v != "" {
+		q, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, newAPIError(http.StatusBadRequest, errorCodeInvalidQuality, "invalid compression quality", err)
+		}
+
+		opts.Quality = uint(q)
+	}
+
+	// Parse output formats
+	aerr := parseOutputOptions(r.URL.Query(), &opts)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse output layout
+	opts.Layout, aerr = parseLayout(r.URL.Query().Get("layout"))
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse alpha mode and background color
+	opts.Alpha, aerr = parseAlpha(r.URL.Query().Get("alpha"), opts.alphaFormat())
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	opts.Background, aerr = parseBackground(r.URL.Query().Get("background"), opts.alphaFormat())
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse page operation options
+	aerr = parseOperationOptions(r, &opts)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse format-specific input options
+	aerr = parseInputOptions(r.URL.Query(), &opts)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse renditions
+	opts.Sizes, aerr = parseSizes(r.URL.Query())
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse text recognition
+	opts.OCR, aerr = parseOCROptions(r.URL.Query(), opts)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Parse filename template
+	if v := r.URL.Query().Get("filename-template"); v != "" {
+		_, err := expandFilenameTemplate(v, entryNameData{Basename: defaultBasename, Format: opts.Format, Ext: "ext"})
+		if err != nil {
+			return opts, newAPIError(http.StatusBadRequest, errorCodeInvalidTemplate, "invalid filename template", err)
+		}
+
+		opts.FilenameTemplate = v
+	}
+
+	// Parse manifest and sanitization report, which implies the manifest
+	opts.Manifest, aerr = parseBoolParam(r, "manifest")
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	opts.Report, aerr = parseBoolParam(r, "report")
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	opts.Manifest = opts.Manifest || opts.Report
+
+	// Parse result storage
+	opts.Store, aerr = parseBoolParam(r, "store")
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	// Pick archive password, which an "archive-password" part of multipart requests overrides
+	opts.ArchivePassword = r.Header.Get(archivePasswordHeader)
+	addSecret(r.Context(), opts.ArchivePassword)
+
+	// Check output formats against key policy
+	return opts, checkKeyFormats(r.Context(), opts)
+}
+
+// parseInputOptions parses the options that apply to reading specific input formats.
+func parseInputOptions(query url.Values, opts *convertOptions) *apiError {
+	var aerr *apiError
+
+	// Parse SVG rasterization size
+	opts.SVG, aerr = parseSVGOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse RAW development options
+	opts.RAW, aerr = parseRAWOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse DICOM window
+	opts.DICOM, aerr = parseDICOMOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse layer handling
+	opts.Layers, aerr = parseLayersMode(query.Get("layers"))
+	if aerr != nil {
+		return aerr
+	}
+
+	return nil
+}
+
+// parseOutputOptions parses the output formats and the assembly of all pages into an animation or a PDF/A document.
+// Assembled pages are encoded in an intermediate format first.
+func parseOutputOptions(query url.Values, opts *convertOptions) *apiError {
+	var aerr *apiError
+
+	// Parse output formats
+	if v := query.Get("format"); strings.EqualFold(v, formatPDFA) {
+		opts.PDFA, opts.Format = true, pdfaFrameFormat
+	} else if v != "" {
+		opts.Format, opts.Formats, aerr = parseFormats(v)
+		if aerr != nil {
+			return aerr
+		}
+	}
+
+	// Parse animation options, which encode frames losslessly
+	opts.Animate, aerr = parseAnimateOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	if opts.Animate == nil {
+		return nil
+	}
+
+	if opts.PDFA {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "animate cannot be combined with PDF/A", nil)
+	}
+
+	opts.Format, opts.Formats = animateFrameFormat, nil
+
+	return nil
+}
+
+// parseOperationOptions parses the options of all optional page operations from the URL parameters of the request.
+func parseOperationOptions(r *http.Request, opts *convertOptions) *apiError {
+	var aerr *apiError
+
+	// Parse split options
+	opts.Split, aerr = parseSplitOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse mirroring options
+	opts.Flip, aerr = parseBoolParam(r, "flip")
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.Flop, aerr = parseBoolParam(r, "flop")
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse rotation options
+	opts.Rotate, aerr = parseRotateOptions(r.URL.Query(), opts.alphaFormat())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse crop options
+	opts.Crop, aerr = parseCropOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse noise reduction, blur, and sharpen options
+	opts.Filter, aerr = parseFilterOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse brightness, contrast, and gamma options
+	opts.Adjust, aerr = parseAdjustOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse grayscale and bitonal options
+	opts.Tone, aerr = parseToneOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse watermark options
+	watermark, aerr := parseBoolParam(r, "watermark")
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.Watermark, aerr = parseWatermarkOptions(r.URL.Query(), watermark)
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse text annotation options
+	opts.Text, aerr = parseTextOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse target ICC profile and colorspace preservation
+	opts.Profile, aerr = parseProfileOptions(r.URL.Query())
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.KeepColorspace, aerr = parseKeepColorspace(r, opts.outputFormats())
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse metadata handling
+	opts.Metadata, aerr = parseMetadataMode(r.URL.Query().Get("metadata"))
+	if aerr != nil {
+		return aerr
+	}
+
+	// Parse format-specific options
+	return parseEncodeOptions(r.URL.Query(), opts)
+}
+
+// parseLayout parses the output layout.
+func parseLayout(v string) (layoutType, *apiError) {
+	layout := layoutType(strings.ToUpper(v))
+
+	switch layout {
+	case "":
+		return layoutTypeKeep, nil
+
+	case layoutTypeLandscape, layoutTypePortrait, layoutTypeKeep:
+		return layout, nil
+	}
+
+	return "", newAPIError(http.StatusBadRequest, errorCodeInvalidLayout, "invalid output layout", nil)
+}
+
+// parseAlpha parses the alpha mode. Transparency can only be kept for output formats that can hold an alpha channel.
+func parseAlpha(v, format string) (alphaMode, *apiError) {
+	mode := alphaMode(strings.ToUpper(v))
+
+	switch mode {
+	case "":
+		return alphaModeBackground, nil
+
+	case alphaModeKeep:
+		if !formatCapabilityMap[format].Alpha {
+			return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "alpha=keep requires alpha", nil)
+		}
+
+		return mode, nil
+
+	case alphaModeRemove, alphaModeBackground:
+		return mode, nil
+	}
+
+	return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid alpha parameter", nil)
+}
+
+// backgroundColor matches the supported background colors.
+var backgroundColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// parseBackground parses the background color, which is either "#RRGGBB" or "transparent". Transparent backgrounds
+// are only allowed for output formats that can hold an alpha channel.
+func parseBackground(v, format string) (string, *apiError) {
+	v = strings.ToLower(v)
+
+	switch {
+	case v == "":
+		return "", nil
+
+	case v == backgroundTransparent:
+		if !formatCapabilityMap[format].Alpha {
+			return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "transparent background requires alpha", nil)
+		}
+
+		return v, nil
+
+	case backgroundColor.MatchString(v):
+		return v, nil
+	}
+
+	return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid background parameter", nil)
+}
+
+// parseBoolParam parses an optional boolean URL parameter, which defaults to false.
+func parseBoolParam(r *http.Request, name string) (bool, *apiError) {
+	return parseBoolQuery(r.URL.Query(), name)
+}
+
+// parseBoolQuery parses an optional boolean parameter of the query, which defaults to false.
+func parseBoolQuery(query url.Values, name string) (bool, *apiError) {
+	v := query.Get(name)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	return b, nil
+}
+
+// pageWorkers returns the number of pages that are converted in parallel.
+func pageWorkers() int {
+	if n := config().GetInt("page-workers"); n > 0 {
+		return n
+	}
+
+	return runtime.NumCPU()
+}
+
+// convertHandler converts a (multi-page) image into a Zip archive with the given image engine, which is stored in the
+// given result storage instead of being sent if requested.
+func convertHandler(
+	policies []*policy, entryNameTmpl *template.Template, watermark []byte, profiles map[string][]byte, engine *ocrEngine,
+	images imageEngine, store *resultStore,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Mark response as negotiated
+		w.Header().Add("Vary", "Accept")
+
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options, and negotiate response
+		opts, aerr := parseConvertOptions(r)
+		if aerr == nil {
+			aerr = checkOCR(opts.OCR, engine)
+		}
+
+		batch := false
+		if aerr == nil {
+			batch, aerr = parseBatchMode(r, opts)
+		}
+
+		if aerr == nil {
+			aerr = checkJSONRequest(r, opts, batch)
+		}
+
+		if aerr == nil {
+			aerr = negotiateResponse(r, &opts, batch)
+		}
+
+		if aerr == nil {
+			aerr = checkStore(opts.Store, store)
+		}
+
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body, which is an archive of documents in batch mode
+		read := readInput
+		if batch {
+			read = readArchiveInput
+		}
+
+		in, aerr := read(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Attach watermark image, ICC profile, metadata fields, and archive password
+		if aerr := attachParts(r, &opts, in, watermark, profiles); aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to attach parts", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Convert all documents of batch inputs, or all files of multipart requests, into a single Zip archive
+		if batch || (len(in.extra) > 0) {
+			bc := newBatchConverter(in, opts, images, engine, pol.MaxPages, entryNameTmpl)
+
+			var archive []byte
+			if batch {
+				archive, aerr = bc.convertArchive(r.Context())
+			} else {
+				archive, aerr = bc.convertFiles(r, policies, watermark, profiles)
+			}
+
+			if aerr != nil {
+				slog.ErrorContext(r.Context(), "Failed to convert batch", slog.Any("error", aerr))
+				renderAPIError(w, r, aerr)
+				return
+			}
+
+			renderArchive(w, r, archive, bc.man, store, opts)
+			return
+		}
+
+		// Convert all pages
+		results, report, aerr := images.convert(r.Context(), in, opts, pol.MaxPages)
+		if aerr != nil {
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Assemble animation or PDF/A document
+		if opts.Animate != nil {
+			renderAnimation(w, r, results, opts.Animate)
+			return
+		}
+
+		if opts.PDFA {
+			renderPDFA(w, r, results, opts.Density)
+			return
+		}
+
+		// Recognize text
+		if !recognizeText(w, r, engine, results, opts) {
+			return
+		}
+
+		// We're good
+		renderResults(w, r, results, report, in, opts, entryNameTmpl, store)
+	}
+}
+
+// renderResults responds with the output images as negotiated: as JSON, as the output image of a single page, or as
+// an archive of all of them otherwise.
+func renderResults(
+	w http.ResponseWriter, r *http.Request, results []pageResult, report *inputReport, in *input, opts convertOptions,
+	entryNameTmpl *template.Template, store *resultStore,
+) {
+	if (opts.Response == jsonMediaType) && !opts.Store {
+		renderPages(w, r, results, report, uploadBasename(in.filename), entryNameTmpl, opts)
+		return
+	}
+
+	if opts.isImageResponse() {
+		renderImage(w, r, results, opts)
+		return
+	}
+
+	man := &manifest{Parameters: opts, Input: report, Pages: []manifestPage{}}
+
+	archive, aerr := writeArchive(r.Context(), results, man, uploadBasename(in.filename), entryNameTmpl, opts)
+	if aerr != nil {
+		slog.ErrorContext(r.Context(), "Failed to write Zip archive", slog.Any("error", aerr))
+		renderAPIError(w, r, aerr)
+		return
+	}
+
+	renderArchive(w, r, archive, man, store, opts)
+}
+
+// attachParts attaches the watermark image, ICC profile, metadata fields, and archive password supplied as multipart
+// parts to the options.
+func attachParts(r *http.Request, opts *convertOptions, in *input, watermark []byte, profiles map[string][]byte) *apiError {
+	aerr := attachWatermark(r, opts, in, watermark)
+	if aerr == nil {
+		aerr = attachProfile(opts, in, profiles)
+	}
+
+	if aerr == nil {
+		aerr = attachFields(opts, in)
+	}
+
+	if aerr == nil {
+		aerr = attachArchivePassword(opts, in)
+	}
+
+	return aerr
+}
+
+// readWand reads the image into a magick wand from the pool, rendering vector inputs at the density of the options.
+// RAW camera files are developed by the configured decoder, SVG inputs are sanitized and rendered at their requested
+// size, and DICOM inputs are rendered with their requested window. The wand must be returned with releaseWand.
+func readWand(ctx context.Context, in *input, opts convertOptions) (*imagick.MagickWand, *apiError) {
+	// Fail fast while the temporary disk is full
+	if aerr := tempDisk.admit(); aerr != nil {
+		return nil, aerr
+	}
+
+	defer measureCPU(ctx)()
+
+	mw := acquireWand()
+
+	// Develop RAW camera file, or prepare SVG or DICOM input
+	data, density, path := in.data, opts.Density, in.path
+
+	var err error
+
+	switch {
+	case isRAW(in):
+		data, err = decodeRAW(ctx, data, opts.RAW)
+		path = ""
+	case isSVG(data):
+		data, density, err = prepareSVG(mw, data, opts)
+		path = ""
+	case isDICOM(data):
+		err = prepareDICOM(mw, opts)
+	}
+
+	if err != nil {
+		releaseWand(mw)
+		return nil, newAPIError(http.StatusUnprocessableEntity, errorCodeDecodeFailed, "failed to prepare image", err)
+	}
+
+	// Set density
+	err = mw.SetResolution(density, density)
+	if err != nil {
+		releaseWand(mw)
+		return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to set density", err)
+	}
+
+	// Set password of protected PDFs
+	if in.password != "" {
+		err = mw.SetOption("authenticate", in.password)
+		if err != nil {
+			releaseWand(mw)
+			return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to set password", err)
+		}
+	}
+
+	// Fail fast while Ghostscript keeps failing
+	gs := usesGhostscript(data)
+	if gs && !ghostscriptBreaker.allow() {
+		releaseWand(mw)
+		return nil, newAPIError(http.StatusServiceUnavailable, errorCodeCircuitOpen, "Ghostscript unavailable", nil)
+	}
+
+	// Read image, retrying transient delegate failures
+	err = retryTransient(ctx, "read image", func() error { return readImageData(mw, data, path) })
+	if gs {
+		ghostscriptBreaker.record(err)
+	}
+
+	if err != nil {
+		releaseWand(mw)
+		return nil, readError(in, err)
+	}
+
+	// Arrange layers of PSD and XCF inputs
+	if isLayered(data) {
+		mw, err = arrangeLayers(mw, data, opts.Layers)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to arrange layers", err)
+		}
+	}
+
+	// Account usage
+	countPages(ctx, mw.GetNumberImages())
+	auditPages(ctx, mw.GetNumberImages())
+
+	return mw, nil
+}
+
+// readError returns the API error of a failed image read.
+func readError(in *input, err error) *apiError {
+	switch {
+	case isEncryptedPDF(in.data) && (in.password == ""):
+		return newAPIError(http.StatusUnprocessableEntity, errorCodePasswordRequired, "password required", err)
+	case isEncryptedPDF(in.data):
+		return newAPIError(http.StatusUnprocessableEntity, errorCodePasswordInvalid, "invalid password", err)
+	case isDiskExhausted(err):
+		return newAPIError(http.StatusInsufficientStorage, errorCodeTempDiskFull, "temporary disk exhausted", err)
+	case isTransient(err):
+		return newAPIError(http.StatusServiceUnavailable, errorCodeTransientFailure, "transient failure reading image", err)
+	}
+
+	return newAPIError(http.StatusUnprocessableEntity, errorCodeDecodeFailed, "failed to read image", err)
+}
+
+// readImageData reads the image into the magick wand, from the temporary file it was spilled to if there is one, so
+// ImageMagick does not need a copy of it in memory.
+func readImageData(mw *imagick.MagickWand, data []byte, path string) error {
+	if path != "" {
+		return mw.ReadImage(path)
+	}
+
+	return mw.ReadImageBlob(data)
+}
+
+// pagesError returns the API error of a failed page conversion.
+func pagesError(err error) *apiError {
+	var aerr *apiError
+	if errors.As(err, &aerr) {
+		return aerr
+	}
+
+	if isDiskExhausted(err) {
+		return newAPIError(http.StatusInsufficientStorage, errorCodeTempDiskFull, "temporary disk exhausted", err)
+	}
+
+	return newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to convert pages", err)
+}
+
+// convertPages converts all pages of the given wand using a bounded number of goroutines. Each page is pulled into its
+// own magick wand, so pages can be processed independently. Results are returned in page order.
+func convertPages(ctx context.Context, mw *imagick.MagickWand, pages int, opts convertOptions) ([]pageResult, error) {
+	results := make([][]pageResult, pages)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return firstErr != nil
+	}
+
+	sem := make(chan struct{}, pageWorkers())
+
+	for page := 0; (page < pages) && !failed(); page++ {
+		sem <- struct{}{}
+
+		// Pull current image into its own magick wand
+		mw.SetIteratorIndex(page)
+		mwi := mw.GetImage()
+
+		wg.Add(1)
+
+		exited := trackAttempt(ctx)
+
+		go func() {
+			var attempts sync.WaitGroup
+
+			// Abandoned attempts keep the page worker until they exit, even though the page is done
+			defer exited()
+			defer func() { <-sem }()
+			defer attempts.Wait()
+			defer wg.Done()
+			defer mwi.Destroy()
+
+			start := time.Now()
+			cpu := measureCPU(ctx)
+
+			res, err := convertSourcePage(withAttempts(ctx, &attempts), mwi, page, pages, opts)
+			cpu()
+
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if firstErr == nil {
+					firstErr = err
+				}
+
+				return
+			}
+
+			results[page] = res
+
+			for _, r := range res {
+				logPage(ctx, r, time.Since(start))
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// Flatten results
+	var flat []pageResult
+	for _, res := range results {
+		flat = append(flat, res...)
+	}
+
+	return flat, nil
+}
+
+// convertSourcePage converts a single page of the input into one output image per rendition, or into two if pages are
+// split.
+func convertSourcePage(
+	ctx context.Context, mwi *imagick.MagickWand, page, pages int, opts convertOptions,
+) ([]pageResult, error) {
+	if opts.Split == nil {
+		return convertPageWithBudget(ctx, mwi, page, pages, opts)
+	}
+
+	// Split page
+	halves, err := splitPage(mwi, opts.Split)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to split page", err)
+	}
+
+	defer func() {
+		for _, mwh := range halves {
+			mwh.Destroy()
+		}
+	}()
+
+	// Convert both halves
+	var results []pageResult
+
+	for part, mwh := range halves {
+		res, err := convertPageWithBudget(ctx, mwh, page, pages, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range res {
+			res[i].data.Part = part
+			res[i].data.Half = splitHalvesMap[opts.Split.Direction][part]
+		}
+
+		results = append(results, res...)
+	}
+
+	return results, nil
+}
+
+// logPage emits a debug log record for a converted page, sampled at the configured rate.
+func logPage(ctx context.Context, res pageResult, duration time.Duration) {
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+
+	if rate := config().GetFloat64("log-page-sample-rate"); (rate < 1.0) && (rand.Float64() >= rate) {
+		return
+	}
+
+	slog.DebugContext(ctx, "Converted page",
+		slog.Int("page", res.data.Page),
+		slog.Uint64("width", uint64(res.data.Width)),
+		slog.Uint64("height", uint64(res.data.Height)),
+		slog.Duration("duration", duration),
+		slog.Int("bytes", len(res.out)))
+}
+
+// convertPage converts a single page into one output image per rendition.
+func convertPage(mwi *imagick.MagickWand, page, pages int, opts convertOptions) ([]pageResult, error) {
+	colorspace := mwi.GetImageColorspace()
+
+	// Prepare transparency for flattening
+	err := prepareAlpha(mwi, opts)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to prepare alpha channel", err)
+	}
+
+	// Flatten image
+	mwm := mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+	defer mwm.Destroy()
+
+	// Apply all operations
+	err = applyPageOperations(mwm, opts, pageInfo{index: page, count: pages, colorspace: colorspace})
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode all renditions
+	return encodeRenditions(mwm, page, pages, opts)
+}
+
+// prepareAlpha prepares the image for flattening according to the alpha mode: transparency is kept by flattening onto a
+// transparent background, removed by deactivating the alpha channel, or replaced by the background color (which
+// defaults to white if any output format lacks alpha).
+func prepareAlpha(mw *imagick.MagickWand, opts convertOptions) error {
+	switch opts.Alpha {
+	case alphaModeKeep:
+		return setBackground(mw, backgroundTransparent)
+
+	case alphaModeRemove:
+		return mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_DEACTIVATE)
+
+	case alphaModeBackground:
+		background := opts.Background
+		if (background == "") && !formatCapabilityMap[opts.alphaFormat()].Alpha {
+			background = backgroundDefault
+		}
+
+		if background != "" {
+			return setBackground(mw, background)
+		}
+	}
+
+	return nil
+}
+
+// setBackground sets the background color of the image.
+func setBackground(mw *imagick.MagickWand, color string) error {
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	if !pw.SetColor(color) {
+		return fmt.Errorf("invalid color %q", color)
+	}
+
+	return mw.SetImageBackgroundColor(pw)
+}
+
+// forceLayout rotates the image if its orientation does not match the given layout.
+func forceLayout(mw *imagick.MagickWand, layout layoutType) error {
+	// Get dimensions
+	width := mw.GetImageWidth()
+	height := mw.GetImageHeight()
+
+	switch layout {
+	case layoutTypeLandscape:
+		if width >= height {
+			return nil
+		}
+
+	case layoutTypePortrait:
+		if height >= width {
+			return nil
+		}
+
+	case layoutTypeKeep:
+		return nil
+	}
+
+	// Rotate image
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	return mw.RotateImage(pw, -90.0)
+}
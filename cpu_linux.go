@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// threadCPUTime returns the user and system CPU time spent by the calling OS thread.
+func threadCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+
+	err := syscall.Getrusage(syscall.RUSAGE_THREAD, &ru)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// threadCPUTime returns the CPU time spent by the calling OS thread, which is only supported on Linux.
+func threadCPUTime() (time.Duration, bool) {
+	return 0, false
+}
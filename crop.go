@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// cropGeometry matches crop geometries such as "1200x300", "1200x300+0+50", or "600x600-20+20".
+var cropGeometry = regexp.MustCompile(`^(\d+)x(\d+)(?:([+-]\d+)([+-]\d+))?$`)
+
+// cropOptions defines the region extracted from each page.
+type cropOptions struct {
+	Width   uint   `json:"width"`   // Width is the width of the region in pixels.
+	Height  uint   `json:"height"`  // Height is the height of the region in pixels.
+	X       int    `json:"x"`       // X is the horizontal offset of the region, relative to the gravity.
+	Y       int    `json:"y"`       // Y is the vertical offset of the region, relative to the gravity.
+	Gravity string `json:"gravity"` // Gravity is the edge or corner the offsets are relative to.
+}
+
+// parseCropOptions parses the crop URL parameters. It returns nil if no crop is set.
+func parseCropOptions(query url.Values) (*cropOptions, *apiError) {
+	v := query.Get("crop")
+	if v == "" {
+		return nil, nil
+	}
+
+	// Parse geometry
+	m := cropGeometry.FindStringSubmatch(v)
+	if m == nil {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid crop parameter", nil)
+	}
+
+	width, _ := strconv.ParseUint(m[1], 10, 32)
+	height, _ := strconv.ParseUint(m[2], 10, 32)
+	x, _ := strconv.Atoi(m[3])
+	y, _ := strconv.Atoi(m[4])
+
+	if (width == 0) || (height == 0) {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid crop parameter", nil)
+	}
+
+	opts := &cropOptions{Width: uint(width), Height: uint(height), X: x, Y: y, Gravity: "northwest"}
+
+	// Parse gravity
+	if v := query.Get("gravity"); v != "" {
+		v = normalizeGravity(v)
+		if _, ok := gravityMap[v]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid gravity parameter", nil)
+		}
+
+		opts.Gravity = v
+	}
+
+	return opts, nil
+}
+
+// applyCropOptions extracts the region from the page. Regions reaching beyond the page are clipped.
+func applyCropOptions(mw *imagick.MagickWand, opts *cropOptions) error {
+	pageWidth, pageHeight := int(mw.GetImageWidth()), int(mw.GetImageHeight())
+	width, height := int(opts.Width), int(opts.Height)
+
+	// Resolve offsets relative to the gravity
+	x, y := opts.X, opts.Y
+
+	switch gravityMap[opts.Gravity] { //nolint:exhaustive
+	case imagick.GRAVITY_NORTH, imagick.GRAVITY_CENTER, imagick.GRAVITY_SOUTH:
+		x += (pageWidth - width) / 2
+	case imagick.GRAVITY_NORTH_EAST, imagick.GRAVITY_EAST, imagick.GRAVITY_SOUTH_EAST:
+		x = pageWidth - width - x
+	}
+
+	switch gravityMap[opts.Gravity] { //nolint:exhaustive
+	case imagick.GRAVITY_WEST, imagick.GRAVITY_CENTER, imagick.GRAVITY_EAST:
+		y += (pageHeight - height) / 2
+	case imagick.GRAVITY_SOUTH_WEST, imagick.GRAVITY_SOUTH, imagick.GRAVITY_SOUTH_EAST:
+		y = pageHeight - height - y
+	}
+
+	// Clip region to page
+	left, top := max(x, 0), max(y, 0)
+	right, bottom := min(x+width, pageWidth), min(y+height, pageHeight)
+
+	if (right <= left) || (bottom <= top) {
+		return errors.New("crop region outside of page")
+	}
+
+	// Crop
+	err := mw.CropImage(uint(right-left), uint(bottom-top), left, top)
+	if err != nil {
+		return fmt.Errorf("crop image: %w", err)
+	}
+
+	err = mw.SetImagePage(uint(right-left), uint(bottom-top), 0, 0)
+	if err != nil {
+		return fmt.Errorf("reset page: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// formatDelegate defines the delegate library ImageMagick requires to decode a format.
+type formatDelegate struct {
+	delegate string // delegate is the name of the delegate listed by ImageMagick, e.g. "heic".
+	library  string // library is the name of the library that provides the delegate, e.g. "libheif".
+}
+
+// formatDelegateMap defines the input formats that ImageMagick can only decode if built with a delegate library.
+var formatDelegateMap = map[string]formatDelegate{
+	"HEIC": {delegate: "heic", library: "libheif"},
+}
+
+// optionalOutputFormats defines the output formats that are only supported if the linked ImageMagick has a coder for
+// them.
+var optionalOutputFormats = map[string]bool{
+	"J2K": true,
+	"JP2": true,
+	"JXL": true,
+}
+
+// availableDelegates returns the delegate libraries ImageMagick was built with. It must not be called before
+// ImageMagick is initialized.
+var availableDelegates = sync.OnceValue(func() []string {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	available, err := mw.QueryConfigureOption("DELEGATES")
+	if err != nil {
+		slog.Warn("Failed to query delegates", slog.Any("error", err))
+		return nil
+	}
+
+	return strings.Fields(strings.ToLower(available))
+})
+
+// availableCoders returns the names of all coders of the linked ImageMagick. It must not be called before ImageMagick
+// is initialized.
+var availableCoders = sync.OnceValue(func() []string {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	return mw.QueryFormats("*")
+})
+
+// formatAvailable returns false if decoding the input format requires a delegate library that ImageMagick was built
+// without.
+func formatAvailable(format string) bool {
+	fd, ok := formatDelegateMap[format]
+	return !ok || slices.Contains(availableDelegates(), fd.delegate)
+}
+
+// outputFormatAvailable returns false if the output format is optional and the linked ImageMagick has no coder for it.
+func outputFormatAvailable(format string) bool {
+	return !optionalOutputFormats[format] || slices.Contains(availableCoders(), format)
+}
+
+// logOptionalFormats logs the availability of all input formats that require a delegate library, and of all optional
+// output formats.
+func logOptionalFormats() {
+	for format, fd := range formatDelegateMap {
+		if formatAvailable(format) {
+			slog.Info("Input format available", slog.String("format", format), slog.String("library", fd.library))
+		} else {
+			slog.Warn("Input format not available", slog.String("format", format), slog.String("library", fd.library))
+		}
+	}
+
+	for format := range optionalOutputFormats {
+		if outputFormatAvailable(format) {
+			slog.Info("Output format available", slog.String("format", format))
+		} else {
+			slog.Warn("Output format not available", slog.String("format", format))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// dicomOptions defines the window that maps the stored values of DICOM inputs onto grayscale.
+type dicomOptions struct {
+	Center float64 `json:"center"` // Center is the stored value rendered as medium gray.
+	Width  float64 `json:"width"`  // Width is the range of stored values spread from black to white.
+}
+
+// parseDICOMOptions parses the window of DICOM inputs. It returns nil if no window is given, in which case the
+// window is derived from the range of the stored values.
+func parseDICOMOptions(query url.Values) (*dicomOptions, *apiError) {
+	invalid := func(name string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	vc, vw := query.Get("window-center"), query.Get("window-width")
+	if (vc == "") && (vw == "") {
+		return nil, nil
+	}
+
+	// Both are required
+	center, err := strconv.ParseFloat(vc, 64)
+	if (err != nil) || math.IsNaN(center) || math.IsInf(center, 0) {
+		return nil, invalid("window-center", err)
+	}
+
+	width, err := strconv.ParseFloat(vw, 64)
+	if (err != nil) || !(width >= 1) || math.IsInf(width, 0) {
+		return nil, invalid("window-width", err)
+	}
+
+	return &dicomOptions{Center: center, Width: width}, nil
+}
+
+// isDICOM returns true if the input is a DICOM file.
+func isDICOM(data []byte) bool {
+	return sniffFormat(data[:min(len(data), sniffLength)]) == "DCM"
+}
+
+// prepareDICOM configures the window the DICOM input is rendered with. Without a requested window, the range of the
+// stored values is used, instead of the full range of their bit depth that renders most exports nearly black.
+func prepareDICOM(mw *imagick.MagickWand, opts convertOptions) error {
+	if opts.DICOM == nil {
+		err := mw.SetOption("dcm:display-range", "reset")
+		if err != nil {
+			return fmt.Errorf("set display range: %w", err)
+		}
+
+		return nil
+	}
+
+	err := mw.SetOption("dcm:window", fmt.Sprintf("%gx%g", opts.DICOM.Center, opts.DICOM.Width))
+	if err != nil {
+		return fmt.Errorf("set window: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	contentDigestHeader = "X-Content-SHA256" // contentDigestHeader carries the hex-encoded SHA-256 of the request body.
+	contentMD5Header    = "Content-MD5"      // contentMD5Header carries the base64-encoded MD5 of the request body.
+)
+
+const (
+	digestHeader   = "Digest"            // digestHeader carries the base64-encoded SHA-256 digest of the response body.
+	checksumHeader = "X-Checksum-SHA256" // checksumHeader carries the hex-encoded SHA-256 digest of the response body.
+)
+
+// errDigestMismatch is returned by digest readers if the body does not match its expected digest.
+var errDigestMismatch = errors.New("body does not match its digest")
+
+// digestReader defines a reader that hashes the body while it is read, and fails instead of reporting the end of the
+// body if the digest does not match.
+type digestReader struct {
+	io.ReadCloser
+
+	hash hash.Hash // hash is the digest of everything read so far.
+	want []byte    // want is the expected digest.
+}
+
+// newDigestReader returns a reader that verifies the body against the hex-encoded SHA-256 digest.
+func newDigestReader(body io.ReadCloser, digest string) (*digestReader, error) {
+	want, err := hex.DecodeString(digest)
+	if (err != nil) || (len(want) != sha256.Size) {
+		return nil, errors.New("invalid digest")
+	}
+
+	return &digestReader{ReadCloser: body, hash: sha256.New(), want: want}, nil
+}
+
+// newMD5Reader returns a reader that verifies the body against the base64-encoded MD5 digest of RFC 1864. MD5 only
+// guards against accidental corruption, such as truncated uploads, not against tampering.
+func newMD5Reader(body io.ReadCloser, digest string) (*digestReader, error) {
+	want, err := base64.StdEncoding.DecodeString(digest)
+	if (err != nil) || (len(want) != md5.Size) {
+		return nil, errors.New("invalid digest")
+	}
+
+	return &digestReader{ReadCloser: body, hash: md5.New(), want: want}, nil
+}
+
+// verifyIntegrity is a middleware that verifies the request body against the digests of the Content-MD5 and
+// X-Content-SHA256 headers, if any, while it is read. Inputs are read completely before they are converted, so
+// truncated or corrupted uploads fail with DIGEST_MISMATCH instead of producing corrupt outputs.
+func verifyIntegrity(next http.Handler) http.Handler {
+	readers := []struct {
+		header string
+		open   func(io.ReadCloser, string) (*digestReader, error)
+	}{
+		{contentMD5Header, newMD5Reader},
+		{contentDigestHeader, newDigestReader},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rd := range readers {
+			digest := r.Header.Get(rd.header)
+			if digest == "" {
+				continue
+			}
+
+			dr, err := rd.open(r.Body, digest)
+			if err != nil {
+				aerr := newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+rd.header+" header", err)
+
+				slog.ErrorContext(r.Context(), "Request rejected by digest", slog.Any("error", aerr))
+				rejectEarly(w, r, aerr)
+
+				return
+			}
+
+			r.Body = dr
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Read reads from the body and hashes the data read. At the end of the body, the digest is compared.
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.hash.Write(p[:n]) //nolint:errcheck
+
+	if errors.Is(err, io.EOF) && (subtle.ConstantTimeCompare(d.hash.Sum(nil), d.want) != 1) {
+		return n, errDigestMismatch
+	}
+
+	return n, err
+}
+
+// setChecksumHeaders sets the headers carrying the SHA-256 digest of the response body, both as instance digest of
+// RFC 3230 and hex-encoded, so clients can verify outputs without unpacking them.
+func setChecksumHeaders(w http.ResponseWriter, body []byte) {
+	sum := sha256.Sum256(body)
+
+	w.Header().Set(digestHeader, "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	w.Header().Set(checksumHeader, hex.EncodeToString(sum[:]))
+}
+
+// sha256Hex returns the hex-encoded SHA-256 digest of the data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskFree returns the number of bytes available to unprivileged users on the file system of the given directory.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, fmt.Errorf("stat file system: %w", err)
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil //nolint:unconvert
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskFree returns the number of bytes available to the user on the volume of the given directory.
+func diskFree(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, fmt.Errorf("convert path: %w", err)
+	}
+
+	var free uint64
+
+	err = windows.GetDiskFreeSpaceEx(path, &free, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("query volume: %w", err)
+	}
+
+	return free, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// minTempSpace is the free space of the temporary directory below which the doctor warns.
+const minTempSpace = 1 << 30
+
+// CmdDoctor defines the command to diagnose the environment.
+var CmdDoctor = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose the environment of the server",
+	Long: "Report the linked ImageMagick, its policy restrictions, delegate libraries, external tools, resource " +
+		"limits, and temporary directory, and convert a sample image to and from every supported format.",
+	Args: cobra.NoArgs,
+	RunE: runDoctor,
+}
+
+// Initialize command options
+func init() {
+	CmdMain.AddCommand(CmdDoctor)
+}
+
+// doctorDelegates defines the delegate libraries the server relies on, by the name ImageMagick lists them with.
+var doctorDelegates = map[string]string{
+	"fontconfig": "Fontconfig",
+	"freetype":   "FreeType",
+	"heic":       "libheif",
+	"jng":        "libpng",
+	"jpeg":       "libjpeg",
+	"jxl":        "libjxl",
+	"lcms":       "Little CMS",
+	"openjp2":    "OpenJPEG",
+	"png":        "libpng",
+	"rsvg":       "librsvg",
+	"tiff":       "libtiff",
+	"webp":       "libwebp",
+	"xml":        "libxml2",
+	"zlib":       "zlib",
+}
+
+// doctorResources defines the ImageMagick resource limits that are reported.
+var doctorResources = map[string]imagick.ResourceType{
+	"area":   imagick.RESOURCE_AREA,
+	"disk":   imagick.RESOURCE_DISK,
+	"file":   imagick.RESOURCE_FILE,
+	"map":    imagick.RESOURCE_MAP,
+	"memory": imagick.RESOURCE_MEMORY,
+	"thread": imagick.RESOURCE_THREAD,
+	"time":   imagick.RESOURCE_TIME,
+}
+
+// doctorSampleFormats defines the formats a sample image is converted to and from in addition to the output formats,
+// since they exercise delegates that inputs rely on.
+var doctorSampleFormats = []string{"GIF", "HEIC", "PDF"}
+
+// doctorReport defines the report of the doctor, which is written while checks are performed.
+type doctorReport struct {
+	w        io.Writer
+	problems int
+}
+
+// ok reports a passed check.
+func (r *doctorReport) ok(name, format string, args ...any) {
+	fmt.Fprintf(r.w, "  ok    %-24s %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// warn reports a check that passed with limitations.
+func (r *doctorReport) warn(name, format string, args ...any) {
+	fmt.Fprintf(r.w, "  warn  %-24s %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// fail reports a failed check.
+func (r *doctorReport) fail(name, format string, args ...any) {
+	r.problems++
+	fmt.Fprintf(r.w, "  FAIL  %-24s %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// section starts a new section of the report.
+func (r *doctorReport) section(title string) {
+	fmt.Fprintf(r.w, "\n%s\n", title)
+}
+
+// runDoctor is called when the doctor command is used.
+func runDoctor(cmd *cobra.Command, _ []string) error {
+	r := &doctorReport{w: cmd.OutOrStdout()}
+
+	// Prepare hardened mode
+	if viper.GetBool("hardened") {
+		err := prepareHardened(viper.GetString("hardened-root"))
+		if err != nil {
+			return fmt.Errorf("prepare hardened mode: %w", err)
+		}
+	}
+
+	// Initialization ImageMagick
+	imagick.Initialize()
+	defer imagick.Terminate()
+
+	checkImageMagick(r)
+	checkPolicy(r)
+	checkDelegates(r)
+	checkTools(r)
+	checkResources(r)
+	checkTempDir(r)
+	checkSamples(r)
+
+	if r.problems > 0 {
+		return fmt.Errorf("doctor found %d problems", r.problems)
+	}
+
+	fmt.Fprintln(r.w, "\nNo problems found.")
+
+	return nil
+}
+
+// checkImageMagick reports the version of the linked ImageMagick.
+func checkImageMagick(r *doctorReport) {
+	r.section("ImageMagick")
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	version, _ := imagick.GetVersion()
+	quantum, _ := imagick.GetQuantumDepth()
+	features, _ := mw.QueryConfigureOption("FEATURES")
+
+	r.ok("version", "%s", version)
+	r.ok("quantum depth", "%s", quantum)
+	r.ok("features", "%s", strings.Join(strings.Fields(features), " "))
+
+	if viper.GetBool("hardened") {
+		err := verifyHardened(viper.GetStringSlice("hardened-delegates"))
+		if err != nil {
+			r.fail("hardened mode", "%v", err)
+		} else {
+			r.ok("hardened mode", "policy in effect")
+		}
+	}
+}
+
+// policyMap defines the elements of an ImageMagick policy.xml that are reported.
+type policyMap struct {
+	Policies []struct {
+		Domain  string `xml:"domain,attr"`
+		Rights  string `xml:"rights,attr"`
+		Pattern string `xml:"pattern,attr"`
+		Name    string `xml:"name,attr"`
+		Value   string `xml:"value,attr"`
+	} `xml:"policy"`
+}
+
+// checkPolicy reports the restrictions of all policy files found in the configuration paths of ImageMagick.
+func checkPolicy(r *doctorReport) {
+	r.section("Policy")
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	dirs := filepath.SplitList(os.Getenv("MAGICK_CONFIGURE_PATH"))
+	if dir, _ := mw.QueryConfigureOption("CONFIGURE_PATH"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+
+	found := false
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "policy.xml")
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		found = true
+
+		if err != nil {
+			r.fail("policy file", "%s: %v", path, err)
+			continue
+		}
+
+		var pm policyMap
+
+		err = xml.Unmarshal(data, &pm)
+		if err != nil {
+			r.fail("policy file", "%s: %v", path, err)
+			continue
+		}
+
+		r.ok("policy file", "%s (%d policies)", path, len(pm.Policies))
+
+		for _, p := range pm.Policies {
+			switch {
+			case (p.Rights != "") && (p.Pattern != ""):
+				r.warn(p.Domain+" "+p.Pattern, "rights %s", p.Rights)
+			case (p.Name != "") && (p.Value != ""):
+				r.ok(p.Domain+" "+p.Name, "%s", p.Value)
+			}
+		}
+	}
+
+	if !found {
+		r.ok("policy file", "none found, no restrictions")
+	}
+}
+
+// checkDelegates reports the delegate libraries ImageMagick was built with or without.
+func checkDelegates(r *doctorReport) {
+	r.section("Delegates")
+
+	names := make([]string, 0, len(doctorDelegates))
+	for name := range doctorDelegates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if slices.Contains(availableDelegates(), name) {
+			r.ok(name, "%s", doctorDelegates[name])
+		} else {
+			r.warn(name, "%s missing", doctorDelegates[name])
+		}
+	}
+}
+
+// checkTools reports the external executables used by the server.
+func checkTools(r *doctorReport) {
+	r.section("Tools")
+
+	vips := ""
+	if strings.EqualFold(viper.GetString("engine"), engineVips) {
+		vips = viper.GetString("vips")
+	}
+
+	tools := []struct {
+		name string
+		path string
+		use  string
+	}{
+		{name: "ghostscript", path: viper.GetString("ghostscript"), use: "PDF inputs and PDF/A outputs"},
+		{name: "tesseract", path: viper.GetString("tesseract"), use: "text recognition"},
+		{name: "zbarimg", path: viper.GetString("zbarimg"), use: "barcode detection"},
+		{name: "raw-decoder", path: viper.GetString("raw-decoder"), use: "RAW camera files"},
+		{name: "vips", path: vips, use: "vips engine"},
+	}
+
+	for _, t := range tools {
+		if t.path == "" {
+			r.ok(t.name, "disabled")
+			continue
+		}
+
+		path, err := exec.LookPath(t.path)
+		if err != nil {
+			r.warn(t.name, "%s not found, no %s", t.path, t.use)
+			continue
+		}
+
+		r.ok(t.name, "%s", path)
+	}
+}
+
+// checkResources reports the resource limits of ImageMagick.
+func checkResources(r *doctorReport) {
+	r.section("Resource limits")
+
+	names := make([]string, 0, len(doctorResources))
+	for name := range doctorResources {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.ok(name, "%d", imagick.GetResourceLimit(doctorResources[name]))
+	}
+}
+
+// checkTempDir reports whether the temporary directory of ImageMagick is writable and how much space is left.
+func checkTempDir(r *doctorReport) {
+	r.section("Temporary directory")
+
+	dir := magickTempDir()
+
+	f, err := os.CreateTemp(dir, "magick-server-doctor-*")
+	if err != nil {
+		r.fail("writable", "%s: %v", dir, err)
+		return
+	}
+
+	f.Close()           //nolint:errcheck
+	os.Remove(f.Name()) //nolint:errcheck
+
+	r.ok("writable", "%s", dir)
+
+	free, err := diskFree(dir)
+
+	switch {
+	case err != nil:
+		r.warn("free space", "%v", err)
+	case free < minTempSpace:
+		r.warn("free space", "%d MiB, large documents may fail", free>>20)
+	default:
+		r.ok("free space", "%d MiB", free>>20)
+	}
+}
+
+// checkSamples converts a built-in sample image to every supported output format, and a few input formats that rely on
+// delegates, and reads the result back. Failures of the latter are only warned about, since not all of them can be
+// written by every ImageMagick build.
+func checkSamples(r *doctorReport) {
+	r.section("Sample conversions")
+
+	formats := make([]string, 0, len(formatExtensionMap)+len(doctorSampleFormats))
+	for format := range formatExtensionMap {
+		formats = append(formats, format)
+	}
+
+	formats = append(formats, doctorSampleFormats...)
+	sort.Strings(formats)
+
+	for _, format := range formats {
+		if !outputFormatAvailable(format) || !formatAvailable(format) {
+			r.warn(format, "not supported by ImageMagick")
+			continue
+		}
+
+		size, err := convertSample(format)
+
+		switch {
+		case (err != nil) && slices.Contains(doctorSampleFormats, format):
+			r.warn(format, "%v", err)
+			continue
+		case err != nil:
+			r.fail(format, "%v", err)
+			continue
+		}
+
+		r.ok(format, "%d bytes", size)
+	}
+}
+
+// convertSample converts the built-in sample image to the format, reads it back, and returns the encoded size.
+func convertSample(format string) (int, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	err := mw.ReadImage("rose:")
+	if err != nil {
+		return 0, fmt.Errorf("read sample: %w", err)
+	}
+
+	err = mw.SetImageFormat(format)
+	if err != nil {
+		return 0, fmt.Errorf("set format: %w", err)
+	}
+
+	blob, err := mw.GetImageBlob()
+	if err != nil {
+		return 0, fmt.Errorf("encode: %w", err)
+	}
+
+	rw := imagick.NewMagickWand()
+	defer rw.Destroy()
+
+	err = rw.ReadImageBlob(blob)
+	if err != nil {
+		return 0, fmt.Errorf("decode: %w", err)
+	}
+
+	return len(blob), nil
+}
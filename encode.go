@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// pngFilterMap defines the supported PNG filters and their ImageMagick values.
+var pngFilterMap = map[string]string{
+	"none":     "0",
+	"sub":      "1",
+	"up":       "2",
+	"average":  "3",
+	"paeth":    "4",
+	"adaptive": "5",
+}
+
+// jpegSubsamplingMap defines the supported chroma subsampling modes and their sampling factors.
+var jpegSubsamplingMap = map[string]string{
+	"420": "2x2,1x1,1x1",
+	"422": "2x1,1x1,1x1",
+	"444": "1x1,1x1,1x1",
+}
+
+// parseEncodeOptions parses the options of all format-specific encoders.
+func parseEncodeOptions(query url.Values, opts *convertOptions) *apiError {
+	var aerr *apiError
+
+	opts.JPEG, aerr = parseJPEGOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.PNG, aerr = parsePNGOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.JXL, aerr = parseJXLOptions(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	opts.JP2, aerr = parseJP2Options(query)
+	if aerr != nil {
+		return aerr
+	}
+
+	return nil
+}
+
+// jpegOptions defines JPEG-specific encoding options.
+type jpegOptions struct {
+	Interlace   string `json:"interlace,omitempty"`   // Interlace is either "plane" (progressive) or "none" (baseline).
+	Subsampling string `json:"subsampling,omitempty"` // Subsampling is the chroma subsampling, e.g. "420".
+}
+
+// parseJPEGOptions parses the JPEG-specific URL parameters. It returns nil if none of them are set.
+func parseJPEGOptions(query url.Values) (*jpegOptions, *apiError) {
+	opts := &jpegOptions{}
+	set := false
+
+	// Parse interlacing
+	if v := query.Get("interlace"); v != "" {
+		v = strings.ToLower(v)
+		if (v != "plane") && (v != "none") {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid interlace parameter", nil)
+		}
+
+		opts.Interlace = v
+		set = true
+	}
+
+	// Parse chroma subsampling
+	if v := query.Get("subsampling"); v != "" {
+		v = strings.NewReplacer(":", "", "-", "").Replace(v)
+		if _, ok := jpegSubsamplingMap[v]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid subsampling parameter", nil)
+		}
+
+		opts.Subsampling = v
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// applyJPEGOptions configures the JPEG encoder of the given wand.
+func applyJPEGOptions(mw *imagick.MagickWand, opts *jpegOptions) error {
+	switch opts.Interlace {
+	case "plane":
+		err := mw.SetInterlaceScheme(imagick.INTERLACE_PLANE)
+		if err != nil {
+			return fmt.Errorf("set interlacing: %w", err)
+		}
+
+	case "none":
+		err := mw.SetInterlaceScheme(imagick.INTERLACE_NO)
+		if err != nil {
+			return fmt.Errorf("set interlacing: %w", err)
+		}
+	}
+
+	if opts.Subsampling != "" {
+		err := mw.SetOption("jpeg:sampling-factor", jpegSubsamplingMap[opts.Subsampling])
+		if err != nil {
+			return fmt.Errorf("set subsampling: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// pngOptions defines PNG-specific encoding options.
+type pngOptions struct {
+	CompressionLevel *uint  `json:"compression_level,omitempty"` // CompressionLevel is the zlib level from 0 to 9.
+	Filter           string `json:"filter,omitempty"`            // Filter is the row filter applied before compression.
+	Interlace        bool   `json:"interlace,omitempty"`         // Interlace enables Adam7 interlacing.
+	BitDepth         uint   `json:"bit_depth,omitempty"`         // BitDepth is the bit depth per sample.
+}
+
+// parsePNGOptions parses the PNG-specific URL parameters. It returns nil if none of them are set.
+func parsePNGOptions(query url.Values) (*pngOptions, *apiError) {
+	opts := &pngOptions{}
+	set := false
+
+	// Parse compression level
+	if v := query.Get("png-compression"); v != "" {
+		l, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (l > 9) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid png-compression parameter", err)
+		}
+
+		level := uint(l)
+		opts.CompressionLevel = &level
+		set = true
+	}
+
+	// Parse filter
+	if v := query.Get("png-filter"); v != "" {
+		v = strings.ToLower(v)
+		if _, ok := pngFilterMap[v]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid png-filter parameter", nil)
+		}
+
+		opts.Filter = v
+		set = true
+	}
+
+	// Parse interlacing
+	if query.Get("png-interlace") != "" {
+		interlace, aerr := parseBoolQuery(query, "png-interlace")
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		opts.Interlace = interlace
+		set = true
+	}
+
+	// Parse bit depth
+	if v := query.Get("png-bit-depth"); v != "" {
+		d, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || ((d != 1) && (d != 2) && (d != 4) && (d != 8) && (d != 16)) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid png-bit-depth parameter", err)
+		}
+
+		opts.BitDepth = uint(d)
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// applyPNGOptions configures the PNG encoder of the given wand.
+func applyPNGOptions(mw *imagick.MagickWand, opts *pngOptions) error {
+	if opts.CompressionLevel != nil {
+		err := mw.SetOption("png:compression-level", strconv.FormatUint(uint64(*opts.CompressionLevel), 10))
+		if err != nil {
+			return fmt.Errorf("set compression level: %w", err)
+		}
+	}
+
+	if opts.Filter != "" {
+		err := mw.SetOption("png:compression-filter", pngFilterMap[opts.Filter])
+		if err != nil {
+			return fmt.Errorf("set filter: %w", err)
+		}
+	}
+
+	if opts.Interlace {
+		err := mw.SetInterlaceScheme(imagick.INTERLACE_PNG)
+		if err != nil {
+			return fmt.Errorf("set interlacing: %w", err)
+		}
+	}
+
+	if opts.BitDepth > 0 {
+		err := mw.SetOption("png:bit-depth", strconv.FormatUint(uint64(opts.BitDepth), 10))
+		if err != nil {
+			return fmt.Errorf("set bit depth: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// jxlOptions defines JPEG XL-specific encoding options.
+type jxlOptions struct {
+	Effort uint `json:"effort"` // Effort is the encoder effort from 1 (fastest) to 9 (smallest).
+}
+
+// parseJXLOptions parses the JPEG XL-specific URL parameters. It returns nil if none of them are set.
+func parseJXLOptions(query url.Values) (*jxlOptions, *apiError) {
+	v := query.Get("jxl-effort")
+	if v == "" {
+		return nil, nil
+	}
+
+	e, err := strconv.ParseUint(v, 10, 64)
+	if (err != nil) || (e < 1) || (e > 9) {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid jxl-effort parameter", err)
+	}
+
+	return &jxlOptions{Effort: uint(e)}, nil
+}
+
+// applyJXLOptions configures the JPEG XL encoder of the given wand.
+func applyJXLOptions(mw *imagick.MagickWand, opts *jxlOptions) error {
+	err := mw.SetOption("jxl:effort", strconv.FormatUint(uint64(opts.Effort), 10))
+	if err != nil {
+		return fmt.Errorf("set effort: %w", err)
+	}
+
+	return nil
+}
+
+// maxJP2Layers is the largest supported number of JPEG 2000 quality layers.
+const maxJP2Layers = 10
+
+// jp2Options defines JPEG 2000-specific encoding options.
+type jp2Options struct {
+	Rates       []float64 `json:"rates,omitempty"`       // Rates are the compression ratios of all quality layers.
+	Lossless    bool      `json:"lossless,omitempty"`    // Lossless uses the reversible wavelet transform.
+	Resolutions uint      `json:"resolutions,omitempty"` // Resolutions is the number of resolution levels.
+}
+
+// parseJP2Options parses the JPEG 2000-specific URL parameters. It returns nil if none of them are set.
+func parseJP2Options(query url.Values) (*jp2Options, *apiError) {
+	invalid := func(name string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	opts := &jp2Options{}
+	set := false
+
+	// Parse compression ratios, from the lowest quality layer to the highest
+	if v := query.Get("jp2-rate"); v != "" {
+		items := strings.Split(v, ",")
+		if len(items) > maxJP2Layers {
+			return nil, invalid("jp2-rate", nil)
+		}
+
+		for _, item := range items {
+			r, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+			if (err != nil) || !(r >= 1) || math.IsInf(r, 0) || ((len(opts.Rates) > 0) && (r >= opts.Rates[len(opts.Rates)-1])) {
+				return nil, invalid("jp2-rate", err)
+			}
+
+			opts.Rates = append(opts.Rates, r)
+		}
+
+		set = true
+	}
+
+	// Parse lossless mode
+	if query.Get("jp2-lossless") != "" {
+		lossless, aerr := parseBoolQuery(query, "jp2-lossless")
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		// Rate control is lossy
+		if lossless && (len(opts.Rates) > 0) {
+			return nil, invalid("jp2-lossless", nil)
+		}
+
+		opts.Lossless = lossless
+		set = true
+	}
+
+	// Parse number of resolution levels
+	if v := query.Get("jp2-resolutions"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (n < 1) || (n > 32) {
+			return nil, invalid("jp2-resolutions", err)
+		}
+
+		opts.Resolutions = uint(n)
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// applyJP2Options configures the JPEG 2000 encoder of the given wand.
+func applyJP2Options(mw *imagick.MagickWand, opts *jp2Options) error {
+	if len(opts.Rates) > 0 {
+		rates := make([]string, 0, len(opts.Rates))
+		for _, r := range opts.Rates {
+			rates = append(rates, strconv.FormatFloat(r, 'f', -1, 64))
+		}
+
+		err := mw.SetOption("jp2:rate", strings.Join(rates, ","))
+		if err != nil {
+			return fmt.Errorf("set compression ratios: %w", err)
+		}
+	}
+
+	if opts.Lossless {
+		err := mw.SetOption("jp2:reversible", "true")
+		if err == nil {
+			err = mw.SetImageCompressionQuality(100)
+		}
+
+		if err != nil {
+			return fmt.Errorf("set lossless mode: %w", err)
+		}
+	}
+
+	if opts.Resolutions > 0 {
+		err := mw.SetOption("jp2:number-resolutions", strconv.FormatUint(uint64(opts.Resolutions), 10))
+		if err != nil {
+			return fmt.Errorf("set resolution levels: %w", err)
+		}
+	}
+
+	return nil
+}
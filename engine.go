@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	engineImagick = "imagick" // engineImagick is the name of the ImageMagick engine.
+	engineVips    = "vips"    // engineVips is the name of the libvips engine.
+)
+
+// vipsMaxCoord is the largest image dimension supported by libvips, which leaves the height of renditions unbounded.
+const vipsMaxCoord = 10000000
+
+// vipsInputFormats defines the input formats the vips engine reads. They hold a single raster page each.
+var vipsInputFormats = map[string]bool{
+	"JPEG": true,
+	"PNG":  true,
+	"WEBP": true,
+}
+
+// vipsOutputSuffixes defines the output formats the vips engine writes, by the suffix libvips selects the saver with.
+var vipsOutputSuffixes = map[string]string{
+	"JPEG": ".jpg",
+	"PNG":  ".png",
+	"WEBP": ".webp",
+}
+
+// imageEngine defines an engine that converts all pages of an input into output images.
+type imageEngine interface {
+	// convert converts all pages of the input, rejecting inputs with more than maxPages pages unless it is 0. The
+	// sanitization report of the input is returned as well, if requested.
+	convert(ctx context.Context, in *input, opts convertOptions, maxPages uint) ([]pageResult, *inputReport, *apiError)
+}
+
+// newImageEngine creates the image engine of the given name, either "imagick" or "vips". The vips engine runs the given
+// vips executable, and leaves everything but plain raster resizing to ImageMagick.
+func newImageEngine(name, vips string) (imageEngine, error) {
+	switch strings.ToLower(name) {
+	case "", engineImagick:
+		return imagickEngine{}, nil
+
+	case engineVips:
+		path, err := exec.LookPath(vips)
+		if err != nil {
+			return nil, fmt.Errorf("look up vips executable: %w", err)
+		}
+
+		return &vipsEngine{path: path, fallback: imagickEngine{}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown image engine %q", name)
+}
+
+// imagickEngine defines the engine that converts images with ImageMagick.
+type imagickEngine struct{}
+
+// convert reads the input into a magick wand and converts all of its pages in parallel.
+func (imagickEngine) convert(
+	ctx context.Context, in *input, opts convertOptions, maxPages uint,
+) ([]pageResult, *inputReport, *apiError) {
+	// Read image
+	mw, aerr := readWand(ctx, in, opts)
+	if aerr != nil {
+		slog.ErrorContext(ctx, "Failed to read image", slog.Any("error", aerr))
+		return nil, nil, aerr
+	}
+
+	defer releaseWand(mw)
+
+	// Inspect input
+	var report *inputReport
+
+	if opts.Report {
+		report = inspectInput(in, mw)
+		if len(report.Indicators) > 0 {
+			slog.WarnContext(ctx, "Suspicious input", slog.Any("indicators", report.Indicators))
+		}
+	}
+
+	// Enforce page limit
+	pages := int(mw.GetNumberImages())
+
+	if (maxPages > 0) && (uint(pages) > maxPages) {
+		slog.ErrorContext(ctx, "Page limit exceeded", slog.Int("pages", pages), slog.Uint64("limit", uint64(maxPages)))
+		return nil, nil, newAPIError(http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded", nil)
+	}
+
+	// Convert all pages
+	results, err := convertPages(ctx, mw, pages, opts)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to convert pages", slog.Any("error", err))
+		return nil, nil, pagesError(err)
+	}
+
+	return results, report, nil
+}
+
+// vipsEngine defines the engine that resizes plain raster images with the vips command line tool, which is several
+// times faster and needs far less memory than ImageMagick. All other conversions are passed on to the fallback engine.
+type vipsEngine struct {
+	path     string      // path is the path of the vips executable.
+	fallback imageEngine // fallback converts what the vips engine does not support.
+}
+
+// convert resizes the input into all renditions if it is a plain raster image, or passes it on to the fallback engine
+// otherwise. If vips fails, e.g. on a corrupt input, the input is passed on as well, so errors are reported alike.
+func (e *vipsEngine) convert(
+	ctx context.Context, in *input, opts convertOptions, maxPages uint,
+) ([]pageResult, *inputReport, *apiError) {
+	if !vipsSupports(in, opts) {
+		return e.fallback.convert(ctx, in, opts, maxPages)
+	}
+
+	results, err := e.convertRenditions(ctx, in, opts)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to convert with vips, falling back to ImageMagick", slog.Any("error", err))
+		return e.fallback.convert(ctx, in, opts, maxPages)
+	}
+
+	countPages(ctx, 1)
+	auditPages(ctx, 1)
+
+	return results, nil, nil
+}
+
+// convertRenditions resizes the single page of the input to every requested width, once per output format.
+func (e *vipsEngine) convertRenditions(ctx context.Context, in *input, opts convertOptions) ([]pageResult, error) {
+	var results []pageResult
+
+	for _, size := range opts.Sizes {
+		for _, format := range opts.outputFormats() {
+			start := time.Now()
+
+			out, err := runCommand(ctx, e.path, vipsThumbnailArgs(format, opts.Quality, size), in.data)
+			if err != nil {
+				return nil, err
+			}
+
+			res, err := vipsResult(out, format, size)
+			if err != nil {
+				return nil, err
+			}
+
+			logPage(ctx, res, time.Since(start))
+			results = append(results, res)
+		}
+	}
+
+	return results, nil
+}
+
+// vipsThumbnailArgs returns the vips arguments that read an image from standard input, shrink it to the given width,
+// keeping the aspect ratio but never enlarging it, and write it to standard output in the given format.
+func vipsThumbnailArgs(format string, quality, size uint) []string {
+	out := vipsOutputSuffixes[format]
+	if format != "PNG" {
+		out += "[Q=" + strconv.FormatUint(uint64(quality), 10) + "]"
+	}
+
+	return []string{
+		"thumbnail_source", "[descriptor=0]", out, strconv.FormatUint(uint64(size), 10),
+		"--height", strconv.Itoa(vipsMaxCoord), "--size", "down",
+	}
+}
+
+// vipsResult pings the output image written by vips to collect the metadata its Zip archive entry is named with,
+// without decoding its pixels. Whether the page is gray or bilevel is not determined, see vipsSupports.
+func vipsResult(out []byte, format string, size uint) (pageResult, error) {
+	mw := acquireWand()
+	defer releaseWand(mw)
+
+	err := mw.PingImageBlob(out)
+	if err != nil {
+		return pageResult{}, fmt.Errorf("ping vips output: %w", err)
+	}
+
+	data := entryNameData{
+		Pages:  1,
+		Size:   size,
+		Format: format,
+		Ext:    formatExtensionMap[format],
+		Width:  mw.GetImageWidth(),
+		Height: mw.GetImageHeight(),
+	}
+
+	return pageResult{out: out, data: data}, nil
+}
+
+// vipsSupports returns true if the conversion only resizes a single raster page into renditions, which the vips engine
+// produces alike. Options are compared against a copy holding only what the vips engine honors or what does not affect
+// raster inputs, so options added later are left to ImageMagick until vips is taught about them. In hardened mode,
+// all conversions are left to ImageMagick, since the resource limits of the hardened policy do not apply to vips. So are
+// conversions named by the entry name template if it tells gray or bilevel pages apart, which needs their pixels.
+func vipsSupports(in *input, opts convertOptions) bool {
+	if config().GetBool("hardened") {
+		return false
+	}
+
+	tmpl := config().GetString("entry-name")
+	if (opts.FilenameTemplate == "") && (strings.Contains(tmpl, "Gray") || strings.Contains(tmpl, "Bilevel")) {
+		return false
+	}
+
+	format := sniffFormat(in.data[:min(len(in.data), sniffLength)])
+	if !vipsInputFormats[format] || (len(opts.Sizes) == 0) {
+		return false
+	}
+
+	// Transparency is kept as is, so it must not have to be flattened
+	if (format != "JPEG") && (opts.Alpha != alphaModeKeep) {
+		return false
+	}
+
+	for _, f := range opts.outputFormats() {
+		if vipsOutputSuffixes[f] == "" {
+			return false
+		}
+	}
+
+	plain := convertOptions{
+		Density:          opts.Density,
+		Quality:          opts.Quality,
+		Format:           opts.Format,
+		Formats:          opts.Formats,
+		Layout:           layoutTypeKeep,
+		Alpha:            opts.Alpha,
+		Background:       opts.Background,
+		SVG:              opts.SVG,
+		RAW:              opts.RAW,
+		DICOM:            opts.DICOM,
+		Layers:           opts.Layers,
+		Metadata:         metadataModeKeep,
+		Sizes:            opts.Sizes,
+		OCR:              opts.OCR,
+		FilenameTemplate: opts.FilenameTemplate,
+		Manifest:         opts.Manifest,
+		Store:            opts.Store,
+		ArchivePassword:  opts.ArchivePassword,
+	}
+
+	return reflect.DeepEqual(opts, plain)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+)
+
+// errorCode defines a stable, machine-readable error code.
+type errorCode string
+
+const (
+	errorCodeNotFound          errorCode = "NOT_FOUND"           // errorCodeNotFound signals an unknown endpoint.
+	errorCodeMethodNotAllowed  errorCode = "METHOD_NOT_ALLOWED"  // errorCodeMethodNotAllowed signals an unsupported method.
+	errorCodeInvalidDensity    errorCode = "INVALID_DENSITY"     // errorCodeInvalidDensity signals an invalid density.
+	errorCodeInvalidQuality    errorCode = "INVALID_QUALITY"     // errorCodeInvalidQuality signals an invalid quality.
+	errorCodeInvalidFormat     errorCode = "INVALID_FORMAT"      // errorCodeInvalidFormat signals an invalid format.
+	errorCodeInvalidLayout     errorCode = "INVALID_LAYOUT"      // errorCodeInvalidLayout signals an invalid layout.
+	errorCodeInvalidTemplate   errorCode = "INVALID_TEMPLATE"    // errorCodeInvalidTemplate signals an invalid template.
+	errorCodeInvalidParameter  errorCode = "INVALID_PARAMETER"   // errorCodeInvalidParameter signals any other invalid param.
+	errorCodePolicyDenied      errorCode = "POLICY_DENIED"       // errorCodePolicyDenied signals a request policy denial.
+	errorCodeBodyReadFailed    errorCode = "BODY_READ_FAILED"    // errorCodeBodyReadFailed signals an unreadable body.
+	errorCodeBodyTooLarge      errorCode = "BODY_TOO_LARGE"      // errorCodeBodyTooLarge signals an oversized body.
+	errorCodeLengthRequired    errorCode = "LENGTH_REQUIRED"     // errorCodeLengthRequired signals a missing length.
+	errorCodeUnsupportedMedia  errorCode = "UNSUPPORTED_MEDIA"   // errorCodeUnsupportedMedia signals an unsupported input.
+	errorCodeMissingFile       errorCode = "MISSING_FILE"        // errorCodeMissingFile signals a missing file part.
+	errorCodeDecodeFailed      errorCode = "DECODE_FAILED"       // errorCodeDecodeFailed signals an undecodable input.
+	errorCodeTransientFailure  errorCode = "TRANSIENT_FAILURE"   // errorCodeTransientFailure signals a retryable failure.
+	errorCodeCircuitOpen       errorCode = "CIRCUIT_OPEN"        // errorCodeCircuitOpen signals a failing delegate.
+	errorCodePageLimitExceeded errorCode = "PAGE_LIMIT_EXCEEDED" // errorCodePageLimitExceeded signals too many pages.
+	errorCodeProcessingFailed  errorCode = "PROCESSING_FAILED"   // errorCodeProcessingFailed signals a failed operation.
+	errorCodeEncodeFailed      errorCode = "ENCODE_FAILED"       // errorCodeEncodeFailed signals a failed encoding.
+	errorCodeArchiveFailed     errorCode = "ARCHIVE_FAILED"      // errorCodeArchiveFailed signals a failed archive write.
+	errorCodeServerBusy        errorCode = "SERVER_BUSY"         // errorCodeServerBusy signals an exhausted queue.
+	errorCodeSessionNotFound   errorCode = "SESSION_NOT_FOUND"   // errorCodeSessionNotFound signals an unknown session.
+	errorCodeSizeMismatch      errorCode = "SIZE_MISMATCH"       // errorCodeSizeMismatch signals images of different sizes.
+	errorCodePasswordRequired  errorCode = "PASSWORD_REQUIRED"   // errorCodePasswordRequired signals an encrypted PDF.
+	errorCodePasswordInvalid   errorCode = "PASSWORD_INVALID"    // errorCodePasswordInvalid signals a wrong PDF password.
+	errorCodeOCRUnavailable    errorCode = "OCR_UNAVAILABLE"     // errorCodeOCRUnavailable signals missing Tesseract.
+	errorCodeZbarUnavailable   errorCode = "ZBAR_UNAVAILABLE"    // errorCodeZbarUnavailable signals missing zbar.
+	errorCodeSignatureInvalid  errorCode = "SIGNATURE_INVALID"   // errorCodeSignatureInvalid signals a bad signature.
+	errorCodeDigestMismatch    errorCode = "DIGEST_MISMATCH"     // errorCodeDigestMismatch signals a corrupt body.
+	errorCodeQuotaExceeded     errorCode = "QUOTA_EXCEEDED"      // errorCodeQuotaExceeded signals an exhausted quota.
+	errorCodeAddressDenied     errorCode = "ADDRESS_DENIED"      // errorCodeAddressDenied signals a blocked address.
+	errorCodeServerDraining    errorCode = "SERVER_DRAINING"     // errorCodeServerDraining signals a draining server.
+	errorCodeServerOverloaded  errorCode = "SERVER_OVERLOADED"   // errorCodeServerOverloaded signals memory pressure.
+	errorCodeUnauthorized      errorCode = "UNAUTHORIZED"        // errorCodeUnauthorized signals a bad admin token.
+	errorCodeIdempotencyReused errorCode = "IDEMPOTENCY_REUSED"  // errorCodeIdempotencyReused signals a reused key.
+	errorCodeTempDiskFull      errorCode = "TEMP_DISK_FULL"      // errorCodeTempDiskFull signals an exhausted temp disk.
+	errorCodeStoreUnavailable  errorCode = "STORE_UNAVAILABLE"   // errorCodeStoreUnavailable signals missing storage.
+	errorCodeResultNotFound    errorCode = "RESULT_NOT_FOUND"    // errorCodeResultNotFound signals an unknown result.
+	errorCodeUploadNotFound    errorCode = "UPLOAD_NOT_FOUND"    // errorCodeUploadNotFound signals an unknown upload.
+	errorCodeUploadIncomplete  errorCode = "UPLOAD_INCOMPLETE"   // errorCodeUploadIncomplete signals a partial upload.
+	errorCodeOffsetMismatch    errorCode = "OFFSET_MISMATCH"     // errorCodeOffsetMismatch signals a wrong upload offset.
+	errorCodeTooManyDocuments  errorCode = "TOO_MANY_DOCUMENTS"  // errorCodeTooManyDocuments signals an oversized batch.
+	errorCodeFetchFailed       errorCode = "FETCH_FAILED"        // errorCodeFetchFailed signals an unfetchable input URL.
+	errorCodeNotAcceptable     errorCode = "NOT_ACCEPTABLE"      // errorCodeNotAcceptable signals an unsupported Accept.
+)
+
+// errorResponse defines the envelope of all error responses.
+type errorResponse struct {
+	Code      errorCode `json:"code"`                 // Code is a stable, machine-readable error code.
+	Message   string    `json:"message"`              // Message is a human-readable description of the error.
+	RequestID string    `json:"request_id,omitempty"` // RequestID identifies the request in the server logs.
+}
+
+// renderError responds with the given status and an error envelope.
+func renderError(w http.ResponseWriter, r *http.Request, status int, code errorCode, message string) {
+	auditError(r.Context(), code)
+
+	render.Status(r, status)
+	render.JSON(w, r, errorResponse{
+		Code:      code,
+		Message:   redactString(message, contextSecrets(r.Context())),
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+}
+
+// notFoundHandler responds to unknown endpoints.
+func notFoundHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderError(w, r, http.StatusNotFound, errorCodeNotFound, "endpoint not found")
+	}
+}
+
+// methodNotAllowedHandler responds to unsupported methods on known endpoints.
+func methodNotAllowedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiError defines an error that carries everything needed to render an error envelope.
+type apiError struct {
+	status  int       // status is the HTTP status code to respond with.
+	code    errorCode // code is the error code of the envelope.
+	message string    // message is the message of the envelope.
+	err     error     // err is the underlying error, which is only logged.
+}
+
+// newAPIError creates a new API error.
+func newAPIError(status int, code errorCode, message string, err error) *apiError {
+	return &apiError{status: status, code: code, message: message, err: err}
+}
+
+// Error returns the message and the underlying error.
+func (e *apiError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+
+	return e.message + ": " + e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+// renderAPIError responds with the error envelope of the given API error.
+func renderAPIError(w http.ResponseWriter, r *http.Request, err *apiError) {
+	renderError(w, r, err.status, err.code, err.message)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// optionsPart is the name of the multipart part that overrides parameters of individual "file" parts.
+const optionsPart = "options"
+
+// fixedParams are the parameters that apply to the whole request, and cannot be overridden per file.
+var fixedParams = map[string]bool{"mode": true, "store": true, "upload": true}
+
+// parseFileOverrides parses the options part, if any. The part is a JSON array with an object of parameter overrides
+// per "file" part, in order; values are strings, numbers, or booleans, and null objects override nothing.
+func parseFileOverrides(in *input, files int) ([]url.Values, *apiError) {
+	invalid := func(message string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, message, err)
+	}
+
+	part, ok := in.parts[optionsPart]
+	if !ok {
+		return nil, nil
+	}
+
+	var objs []map[string]any
+
+	dec := json.NewDecoder(bytes.NewReader(part))
+	dec.UseNumber()
+
+	err := dec.Decode(&objs)
+	if err != nil {
+		return nil, invalid("invalid file options", err)
+	}
+
+	if len(objs) > files {
+		return nil, invalid("more file options than files", nil)
+	}
+
+	overrides := make([]url.Values, len(objs))
+
+	for i, obj := range objs {
+		overrides[i] = url.Values{}
+
+		for k, v := range obj {
+			if fixedParams[k] {
+				return nil, invalid("parameter "+k+" cannot be overridden per file", nil)
+			}
+
+			switch v.(type) {
+			case string, json.Number, bool:
+				overrides[i].Set(k, fmt.Sprint(v))
+			default:
+				return nil, invalid("invalid value of file option "+k, nil)
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+// fileOptions returns the conversion options of a single file, and its maximum number of pages, from the parameters of
+// the request with the overrides applied. Policies are evaluated against the overridden parameters as well.
+func fileOptions(
+	r *http.Request, in *input, overrides url.Values, policies []*policy, watermark []byte, profiles map[string][]byte,
+	engine *ocrEngine,
+) (convertOptions, uint, *apiError) {
+	query := r.URL.Query()
+	for k, v := range overrides {
+		query[k] = v
+	}
+
+	fr := r.Clone(r.Context())
+	fr.URL.RawQuery = query.Encode()
+
+	pol := evaluatePolicies(policies, fr)
+	if pol.Denied != "" {
+		slog.ErrorContext(r.Context(), "File denied by policy", slog.String("policy", pol.Denied))
+		return convertOptions{}, 0, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil)
+	}
+
+	opts, aerr := parseConvertOptions(fr)
+	if aerr == nil {
+		aerr = checkOCR(opts.OCR, engine)
+	}
+
+	if (aerr == nil) && opts.singleFile() {
+		aerr = newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "multiple files require a Zip archive", nil)
+	}
+
+	if aerr == nil {
+		aerr = attachParts(fr, &opts, in, watermark, profiles)
+	}
+
+	return opts, pol.MaxPages, aerr
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	maxDenoiseRadius = 10  // maxDenoiseRadius is the largest supported noise reduction radius in pixels.
+	maxKernelSize    = 100 // maxKernelSize is the largest supported radius and sigma of blur and sharpen kernels.
+)
+
+// kernelOptions defines the Gaussian kernel of a blur or sharpen operation.
+type kernelOptions struct {
+	Radius float64 `json:"radius"` // Radius is the radius of the kernel in pixels, or 0 to pick one from the sigma.
+	Sigma  float64 `json:"sigma"`  // Sigma is the standard deviation of the kernel in pixels.
+}
+
+// filterOptions defines the noise reduction, blur, and sharpen options.
+type filterOptions struct {
+	Despeckle bool           `json:"despeckle,omitempty"` // Despeckle removes speckles while preserving edges.
+	Denoise   uint           `json:"denoise,omitempty"`   // Denoise is the radius of the noise reduction in pixels, or 0.
+	Blur      *kernelOptions `json:"blur,omitempty"`      // Blur is the kernel of the Gaussian blur.
+	Sharpen   *kernelOptions `json:"sharpen,omitempty"`   // Sharpen is the kernel of the unsharp mask.
+}
+
+// parseFilterOptions parses the noise reduction, blur, and sharpen URL parameters. It returns nil if none of them are
+// set.
+func parseFilterOptions(query url.Values) (*filterOptions, *apiError) {
+	opts := &filterOptions{}
+	set := false
+
+	// Parse despeckle
+	var aerr *apiError
+
+	opts.Despeckle, aerr = parseBoolQuery(query, "despeckle")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	set = set || opts.Despeckle
+
+	// Parse noise reduction radius
+	if v := query.Get("denoise"); v != "" {
+		r, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (r < 1) || (r > maxDenoiseRadius) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid denoise parameter", err)
+		}
+
+		opts.Denoise = uint(r)
+		set = true
+	}
+
+	// Parse blur and sharpen kernels
+	opts.Blur, aerr = parseKernel(query, "blur")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	opts.Sharpen, aerr = parseKernel(query, "sharpen")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	set = set || (opts.Blur != nil) || (opts.Sharpen != nil)
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// parseKernel parses a kernel given as "RADIUSxSIGMA", e.g. "0x1.5". It returns nil if the parameter is not set.
+func parseKernel(query url.Values, name string) (*kernelOptions, *apiError) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	invalid := newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", nil)
+
+	r, s, ok := strings.Cut(strings.ToLower(v), "x")
+	if !ok {
+		return nil, invalid
+	}
+
+	radius, err := strconv.ParseFloat(r, 64)
+	if (err != nil) || !((radius >= 0) && (radius <= maxKernelSize)) {
+		return nil, invalid
+	}
+
+	sigma, err := strconv.ParseFloat(s, 64)
+	if (err != nil) || !((sigma > 0) && (sigma <= maxKernelSize)) {
+		return nil, invalid
+	}
+
+	return &kernelOptions{Radius: radius, Sigma: sigma}, nil
+}
+
+// applyFilterOptions removes speckles, reduces noise, blurs, and sharpens the image, in that order. Noise is reduced by
+// replacing peak pixels within the given radius, just like ImageMagick's "-noise" option, and the image is sharpened
+// with an unsharp mask, which restores the crispness of downsized pages.
+func applyFilterOptions(mw *imagick.MagickWand, opts *filterOptions) error {
+	// Remove speckles
+	if opts.Despeckle {
+		err := mw.DespeckleImage()
+		if err != nil {
+			return fmt.Errorf("despeckle image: %w", err)
+		}
+	}
+
+	// Reduce noise
+	if opts.Denoise > 0 {
+		size := 2*opts.Denoise + 1
+
+		err := mw.StatisticImage(imagick.STATISTIC_NONPEAK, size, size)
+		if err != nil {
+			return fmt.Errorf("reduce noise: %w", err)
+		}
+	}
+
+	// Blur image
+	if opts.Blur != nil {
+		err := mw.BlurImage(opts.Blur.Radius, opts.Blur.Sigma)
+		if err != nil {
+			return fmt.Errorf("blur image: %w", err)
+		}
+	}
+
+	// Sharpen image
+	if opts.Sharpen != nil {
+		err := mw.UnsharpMaskImage(opts.Sharpen.Radius, opts.Sharpen.Sigma, 1.0, 0.0)
+		if err != nil {
+			return fmt.Errorf("sharpen image: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// gravityMap defines the supported gravities, i.e. where on a page something is placed.
+var gravityMap = map[string]imagick.GravityType{
+	"northwest": imagick.GRAVITY_NORTH_WEST,
+	"north":     imagick.GRAVITY_NORTH,
+	"northeast": imagick.GRAVITY_NORTH_EAST,
+	"west":      imagick.GRAVITY_WEST,
+	"center":    imagick.GRAVITY_CENTER,
+	"east":      imagick.GRAVITY_EAST,
+	"southwest": imagick.GRAVITY_SOUTH_WEST,
+	"south":     imagick.GRAVITY_SOUTH,
+	"southeast": imagick.GRAVITY_SOUTH_EAST,
+}
+
+// normalizeGravity normalizes gravity names, so "SouthEast", "south-east", and "south_east" are treated alike.
+func normalizeGravity(v string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(v))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// hardenedPolicy is the template of the restrictive ImageMagick policy used in hardened mode.
+//
+//go:embed policy.xml
+var hardenedPolicy string
+
+// hardenedLimit defines a resource limit of the hardened policy.
+type hardenedLimit struct {
+	resource imagick.ResourceType // resource is the ImageMagick resource.
+	bytes    int64                // bytes is the limit in bytes (or pixels for width and height).
+}
+
+// hardenedLimits defines the resource limits of the hardened policy, which are checked after initialization to verify
+// that the policy is in effect.
+var hardenedLimits = map[string]hardenedLimit{
+	"Memory": {resource: imagick.RESOURCE_MEMORY, bytes: 256 << 20},
+	"Map":    {resource: imagick.RESOURCE_MAP, bytes: 512 << 20},
+	"Disk":   {resource: imagick.RESOURCE_DISK, bytes: 1 << 30},
+	"Width":  {resource: imagick.RESOURCE_WIDTH, bytes: 16 << 10},
+	"Height": {resource: imagick.RESOURCE_HEIGHT, bytes: 16 << 10},
+}
+
+// prepareHardened creates the configuration and temporary directories under the given root, writes the restrictive
+// policy, and points ImageMagick at them. It must be called before ImageMagick is initialized.
+func prepareHardened(root string) error {
+	// Create directories
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("resolve root: %w", err)
+	}
+
+	configDir := filepath.Join(root, "etc")
+	tempDir := filepath.Join(root, "tmp")
+
+	for _, dir := range []string{configDir, tempDir} {
+		err := os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+	}
+
+	// Render policy
+	tmpl, err := template.New("policy").Parse(hardenedPolicy)
+	if err != nil {
+		return fmt.Errorf("parse policy: %w", err)
+	}
+
+	data := map[string]any{"TemporaryPath": tempDir}
+	for name, l := range hardenedLimits {
+		data[name] = l.bytes
+	}
+
+	var sb strings.Builder
+
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		return fmt.Errorf("render policy: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(configDir, "policy.xml"), []byte(sb.String()), 0o600)
+	if err != nil {
+		return fmt.Errorf("write policy: %w", err)
+	}
+
+	// Point ImageMagick (and anything else) at the root
+	env := map[string]string{
+		"MAGICK_CONFIGURE_PATH": configDir,
+		"MAGICK_TEMPORARY_PATH": tempDir,
+		"TMPDIR":                tempDir,
+	}
+
+	for k, v := range env {
+		err := os.Setenv(k, v)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyHardened checks that the hardened policy is in effect and that all required delegates are available. It must
+// be called after ImageMagick is initialized.
+func verifyHardened(delegates []string) error {
+	// Verify policy
+	for name, l := range hardenedLimits {
+		if limit := imagick.GetResourceLimit(l.resource); limit != l.bytes {
+			return fmt.Errorf("policy not in effect: %s limit is %d instead of %d", strings.ToLower(name), limit, l.bytes)
+		}
+	}
+
+	// Verify delegates
+	for _, d := range delegates {
+		if !slices.Contains(availableDelegates(), strings.ToLower(d)) {
+			return fmt.Errorf("required delegate %q is missing", d)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"     // idempotencyKeyHeader is the header that identifies a retried request.
+	idempotentReplayedHeader = "Idempotent-Replayed" // idempotentReplayedHeader marks replayed responses.
+)
+
+// maxIdempotencyKey is the maximum length of an idempotency key.
+const maxIdempotencyKey = 255
+
+// idempotentResponse defines a response kept for retries of the request it was sent for.
+type idempotentResponse struct {
+	id          string        // id identifies the request by client key, path, and idempotency key.
+	done        chan struct{} // done is closed once the original request has been handled.
+	fingerprint []byte        // fingerprint is the digest of the method, URL, and body of the original request.
+	status      int           // status is the status of the response, or 0 if the response was not kept.
+	header      http.Header   // header are the headers set by the handler.
+	body        []byte        // body is the body of the response.
+	expires     time.Time     // expires is the time the response expires.
+	elem        *list.Element // elem is the position of the response in the cache's age list, once it is kept.
+}
+
+// idempotencyCache defines a cache of successful responses by idempotency key, so retried requests get the original
+// response instead of converting again. The cache is bounded by the total size of the responses, the oldest responses
+// are evicted first, and responses expire after the time-to-live.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse // responses are all kept and pending responses, by ID.
+	age       *list.List                     // age orders kept responses from newest to oldest.
+	size      int64                          // size is the total size of all kept responses.
+	maxSize   int64                          // maxSize is the maximum total size of all kept responses.
+	maxBody   int64                          // maxBody is the maximum size of a single kept response.
+	ttl       time.Duration                  // ttl is the time after which a response expires.
+}
+
+// newIdempotencyCache creates a new idempotency cache, keeping responses of up to maxBody bytes (or up to maxSize if
+// not positive). It returns nil if idempotency keys are not honored.
+func newIdempotencyCache(maxSize, maxBody int64, ttl time.Duration) *idempotencyCache {
+	if maxSize <= 0 {
+		return nil
+	}
+
+	if (maxBody <= 0) || (maxBody > maxSize) {
+		maxBody = maxSize
+	}
+
+	return &idempotencyCache{
+		responses: map[string]*idempotentResponse{}, age: list.New(), maxSize: maxSize, maxBody: maxBody, ttl: ttl,
+	}
+}
+
+// begin returns the response with the given ID, which may still be pending. If there is none, a new pending response
+// is added, and true is returned, so the caller handles the request.
+func (c *idempotencyCache) begin(id string) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	// Evict expired responses
+	for e := c.age.Back(); e != nil; {
+		prev := e.Prev()
+
+		if res, _ := e.Value.(*idempotentResponse); !now.Before(res.expires) {
+			c.unlink(res)
+		}
+
+		e = prev
+	}
+
+	if res, ok := c.responses[id]; ok {
+		return res, false
+	}
+
+	res := &idempotentResponse{id: id, done: make(chan struct{})}
+	c.responses[id] = res
+
+	return res, true
+}
+
+// finish completes the pending response. It is kept if it has a status, evicting the oldest responses as needed, and
+// removed otherwise, so the request can be retried.
+func (c *idempotencyCache) finish(res *idempotentResponse) {
+	c.mu.Lock()
+
+	if (res.status == 0) || (int64(len(res.body)) > c.maxBody) {
+		res.status = 0
+		delete(c.responses, res.id)
+	} else {
+		for (c.age.Len() > 0) && (c.size+int64(len(res.body)) > c.maxSize) {
+			old, _ := c.age.Back().Value.(*idempotentResponse)
+			c.unlink(old)
+		}
+
+		res.expires = time.Now().Add(c.ttl)
+		res.elem = c.age.PushFront(res)
+		c.size += int64(len(res.body))
+	}
+
+	c.mu.Unlock()
+
+	close(res.done)
+}
+
+// unlink removes the kept response from the cache. The caller must hold the lock.
+func (c *idempotencyCache) unlink(res *idempotentResponse) {
+	c.age.Remove(res.elem)
+	c.size -= int64(len(res.body))
+	delete(c.responses, res.id)
+}
+
+// replay is a middleware that honors the Idempotency-Key header of POST requests: the first request with a key is
+// handled and its successful response is kept, while retries with the same key get the kept response, waiting for the
+// first request if it is still being handled. Keys are scoped by client key and path, and reusing a key for a different
+// request is rejected.
+func (c *idempotencyCache) replay(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if (key == "") || (r.Method != http.MethodPost) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			slog.ErrorContext(r.Context(), "Idempotency key too long", slog.Int("length", len(key)))
+			rejectEarly(w, r, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid idempotency key", nil))
+			return
+		}
+
+		id := clientKey(r.Context()) + "\x00" + r.URL.Path + "\x00" + key
+
+		for {
+			res, first := c.begin(id)
+			if first {
+				c.record(w, r, res, next)
+				return
+			}
+
+			select {
+			case <-res.done:
+			case <-r.Context().Done():
+				return
+			}
+
+			// Handle the request again if the original response was not kept
+			if res.status != 0 {
+				c.send(w, r, res)
+				return
+			}
+		}
+	})
+}
+
+// record handles the request, and keeps the response if it is successful and not larger than a single kept response
+// may be. Larger responses stop being buffered as soon as their Content-Length or the bytes written exceed the limit.
+func (c *idempotencyCache) record(w http.ResponseWriter, r *http.Request, res *idempotentResponse, next http.Handler) {
+	defer c.finish(res)
+
+	fp := requestFingerprint(r)
+	before := w.Header().Clone()
+	body := &cappedBuffer{header: w.Header(), limit: c.maxBody}
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	ww.Tee(body)
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.TeeReader(r.Body, fp), Closer: r.Body}
+
+	next.ServeHTTP(ww, r)
+
+	if (ww.Status() < http.StatusOK) || (ww.Status() >= http.StatusMultipleChoices) || body.overflow {
+		return
+	}
+
+	// Complete fingerprint with the rest of the body, and keep the headers set by the handler
+	io.Copy(fp, r.Body) //nolint:errcheck
+
+	res.header = http.Header{}
+
+	for name, values := range w.Header() {
+		if !slices.Equal(before[name], values) {
+			res.header[name] = values
+		}
+	}
+
+	res.fingerprint, res.status, res.body = fp.Sum(nil), ww.Status(), body.Bytes()
+}
+
+// cappedBuffer defines a buffer that stops buffering once it would exceed its limit, discarding what it holds.
+type cappedBuffer struct {
+	bytes.Buffer
+
+	header   http.Header // header are the headers of the response, whose Content-Length is checked on the first write.
+	limit    int64       // limit is the maximum number of bytes buffered.
+	overflow bool        // overflow is set once the limit has been exceeded.
+}
+
+// Write buffers the data unless the limit is exceeded. It never fails, so the response it is teed from is unaffected.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow && (b.Len() == 0) {
+		n, err := strconv.ParseInt(b.header.Get("Content-Length"), 10, 64)
+		b.overflow = (err == nil) && (n > b.limit)
+	}
+
+	if b.overflow || (int64(b.Len()+len(p)) > b.limit) {
+		b.overflow = true
+		b.Buffer = bytes.Buffer{}
+
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// send responds with the kept response, unless the request differs from the original one.
+func (c *idempotencyCache) send(w http.ResponseWriter, r *http.Request, res *idempotentResponse) {
+	fp := requestFingerprint(r)
+	io.Copy(fp, r.Body) //nolint:errcheck
+
+	if !bytes.Equal(fp.Sum(nil), res.fingerprint) {
+		slog.ErrorContext(r.Context(), "Idempotency key reused for a different request")
+		rejectEarly(w, r, newAPIError(http.StatusUnprocessableEntity, errorCodeIdempotencyReused,
+			"idempotency key reused for a different request", nil))
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Replaying response of idempotent request", slog.Int("status", res.status))
+
+	for name, values := range res.header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(res.status)
+	w.Write(res.body) //nolint:errcheck
+}
+
+// requestFingerprint returns a digest of the method and URL of the request, which the body is to be written to.
+func requestFingerprint(r *http.Request) hash.Hash {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n") //nolint:errcheck
+
+	return h
+}
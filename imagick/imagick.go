@@ -0,0 +1,9 @@
+// Package imagick provides the parts of the ImageMagick Go bindings used by the server, so it can be built against
+// ImageMagick 6 (gopkg.in/gographics/imagick.v2, the default) or ImageMagick 7 (gopkg.in/gographics/imagick.v3, with
+// the "im7" build tag) from the same code.
+//
+// Types, constants, and functions that are the same in both bindings are re-exported under their original names.
+// Operations whose signatures differ between the bindings (e.g. the blur argument of resizing, which ImageMagick 7
+// dropped) are wrapped by functions taking the wand as first argument, and constants that were renamed (e.g. matte to
+// alpha) are exported under their ImageMagick 7 name.
+package imagick
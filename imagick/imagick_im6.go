@@ -0,0 +1,164 @@
+//go:build !im7
+
+package imagick
+
+import (
+	im "gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// MagickWand holds a list of images.
+type MagickWand = im.MagickWand
+
+// PixelWand holds a color.
+type PixelWand = im.PixelWand
+
+// DrawingWand holds drawing and text settings.
+type DrawingWand = im.DrawingWand
+
+// ColorspaceType defines a colorspace.
+type ColorspaceType = im.ColorspaceType
+
+// FilterType defines a resampling filter.
+type FilterType = im.FilterType
+
+// GravityType defines the placement of an image relative to another.
+type GravityType = im.GravityType
+
+// ImageType defines the type of an image, e.g. grayscale or true color.
+type ImageType = im.ImageType
+
+// ResourceType defines a resource whose usage can be limited.
+type ResourceType = im.ResourceType
+
+// Constants of the bindings, under their original names.
+//
+//nolint:revive
+const (
+	ALPHA_CHANNEL_DEACTIVATE = im.ALPHA_CHANNEL_DEACTIVATE
+
+	COLORSPACE_CMYK      = im.COLORSPACE_CMYK
+	COLORSPACE_GRAY      = im.COLORSPACE_GRAY
+	COLORSPACE_LAB       = im.COLORSPACE_LAB
+	COLORSPACE_SRGB      = im.COLORSPACE_SRGB
+	COLORSPACE_UNDEFINED = im.COLORSPACE_UNDEFINED
+
+	COMPOSITE_OP_DISSOLVE = im.COMPOSITE_OP_DISSOLVE
+
+	DISPOSE_BACKGROUND = im.DISPOSE_BACKGROUND
+
+	FILTER_LANCZOS = im.FILTER_LANCZOS
+
+	GRAVITY_CENTER     = im.GRAVITY_CENTER
+	GRAVITY_EAST       = im.GRAVITY_EAST
+	GRAVITY_NORTH      = im.GRAVITY_NORTH
+	GRAVITY_NORTH_EAST = im.GRAVITY_NORTH_EAST
+	GRAVITY_NORTH_WEST = im.GRAVITY_NORTH_WEST
+	GRAVITY_SOUTH      = im.GRAVITY_SOUTH
+	GRAVITY_SOUTH_EAST = im.GRAVITY_SOUTH_EAST
+	GRAVITY_SOUTH_WEST = im.GRAVITY_SOUTH_WEST
+	GRAVITY_WEST       = im.GRAVITY_WEST
+
+	IMAGE_LAYER_FLATTEN = im.IMAGE_LAYER_FLATTEN
+
+	IMAGE_TYPE_BILEVEL         = im.IMAGE_TYPE_BILEVEL
+	IMAGE_TYPE_GRAYSCALE       = im.IMAGE_TYPE_GRAYSCALE
+	IMAGE_TYPE_GRAYSCALE_ALPHA = im.IMAGE_TYPE_GRAYSCALE_MATTE
+
+	INTERLACE_NO    = im.INTERLACE_NO
+	INTERLACE_PLANE = im.INTERLACE_PLANE
+	INTERLACE_PNG   = im.INTERLACE_PNG
+
+	METRIC_ABSOLUTE_ERROR             = im.METRIC_ABSOLUTE_ERROR
+	METRIC_PEAK_SIGNAL_TO_NOISE_RATIO = im.METRIC_PEAK_SIGNAL_TO_NOISE_RATIO
+	METRIC_ROOT_MEAN_SQUARED_ERROR    = im.METRIC_ROOT_MEAN_SQUARED_ERROR
+
+	MONTAGE_MODE_UNFRAME = im.MONTAGE_MODE_UNFRAME
+
+	PIXEL_CHAR  = im.PIXEL_CHAR
+	PIXEL_FLOAT = im.PIXEL_FLOAT
+
+	RESOLUTION_PIXELS_PER_INCH = im.RESOLUTION_PIXELS_PER_INCH
+
+	RESOURCE_AREA   = im.RESOURCE_AREA
+	RESOURCE_DISK   = im.RESOURCE_DISK
+	RESOURCE_FILE   = im.RESOURCE_FILE
+	RESOURCE_HEIGHT = im.RESOURCE_HEIGHT
+	RESOURCE_MAP    = im.RESOURCE_MAP
+	RESOURCE_MEMORY = im.RESOURCE_MEMORY
+	RESOURCE_THREAD = im.RESOURCE_THREAD
+	RESOURCE_TIME   = im.RESOURCE_TIME
+	RESOURCE_WIDTH  = im.RESOURCE_WIDTH
+
+	STATISTIC_NONPEAK = im.STATISTIC_NONPEAK
+)
+
+// Initialize initializes the MagickWand environment.
+func Initialize() {
+	im.Initialize()
+}
+
+// Terminate terminates the MagickWand environment.
+func Terminate() {
+	im.Terminate()
+}
+
+// NewMagickWand returns a new, empty wand.
+func NewMagickWand() *MagickWand {
+	return im.NewMagickWand()
+}
+
+// NewPixelWand returns a new pixel wand.
+func NewPixelWand() *PixelWand {
+	return im.NewPixelWand()
+}
+
+// NewDrawingWand returns a new drawing wand.
+func NewDrawingWand() *DrawingWand {
+	return im.NewDrawingWand()
+}
+
+// GetVersion returns the version of ImageMagick, as string and as number.
+func GetVersion() (string, uint) {
+	return im.GetVersion()
+}
+
+// GetQuantumDepth returns the quantum depth of ImageMagick, as string and as number.
+func GetQuantumDepth() (string, uint) {
+	return im.GetQuantumDepth()
+}
+
+// GetQuantumRange returns the quantum range of ImageMagick, as string and as number.
+func GetQuantumRange() (string, uint) {
+	return im.GetQuantumRange()
+}
+
+// GetResourceLimit returns the limit of the resource.
+func GetResourceLimit(rtype ResourceType) int64 {
+	return im.GetResourceLimit(rtype)
+}
+
+// SetResourceLimit sets the limit of the resource, and returns false if it cannot be set.
+func SetResourceLimit(rtype ResourceType, limit uint64) bool {
+	return im.SetResourceLimit(rtype, limit)
+}
+
+// ResizeImage scales the current image to the given size with the given filter.
+func ResizeImage(mw *MagickWand, cols, rows uint, filter FilterType) error {
+	return mw.ResizeImage(cols, rows, filter, 1.0)
+}
+
+// ResampleImage resamples the current image to the given resolution with the given filter.
+func ResampleImage(mw *MagickWand, xRes, yRes float64, filter FilterType) error {
+	return mw.ResampleImage(xRes, yRes, filter, 1.0)
+}
+
+// QuantizeImage reduces the current image to the given number of colors in the given colorspace, without dithering.
+func QuantizeImage(mw *MagickWand, colors uint, colorspace ColorspaceType) error {
+	return mw.QuantizeImage(colors, colorspace, 0, false, false)
+}
+
+// IdentifyImageType returns the type of the current image as identified from its pixels, e.g. grayscale for a color
+// image that only contains shades of gray.
+func IdentifyImageType(mw *MagickWand) ImageType {
+	return mw.GetImageType()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// sniffLength is the number of bytes inspected to detect the input format.
+const sniffLength = 512
+
+const (
+	passwordHeader        = "X-PDF-Password"     // passwordHeader is the request header that may supply the PDF password.
+	passwordPart          = "password"           // passwordPart is the multipart part that may supply the PDF password.
+	archivePasswordHeader = "X-Archive-Password" // archivePasswordHeader may supply the password of the Zip archive.
+	archivePasswordPart   = "archive-password"   // archivePasswordPart may supply the password of the Zip archive.
+)
+
+// magicSignature defines a byte sequence that identifies a format.
+type magicSignature struct {
+	format string // format is the ImageMagick name of the format.
+	offset int    // offset is the position of the magic bytes.
+	magic  string // magic are the magic bytes.
+}
+
+// magicSignatures defines the signatures of well-known input formats.
+var magicSignatures = []magicSignature{
+	{format: "JPEG", offset: 0, magic: "\xff\xd8\xff"},
+	{format: "PNG", offset: 0, magic: "\x89PNG\r\n\x1a\n"},
+	{format: "GIF", offset: 0, magic: "GIF87a"},
+	{format: "GIF", offset: 0, magic: "GIF89a"},
+	{format: "CR2", offset: 0, magic: "II*\x00\x10\x00\x00\x00CR"},
+	{format: "TIFF", offset: 0, magic: "II*\x00"},
+	{format: "TIFF", offset: 0, magic: "MM\x00*"},
+	{format: "PDF", offset: 0, magic: "%PDF-"},
+	{format: "PS", offset: 0, magic: "%!PS"},
+	{format: "BMP", offset: 0, magic: "BM"},
+	{format: "WEBP", offset: 8, magic: "WEBP"},
+	{format: "PSD", offset: 0, magic: "8BPS"},
+	{format: "XCF", offset: 0, magic: "gimp xcf"},
+	{format: "ICO", offset: 0, magic: "\x00\x00\x01\x00"},
+	{format: "JP2", offset: 0, magic: "\x00\x00\x00\x0cjP  \r\n\x87\n"},
+	{format: "J2K", offset: 0, magic: "\xff\x4f\xff\x51"},
+	{format: "JXL", offset: 0, magic: "\xff\x0a"},
+	{format: "JXL", offset: 0, magic: "\x00\x00\x00\x0cJXL \r\n\x87\n"},
+	{format: "HEIC", offset: 4, magic: "ftypheic"},
+	{format: "HEIC", offset: 4, magic: "ftypheix"},
+	{format: "HEIC", offset: 4, magic: "ftypmif1"},
+	{format: "HEIC", offset: 4, magic: "ftypmsf1"},
+	{format: "DCM", offset: 128, magic: "DICM"},
+}
+
+// sniffFormat returns the format identified by the magic bytes at the start of the input, or an empty string if the
+// format is unknown.
+func sniffFormat(head []byte) string {
+	for _, s := range magicSignatures {
+		if (len(head) >= s.offset+len(s.magic)) && (string(head[s.offset:s.offset+len(s.magic)]) == s.magic) {
+			return s.format
+		}
+	}
+
+	// SVG is text-based and may be preceded by an XML declaration, comments, or a doctype of any length, so all XML is
+	// treated as SVG, and rejected later unless it is one
+	if isXMLText(head) || hasSVGElement(head) {
+		return "SVG"
+	}
+
+	return ""
+}
+
+// checkHeaders validates the request headers before the body is read, so oversized or unsupported uploads can be
+// rejected without ingesting them.
+func checkHeaders(r *http.Request) *apiError {
+	// Require length
+	if config().GetBool("require-content-length") && (r.ContentLength < 0) {
+		return newAPIError(http.StatusLengthRequired, errorCodeLengthRequired, "content length required", nil)
+	}
+
+	// Check length
+	if limit := config().GetInt64("max-body-size"); (limit > 0) && (r.ContentLength > limit) {
+		return newAPIError(http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "request body too large", nil)
+	}
+
+	// Check content type
+	if allowed := config().GetStringSlice("content-types"); len(allowed) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if !slices.ContainsFunc(allowed, func(t string) bool { return strings.EqualFold(t, mediaType) }) {
+			return newAPIError(http.StatusUnsupportedMediaType, errorCodeUnsupportedMedia, "unsupported content type", nil)
+		}
+	}
+
+	return nil
+}
+
+// rejectEarly responds with the given error before the request body has been read. The connection is closed
+// afterwards, so the server does not have to drain a potentially huge body.
+func rejectEarly(w http.ResponseWriter, r *http.Request, err *apiError) {
+	w.Header().Set("Connection", "close")
+	renderAPIError(w, r, err)
+}
+
+// input defines the input of a conversion.
+type input struct {
+	data            []byte            // data is the image to convert.
+	path            string            // path is the temporary file holding the image, if it was spilled to disk.
+	filename        string            // filename is the original filename of the image, if known.
+	parts           map[string][]byte // parts are any additional multipart parts, by name.
+	password        string            // password decrypts password-protected PDFs, if given.
+	archivePassword string            // archivePassword encrypts the Zip archive, if given as multipart part.
+	extra           []*input          // extra are the images of any further "file" parts, in order.
+}
+
+// readInput reads the request body, which is either the image itself or a multipart form with the image in its "file"
+// part, unless the image is a completed resumable upload. The body size is checked against the configured limit while
+// reading, and the first chunk of the image is inspected to reject unsupported formats before the whole body has
+// arrived. A PDF password is taken from the "password" part or the X-PDF-Password header, and is redacted from all
+// further logs and errors, as is the password of the Zip archive.
+func readInput(w http.ResponseWriter, r *http.Request) (*input, *apiError) {
+	return readBody(w, r, checkFormat)
+}
+
+// readBody reads the request body like readInput, but checks the first chunk of the file with the given function.
+func readBody(w http.ResponseWriter, r *http.Request, check func(head []byte) *apiError) (*input, *apiError) {
+	// Stop reading bodies that turn out to be too large
+	if limit := config().GetInt64("max-body-size"); limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+
+	// Read body
+	var (
+		in   *input
+		aerr *apiError
+	)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	up := contextUpload(r.Context())
+
+	switch {
+	case up != nil:
+		in, aerr = up.input(r.Context(), check)
+	case mediaType == "multipart/form-data":
+		in, aerr = readMultipartInput(r, check)
+	case mediaType == jsonMediaType:
+		in, aerr = readJSONInput(r, check)
+	default:
+		in = &input{parts: map[string][]byte{}}
+		in.data, in.path, aerr = readFile(r.Context(), r.Body, check)
+	}
+
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	auditInput(r.Context(), in.data)
+
+	// Read remaining body, so a digest of the body covers all of it
+	_, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return nil, bodyReadError(err)
+	}
+
+	// Pick password
+	if part, ok := in.parts[passwordPart]; ok {
+		in.password = string(part)
+		delete(in.parts, passwordPart)
+	} else {
+		in.password = r.Header.Get(passwordHeader)
+	}
+
+	addSecret(r.Context(), in.password)
+
+	if part, ok := in.parts[archivePasswordPart]; ok {
+		in.archivePassword = string(part)
+		delete(in.parts, archivePasswordPart)
+		addSecret(r.Context(), in.archivePassword)
+	}
+
+	return in, nil
+}
+
+// isEncryptedPDF returns true if the data is a PDF that declares an encryption dictionary.
+func isEncryptedPDF(data []byte) bool {
+	return (sniffFormat(data) == "PDF") && bytes.Contains(data, []byte("/Encrypt"))
+}
+
+// readMultipartInput reads a multipart form. The first "file" part holds the image, and any further "file" parts are
+// kept in order, up to --batch-max-documents in total. All other parts are kept by name.
+func readMultipartInput(r *http.Request, check func(head []byte) *apiError) (*input, *apiError) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, bodyReadError(err)
+	}
+
+	in := &input{parts: map[string][]byte{}}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, bodyReadError(err)
+		}
+
+		// Read image parts
+		if part.FormName() == "file" {
+			limit := config().GetInt("batch-max-documents")
+			if (in.data != nil) && (limit > 0) && (1+len(in.extra) >= limit) {
+				return nil, newAPIError(http.StatusUnprocessableEntity, errorCodeTooManyDocuments, "too many file parts", nil)
+			}
+
+			data, path, aerr := readFile(r.Context(), part, check)
+			if aerr != nil {
+				return nil, aerr
+			}
+
+			if in.data == nil {
+				in.data, in.path, in.filename = data, path, part.FileName()
+			} else {
+				in.extra = append(in.extra, &input{data: data, path: path, filename: part.FileName()})
+			}
+
+			continue
+		}
+
+		// Read any other part
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, bodyReadError(err)
+		}
+
+		in.parts[part.FormName()] = data
+	}
+
+	if in.data == nil {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeMissingFile, "missing file part", nil)
+	}
+
+	return in, nil
+}
+
+// readImage reads an image, rejecting unsupported formats after the first chunk. Images larger than --spill-threshold
+// are spilled to a temporary file, whose path is returned as well, and which is removed once the context is done.
+func readImage(ctx context.Context, rd io.Reader) ([]byte, string, *apiError) {
+	return readFile(ctx, rd, checkFormat)
+}
+
+// readFile reads a file like readImage, but checks its first chunk with the given function.
+func readFile(ctx context.Context, rd io.Reader, check func(head []byte) *apiError) ([]byte, string, *apiError) {
+	// Inspect first chunk
+	br := bufio.NewReaderSize(rd, sniffLength)
+
+	head, err := br.Peek(sniffLength)
+	if (err != nil) && !errors.Is(err, io.EOF) {
+		return nil, "", bodyReadError(err)
+	}
+
+	aerr := check(head)
+	if aerr != nil {
+		return nil, "", aerr
+	}
+
+	// Read remaining data, spilling large images to disk
+	sp := newSpool()
+
+	_, err = br.WriteTo(sp)
+	if err != nil {
+		sp.discard()
+		return nil, "", bodyReadError(err)
+	}
+
+	data, path, err := sp.finish(ctx)
+	if err != nil {
+		return nil, "", bodyReadError(err)
+	}
+
+	return data, path, nil
+}
+
+// checkFormat rejects images whose first chunk reveals a format that is not allowed or not supported.
+func checkFormat(head []byte) *apiError {
+	format := sniffFormat(head)
+
+	if allowed := config().GetStringSlice("input-formats"); len(allowed) > 0 {
+		if !slices.ContainsFunc(allowed, func(f string) bool { return strings.EqualFold(f, format) }) {
+			return newAPIError(http.StatusUnsupportedMediaType, errorCodeUnsupportedMedia, "unsupported input format", nil)
+		}
+	}
+
+	if !formatAvailable(format) {
+		library := formatDelegateMap[format].library
+		message := fmt.Sprintf("%s input is not supported, since ImageMagick was built without %s", format, library)
+
+		return newAPIError(http.StatusUnsupportedMediaType, errorCodeUnsupportedMedia, message, nil)
+	}
+
+	return nil
+}
+
+// bodyReadError maps an error that occurred while reading the request body to an API error.
+func bodyReadError(err error) *apiError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return newAPIError(http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "request body too large", err)
+	}
+
+	if errors.Is(err, errSpill) {
+		return newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to spill request body to disk", err)
+	}
+
+	if errors.Is(err, errDigestMismatch) {
+		return newAPIError(http.StatusUnprocessableEntity, errorCodeDigestMismatch, "request body does not match its digest", err)
+	}
+
+	return newAPIError(http.StatusBadRequest, errorCodeBodyReadFailed, "failed to read request body", err)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// maxMetadataSize is the size above which an embedded metadata profile is considered suspicious.
+const maxMetadataSize = 1 << 20
+
+// indicatorCode defines a stable, machine-readable code of a suspicious input indicator.
+type indicatorCode string
+
+const (
+	indicatorExtensionMismatch indicatorCode = "EXTENSION_MISMATCH" // indicatorExtensionMismatch signals a wrong extension.
+	indicatorJavaScript        indicatorCode = "JAVASCRIPT"         // indicatorJavaScript signals embedded scripts.
+	indicatorAutoAction        indicatorCode = "AUTO_ACTION"        // indicatorAutoAction signals PDF open or launch actions.
+	indicatorEmbeddedFile      indicatorCode = "EMBEDDED_FILE"      // indicatorEmbeddedFile signals PDF file attachments.
+	indicatorOversizedMetadata indicatorCode = "OVERSIZED_METADATA" // indicatorOversizedMetadata signals huge profiles.
+	indicatorPolyglot          indicatorCode = "POLYGLOT"           // indicatorPolyglot signals a second file signature.
+	indicatorTrailingData      indicatorCode = "TRAILING_DATA"      // indicatorTrailingData signals data after the end.
+)
+
+// extensionFormatMap defines the formats expected for well-known file extensions.
+var extensionFormatMap = map[string]string{
+	"arw": "TIFF", "bmp": "BMP", "cr2": "CR2", "dcm": "DCM", "dng": "TIFF", "gif": "GIF", "heic": "HEIC", "heif": "HEIC",
+	"ico": "ICO", "j2k": "J2K", "jp2": "JP2", "jpeg": "JPEG", "jpg": "JPEG", "jxl": "JXL", "nef": "TIFF", "pdf": "PDF",
+	"png": "PNG", "ps": "PS", "psd": "PSD", "svg": "SVG", "tif": "TIFF", "tiff": "TIFF", "webp": "WEBP", "xcf": "XCF",
+}
+
+// pdfIndicators defines the PDF names that indicate active content.
+var pdfIndicators = []struct {
+	name string        // name is the PDF name.
+	code indicatorCode // code is the indicator reported if the name is present.
+}{
+	{name: "/JavaScript", code: indicatorJavaScript},
+	{name: "/JS", code: indicatorJavaScript},
+	{name: "/OpenAction", code: indicatorAutoAction},
+	{name: "/AA", code: indicatorAutoAction},
+	{name: "/Launch", code: indicatorAutoAction},
+	{name: "/EmbeddedFile", code: indicatorEmbeddedFile},
+}
+
+// scriptPattern matches script elements and event handler attributes of markup.
+var scriptPattern = regexp.MustCompile(`(?i)<script|\son[a-z]+\s*=|javascript:`)
+
+// inputIndicator defines a single suspicious indicator found in the input.
+type inputIndicator struct {
+	Code    indicatorCode `json:"code"`    // Code is a stable, machine-readable indicator code.
+	Message string        `json:"message"` // Message is a human-readable description of the indicator.
+}
+
+// inputReport defines the sanitization report of an input.
+type inputReport struct {
+	Filename   string           `json:"filename,omitempty"` // Filename is the original filename of the upload.
+	Format     string           `json:"format"`             // Format is the format identified by its magic bytes.
+	Size       int              `json:"size"`               // Size is the size of the input in bytes.
+	Indicators []inputIndicator `json:"indicators"`         // Indicators lists everything suspicious about the input.
+}
+
+// add adds an indicator to the report.
+func (rep *inputReport) add(code indicatorCode, format string, args ...any) {
+	rep.Indicators = append(rep.Indicators, inputIndicator{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// inspectInput reports indicators of suspicious inputs, without rejecting them: mismatched extensions, active content
+// in PDFs and SVGs, oversized metadata, signatures of other formats within the input, and data after its end.
+func inspectInput(in *input, mw *imagick.MagickWand) *inputReport {
+	head := in.data[:min(len(in.data), sniffLength)]
+
+	rep := &inputReport{
+		Filename:   in.filename,
+		Format:     sniffFormat(head),
+		Size:       len(in.data),
+		Indicators: []inputIndicator{},
+	}
+
+	// Check extension
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(in.filename), "."))
+	if expected, ok := extensionFormatMap[ext]; ok && (rep.Format != "") && (expected != rep.Format) {
+		rep.add(indicatorExtensionMismatch, "extension %q does not match format %s", ext, rep.Format)
+	}
+
+	// Check active content
+	switch rep.Format {
+	case "PDF":
+		for _, pi := range pdfIndicators {
+			if containsPDFName(in.data, pi.name) {
+				rep.add(pi.code, "PDF contains %s", pi.name)
+			}
+		}
+
+	case "SVG":
+		if scriptPattern.Match(in.data) {
+			rep.add(indicatorJavaScript, "SVG contains scripts or event handlers")
+		}
+	}
+
+	// Check signatures of other formats
+	inspectPolyglot(rep, in.data)
+
+	// Check metadata of all images
+	for i := 0; i < int(mw.GetNumberImages()); i++ {
+		mw.SetIteratorIndex(i)
+
+		for _, name := range mw.GetImageProfiles("*") {
+			if size := len(mw.GetImageProfile(name)); size > maxMetadataSize {
+				rep.add(indicatorOversizedMetadata, "%s profile of page %d has %d bytes", name, i, size)
+			}
+		}
+	}
+
+	return rep
+}
+
+// containsPDFName returns true if the PDF contains the given name, not followed by further name characters.
+func containsPDFName(data []byte, name string) bool {
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte(name))
+		if i < 0 {
+			return false
+		}
+
+		rest = rest[i+len(name):]
+		if (len(rest) == 0) || !isPDFNameChar(rest[0]) {
+			return true
+		}
+	}
+}
+
+// isPDFNameChar returns true if the character continues a PDF name, i.e. it is no whitespace or delimiter.
+func isPDFNameChar(c byte) bool {
+	return (c > ' ') && !strings.ContainsRune("()<>[]{}/%", rune(c))
+}
+
+// inspectPolyglot reports signatures of other formats within the input, and data after the end of PNG and JPEG
+// inputs. Such files are valid in more than one format and are a common way to smuggle content past filters.
+func inspectPolyglot(rep *inputReport, data []byte) {
+	// Check PDF header beyond the start, which PDF readers accept within the first kilobyte
+	if i := bytes.Index(data, []byte("%PDF-")); (i > 0) && (rep.Format != "PDF") {
+		rep.add(indicatorPolyglot, "PDF signature at offset %d", i)
+	}
+
+	// Check Zip archives, e.g. appended Java archives
+	if i := bytes.Index(data, []byte("PK\x03\x04")); i >= 0 {
+		rep.add(indicatorPolyglot, "Zip signature at offset %d", i)
+	}
+
+	// Check markup in binary formats
+	if (rep.Format != "SVG") && (rep.Format != "") && bytes.Contains(bytes.ToLower(data), []byte("<html")) {
+		rep.add(indicatorPolyglot, "HTML markup in %s input", rep.Format)
+	}
+
+	// Check data after the end
+	var end int
+
+	switch rep.Format {
+	case "PNG":
+		if i := bytes.LastIndex(data, []byte("IEND")); i >= 0 {
+			end = i + 8
+		}
+
+	case "JPEG":
+		if i := bytes.LastIndex(data, []byte("\xff\xd9")); i >= 0 {
+			end = i + 2
+		}
+	}
+
+	if (end > 0) && (len(bytes.TrimRight(data[end:], "\x00")) > 0) {
+		rep.add(indicatorTrailingData, "%d bytes after the end of the %s image", len(data)-end, rep.Format)
+	}
+}
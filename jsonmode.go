@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/go-chi/render"
+)
+
+// jsonMediaType is the media type of JSON requests, which carry the image base64-encoded or as URL, and are answered
+// with the output images base64-encoded.
+const jsonMediaType = "application/json"
+
+// jsonRequest defines the body of JSON requests. Exactly one of Data and URL must be given.
+type jsonRequest struct {
+	Data     []byte `json:"data"`     // Data is the base64-encoded image.
+	URL      string `json:"url"`      // URL is the HTTP(S) URL the image is fetched from.
+	Filename string `json:"filename"` // Filename is the original filename of the image, if known.
+	Password string `json:"password"` // Password decrypts password-protected PDFs, if given.
+}
+
+// jsonPage defines a single output image of the response to JSON requests.
+type jsonPage struct {
+	manifestPage
+
+	Data []byte `json:"data"`           // Data is the base64-encoded output image.
+	Text string `json:"text,omitempty"` // Text is the text recognized in the output image, if requested.
+}
+
+// jsonResponse defines the response to JSON requests.
+type jsonResponse struct {
+	Input *inputReport `json:"input,omitempty"` // Input is the sanitization report of the input, if requested.
+	Pages []jsonPage   `json:"pages"`           // Pages lists all output images, in order.
+}
+
+// isJSONRequest returns true if the request body is a JSON request, instead of the image or a multipart form.
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return (mediaType == jsonMediaType) && (contextUpload(r.Context()) == nil)
+}
+
+// checkJSONRequest fails if a JSON request asks for an output that cannot be answered with a list of output images,
+// i.e. a batch, a stored result, an encrypted Zip archive, or a single file.
+func checkJSONRequest(r *http.Request, opts convertOptions, batch bool) *apiError {
+	if !isJSONRequest(r) {
+		return nil
+	}
+
+	if batch || opts.Store || (opts.ArchivePassword != "") || opts.singleFile() {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "JSON requests only support page outputs", nil)
+	}
+
+	return nil
+}
+
+// readJSONInput reads a JSON request. The image is either decoded from base64 or a data URI, or fetched from its URL if
+// the host is listed in --input-url-hosts. The password of the request stands in for the "password" part of multipart forms.
+func readJSONInput(r *http.Request, check func(head []byte) *apiError) (*input, *apiError) {
+	var req jsonRequest
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	invalid := func(err error) *apiError {
+		if aerr := bodyReadError(err); aerr.code != errorCodeBodyReadFailed {
+			return aerr
+		}
+
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid JSON request", err)
+	}
+
+	err := dec.Decode(&req)
+	if err != nil {
+		return nil, invalid(err)
+	}
+
+	// Read the body to its end, so nothing may follow the request and its digest is verified before any URL is fetched
+	_, err = dec.Token()
+	if !errors.Is(err, io.EOF) {
+		if err == nil {
+			err = errors.New("unexpected data after JSON request")
+		}
+
+		return nil, invalid(err)
+	}
+
+	in := &input{filename: req.Filename, parts: map[string][]byte{}}
+	if req.Password != "" {
+		in.parts[passwordPart] = []byte(req.Password)
+	}
+
+	var aerr *apiError
+
+	switch {
+	case (req.Data != nil) && (req.URL != ""):
+		aerr = newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "only one of data and url may be given", nil)
+	case req.Data != nil:
+		in.data, in.path, aerr = readFile(r.Context(), bytes.NewReader(req.Data), check)
+	case isDataURI(req.URL):
+		in.data, in.path, aerr = readDataURI(r.Context(), req.URL, check)
+	case req.URL != "":
+		in.data, in.path, aerr = fetchInput(r.Context(), req.URL, check)
+		if in.filename == "" {
+			in.filename = urlFilename(req.URL)
+		}
+	default:
+		aerr = newAPIError(http.StatusBadRequest, errorCodeMissingFile, "missing data or url", nil)
+	}
+
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return in, nil
+}
+
+// isDataURI returns true if the URL is a data URI, e.g. the output of canvas.toDataURL().
+func isDataURI(rawURL string) bool {
+	return (len(rawURL) >= 5) && strings.EqualFold(rawURL[:5], "data:")
+}
+
+// readDataURI reads the image of a data URI, which is either base64-encoded or percent-encoded. The media type of the
+// URI is ignored, since the image is checked like request bodies.
+func readDataURI(ctx context.Context, rawURL string, check func(head []byte) *apiError) ([]byte, string, *apiError) {
+	invalid := func(err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid data URI", err)
+	}
+
+	header, payload, ok := strings.Cut(rawURL[5:], ",")
+	if !ok {
+		return nil, "", invalid(nil)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		data, err = base64.StdEncoding.DecodeString(payload)
+	} else {
+		var s string
+		s, err = url.PathUnescape(payload)
+		data = []byte(s)
+	}
+
+	if err != nil {
+		return nil, "", invalid(err)
+	}
+
+	return readFile(ctx, bytes.NewReader(data), check)
+}
+
+// checkInputURL fails unless the URL is an HTTP(S) URL of one of the hosts listed in --input-url-hosts.
+func checkInputURL(u *url.URL) error {
+	hosts := config().GetStringSlice("input-url-hosts")
+
+	if (u.Scheme != "http") && (u.Scheme != "https") {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	if !slices.ContainsFunc(hosts, func(h string) bool { return strings.EqualFold(h, u.Hostname()) }) {
+		return fmt.Errorf("host %q not allowed", u.Hostname())
+	}
+
+	return nil
+}
+
+// fetchInput fetches the image from its URL within --input-url-timeout, following redirects to allowed hosts only. The
+// image is bound by --max-body-size, and checked like request bodies.
+func fetchInput(ctx context.Context, rawURL string, check func(head []byte) *apiError) ([]byte, string, *apiError) {
+	if len(config().GetStringSlice("input-url-hosts")) == 0 {
+		return nil, "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "input URLs are not enabled", nil)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		err = checkInputURL(u)
+	}
+
+	if err != nil {
+		return nil, "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid input URL", err)
+	}
+
+	// Fetch image
+	fetchCtx := ctx
+
+	if timeout := config().GetDuration("input-url-timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+
+		fetchCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid input URL", err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+
+			return checkInputURL(req.URL)
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", newAPIError(http.StatusBadGateway, errorCodeFetchFailed, "failed to fetch input URL", err)
+	}
+
+	defer res.Body.Close() //nolint:errcheck
+
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected status %d", res.StatusCode)
+		return nil, "", newAPIError(http.StatusBadGateway, errorCodeFetchFailed, "failed to fetch input URL", err)
+	}
+
+	body := res.Body
+	if limit := config().GetInt64("max-body-size"); limit > 0 {
+		body = http.MaxBytesReader(nil, body, limit)
+	}
+
+	data, file, aerr := readFile(ctx, body, check)
+	if (aerr != nil) && (aerr.code == errorCodeBodyReadFailed) {
+		return nil, "", newAPIError(http.StatusBadGateway, errorCodeFetchFailed, "failed to fetch input URL", aerr.err)
+	}
+
+	return data, file, aerr
+}
+
+// urlFilename returns the last segment of the URL path, which names the output images of fetched inputs.
+func urlFilename(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
+
+// renderPages responds to JSON requests with all output images, in order, named like the entries of Zip archives.
+func renderPages(
+	w http.ResponseWriter, r *http.Request, results []pageResult, report *inputReport, basename string,
+	entryNameTmpl *template.Template, opts convertOptions,
+) {
+	res := jsonResponse{Input: report, Pages: make([]jsonPage, 0, len(results))}
+	namer := newEntryNamer()
+
+	for _, pr := range results {
+		name, err := pageName(entryNameTmpl, opts, pr, basename)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to name output image", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeArchiveFailed, "failed to name output image")
+
+			return
+		}
+
+		page := jsonPage{manifestPage: newManifestPage(namer.unique(name), pr), Data: pr.out}
+		if pr.text != nil {
+			page.Text = string(pr.text)
+			page.TextSHA256 = sha256Hex(pr.text)
+		}
+
+		res.Pages = append(res.Pages, page)
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, res)
+}
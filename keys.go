@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// anyKey is the name of the key policy that applies to all clients without a key policy of their own.
+const anyKey = "*"
+
+// keyPolicyKey is the context key of the key policy that applies to a request.
+type keyPolicyKey struct{}
+
+// keyPolicy defines the limits of a client key as read from the configuration. Clients are identified by the key their
+// requests are signed with, or else by the common name of their client certificate.
+type keyPolicy struct {
+	Name        string   `mapstructure:"name"`          // Name is the signature key or client certificate name, or "*".
+	Formats     []string `mapstructure:"formats"`       // Formats are the allowed output formats (empty for any).
+	MaxPages    uint     `mapstructure:"max-pages"`     // MaxPages limits the pages per request (0 for unlimited).
+	MaxBodySize int64    `mapstructure:"max-body-size"` // MaxBodySize limits the request body size (0 for unlimited).
+	DailyQuota  uint     `mapstructure:"daily-quota"`   // DailyQuota limits successful requests per UTC day.
+	Priority    int      `mapstructure:"priority"`      // Priority orders requests waiting for a conversion slot.
+	Classes     []string `mapstructure:"classes"`       // Classes are the allowed request classes (empty for any).
+
+	QuotaWarnings []float64 `mapstructure:"quota-warnings"` // QuotaWarnings are the fractions of the quota warned about.
+}
+
+// quotaWarning defines the notification posted to --quota-webhook once a client key passes a warning threshold of its
+// daily quota.
+type quotaWarning struct {
+	Policy    string  `json:"policy"`    // Policy is the name of the key policy.
+	Key       string  `json:"key"`       // Key is the client key, empty for anonymous clients.
+	Day       string  `json:"day"`       // Day is the UTC day, e.g. "2026-10-14".
+	Threshold float64 `json:"threshold"` // Threshold is the fraction of the quota that was passed.
+	Used      uint    `json:"used"`      // Used is the number of requests counted on the day.
+	Quota     uint    `json:"quota"`     // Quota is the daily quota.
+}
+
+// keyPolicies defines the compiled key policies.
+type keyPolicies struct {
+	policies map[string]*keyPolicy // policies are the key policies, by name.
+	usage    *keyUsage             // usage is the usage of each client key on the current day.
+}
+
+// keyUsage defines the usage of each client key on the current day. It is kept when the key policies are reloaded.
+type keyUsage struct {
+	mu     sync.Mutex
+	day    string          // day is the current UTC day, e.g. "2026-10-14".
+	counts map[string]uint // counts is the number of successful requests on the current day, by client key.
+	warned map[string]int  // warned is the number of warning thresholds notified on the current day, by client key.
+}
+
+// newKeyUsage creates a new, empty usage of client keys.
+func newKeyUsage() *keyUsage {
+	return &keyUsage{counts: map[string]uint{}, warned: map[string]int{}}
+}
+
+// newKeyPolicies compiles the given key policies, accounting quotas to the given usage. It returns nil if there are
+// none.
+func newKeyPolicies(list []keyPolicy, usage *keyUsage) (*keyPolicies, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	kp := &keyPolicies{policies: make(map[string]*keyPolicy, len(list)), usage: usage}
+
+	for i := range list {
+		p := &list[i]
+
+		if p.Name == "" {
+			return nil, fmt.Errorf("key policy #%d has no name", i)
+		}
+
+		if _, ok := kp.policies[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate key policy %s", p.Name)
+		}
+
+		for j, f := range p.Formats {
+			f = strings.ToUpper(f)
+
+			if _, ok := formatExtensionMap[f]; !ok && (f != formatPDFA) {
+				return nil, fmt.Errorf("invalid format %q in key policy %s", f, p.Name)
+			}
+
+			p.Formats[j] = f
+		}
+
+		for _, t := range p.QuotaWarnings {
+			if !((t > 0) && (t < 1)) {
+				return nil, fmt.Errorf("invalid quota warning %v in key policy %s", t, p.Name)
+			}
+		}
+
+		slices.Sort(p.QuotaWarnings)
+
+		kp.policies[p.Name] = p
+	}
+
+	return kp, nil
+}
+
+// clientKey returns the key identifying the client of the request: the key it was signed with, or else the common name
+// of the client certificate. It is empty for anonymous clients.
+func clientKey(ctx context.Context) string {
+	if key := signatureKey(ctx); key != "" {
+		return key
+	}
+
+	return clientCN(ctx)
+}
+
+// enforce is a middleware that applies the key policy of the client: it limits the request body size, and stores the
+// policy in the request context for the daily quota and all other limits.
+func (k *keyPolicies) enforce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r.Context())
+
+		p, ok := k.policies[key]
+		if !ok {
+			p, ok = k.policies[anyKey]
+		}
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logAccess(r.Context(), slog.String("key_policy", p.Name))
+
+		// Limit body size
+		if p.MaxBodySize > 0 {
+			if r.ContentLength > p.MaxBodySize {
+				slog.ErrorContext(r.Context(), "Request rejected by key policy", slog.String("policy", p.Name))
+				rejectEarly(w, r, newAPIError(http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "request body too large", nil))
+
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, p.MaxBodySize)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyPolicyKey{}, p)))
+	})
+}
+
+// quota is a middleware that counts conversions against the daily quota of the key policy of the client. The request
+// is reserved a unit of the quota before it is served, or rejected if the quota is exhausted, and the unit is refunded
+// unless the request succeeds, so concurrent requests cannot exceed the quota. Past a warning threshold of the policy,
+// responses carry a Warning and a Quota-Remaining header, and --quota-webhook is notified once per threshold and day.
+func (k *keyPolicies) quota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := contextKeyPolicy(r.Context())
+		if (p == nil) || (p.DailyQuota == 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Reserve unit of quota
+		key, now := clientKey(r.Context()), time.Now()
+
+		used, ok := k.usage.reserve(key, p.DailyQuota, now)
+		if !ok {
+			slog.ErrorContext(r.Context(), "Daily quota exceeded", slog.String("policy", p.Name))
+
+			w.Header().Set("Retry-After", strconv.Itoa(secondsUntilTomorrow(now)))
+			rejectEarly(w, r, newAPIError(http.StatusTooManyRequests, errorCodeQuotaExceeded, "daily quota exceeded", nil))
+
+			return
+		}
+
+		// Warn about approaching quota
+		if level := warningLevel(p.QuotaWarnings, used, p.DailyQuota); level > 0 {
+			threshold := p.QuotaWarnings[level-1]
+
+			w.Header().Set("Quota-Remaining", strconv.FormatUint(uint64(p.DailyQuota-used), 10))
+			w.Header().Set("Warning", fmt.Sprintf(`299 - "%.0f%% of daily quota used"`, 100*threshold))
+
+			if k.usage.warn(key, level, now) {
+				slog.WarnContext(r.Context(), "Daily quota warning threshold passed",
+					slog.String("policy", p.Name), slog.Float64("threshold", threshold))
+
+				go notifyQuotaWarning(context.WithoutCancel(r.Context()), quotaWarning{
+					Policy: p.Name, Key: key, Day: now.UTC().Format(time.DateOnly),
+					Threshold: threshold, Used: used, Quota: p.DailyQuota,
+				})
+			}
+		}
+
+		// Serve request, refunding the unit unless successful
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		if ww.Status() >= http.StatusBadRequest {
+			k.usage.refund(key, now)
+		}
+	})
+}
+
+// reserve counts a request of the client key on the current day, unless the given quota is exhausted already. It
+// returns the number of requests counted including this one, or false if the quota is exhausted.
+func (u *keyUsage) reserve(key string, quota uint, now time.Time) (uint, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.rollOver(now)
+
+	if u.counts[key] >= quota {
+		return u.counts[key], false
+	}
+
+	u.counts[key]++
+
+	return u.counts[key], true
+}
+
+// warn records that the client key passed the given number of warning thresholds on the current day. It returns true
+// if the last of them was not passed before, so each threshold is notified only once per day.
+func (u *keyUsage) warn(key string, level int, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.rollOver(now)
+
+	if u.warned[key] >= level {
+		return false
+	}
+
+	u.warned[key] = level
+
+	return true
+}
+
+// refund takes back a request of the client key reserved at the given time, unless a new UTC day has begun since.
+func (u *keyUsage) refund(key string, reserved time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if (reserved.UTC().Format(time.DateOnly) == u.day) && (u.counts[key] > 0) {
+		u.counts[key]--
+	}
+}
+
+// rollOver resets the usage of all client keys once a new UTC day has begun. It must be called with the mutex held.
+func (u *keyUsage) rollOver(now time.Time) {
+	if day := now.UTC().Format(time.DateOnly); day != u.day {
+		u.day = day
+		clear(u.counts)
+		clear(u.warned)
+	}
+}
+
+// warningLevel returns the number of the sorted warning thresholds the used part of the quota has reached.
+func warningLevel(thresholds []float64, used, quota uint) int {
+	level := 0
+
+	for (level < len(thresholds)) && (float64(used) >= thresholds[level]*float64(quota)) {
+		level++
+	}
+
+	return level
+}
+
+// notifyQuotaWarning posts the warning as JSON to --quota-webhook, if configured. Failures are logged only.
+func notifyQuotaWarning(ctx context.Context, warning quotaWarning) {
+	webhook := config().GetString("quota-webhook")
+	if webhook == "" {
+		return
+	}
+
+	data, err := json.Marshal(warning)
+	if err == nil {
+		err = postJSON(ctx, webhook, data)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to notify quota warning", slog.String("policy", warning.Policy), slog.Any("error", err))
+	}
+}
+
+// secondsUntilTomorrow returns the number of seconds until the next UTC day begins.
+func secondsUntilTomorrow(now time.Time) int {
+	now = now.UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	return max(1, int(tomorrow.Sub(now).Seconds()))
+}
+
+// contextKeyPolicy returns the key policy stored in the context, or nil if there is none.
+func contextKeyPolicy(ctx context.Context) *keyPolicy {
+	p, _ := ctx.Value(keyPolicyKey{}).(*keyPolicy)
+	return p
+}
+
+// requestPriority returns the priority of the request as given by its key policy, or 0 if there is none.
+func requestPriority(ctx context.Context) int {
+	if p := contextKeyPolicy(ctx); p != nil {
+		return p.Priority
+	}
+
+	return 0
+}
+
+// checkKeyFormats rejects the output formats of the options if the key policy of the request does not allow them.
+func checkKeyFormats(ctx context.Context, opts convertOptions) *apiError {
+	p := contextKeyPolicy(ctx)
+	if (p == nil) || (len(p.Formats) == 0) {
+		return nil
+	}
+
+	formats := opts.outputFormats()
+
+	switch {
+	case opts.PDFA:
+		formats = []string{formatPDFA}
+	case opts.Animate != nil:
+		formats = []string{opts.Animate.Format}
+	}
+
+	for _, f := range formats {
+		if !slices.Contains(p.Formats, f) {
+			return newAPIError(http.StatusForbidden, errorCodePolicyDenied, "output format "+f+" not allowed", nil)
+		}
+	}
+
+	return nil
+}
+
+// checkKeyClass rejects the request class if the key policy of the request does not allow it.
+func checkKeyClass(ctx context.Context, class string) *apiError {
+	p := contextKeyPolicy(ctx)
+	if (p == nil) || (len(p.Classes) == 0) || slices.Contains(p.Classes, class) {
+		return nil
+	}
+
+	return newAPIError(http.StatusForbidden, errorCodePolicyDenied, "priority "+class+" not allowed", nil)
+}
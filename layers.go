@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// layersMode defines how layered inputs (PSD and XCF) are turned into pages.
+type layersMode string
+
+const (
+	layersModeFlatten layersMode = "FLATTEN" // layersModeFlatten merges all layers into a single page.
+	layersModeFirst   layersMode = "FIRST"   // layersModeFirst only keeps the first image, i.e. the PSD composite.
+	layersModeAll     layersMode = "ALL"     // layersModeAll converts every layer into a page of its own.
+)
+
+// parseLayersMode parses how layered inputs are turned into pages.
+func parseLayersMode(v string) (layersMode, *apiError) {
+	mode := layersMode(strings.ToUpper(v))
+
+	switch mode {
+	case "":
+		return layersModeFlatten, nil
+
+	case layersModeFlatten, layersModeFirst, layersModeAll:
+		return mode, nil
+	}
+
+	return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid layers parameter", nil)
+}
+
+// isLayered returns true if the input is a layered PSD or XCF document.
+func isLayered(data []byte) bool {
+	format := sniffFormat(data[:min(len(data), sniffLength)])
+	return (format == "PSD") || (format == "XCF")
+}
+
+// arrangeLayers turns the layers of a PSD or XCF document into pages. ImageMagick reads PSDs as their composite
+// followed by all layers, and XCFs as their layers only. The given wand is released to the pool unless it is returned.
+func arrangeLayers(mw *imagick.MagickWand, data []byte, mode layersMode) (*imagick.MagickWand, error) {
+	if mw.GetNumberImages() < 2 {
+		return mw, nil
+	}
+
+	// Keep first image only
+	if mode == layersModeFirst {
+		mw.SetIteratorIndex(0)
+		mwf := mw.GetImage()
+		releaseWand(mw)
+
+		return mwf, nil
+	}
+
+	// Drop PSD composite
+	if sniffFormat(data[:min(len(data), sniffLength)]) == "PSD" {
+		mw.SetIteratorIndex(0)
+
+		err := mw.RemoveImage()
+		if err != nil {
+			releaseWand(mw)
+			return nil, fmt.Errorf("remove composite: %w", err)
+		}
+	}
+
+	if mode == layersModeAll {
+		return mw, nil
+	}
+
+	// Merge layers onto their canvas
+	mw.ResetIterator()
+
+	mwm := mw.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+	releaseWand(mw)
+
+	return mwm, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/render"
+)
+
+// lifecycle tracks whether the server is ready for traffic, and the conversions in flight.
+type lifecycle struct {
+	stopping atomic.Bool  // stopping is set once the server has begun to shut down.
+	draining atomic.Bool  // draining is set while new conversions are rejected.
+	active   atomic.Int64 // active is the number of conversions in flight, including queued ones.
+}
+
+// stop marks the server as shutting down, so it is no longer reported as ready.
+func (l *lifecycle) stop() {
+	l.stopping.Store(true)
+}
+
+// track is a middleware that counts the request as conversion in flight until it has been handled, or rejects it while
+// the server is draining.
+func (l *lifecycle) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.draining.Load() {
+			slog.ErrorContext(r.Context(), "Request rejected while draining")
+			rejectEarly(w, r, newAPIError(http.StatusServiceUnavailable, errorCodeServerDraining, "server draining", nil))
+
+			return
+		}
+
+		l.active.Add(1)
+		defer l.active.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// status returns the status of the server, and whether it is ready for traffic.
+func (l *lifecycle) status() (string, bool) {
+	switch {
+	case l.stopping.Load():
+		return "SHUTTING_DOWN", false
+	case l.draining.Load():
+		return "DRAINING", false
+	}
+
+	return "OK", true
+}
+
+// readyzHandler responds with whether the server is ready for traffic. While the server is draining, or once it has
+// begun to shut down, it responds with 503, so load balancers stop sending traffic while conversions in flight are
+// finished.
+func readyzHandler(l *lifecycle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, ready := l.status()
+		if !ready {
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, map[string]any{"status": status, "active_conversions": l.active.Load()})
+
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, map[string]any{"status": status})
+	}
+}
+
+// drainHandler starts or stops draining, and responds with the status of the server and the conversions in flight.
+func drainHandler(l *lifecycle, drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.draining.Swap(drain) != drain {
+			slog.InfoContext(r.Context(), "Changed drain mode", slog.Bool("draining", drain))
+		}
+
+		status, _ := l.status()
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, map[string]any{"status": status, "active_conversions": l.active.Load()})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queueDepthHeader is the header reporting the number of requests waiting for a conversion slot.
+const queueDepthHeader = "X-Queue-Depth"
+
+// adaptInterval is the interval in which an adaptive concurrency limit is adjusted.
+const adaptInterval = time.Second
+
+// requestClass defines the class of a request. Waiting requests are ordered by their class first, and by their priority
+// within the same class.
+type requestClass int
+
+const (
+	requestClassBatch       requestClass = iota // requestClassBatch is bulk processing that can wait.
+	requestClassNormal                          // requestClassNormal is the class of requests that do not choose one.
+	requestClassInteractive                     // requestClassInteractive is a request a user waits for, e.g. a preview.
+)
+
+// requestClassMap defines all request classes, by name.
+var requestClassMap = map[string]requestClass{
+	"batch":       requestClassBatch,
+	"normal":      requestClassNormal,
+	"interactive": requestClassInteractive,
+}
+
+// parseRequestClass parses the class of the request from its priority parameter. It returns the normal class if the
+// parameter is not set. The key policy of the request may restrict the classes that can be chosen.
+func parseRequestClass(r *http.Request) (requestClass, *apiError) {
+	v := strings.ToLower(r.URL.Query().Get("priority"))
+	if v == "" {
+		return requestClassNormal, nil
+	}
+
+	class, ok := requestClassMap[v]
+	if !ok {
+		return 0, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid priority parameter", nil)
+	}
+
+	return class, checkKeyClass(r.Context(), v)
+}
+
+// limiter bounds the number of concurrent conversions and queues excess requests up to a limit. Waiting requests get
+// a slot in order of their class and priority, and in order of arrival within the same class and priority. It also estimates when a slot
+// will become available, so back-pressure can be signaled to clients and gateways. With a memory limit, the
+// concurrency limit adapts to the resident memory of the process, and new conversions are shed above the limit.
+type limiter struct {
+	ceiling  int64         // ceiling is the maximum number of concurrent conversions.
+	maxQueue int64         // maxQueue is the maximum number of waiting requests.
+	timeout  time.Duration // timeout is the maximum time a request waits for a slot.
+	maxRSS   uint64        // maxRSS is the resident memory above which new conversions are shed, if adaptive.
+	queued   atomic.Int64  // queued is the number of waiting requests.
+	active   atomic.Int64  // active is the number of running conversions.
+	current  atomic.Int64  // current is the current concurrency limit, which is the ceiling unless adaptive.
+	shedding atomic.Bool   // shedding is set while new conversions are shed.
+
+	mu      sync.Mutex
+	waiters []*waiter     // waiters are the waiting requests, by descending priority.
+	average time.Duration // average is the moving average of the conversion duration.
+}
+
+// waiter defines a request waiting for a conversion slot.
+type waiter struct {
+	class    requestClass  // class is the class of the request.
+	priority int           // priority is the priority of the request.
+	ready    chan struct{} // ready is closed once a slot has been handed over to the request.
+}
+
+// newLimiter creates a new limiter. It returns nil if concurrency is unlimited. If a memory limit is given, the
+// concurrency limit starts at half the given concurrency, and is adjusted to the resident memory from then on.
+func newLimiter(concurrency, maxQueue int, timeout time.Duration, maxRSS uint64) *limiter {
+	if concurrency <= 0 {
+		return nil
+	}
+
+	l := &limiter{
+		ceiling:  int64(concurrency),
+		maxQueue: int64(maxQueue),
+		timeout:  timeout,
+	}
+
+	l.current.Store(l.ceiling)
+
+	if maxRSS == 0 {
+		return l
+	}
+
+	if _, err := residentMemory(); err != nil {
+		slog.Warn("Adaptive concurrency not available", slog.Any("error", err))
+		return l
+	}
+
+	l.maxRSS = maxRSS
+	l.current.Store(max(1, l.ceiling/2))
+
+	go l.adapt(adaptInterval)
+
+	return l
+}
+
+// acquire waits for a free conversion slot, queued by the given class and priority. It returns a function that releases
+// the slot.
+func (l *limiter) acquire(ctx context.Context, class requestClass, priority int) (func(), *apiError) {
+	busy := newAPIError(http.StatusServiceUnavailable, errorCodeServerBusy, "server busy", nil)
+
+	// Shed load under memory pressure
+	if l.shedding.Load() {
+		return nil, newAPIError(http.StatusServiceUnavailable, errorCodeServerOverloaded, "server overloaded", nil)
+	}
+
+	l.mu.Lock()
+
+	// Try to get a slot right away, unless others are waiting already
+	if (len(l.waiters) == 0) && (l.active.Load() < l.current.Load()) {
+		l.active.Add(1)
+		l.mu.Unlock()
+
+		return l.release(time.Now()), nil
+	}
+
+	// Enqueue
+	if int64(len(l.waiters)) >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, busy
+	}
+
+	w := &waiter{class: class, priority: priority, ready: make(chan struct{})}
+
+	i := slices.IndexFunc(l.waiters, func(o *waiter) bool {
+		return (o.class < class) || ((o.class == class) && (o.priority < priority))
+	})
+	if i < 0 {
+		i = len(l.waiters)
+	}
+
+	l.waiters = slices.Insert(l.waiters, i, w)
+	l.queued.Store(int64(len(l.waiters)))
+
+	wait := l.timeout
+
+	l.mu.Unlock()
+
+	// Wait for slot
+	var timeout <-chan time.Time
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	select {
+	case <-w.ready:
+		return l.release(time.Now()), nil
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	// Dequeue, or give back the slot if it was handed over in the meantime
+	l.mu.Lock()
+
+	i = slices.Index(l.waiters, w)
+	if i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+		l.queued.Store(int64(len(l.waiters)))
+	}
+
+	l.mu.Unlock()
+
+	if i < 0 {
+		l.handOver()
+	}
+
+	return nil, busy
+}
+
+// release returns a function that hands the slot over and updates the moving average of the conversion duration.
+func (l *limiter) release(start time.Time) func() {
+	return func() {
+		l.handOver()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if d := time.Since(start); l.average == 0 {
+			l.average = d
+		} else {
+			l.average = (l.average*4 + d) / 5
+		}
+	}
+}
+
+// handOver frees a slot, and hands free slots over to the waiting requests.
+func (l *limiter) handOver() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active.Add(-1)
+	l.dispatch()
+}
+
+// dispatch hands free slots over to the waiting requests, in order, as long as the concurrency limit allows. The caller
+// must hold the lock.
+func (l *limiter) dispatch() {
+	for (len(l.waiters) > 0) && (l.active.Load() < l.current.Load()) {
+		l.active.Add(1)
+		close(l.waiters[0].ready)
+
+		l.waiters = slices.Delete(l.waiters, 0, 1)
+	}
+
+	l.queued.Store(int64(len(l.waiters)))
+}
+
+// adapt adjusts the concurrency limit to the resident memory of the process in the given interval.
+func (l *limiter) adapt(interval time.Duration) {
+	for range time.Tick(interval) {
+		rss, err := residentMemory()
+		if err != nil {
+			slog.Error("Failed to read resident memory", slog.Any("error", err))
+			continue
+		}
+
+		l.adjust(rss)
+	}
+}
+
+// adjust adjusts the concurrency limit to the given resident memory, additively increasing and multiplicatively
+// decreasing it: above 80% of the memory limit it is halved, otherwise it is raised by one while requests are waiting.
+// Above the memory limit, new conversions are shed until memory has been released again.
+func (l *limiter) adjust(rss uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if shed := rss >= l.maxRSS; l.shedding.Swap(shed) != shed {
+		slog.Warn("Changed load shedding", slog.Bool("shedding", shed), slog.Uint64("rss", rss))
+	}
+
+	limit := l.current.Load()
+
+	switch {
+	case rss >= l.maxRSS/10*8:
+		limit = max(1, limit/2)
+	case len(l.waiters) > 0:
+		limit = min(l.ceiling, limit+1)
+	}
+
+	if limit != l.current.Swap(limit) {
+		slog.Debug("Adjusted concurrency limit", slog.Int64("limit", limit), slog.Uint64("rss", rss))
+	}
+
+	l.dispatch()
+}
+
+// resize changes the concurrency limit, the queue limit, and the queue timeout in place, e.g. when the configuration
+// is reloaded. Running conversions keep their slots, and waiting requests get freed slots right away. An adaptive limit
+// keeps adapting, but never exceeds the new ceiling.
+func (l *limiter) resize(concurrency, maxQueue int, timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ceiling = int64(concurrency)
+	l.maxQueue = int64(maxQueue)
+	l.timeout = timeout
+
+	if l.maxRSS == 0 {
+		l.current.Store(l.ceiling)
+	} else {
+		l.current.Store(min(l.current.Load(), l.ceiling))
+	}
+
+	l.dispatch()
+}
+
+// retryAfter estimates the number of seconds until a newly arriving request would get a slot.
+func (l *limiter) retryAfter() int {
+	l.mu.Lock()
+	average := l.average
+	l.mu.Unlock()
+
+	waves := float64(l.queued.Load()+1) / float64(l.current.Load())
+
+	return max(1, int(math.Ceil(waves*average.Seconds())))
+}
+
+// limit is a middleware that runs the request in a conversion slot, or rejects it if the server is busy.
+func (l *limiter) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, aerr := parseRequestClass(r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse request class", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+
+			return
+		}
+
+		release, aerr := l.acquire(r.Context(), class, requestPriority(r.Context()))
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by limiter", slog.Int64("queued", l.queued.Load()))
+			rejectEarly(w, r, aerr)
+
+			return
+		}
+
+		// Abandoned conversion attempts keep the slot until they exit, without delaying the response
+		var attempts sync.WaitGroup
+
+		next.ServeHTTP(w, r.WithContext(withAttempts(r.Context(), &attempts)))
+
+		go func() {
+			attempts.Wait()
+			release()
+		}()
+	})
+}
+
+// hints is a middleware that reports the queue depth on all responses, and adds RateLimit and Retry-After headers to
+// all 429 and 503 responses, so clients and gateways can back off adaptively.
+func (l *limiter) hints(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&hintsWriter{ResponseWriter: w, limiter: l}, r)
+	})
+}
+
+// hintsWriter is a response writer that adds back-pressure headers before the status is written.
+type hintsWriter struct {
+	http.ResponseWriter
+	limiter *limiter
+	written bool
+}
+
+// WriteHeader adds the back-pressure headers and writes the status.
+func (w *hintsWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+
+		h := w.Header()
+		h.Set(queueDepthHeader, strconv.FormatInt(w.limiter.queued.Load(), 10))
+
+		if (status == http.StatusTooManyRequests) || (status == http.StatusServiceUnavailable) {
+			retry := strconv.Itoa(w.limiter.retryAfter())
+
+			if h.Get("Retry-After") == "" {
+				h.Set("Retry-After", retry)
+			}
+
+			limit := w.limiter.current.Load()
+
+			h.Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+			h.Set("RateLimit-Remaining", strconv.FormatInt(max(0, limit-w.limiter.active.Load()), 10))
+			h.Set("RateLimit-Reset", retry)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the data, implying a 200 status if none was written yet.
+func (w *hintsWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying response writer, so http.ResponseController keeps working.
+func (w *hintsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,290 @@
+// Package magicktest runs a real magick-server instance inside Go tests, so clients of the HTTP API can be tested end to
+// end instead of against mocks. The server is built from this module, started on a random local port with its own
+// temporary configuration file, and stopped when the test finishes:
+//
+//	func TestConvert(t *testing.T) {
+//		srv := magicktest.Start(t, magicktest.WithFlag("max-concurrent", "2"))
+//
+//		resp, err := http.Post(srv.URL+"/convert", "application/pdf", bytes.NewReader(pdf))
+//		...
+//	}
+//
+// Building the server requires the Go toolchain and the ImageMagick development files. To test against a prebuilt
+// binary instead, set MAGICK_SERVER_BIN to its path.
+package magicktest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// binaryEnv is the environment variable that selects a prebuilt server binary.
+const binaryEnv = "MAGICK_SERVER_BIN"
+
+// serverPackage is the package the server binary is built from.
+const serverPackage = "github.com/crissyfield/magick-server"
+
+const (
+	startTimeout = 30 * time.Second // startTimeout is the maximum time the server takes to become healthy.
+	stopTimeout  = 10 * time.Second // stopTimeout is the maximum time the server takes to shut down gracefully.
+)
+
+// Server defines a running server instance.
+type Server struct {
+	URL      string // URL is the base URL of the server, e.g. "http://127.0.0.1:49152".
+	AdminURL string // AdminURL is the base URL of the admin listener, if given by WithFlag("admin-listen", ...).
+
+	cmd  *exec.Cmd     // cmd is the server process.
+	logs *syncBuffer   // logs collects the output of the server.
+	done chan struct{} // done is closed once the server process has exited.
+}
+
+// options defines the options of starting a server.
+type options struct {
+	binary string            // binary is the server binary, or empty to build it.
+	config string            // config is the content of the configuration file.
+	flags  map[string]string // flags are additional command line flags, by name.
+}
+
+// Option defines an option of starting a server.
+type Option func(*options)
+
+// WithConfig sets the content of the configuration file, in YAML, e.g. to define request policies.
+func WithConfig(yaml string) Option {
+	return func(o *options) {
+		o.config = yaml
+	}
+}
+
+// WithFlag sets a command line flag, e.g. WithFlag("max-body-size", "1048576"). The admin listener must be given as
+// flag rather than in the configuration file, since the server is only polled for health there if it is known.
+func WithFlag(name, value string) Option {
+	return func(o *options) {
+		o.flags[name] = value
+	}
+}
+
+// WithBinary uses the given server binary instead of building one.
+func WithBinary(path string) Option {
+	return func(o *options) {
+		o.binary = path
+	}
+}
+
+// Start starts a new server and waits until it is healthy. The server is stopped when the test and all its subtests
+// have completed. Start fails the test if the server cannot be started.
+func Start(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+
+	o := &options{binary: os.Getenv(binaryEnv), flags: map[string]string{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// Build binary
+	if o.binary == "" {
+		bin, err := buildBinary()
+		if err != nil {
+			tb.Fatalf("magicktest: %v", err)
+		}
+
+		o.binary = bin
+	}
+
+	// Write configuration file
+	dir := tb.TempDir()
+
+	config := filepath.Join(dir, "config.yaml")
+
+	err := os.WriteFile(config, []byte(o.config), 0o600)
+	if err != nil {
+		tb.Fatalf("magicktest: write configuration file: %v", err)
+	}
+
+	// Pick port
+	addr, err := freeAddress()
+	if err != nil {
+		tb.Fatalf("magicktest: pick port: %v", err)
+	}
+
+	// Start server
+	srv := &Server{URL: "http://" + addr, logs: &syncBuffer{}, done: make(chan struct{})}
+	if admin := o.flags["admin-listen"]; admin != "" {
+		srv.AdminURL = "http://" + admin
+	}
+
+	args := []string{"--config", config, "--listen", addr}
+	for name, value := range o.flags {
+		args = append(args, "--"+name+"="+value)
+	}
+
+	srv.cmd = exec.Command(o.binary, args...)
+	srv.cmd.Dir = dir
+	srv.cmd.Env = isolatedEnv()
+	srv.cmd.Stdout = srv.logs
+	srv.cmd.Stderr = srv.logs
+
+	err = srv.cmd.Start()
+	if err != nil {
+		tb.Fatalf("magicktest: start server: %v", err)
+	}
+
+	go func() {
+		srv.cmd.Wait() //nolint:errcheck
+		close(srv.done)
+	}()
+
+	tb.Cleanup(srv.stop)
+
+	// Wait until healthy
+	err = srv.waitHealthy()
+	if err != nil {
+		tb.Fatalf("magicktest: %v\n%s", err, srv.Logs())
+	}
+
+	return srv
+}
+
+// Logs returns everything the server has logged so far.
+func (s *Server) Logs() string {
+	return s.logs.String()
+}
+
+// waitHealthy polls the health endpoint until it succeeds, the server exits, or the start timeout expires. Health moves
+// to the admin listener if there is one.
+func (s *Server) waitHealthy() error {
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(startTimeout)
+
+	base := s.URL
+	if s.AdminURL != "" {
+		base = s.AdminURL
+	}
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-s.done:
+			return errors.New("server exited during start")
+		default:
+		}
+
+		resp, err := client.Get(base + "/health")
+		if err == nil {
+			resp.Body.Close() //nolint:errcheck
+
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return errors.New("server did not become healthy in time")
+}
+
+// stop shuts the server down gracefully, and kills it if it does not exit in time.
+func (s *Server) stop() {
+	// Windows cannot deliver interrupts to other processes
+	if runtime.GOOS == "windows" {
+		s.cmd.Process.Kill() //nolint:errcheck
+	} else {
+		s.cmd.Process.Signal(os.Interrupt) //nolint:errcheck
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(stopTimeout):
+		s.cmd.Process.Kill() //nolint:errcheck
+		<-s.done
+	}
+}
+
+var (
+	buildOnce sync.Once // buildOnce ensures the binary is built once per test process.
+	buildPath string    // buildPath is the path of the built binary.
+	buildErr  error     // buildErr is the error of building the binary.
+)
+
+// buildBinary builds the server binary into a temporary directory, once per test process.
+func buildBinary() (string, error) {
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "magicktest-")
+		if err != nil {
+			buildErr = fmt.Errorf("create build directory: %w", err)
+			return
+		}
+
+		buildPath = filepath.Join(dir, "magick-server")
+		if runtime.GOOS == "windows" {
+			buildPath += ".exe"
+		}
+
+		out, err := exec.Command("go", "build", "-o", buildPath, serverPackage).CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("build server: %w\n%s", err, out)
+		}
+	})
+
+	return buildPath, buildErr
+}
+
+// freeAddress returns a local address with a port that is currently free. Another process may grab the port before the
+// server binds it, but that is unlikely enough for tests.
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	defer l.Close() //nolint:errcheck
+
+	return l.Addr().String(), nil
+}
+
+// isolatedEnv returns the environment of the test process without any server configuration, so the server only sees
+// the options given to Start.
+func isolatedEnv() []string {
+	var env []string
+
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "MAGICK_SERVER_") {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+// syncBuffer defines a buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write appends to the buffer.
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+// String returns the content of the buffer.
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
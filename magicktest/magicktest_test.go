@@ -0,0 +1,65 @@
+package magicktest
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestStart starts a server, checks that it serves requests, and that it exits once stopped.
+func TestStart(t *testing.T) {
+	if os.Getenv(binaryEnv) == "" {
+		if _, err := buildBinary(); err != nil {
+			t.Skipf("server cannot be built: %v", err)
+		}
+	}
+
+	admin, err := freeAddress()
+	if err != nil {
+		t.Fatalf("pick admin port: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		health func(srv *Server) string
+	}{
+		{
+			name:   "public",
+			opts:   []Option{WithFlag("max-body-size", "1048576")},
+			health: func(srv *Server) string { return srv.URL },
+		},
+		{
+			name:   "admin",
+			opts:   []Option{WithFlag("admin-listen", admin)},
+			health: func(srv *Server) string { return srv.AdminURL },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := Start(t, tt.opts...)
+
+			for _, url := range []string{srv.URL + "/version", tt.health(srv) + "/health"} {
+				resp, err := http.Get(url)
+				if err != nil {
+					t.Fatalf("get %s: %v", url, err)
+				}
+
+				resp.Body.Close() //nolint:errcheck
+
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("get %s: unexpected status %d\n%s", url, resp.StatusCode, srv.Logs())
+				}
+			}
+
+			srv.stop()
+
+			select {
+			case <-srv.done:
+			default:
+				t.Fatal("server still running after stop")
+			}
+		})
+	}
+}
@@ -1,33 +1,37 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"compress/flate"
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/crissyfield/magick-server/imagick"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/httplog/v2"
 	"github.com/go-chi/render"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"gopkg.in/gographics/imagick.v2/imagick"
 )
 
 // Version will be set during build.
 var Version = "(unknown)"
 
+// Commit will be set during build.
+var Commit = "(unknown)"
+
+// BuildDate will be set during build.
+var BuildDate = "(unknown)"
+
+// logLevel is the verbosity of logging output, which can change when the configuration is reloaded.
+var logLevel = new(slog.LevelVar)
+
 // CmdMain defines the root command.
 var CmdMain = &cobra.Command{
 	Use:               "magick-server [flags]",
@@ -41,91 +45,474 @@ var CmdMain = &cobra.Command{
 
 // Initialize command options
 func init() {
+	// Configuration
+	CmdMain.Flags().String("config", "", "configuration file to read instead of searching the default locations")
+	CmdMain.Flags().Bool("watch-config", false, "reload the configuration whenever the configuration file changes")
+
 	// Logging
 	CmdMain.Flags().String("log-level", "info", "verbosity of logging output")
 	CmdMain.Flags().Bool("log-json", false, "change logging format to JSON")
+	CmdMain.Flags().Float64("log-page-sample-rate", 1.0, "fraction of pages that emit a debug log record")
+	CmdMain.Flags().StringSlice("log-redact-keys", defaultRedactKeys, "log attribute keys whose values are redacted")
+
+	// Hardening
+	CmdMain.Flags().Bool("hardened", false, "enforce a restrictive ImageMagick policy, refuse to start otherwise")
+	CmdMain.Flags().String("hardened-root", "/var/lib/magick-server", "directory for policy and temporary files in hardened mode")
+	CmdMain.Flags().StringSlice("hardened-delegates", []string{"jpeg", "png", "tiff"}, "delegates required in hardened mode")
 
 	// Backend
 	CmdMain.Flags().String("listen", ":8081", "address the server should listen to")
+	CmdMain.Flags().Duration("shutdown-timeout", 5*time.Minute, "maximum time conversions in flight may take to finish on shutdown")
+	CmdMain.Flags().String("admin-listen", "", "address serving health, readiness, metrics, and usage off the public port (empty to disable)")
+	CmdMain.Flags().String("admin-token", "", "bearer token required by the admin endpoints of the admin listener (empty to disable them)")
+	CmdMain.Flags().Bool("enable-pprof", false, "serve profiling endpoints below /debug/pprof on the admin listener")
+	CmdMain.Flags().String("tls-cert", "", "PEM file of the server certificate, enables TLS")
+	CmdMain.Flags().String("tls-key", "", "PEM file of the private key of the server certificate")
+	CmdMain.Flags().String("tls-client-ca", "", "PEM file of the CA that issues client certificates, requires them if set")
+
+	// Access control
+	CmdMain.Flags().StringSlice("allow-cidrs", nil, "address ranges clients have to connect from (empty for any)")
+	CmdMain.Flags().StringSlice("deny-cidrs", nil, "address ranges clients must not connect from")
+
+	// Authentication
+	CmdMain.Flags().StringToString("hmac-secrets", nil, "shared secrets that requests have to be signed with, as key=secret")
+	CmdMain.Flags().Duration("hmac-max-skew", 5*time.Minute, "maximum difference between the signing time of requests and now")
+
+	// Auditing
+	CmdMain.Flags().String("audit-log", "", "file hash-chained audit records are appended to, - for standard output")
+	CmdMain.Flags().String("audit-secret", "", "secret keying the hash chain of the audit log (empty for plain SHA-256)")
+
+	// Usage accounting
+	CmdMain.Flags().String("usage-tenant-header", "X-Tenant", "request header naming the tenant usage is accounted to")
+	CmdMain.Flags().String("usage-export", "", "URL usage is posted to, or file it is appended to (empty to disable)")
+	CmdMain.Flags().Duration("usage-export-interval", time.Hour, "interval in which usage is exported")
+	CmdMain.Flags().String("quota-webhook", "", "URL notified when a client key passes a quota warning (empty to disable)")
+
+	// Concurrency
+	CmdMain.Flags().Int("max-concurrent", 0, "maximum number of concurrent conversions (0 for unlimited)")
+	CmdMain.Flags().Int("max-queued", 0, "maximum number of requests waiting for a conversion")
+	CmdMain.Flags().Duration("queue-timeout", 30*time.Second, "maximum time a request waits for a conversion (0 for unlimited)")
+	CmdMain.Flags().Uint64("max-rss", 0, "resident memory in bytes that adapts concurrency and sheds load (0 to disable)")
+
+	// Input
+	CmdMain.Flags().Int64("max-body-size", 0, "maximum size of request bodies in bytes (0 for unlimited)")
+	CmdMain.Flags().Bool("require-content-length", false, "reject request bodies without Content-Length")
+	CmdMain.Flags().StringSlice("content-types", nil, "request content types accepted (empty for any)")
+	CmdMain.Flags().StringSlice("input-formats", nil, "input formats accepted based on their magic bytes (empty for any)")
+	CmdMain.Flags().StringSlice("input-url-hosts", nil, "hosts input URLs of JSON requests may be fetched from (empty to disable)")
+	CmdMain.Flags().Duration("input-url-timeout", 30*time.Second, "maximum time fetching an input URL may take (0 for unlimited)")
+
+	// Conversion
+	CmdMain.Flags().String("engine", engineImagick, "image engine used for conversions, either imagick or vips")
+	CmdMain.Flags().Int("transient-retries", 2, "number of retries of transient ImageMagick failures, e.g. of Ghostscript")
+	CmdMain.Flags().Duration("transient-backoff", 500*time.Millisecond, "delay before the first retry, doubling with every retry")
+	CmdMain.Flags().Int("breaker-threshold", 5, "consecutive Ghostscript failures that make PDF inputs fail fast (0 to disable)")
+	CmdMain.Flags().Duration("breaker-cooldown", 30*time.Second, "time PDF inputs fail fast before Ghostscript is tried again")
+	CmdMain.Flags().Int64("spill-threshold", 64<<20, "size in bytes beyond which inputs and archives are spilled to disk (0 to disable)")
+	CmdMain.Flags().String("spill-dir", "", "directory of spilled temporary files (empty for the system default)")
+	CmdMain.Flags().String("magick-tmpdir", "", "temporary directory of ImageMagick and its delegates (empty for the default)")
+	CmdMain.Flags().Int64("max-temp-disk", 0, "quota of the temporary directory of ImageMagick in bytes (0 for unlimited)")
+	CmdMain.Flags().Int("batch-max-documents", 1000, "maximum number of documents of batch inputs (0 for unlimited)")
+	CmdMain.Flags().String("entry-name", defaultEntryName, "template used to name Zip archive entries")
+	CmdMain.Flags().Int("page-workers", 0, "number of pages converted in parallel (0 for number of CPUs)")
+	CmdMain.Flags().Duration("page-budget", 0, "time budget per page before it is degraded (0 for unlimited)")
+	CmdMain.Flags().StringSlice("page-budget-ladder", defaultBudgetLadder, "degradation steps as density:quality")
+	CmdMain.Flags().String("watermark", "", "image file composited onto pages if requested")
+	CmdMain.Flags().StringToString("icc-profiles", nil, "ICC profiles selectable per request, as name=path")
+	CmdMain.Flags().Int64("idempotency-cache-size", 256<<20, "total size of responses kept for idempotent retries in bytes (0 to disable)")
+	CmdMain.Flags().Int64("idempotency-max-response", 16<<20, "maximum size of a single response kept for idempotent retries in bytes")
+	CmdMain.Flags().Duration("idempotency-ttl", 24*time.Hour, "time responses are kept for idempotent retries")
+	CmdMain.Flags().Int("session-max", 16, "maximum number of cached editing sessions (0 to disable sessions)")
+	CmdMain.Flags().Duration("session-ttl", 10*time.Minute, "idle time after which an editing session expires")
+	CmdMain.Flags().String("storage", "", "URL of the storage results are kept in for later download, e.g. file:///var/lib/magick-server/results")
+	CmdMain.Flags().Duration("result-ttl", 24*time.Hour, "time after which a stored result expires")
+	CmdMain.Flags().String("result-url-secret", "", "secret presigned result URLs are signed with (empty to disable unless the storage signs them)")
+	CmdMain.Flags().Duration("result-url-ttl", time.Hour, "time after which a presigned result URL expires")
+	CmdMain.Flags().String("upload-dir", "", "directory of resumable uploads (empty to disable resumable uploads)")
+	CmdMain.Flags().Int64("max-upload-size", 1<<30, "maximum size of resumable uploads in bytes (0 for unlimited)")
+	CmdMain.Flags().Duration("upload-ttl", 24*time.Hour, "time after which a resumable upload expires")
+	CmdMain.Flags().String("ghostscript", "gs", "Ghostscript executable used to produce PDF/A documents")
+	CmdMain.Flags().String("pdfa-icc-profile", "/usr/share/color/icc/ghostscript/srgb.icc", "sRGB ICC profile embedded as output intent of PDF/A")
+	CmdMain.Flags().String("raw-decoder", "", "dcraw-compatible executable used to develop RAW camera files (empty to disable)")
+	CmdMain.Flags().String("svg-renderer", "RSVG", "ImageMagick coder used to render SVG inputs, e.g. RSVG or MSVG")
+	CmdMain.Flags().String("tesseract", "tesseract", "Tesseract executable used for text recognition (empty to disable)")
+	CmdMain.Flags().String("vips", "vips", "libvips executable used by the vips engine")
+	CmdMain.Flags().String("zbarimg", "zbarimg", "zbar executable used to scan barcodes")
+	CmdMain.Flags().String("zip-method", "auto", "compression of Zip archive entries, either auto, deflate, or store")
 }
 
 // runMain is called when the main command is used.
-func runMain(_ *cobra.Command, _ []string) {
+func runMain(cmd *cobra.Command, _ []string) {
+	// Prepare temporary directory, unless hardened mode provides one
+	err := prepareTempDir(config().GetString("magick-tmpdir"))
+	if err != nil {
+		slog.Error("Failed to prepare temporary directory", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	// Prepare hardened mode
+	if config().GetBool("hardened") {
+		err := prepareHardened(config().GetString("hardened-root"))
+		if err != nil {
+			slog.Error("Failed to prepare hardened mode", slog.Any("error", err))
+			os.Exit(1) //nolint:revive
+		}
+	}
+
 	// Initialization ImageMagick
 	imagick.Initialize()
 	defer imagick.Terminate()
 
-	// Create routing
+	// Verify hardened mode
+	if config().GetBool("hardened") {
+		err := verifyHardened(config().GetStringSlice("hardened-delegates"))
+		if err != nil {
+			slog.Error("Failed to verify hardened mode", slog.Any("error", err))
+			os.Exit(1) //nolint:revive
+		}
+	}
+
+	// Limit and measure temporary disk
+	tempDisk.start(config().GetInt64("max-temp-disk"))
+
+	// Log formats that depend on optional ImageMagick support
+	logOptionalFormats()
+
+	// Account usage
+	meter := newUsageMeter(
+		config().GetString("usage-tenant-header"), config().GetString("usage-export"), config().GetDuration("usage-export-interval"),
+	)
+
+	// Open audit log
+	audit, err := newAuditLog(
+		config().GetString("audit-log"), []byte(config().GetString("audit-secret")), config().GetString("usage-tenant-header"),
+	)
+	if err != nil {
+		slog.Error("Failed to open audit log", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	// Read TLS configuration
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		slog.Error("Failed to read TLS configuration", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	// Open result storage
+	results, err := newResultStore(
+		config().GetString("storage"), config().GetDuration("result-ttl"),
+		config().GetString("result-url-secret"), config().GetDuration("result-url-ttl"),
+	)
+	if err != nil {
+		slog.Error("Failed to open result storage", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	// Prepare resumable uploads
+	uploads, err := newUploadStore(
+		config().GetString("upload-dir"), config().GetInt64("max-upload-size"), config().GetDuration("upload-ttl"),
+	)
+	if err != nil {
+		slog.Error("Failed to prepare resumable uploads", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	// Create state kept across configuration reloads
+	lim := newLimiter(
+		config().GetInt("max-concurrent"), config().GetInt("max-queued"), config().GetDuration("queue-timeout"),
+		config().GetUint64("max-rss"),
+	)
+
+	replays := newIdempotencyCache(
+		config().GetInt64("idempotency-cache-size"), config().GetInt64("idempotency-max-response"),
+		config().GetDuration("idempotency-ttl"),
+	)
+
+	state := &serverState{
+		limiter:  lim,
+		metrics:  newMetrics(lim),
+		meter:    meter,
+		audit:    audit,
+		sessions: newSessionCache(config().GetInt("session-max"), config().GetDuration("session-ttl")),
+		usage:    newKeyUsage(),
+		life:     &lifecycle{},
+		replays:  replays,
+		results:  results,
+		uploads:  uploads,
+	}
+
+	// Build router from configuration
+	cfg, err := readRouterConfig(config(), state.usage)
+	if err != nil {
+		slog.Error("Failed to read configuration", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	handler := newSwitchHandler(newRouter(state, cfg))
+
+	// Start HTTP servers
+	srv := &http.Server{
+		Addr:      config().GetString("listen"),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	serve(srv, "public")
+
+	admin, err := newAdminServer(
+		config().GetString("admin-listen"), config().GetString("admin-token"), state, config().GetBool("enable-pprof"),
+	)
+	if err != nil {
+		slog.Error("Failed to create admin listener", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	if admin != nil {
+		serve(admin, "admin")
+	}
+
+	// Reload configuration on demand
+	watchReload(handler, state, cmd.Root().Flags())
+
+	// Wait for termination
+	stopped := waitForTermination()
+	defer stopped()
+
+	// Stop server, waiting for conversions in flight
+	state.life.stop()
+
+	slog.Info("Server shutting down gracefully...", slog.Int64("conversions", state.life.active.Load()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), config().GetDuration("shutdown-timeout"))
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Failed to gracefully shut down server",
+			slog.Int64("conversions", state.life.active.Load()), slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	if admin != nil {
+		admin.Shutdown(ctx) //nolint:errcheck
+	}
+
+	// Export remaining usage
+	meter.flush(ctx)
+}
+
+// readPolicies reads and compiles the request policies and the key policies from the given configuration snapshot.
+func readPolicies(v *viper.Viper, usage *keyUsage) ([]*policy, *keyPolicies, error) {
+	var (
+		rules   []policyRule
+		keyList []keyPolicy
+	)
+
+	err := v.UnmarshalKey("policies", &rules)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read request policies: %w", err)
+	}
+
+	policies, err := compilePolicies(rules)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compile request policies: %w", err)
+	}
+
+	err = v.UnmarshalKey("keys", &keyList)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read key policies: %w", err)
+	}
+
+	keys, err := newKeyPolicies(keyList, usage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("compile key policies: %w", err)
+	}
+
+	return policies, keys, nil
+}
+
+// newRouter creates the routing of all endpoints.
+func newRouter(state *serverState, cfg *routerConfig) http.Handler {
 	router := chi.NewRouter()
 
+	router.Use(requestID)
+	router.Use(clientIdentity)
+
+	if cfg.addresses != nil {
+		router.Use(cfg.addresses.filter)
+	}
+
+	router.Use(withSecrets)
 	router.Use(middleware.RedirectSlashes)
 	router.Use(middleware.RealIP)
-	router.Use(httplog.RequestLogger(&httplog.Logger{Logger: slog.Default()}))
+	router.Use(state.metrics.record)
+	router.Use(accessLog)
 	router.Use(middleware.NoCache)
 	router.Use(middleware.Recoverer)
+	router.Use(verifyIntegrity)
+
+	lim := state.limiter
+	if lim != nil {
+		router.Use(lim.hints)
+	}
+
+	router.NotFound(notFoundHandler())
+	router.MethodNotAllowed(methodNotAllowedHandler())
+
+	// Health, readiness, and usage move to the admin listener if there is one
+	public := config().GetString("admin-listen") == ""
+
+	if public {
+		router.Get("/health", healthHandler())
+		router.Get("/readyz", readyzHandler(state.life))
+	}
 
-	router.Get("/health", healthHandler())
 	router.Get("/version", versionHandler())
-	router.Post("/convert", convertHandler())
+	router.Get("/formats", formatsHandler())
 
-	// Start HTTP server
-	srv := &http.Server{
-		Addr:    viper.GetString("listen"),
-		Handler: router,
+	// Presigned result URLs need no request signature
+	sig := newSigner(config().GetStringMapString("hmac-secrets"), config().GetDuration("hmac-max-skew"))
+
+	if state.results != nil {
+		router.With(state.results.presigned(sig)).Get("/results/{id}", getResultHandler(state.results))
 	}
 
-	go func() {
-		err := srv.ListenAndServe()
-		if (err != nil) && (err != http.ErrServerClosed) {
-			slog.Error("Failed to start server", slog.Any("error", err))
-			os.Exit(1) //nolint:revive
+	router.Group(func(r chi.Router) {
+		if sig != nil {
+			r.Use(sig.verify)
 		}
-	}()
 
-	slog.Info("Server is listening...", slog.String("address", srv.Addr))
+		if public {
+			r.Get("/usage", usageHandler(state.meter, false))
+		}
 
-	// Wait for user termination
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+		if state.results != nil {
+			r.Get("/results/{id}/url", signResultHandler(state.results))
+		}
 
-	<-done
+		r.Group(func(r chi.Router) {
+			if state.audit != nil {
+				r.Use(state.audit.record)
+			}
 
-	// Stop server
-	slog.Info("Server shutting down gracefully...")
+			if cfg.keys != nil {
+				r.Use(cfg.keys.enforce)
+			}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+			r.Use(state.meter.record)
 
-	if err := srv.Shutdown(ctx); err != nil {
-		slog.Error("Failed to gracefully shut down server", slog.Any("error", err))
-		os.Exit(1) //nolint:revive
-	}
+			if state.replays != nil {
+				r.Use(state.replays.replay)
+			}
+
+			r.Use(state.life.track)
+
+			// Uploads only transfer data, so they do not wait for a conversion slot
+			uploads := state.uploads
+
+			if uploads != nil {
+				r.Group(func(r chi.Router) {
+					r.Use(tusResumable)
+
+					r.Options("/uploads", optionsUploadHandler(uploads))
+					r.Post("/uploads", createUploadHandler(uploads))
+					r.Head("/uploads/{id}", headUploadHandler(uploads))
+					r.Patch("/uploads/{id}", patchUploadHandler(uploads))
+					r.Delete("/uploads/{id}", deleteUploadHandler(uploads))
+				})
+			}
+
+			r.Group(func(r chi.Router) {
+				if uploads != nil {
+					r.Use(uploads.attach)
+				}
+
+				sessions := state.sessions
+
+				// Describing and removing sessions converts nothing, so it counts against no quota and needs no slot
+				if sessions != nil {
+					r.Get("/sessions/{id}", getSessionHandler(sessions))
+					r.Delete("/sessions/{id}", deleteSessionHandler(sessions))
+				}
+
+				r.Group(func(r chi.Router) {
+					if cfg.keys != nil {
+						r.Use(cfg.keys.quota)
+					}
+
+					if lim != nil {
+						r.Use(lim.limit)
+					}
+
+					policies, tmpl, watermark, profiles := cfg.policies, cfg.entryNameTmpl, cfg.watermark, cfg.profiles
+
+					r.Post("/convert", convertHandler(policies, tmpl, watermark, profiles, cfg.engine, cfg.images, state.results))
+					r.Post("/montage", montageHandler(policies))
+					r.Post("/compare", compareHandler(policies))
+					r.Post("/analyze", analyzeHandler(policies))
+					r.Post("/barcodes", barcodesHandler(policies))
+
+					if sessions != nil {
+						r.Post("/sessions", createSessionHandler(sessions, policies))
+						r.Get("/sessions/{id}/pages/{page}", previewSessionHandler(sessions, policies, watermark, profiles))
+						r.Post("/sessions/{id}/render", renderSessionHandler(sessions, policies, tmpl, watermark, profiles, cfg.engine, state.results))
+					}
+				})
+			})
+		})
+	})
+
+	return router
+}
+
+// serve accepts connections on the address of the server in the background, using TLS if configured.
+func serve(srv *http.Server, name string) {
+	go func() {
+		var err error
+
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+
+		if (err != nil) && (err != http.ErrServerClosed) {
+			slog.Error("Failed to start server", slog.String("server", name), slog.Any("error", err))
+			os.Exit(1) //nolint:revive
+		}
+	}()
+
+	slog.Info("Server is listening...",
+		slog.String("server", name), slog.String("address", srv.Addr), slog.Bool("tls", srv.TLSConfig != nil))
 }
 
 // setup will set up configuration management and logging.
 //
-// Configuration options can be set via the command line, via a configuration file (in the current folder, at
-// "/etc/magck-server/config.yaml" or at "~/.config/magick-server/config.yaml"), and via environment variables
-// (all uppercase and prefixed with "MAGICK_SERVER_").
+// Configuration options can be set via the command line, via a configuration file (given by --config, or in the
+// current folder, at "/etc/magck-server/config.yaml" or at "~/.config/magick-server/config.yaml"), and via environment
+// variables (all uppercase and prefixed with "MAGICK_SERVER_").
 func setup(cmd *cobra.Command, _ []string) error {
-	// Connect all options to Viper
-	err := viper.BindPFlags(cmd.Flags())
+	err := bindConfig(viper.GetViper(), cmd.Root().Flags())
 	if err != nil {
-		return fmt.Errorf("bind command line flags: %w", err)
+		return err
 	}
 
-	// Environment variables
-	viper.SetEnvPrefix("MAGICK_SERVER")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
-	viper.AutomaticEnv()
-
 	// Configuration file
-	viper.SetConfigName("config")
-	viper.AddConfigPath("/etc/magick-server")
-	viper.AddConfigPath("$HOME/.config/magick-server")
-	viper.AddConfigPath(".")
+	if path := viper.GetString("config"); path != "" {
+		viper.SetConfigFile(path)
+
+		err = viper.ReadInConfig()
+		if err != nil {
+			return fmt.Errorf("read configuration file: %w", err)
+		}
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("/etc/magick-server")
+		viper.AddConfigPath("$HOME/.config/magick-server")
+		viper.AddConfigPath(".")
 
-	viper.ReadInConfig() //nolint:errcheck
+		viper.ReadInConfig() //nolint:errcheck
+	}
 
 	// Logging
 	var level slog.Level
@@ -135,17 +522,37 @@ func setup(cmd *cobra.Command, _ []string) error {
 		return fmt.Errorf("parse log level: %w", err)
 	}
 
+	logLevel.Set(level)
+
 	var handler slog.Handler
 
 	if viper.GetBool("log-json") {
 		// Use JSON handler
-		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
 	} else {
 		// Use text handler
-		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+		handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
 	}
 
-	slog.SetDefault(slog.New(handler))
+	handler = newRedactHandler(handler, viper.GetStringSlice("log-redact-keys"))
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	return nil
+}
+
+// bindConfig connects the given options and their environment variables to the given Viper instance.
+func bindConfig(v *viper.Viper, flags *pflag.FlagSet) error {
+	// Connect all options to Viper (which are defined on the root command, even if a subcommand is used)
+	err := v.BindPFlags(flags)
+	if err != nil {
+		return fmt.Errorf("bind command line flags: %w", err)
+	}
+
+	// Environment variables
+	v.SetEnvPrefix("MAGICK_SERVER")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	v.AutomaticEnv()
 
 	return nil
 }
@@ -160,246 +567,123 @@ func main() {
 // healthHandler returns the health status.
 func healthHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Report failing delegates
+		status, circuits := "OK", map[string]circuitState{ghostscriptBreaker.name: ghostscriptBreaker.status()}
+
+		for _, state := range circuits {
+			if state != circuitClosed {
+				status = "DEGRADED"
+			}
+		}
+
 		// Return JSON with health
 		render.Status(r, http.StatusOK)
-		render.JSON(w, r, map[string]any{"status": "OK"})
+		render.JSON(w, r, map[string]any{"status": status, "circuits": circuits})
 	}
 }
 
-// versionHandler returns the server version.
+// versionHandler returns the server version and details about the linked ImageMagick library.
 func versionHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Get a new magick wand to query the library
+		mw := imagick.NewMagickWand()
+		defer mw.Destroy()
+
+		// Query library details
+		magickVersion, _ := imagick.GetVersion()
+		_, quantumDepth := imagick.GetQuantumDepth()
+
+		delegates, err := mw.QueryConfigureOption("DELEGATES")
+		if err != nil {
+			slog.WarnContext(r.Context(), "Failed to query delegates", slog.Any("error", err))
+		}
+
 		// Return JSON with version
 		render.Status(r, http.StatusOK)
-		render.JSON(w, r, Version)
+		render.JSON(w, r, map[string]any{
+			"version":    Version,
+			"commit":     Commit,
+			"build_date": BuildDate,
+			"go_version": runtime.Version(),
+			"imagemagick": map[string]any{
+				"version":       magickVersion,
+				"quantum_depth": quantumDepth,
+				"delegates":     strings.Fields(delegates),
+				"formats":       mw.QueryFormats("*"),
+			},
+		})
 	}
 }
 
-// formatExtensionMap defines the supported output formats and their file extensions.
-var formatExtensionMap = map[string]string{
-	"JPEG": "jpg",  // JPEG File Interchange Format
-	"PNG":  "png",  // Portable Network Graphics
-	"TIFF": "tiff", // Tagged Image File Format
+// formatCapability defines the capabilities of an image format.
+type formatCapability struct {
+	MultiPage bool // MultiPage is true if the format can hold multiple pages.
+	Alpha     bool // Alpha is true if the format can hold an alpha channel.
 }
 
-// layoutType defines the output layout to enforce.
-type layoutType string
-
-const (
-	layoutTypeLandscape layoutType = "LANDSCAPE" // layoutTypeLandscape forces a landscape layout.
-	layoutTypePortrait  layoutType = "PORTRAIT"  // layoutTypePortrait forces a portrait layout.
-	layoutTypeKeep      layoutType = "KEEP"      // layoutTypeKeep keeps the original layout.
-)
+// formatCapabilityMap defines the capabilities of well-known formats.
+var formatCapabilityMap = map[string]formatCapability{
+	"BMP":  {MultiPage: false, Alpha: true},
+	"GIF":  {MultiPage: true, Alpha: true},
+	"HEIC": {MultiPage: true, Alpha: true},
+	"ICO":  {MultiPage: true, Alpha: true},
+	"J2K":  {MultiPage: false, Alpha: true},
+	"JPEG": {MultiPage: false, Alpha: false},
+	"JXL":  {MultiPage: false, Alpha: true},
+	"JP2":  {MultiPage: false, Alpha: true},
+	"PDF":  {MultiPage: true, Alpha: true},
+	"PNG":  {MultiPage: false, Alpha: true},
+	"PS":   {MultiPage: true, Alpha: false},
+	"PSD":  {MultiPage: true, Alpha: true},
+	"SVG":  {MultiPage: false, Alpha: true},
+	"TIFF": {MultiPage: true, Alpha: true},
+	"WEBP": {MultiPage: true, Alpha: true},
+	"XCF":  {MultiPage: true, Alpha: true},
+}
 
-// convertHandler converts a (multi-page) image into a Zip archive.
-func convertHandler() http.HandlerFunc { //nolint
+// formatsHandler returns the supported input and output formats.
+func formatsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Parse density
-		density := 300.0
-
-		if v := r.URL.Query().Get("density"); v != "" {
-			d, err := strconv.ParseFloat(v, 64)
-			if err != nil {
-				slog.Error("Failed to parse validate density", slog.Any("error", err), slog.String("value", v))
-				render.Status(r, http.StatusBadRequest)
-				render.JSON(w, r, map[string]any{"error": "invalid density"})
-				return
-			}
-
-			density = d
-		}
-
-		// Parse compression quality
-		quality := uint(85)
-
-		if v := r.URL.Query().Get("quality"); v != "" {
-			q, err := strconv.ParseUint(v, 10, 64)
-			if err != nil {
-				slog.Error("Failed to parse compression quality", slog.Any("error", err), slog.String("value", v))
-				render.Status(r, http.StatusBadRequest)
-				render.JSON(w, r, map[string]any{"error": "invalid compression quality"})
-				return
-			}
-
-			quality = uint(q)
-		}
-
-		// Parse output format
-		format := "JPEG"
-
-		if v := r.URL.Query().Get("format"); v != "" {
-			v = strings.ToUpper(v)
-			if _, ok := formatExtensionMap[v]; !ok {
-				slog.Error("Failed to parse output format", slog.String("value", v))
-				render.Status(r, http.StatusBadRequest)
-				render.JSON(w, r, map[string]any{"error": "invalid output format"})
-				return
-			}
-
-			format = v
-		}
-
-		// Parse output layout
-		layout := layoutTypeKeep
-
-		if v := r.URL.Query().Get("layout"); v != "" {
-			v = strings.ToUpper(v)
-			if (v != string(layoutTypeLandscape)) && (v != string(layoutTypePortrait)) && (v != string(layoutTypeKeep)) {
-				slog.Error("Failed to parse output layout", slog.String("value", v))
-				render.Status(r, http.StatusBadRequest)
-				render.JSON(w, r, map[string]any{"error": "invalid output layout"})
-				return
-			}
-
-			layout = layoutType(v)
-		}
-
-		// Read request body
-		in, err := io.ReadAll(r.Body)
-		if err != nil {
-			slog.Error("Failed to read request body", slog.Any("error", err))
-			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, map[string]any{"error": "failed to read request body"})
-			return
-		}
-
-		// Get a new magick wand
+		// Get a new magick wand to query the library
 		mw := imagick.NewMagickWand()
 		defer mw.Destroy()
 
-		// Set density
-		err = mw.SetResolution(density, density)
-		if err != nil {
-			slog.Error("Failed to set density", slog.Any("error", err))
-			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, map[string]any{"error": "failed to set density"})
-			return
-		}
-
-		// Read image
-		err = mw.ReadImageBlob(in)
-		if err != nil {
-			slog.Error("Failed to read image", slog.Any("error", err))
-			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, map[string]any{"error": "failed to read image"})
-			return
-		}
-
-		// Set up Zip archive
-		buf := &bytes.Buffer{}
-		zipWriter := zip.NewWriter(buf)
-
-		zipWriter.RegisterCompressor(zip.Deflate, func(o io.Writer) (io.WriteCloser, error) {
-			return flate.NewWriter(o, flate.BestSpeed)
-		})
-
-		// Iterate through all pages
-		mw.ResetIterator()
-
-		for page := 0; mw.NextImage(); page++ {
-			// Pull current image into its own magick wand
-			mwi := mw.GetImage()
-			defer mwi.Destroy()
-
-			// Flatten image
-			mwm := mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
-			defer mwm.Destroy()
-
-			// Set compression quality
-			err = mwm.SetImageCompressionQuality(quality)
-			if err != nil {
-				slog.Error("Failed to set compression quality", slog.Any("error", err), slog.Any("quality", quality))
-				render.Status(r, http.StatusInternalServerError)
-				render.JSON(w, r, map[string]any{"error": "failed to set compression quality"})
-				return
-			}
+		// Collect input formats known to the library
+		input := []map[string]any{}
 
-			// Set output format
-			err = mwm.SetImageFormat(format)
-			if err != nil {
-				slog.Error("Failed to set output format", slog.Any("error", err), slog.String("format", format))
-				render.Status(r, http.StatusInternalServerError)
-				render.JSON(w, r, map[string]any{"error": "failed to set output format"})
-				return
+		for _, name := range mw.QueryFormats("*") {
+			if !formatAvailable(name) {
+				continue
 			}
 
-			// Force output layout
-			switch layout {
-			case layoutTypeLandscape:
-				// Get dimensions
-				width := mwm.GetImageWidth()
-				height := mwm.GetImageHeight()
-
-				if width < height {
-					// Rotate image
-					err := mwm.RotateImage(imagick.NewPixelWand(), -90.0)
-					if err != nil {
-						slog.Error("Failed to rotate image", slog.Any("error", err))
-						render.Status(r, http.StatusInternalServerError)
-						render.JSON(w, r, map[string]any{"error": "failed to rotate image"})
-						return
-					}
-				}
-
-			case layoutTypePortrait:
-				// Get dimensions
-				width := mwm.GetImageWidth()
-				height := mwm.GetImageHeight()
-
-				if height < width {
-					// Rotate image
-					err := mwm.RotateImage(imagick.NewPixelWand(), -90.0)
-					if err != nil {
-						slog.Error("Failed to rotate image", slog.Any("error", err))
-						render.Status(r, http.StatusInternalServerError)
-						render.JSON(w, r, map[string]any{"error": "failed to rotate image"})
-						return
-					}
-				}
-
-			case layoutTypeKeep:
-				// Do nothing
-			}
+			c := formatCapabilityMap[name]
+			input = append(input, map[string]any{"name": name, "multi_page": c.MultiPage, "alpha": c.Alpha})
+		}
 
-			// Get output blob
-			out, err := mwm.GetImageBlob()
-			if err != nil {
-				slog.Error("Failed to get output blob", slog.Any("error", err))
-				render.Status(r, http.StatusInternalServerError)
-				render.JSON(w, r, map[string]any{"error": "failed to set output format"})
-				return
+		// Collect output formats allowed by the server
+		names := make([]string, 0, len(formatExtensionMap))
+		for name := range formatExtensionMap {
+			if outputFormatAvailable(name) {
+				names = append(names, name)
 			}
+		}
 
-			// Create new Zip archive entry
-			f, err := zipWriter.Create(fmt.Sprintf("%04d.%s", page, formatExtensionMap[format]))
-			if err != nil {
-				slog.Error("Failed to create new Zip archive entry", slog.Any("error", err))
-				render.Status(r, http.StatusInternalServerError)
-				render.JSON(w, r, map[string]any{"error": "failed to create new Zip archive entry"})
-				return
-			}
+		sort.Strings(names)
 
-			// Write image into Zip archive
-			_, err = f.Write(out)
-			if err != nil {
-				slog.Error("Failed to write image into Zip archive", slog.Any("error", err))
-				render.Status(r, http.StatusInternalServerError)
-				render.JSON(w, r, map[string]any{"error": "failed to write image into Zip archive"})
-				return
-			}
-		}
+		output := []map[string]any{}
 
-		// Close Zip archive
-		err = zipWriter.Close()
-		if err != nil {
-			slog.Error("Failed to close Zip archive", slog.Any("error", err))
-			render.Status(r, http.StatusInternalServerError)
-			render.JSON(w, r, map[string]any{"error": "failed to close Zip archive"})
-			return
+		for _, name := range names {
+			c := formatCapabilityMap[name]
+			output = append(output, map[string]any{
+				"name":       name,
+				"extension":  formatExtensionMap[name],
+				"multi_page": c.MultiPage,
+				"alpha":      c.Alpha,
+			})
 		}
 
-		// We're good
+		// Return JSON with formats
 		render.Status(r, http.StatusOK)
-		render.Data(w, r, buf.Bytes())
+		render.JSON(w, r, map[string]any{"input": input, "output": output})
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+)
+
+// manifestName is the name of the manifest entry within the Zip archive.
+const manifestName = "manifest.json"
+
+// manifestPage defines the metadata of a single output image.
+type manifestPage struct {
+	Filename   string `json:"filename"`              // Filename is the name of the Zip archive entry.
+	Page       int    `json:"page"`                  // Page is the zero-based index of the source page.
+	Half       string `json:"half,omitempty"`        // Half is the half of the source page if pages are split.
+	Rendition  uint   `json:"rendition,omitempty"`   // Rendition is the requested width of the rendition, if requested.
+	Width      uint   `json:"width"`                 // Width is the width of the output image in pixels.
+	Height     uint   `json:"height"`                // Height is the height of the output image in pixels.
+	Size       int    `json:"size"`                  // Size is the size of the output image in bytes.
+	SHA256     string `json:"sha256"`                // SHA256 is the hex-encoded SHA-256 digest of the output image.
+	Text       string `json:"text,omitempty"`        // Text is the name of the entry holding the recognized text, if any.
+	TextSHA256 string `json:"text_sha256,omitempty"` // TextSHA256 is the hex-encoded SHA-256 digest of the recognized text.
+
+	Degraded *pageDegradation `json:"degraded,omitempty"` // Degraded is set if the page exceeded its time budget.
+}
+
+// manifestDocument defines the metadata of a single document of a batch input, or a single file of a multipart request.
+type manifestDocument struct {
+	Name       string          `json:"name"`                 // Name is the name of the document or file.
+	Folder     string          `json:"folder,omitempty"`     // Folder is the folder holding the output images.
+	Parameters *convertOptions `json:"parameters,omitempty"` // Parameters are the options of files with overrides.
+	Input      *inputReport    `json:"input,omitempty"`      // Input is the sanitization report, if requested.
+	Pages      []manifestPage  `json:"pages,omitempty"`      // Pages lists all output images, in order.
+	Error      *errorResponse  `json:"error,omitempty"`      // Error describes why the document could not be converted.
+}
+
+// manifest defines the content of the manifest entry.
+type manifest struct {
+	Parameters convertOptions     `json:"parameters"`          // Parameters are the applied conversion options.
+	Input      *inputReport       `json:"input,omitempty"`     // Input is the sanitization report of the input, if requested.
+	Pages      []manifestPage     `json:"pages,omitempty"`     // Pages lists all output images, in order.
+	Documents  []manifestDocument `json:"documents,omitempty"` // Documents lists all documents of batch inputs, in order.
+}
+
+// newManifestPage collects the metadata of the given output image.
+func newManifestPage(filename string, res pageResult) manifestPage {
+	return manifestPage{
+		Filename:  filename,
+		Page:      res.data.Page,
+		Half:      res.data.Half,
+		Rendition: res.data.Size,
+		Width:     res.data.Width,
+		Height:    res.data.Height,
+		Size:      len(res.out),
+		SHA256:    sha256Hex(res.out),
+		Degraded:  res.degraded,
+	}
+}
+
+// marshal encodes the manifest as indented JSON.
+func (m *manifest) marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	return b, nil
+}
+
+// writeManifest writes the manifest as entry into the archive, encrypted like all other entries.
+func (aw *archiveWriter) writeManifest(m *manifest) error {
+	b, err := m.marshal()
+	if err != nil {
+		return err
+	}
+
+	err = aw.write(manifestName, zip.Deflate, b)
+	if err != nil {
+		return fmt.Errorf("write manifest entry: %w", err)
+	}
+
+	return nil
+}
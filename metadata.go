@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// metadataMode defines how the metadata of the source pages is carried over into the output images.
+type metadataMode string
+
+const (
+	metadataModeKeep     metadataMode = "KEEP"      // metadataModeKeep preserves EXIF, XMP, and IPTC metadata.
+	metadataModeStrip    metadataMode = "STRIP"     // metadataModeStrip removes all metadata except the ICC profile.
+	metadataModeStripGPS metadataMode = "STRIP-GPS" // metadataModeStripGPS only removes location data.
+)
+
+// fieldsPart is the name of the multipart part that may supply metadata fields to write into the output images.
+const fieldsPart = "fields"
+
+const (
+	exifHeader     = "Exif\x00\x00" // exifHeader prefixes the TIFF structure of EXIF profiles.
+	exifGPSInfoTag = 0x8825         // exifGPSInfoTag is the tag of the IFD0 entry pointing at the GPS IFD.
+)
+
+// exifTypeSizes defines the sizes of the values of all TIFF field types, by type.
+var exifTypeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// xmpEmptyPacket is an XMP packet without any properties.
+const xmpEmptyPacket = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>" +
+	`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`</rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+
+// xmpRDFEnd is the end tag of the RDF of XMP packets, before which descriptions are inserted.
+const xmpRDFEnd = "</rdf:RDF>"
+
+// xmpGPSProperties matches the names of all GPS properties of XMP packets.
+const xmpGPSProperties = `(?:exif|exifEX):GPS\w*`
+
+// xmpNamespaces defines the XMP namespaces that can be used without being declared, by prefix.
+var xmpNamespaces = map[string]string{
+	"dc":        "http://purl.org/dc/elements/1.1/",
+	"photoshop": "http://ns.adobe.com/photoshop/1.0/",
+	"xmp":       "http://ns.adobe.com/xap/1.0/",
+	"xmpRights": "http://ns.adobe.com/xap/1.0/rights/",
+}
+
+// xmpFieldAliases defines short names of common metadata fields, and the XMP properties they are written to.
+var xmpFieldAliases = map[string]string{
+	"creator":     "dc:creator",
+	"description": "dc:description",
+	"rights":      "dc:rights",
+	"title":       "dc:title",
+}
+
+// xmpArrayTypes defines the XMP properties whose values are arrays, and the type of the array.
+var xmpArrayTypes = map[string]string{
+	"dc:creator":     "Seq",
+	"dc:description": "Alt",
+	"dc:rights":      "Alt",
+	"dc:title":       "Alt",
+}
+
+// xmpName matches namespace prefixes and local names of XMP properties.
+var xmpName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,63}$`)
+
+// fieldsOptions defines the metadata fields written into the output images.
+type fieldsOptions struct {
+	Properties map[string]string `json:"properties"`           // Properties are the values of all XMP properties, by name.
+	Namespaces map[string]string `json:"namespaces,omitempty"` // Namespaces are the declared XMP namespaces, by prefix.
+}
+
+// parseMetadataMode parses how metadata is carried over.
+func parseMetadataMode(v string) (metadataMode, *apiError) {
+	mode := metadataMode(strings.ToUpper(v))
+
+	switch mode {
+	case "":
+		return metadataModeKeep, nil
+
+	case metadataModeKeep, metadataModeStrip, metadataModeStripGPS:
+		return mode, nil
+	}
+
+	return "", newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid metadata parameter", nil)
+}
+
+// applyMetadataMode strips the metadata of the page as requested. The ICC profile is always retained, since it
+// defines the colors of the page.
+func applyMetadataMode(mw *imagick.MagickWand, mode metadataMode) error {
+	switch mode {
+	case metadataModeStrip:
+		icc := mw.GetImageProfile("icc")
+
+		err := mw.StripImage()
+		if err != nil {
+			return fmt.Errorf("strip metadata: %w", err)
+		}
+
+		if len(icc) > 0 {
+			err = mw.SetImageProfile("icc", []byte(icc))
+			if err != nil {
+				return fmt.Errorf("restore ICC profile: %w", err)
+			}
+		}
+
+	case metadataModeStripGPS:
+		if exif := mw.GetImageProfile("exif"); len(exif) > 0 {
+			err := mw.SetImageProfile("exif", stripEXIFGPS([]byte(exif)))
+			if err != nil {
+				return fmt.Errorf("set EXIF profile: %w", err)
+			}
+		}
+
+		if xmp := mw.GetImageProfile("xmp"); len(xmp) > 0 {
+			err := mw.SetImageProfile("xmp", stripXMPGPS([]byte(xmp)))
+			if err != nil {
+				return fmt.Errorf("set XMP profile: %w", err)
+			}
+		}
+
+		for _, name := range mw.GetImageProperties("exif:GPS*") {
+			mw.DeleteImageProperty(name) //nolint:errcheck
+		}
+
+	case metadataModeKeep:
+	}
+
+	return nil
+}
+
+// stripEXIFGPS empties the GPS IFD of the EXIF profile: all of its entries and their values are zeroed, and its entry
+// count is set to zero. The profile is returned unchanged if it is malformed or has no GPS IFD.
+func stripEXIFGPS(exif []byte) []byte {
+	tiff := bytes.TrimPrefix(exif, []byte(exifHeader))
+	if len(tiff) < 8 {
+		return exif
+	}
+
+	// Determine byte order
+	var bo binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return exif
+	}
+
+	// Find GPS IFD
+	gps := findIFDEntry(tiff, bo, bo.Uint32(tiff[4:8]), exifGPSInfoTag)
+	if (gps < 0) || (uint64(gps)+2 > uint64(len(tiff))) {
+		return exif
+	}
+
+	out := bytes.Clone(exif)
+	tiff = out[len(exif)-len(tiff):]
+
+	// Zero all entries and their values
+	n := uint32(bo.Uint16(tiff[gps:]))
+
+	for i := uint32(0); i < n; i++ {
+		entry := uint64(gps) + 2 + uint64(i)*12
+		if entry+12 > uint64(len(tiff)) {
+			break
+		}
+
+		size := uint64(exifTypeSizes[bo.Uint16(tiff[entry+2:])]) * uint64(bo.Uint32(tiff[entry+4:]))
+		if offset := uint64(bo.Uint32(tiff[entry+8:])); (size > 4) && (offset+size <= uint64(len(tiff))) {
+			clear(tiff[offset : offset+size])
+		}
+
+		clear(tiff[entry : entry+12])
+	}
+
+	bo.PutUint16(tiff[gps:], 0)
+
+	return out
+}
+
+// findIFDEntry returns the value of the entry with the given tag in the IFD at the given offset, interpreted as an
+// offset, or -1 if there is no such entry.
+func findIFDEntry(tiff []byte, bo binary.ByteOrder, ifd uint32, tag uint16) int64 {
+	if uint64(ifd)+2 > uint64(len(tiff)) {
+		return -1
+	}
+
+	n := uint64(bo.Uint16(tiff[ifd:]))
+
+	for i := uint64(0); i < n; i++ {
+		entry := uint64(ifd) + 2 + i*12
+		if entry+12 > uint64(len(tiff)) {
+			return -1
+		}
+
+		if bo.Uint16(tiff[entry:]) == tag {
+			return int64(bo.Uint32(tiff[entry+8:]))
+		}
+	}
+
+	return -1
+}
+
+// stripXMPGPS removes all GPS properties from the XMP packet.
+func stripXMPGPS(xmp []byte) []byte {
+	return removeXMPProperties(xmp, xmpGPSProperties)
+}
+
+// removeXMPProperties removes all properties whose name matches the pattern from the XMP packet, whether they are
+// written as attributes or as elements.
+func removeXMPProperties(xmp []byte, pattern string) []byte {
+	attr := regexp.MustCompile(`\s` + pattern + `\s*=\s*("[^"]*"|'[^']*')`)
+	elem := regexp.MustCompile(`(?s)<` + pattern + `(?:\s[^>]*)?/>|<` + pattern + `(?:\s[^>]*)?>.*?</` + pattern + `>`)
+
+	xmp = attr.ReplaceAll(xmp, nil)
+	return elem.ReplaceAll(xmp, nil)
+}
+
+// attachFields attaches the metadata fields supplied as multipart part to the options. The part is a JSON object of
+// string values: keys are either the alias of a common field (e.g. "title"), the qualified name of an XMP property
+// (e.g. "dc:source" or "dam:assetId"), or the declaration of a custom namespace (e.g. "xmlns:dam").
+func attachFields(opts *convertOptions, in *input) *apiError {
+	invalid := func(message string) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, message, nil)
+	}
+
+	part, ok := in.parts[fieldsPart]
+	if !ok {
+		return nil
+	}
+
+	var fields map[string]string
+
+	err := json.Unmarshal(part, &fields)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid metadata fields", err)
+	}
+
+	namespaces, aerr := parseFieldNamespaces(fields)
+	if aerr != nil {
+		return aerr
+	}
+
+	fo := &fieldsOptions{Properties: map[string]string{}, Namespaces: namespaces}
+
+	// Collect properties
+	for k, v := range fields {
+		if strings.HasPrefix(k, "xmlns:") {
+			continue
+		}
+
+		if alias, ok := xmpFieldAliases[k]; ok {
+			k = alias
+		}
+
+		prefix, name, ok := strings.Cut(k, ":")
+		if !ok || !xmpName.MatchString(name) {
+			return invalid("invalid metadata field " + k)
+		}
+
+		if _, ok := xmpNamespaces[prefix]; !ok && (fo.Namespaces[prefix] == "") {
+			return invalid("undeclared namespace of metadata field " + k)
+		}
+
+		if _, ok := fo.Properties[k]; ok {
+			return invalid("duplicate metadata field " + k)
+		}
+
+		fo.Properties[k] = v
+	}
+
+	if len(fo.Properties) > 0 {
+		opts.Fields = fo
+	}
+
+	return nil
+}
+
+// parseFieldNamespaces parses the declarations of custom namespaces among the metadata fields, by prefix. The
+// prefixes of predefined namespaces and those reserved by XML and RDF cannot be declared.
+func parseFieldNamespaces(fields map[string]string) (map[string]string, *apiError) {
+	namespaces := map[string]string{}
+
+	for k, v := range fields {
+		prefix, ok := strings.CutPrefix(k, "xmlns:")
+		if !ok {
+			continue
+		}
+
+		_, predefined := xmpNamespaces[prefix]
+		reserved := strings.HasPrefix(strings.ToLower(prefix), "xml") || (prefix == "rdf") || (prefix == "x")
+
+		if u, err := url.Parse(v); (err != nil) || !u.IsAbs() || !xmpName.MatchString(prefix) || predefined || reserved {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid metadata namespace "+prefix, err)
+		}
+
+		namespaces[prefix] = v
+	}
+
+	return namespaces, nil
+}
+
+// writeFields writes the metadata fields into the XMP packet of the page. Properties of an existing packet are
+// replaced by the fields of the same name, all others are retained. A new packet is created if the page has none.
+func writeFields(mw *imagick.MagickWand, opts *fieldsOptions) error {
+	xmp := []byte(mw.GetImageProfile("xmp"))
+
+	if bytes.Contains(xmp, []byte(xmpRDFEnd)) {
+		for name := range opts.Properties {
+			xmp = removeXMPProperties(xmp, regexp.QuoteMeta(name))
+		}
+	} else {
+		xmp = []byte(xmpEmptyPacket)
+	}
+
+	// Insert description of all fields
+	end := bytes.LastIndex(xmp, []byte(xmpRDFEnd))
+	xmp = slices.Concat(xmp[:end], xmpDescription(opts), xmp[end:])
+
+	err := mw.SetImageProfile("xmp", xmp)
+	if err != nil {
+		return fmt.Errorf("set XMP profile: %w", err)
+	}
+
+	return nil
+}
+
+// xmpDescription returns an RDF description of all metadata fields, declaring all namespaces used.
+func xmpDescription(opts *fieldsOptions) []byte {
+	var b bytes.Buffer
+
+	escape := func(v string) {
+		xml.EscapeText(&b, []byte(v)) //nolint:errcheck
+	}
+
+	names := make([]string, 0, len(opts.Properties))
+	for name := range opts.Properties {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	// Declare namespaces
+	b.WriteString(`<rdf:Description rdf:about=""`)
+
+	declared := map[string]bool{}
+
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(name, ":")
+		if declared[prefix] {
+			continue
+		}
+
+		ns, ok := xmpNamespaces[prefix]
+		if !ok {
+			ns = opts.Namespaces[prefix]
+		}
+
+		b.WriteString(" xmlns:" + prefix + `="`)
+		escape(ns)
+		b.WriteString(`"`)
+
+		declared[prefix] = true
+	}
+
+	b.WriteString(">")
+
+	// Write properties
+	for _, name := range names {
+		b.WriteString("<" + name + ">")
+
+		switch t := xmpArrayTypes[name]; t {
+		case "":
+			escape(opts.Properties[name])
+
+		case "Alt":
+			b.WriteString(`<rdf:Alt><rdf:li xml:lang="x-default">`)
+			escape(opts.Properties[name])
+			b.WriteString(`</rdf:li></rdf:Alt>`)
+
+		default:
+			b.WriteString("<rdf:" + t + "><rdf:li>")
+			escape(opts.Properties[name])
+			b.WriteString("</rdf:li></rdf:" + t + ">")
+		}
+
+		b.WriteString("</" + name + ">")
+	}
+
+	b.WriteString("</rdf:Description>")
+
+	return b.Bytes()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// unmatchedRoute is the route label of requests that did not match any endpoint.
+const unmatchedRoute = "unmatched"
+
+// requestSeries identifies a series of requests by method, route pattern, and status.
+type requestSeries struct {
+	method string
+	route  string
+	status int
+}
+
+// requestStats defines the number and total duration of requests in a series.
+type requestStats struct {
+	count    uint64
+	duration time.Duration
+}
+
+// metrics collects metrics of the public endpoints and exposes them in the Prometheus text format.
+type metrics struct {
+	limiter  *limiter     // limiter is the conversion limiter, if concurrency is limited.
+	inFlight atomic.Int64 // inFlight is the number of requests currently handled.
+
+	mu       sync.Mutex
+	requests map[requestSeries]*requestStats // requests are the completed requests, by series.
+}
+
+// newMetrics creates a new metrics collector, reporting the state of the given limiter if any.
+func newMetrics(lim *limiter) *metrics {
+	return &metrics{limiter: lim, requests: map[requestSeries]*requestStats{}}
+}
+
+// record is a middleware that counts the request and its duration, by method, route pattern, and status.
+func (m *metrics) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		next.ServeHTTP(ww, r)
+
+		// Route pattern is only known once the request has been routed
+		route := unmatchedRoute
+
+		if rctx := chi.RouteContext(r.Context()); (rctx != nil) && (rctx.RoutePattern() != "") {
+			route = rctx.RoutePattern()
+		}
+
+		m.add(requestSeries{method: r.Method, route: route, status: ww.Status()}, time.Since(start))
+	})
+}
+
+// add counts a completed request.
+func (m *metrics) add(s requestSeries, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests[s] == nil {
+		m.requests[s] = &requestStats{}
+	}
+
+	m.requests[s].count++
+	m.requests[s].duration += d
+}
+
+// write writes all metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	// Copy request series, sorted
+	m.mu.Lock()
+
+	series := make([]requestSeries, 0, len(m.requests))
+	stats := make(map[requestSeries]requestStats, len(m.requests))
+
+	for s, st := range m.requests {
+		series = append(series, s)
+		stats[s] = *st
+	}
+
+	m.mu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+
+		if a.route != b.route {
+			return a.route < b.route
+		}
+
+		if a.method != b.method {
+			return a.method < b.method
+		}
+
+		return a.status < b.status
+	})
+
+	// Requests
+	writeMetricHeader(w, "magick_server_http_requests_total", "counter", "Number of completed HTTP requests.")
+
+	for _, s := range series {
+		fmt.Fprintf(w, "magick_server_http_requests_total{%s} %d\n", s.labels(), stats[s].count)
+	}
+
+	writeMetricHeader(w, "magick_server_http_request_duration_seconds", "summary", "Duration of HTTP requests.")
+
+	for _, s := range series {
+		fmt.Fprintf(w, "magick_server_http_request_duration_seconds_sum{%s} %s\n", s.labels(), formatSeconds(stats[s].duration))
+		fmt.Fprintf(w, "magick_server_http_request_duration_seconds_count{%s} %d\n", s.labels(), stats[s].count)
+	}
+
+	writeMetricHeader(w, "magick_server_http_requests_in_flight", "gauge", "Number of HTTP requests currently handled.")
+	fmt.Fprintf(w, "magick_server_http_requests_in_flight %d\n", m.inFlight.Load())
+
+	// Conversion slots
+	if m.limiter != nil {
+		writeMetricHeader(w, "magick_server_conversions_active", "gauge", "Number of conversions currently running.")
+		fmt.Fprintf(w, "magick_server_conversions_active %d\n", m.limiter.active.Load())
+
+		writeMetricHeader(w, "magick_server_conversions_limit", "gauge", "Current limit of concurrent conversions.")
+		fmt.Fprintf(w, "magick_server_conversions_limit %d\n", m.limiter.current.Load())
+
+		writeMetricHeader(w, "magick_server_conversions_queued", "gauge", "Number of requests waiting for a conversion.")
+		fmt.Fprintf(w, "magick_server_conversions_queued %d\n", m.limiter.queued.Load())
+	}
+
+	// Wand pool
+	writeMetricHeader(w, "magick_server_wands_created_total", "counter", "Number of magick wands allocated by the pool.")
+	fmt.Fprintf(w, "magick_server_wands_created_total %d\n", wandsCreated.Load())
+
+	writeMetricHeader(w, "magick_server_wands_acquired_total", "counter", "Number of magick wands taken from the pool.")
+	fmt.Fprintf(w, "magick_server_wands_acquired_total %d\n", wandsAcquired.Load())
+
+	// Circuit breakers
+	open := 0
+	if ghostscriptBreaker.status() == circuitOpen {
+		open = 1
+	}
+
+	writeMetricHeader(w, "magick_server_circuit_open", "gauge", "Whether the circuit breaker of a delegate is open.")
+	fmt.Fprintf(w, "magick_server_circuit_open{delegate=%q} %d\n", ghostscriptBreaker.name, open)
+
+	// Temporary disk
+	writeMetricHeader(w, "magick_server_temp_disk_bytes", "gauge", "Size of temporary files of ImageMagick in bytes.")
+	fmt.Fprintf(w, "magick_server_temp_disk_bytes %d\n", tempDisk.usage.Load())
+
+	if tempDisk.quota > 0 {
+		writeMetricHeader(w, "magick_server_temp_disk_quota_bytes", "gauge", "Quota of temporary files of ImageMagick in bytes.")
+		fmt.Fprintf(w, "magick_server_temp_disk_quota_bytes %d\n", tempDisk.quota)
+	}
+
+	// Runtime
+	var mem runtime.MemStats
+
+	runtime.ReadMemStats(&mem)
+
+	writeMetricHeader(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	writeMetricHeader(w, "go_memstats_heap_inuse_bytes", "gauge", "Number of heap bytes that are in use.")
+	fmt.Fprintf(w, "go_memstats_heap_inuse_bytes %d\n", mem.HeapInuse)
+
+	writeMetricHeader(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	fmt.Fprintf(w, "go_memstats_sys_bytes %d\n", mem.Sys)
+}
+
+// labels returns the Prometheus labels of the series.
+func (s requestSeries) labels() string {
+	return fmt.Sprintf("method=%q,route=%q,status=%q", s.method, s.route, strconv.Itoa(s.status))
+}
+
+// writeMetricHeader writes the help and type lines of a metric.
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatSeconds formats a duration as seconds.
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// metricsHandler responds with all metrics in the Prometheus text format.
+func metricsHandler(m *metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		m.write(w)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file into memory, copy-on-write, so the file is never modified. It returns the mapped data and a
+// function that releases the mapping.
+func mapFile(f *os.File) ([]byte, func(), error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat file: %w", err)
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(st.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, fmt.Errorf("map file: %w", err)
+	}
+
+	return data, func() { syscall.Munmap(data) }, nil //nolint:errcheck
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// mapFile reads the file into memory, since mapping files is not supported on Windows. It returns the data and a
+// function that does nothing.
+func mapFile(f *os.File) ([]byte, func(), error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, nil, fmt.Errorf("seek file: %w", err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read file: %w", err)
+	}
+
+	return data, func() {}, nil
+}
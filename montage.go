@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	maxMontageColumns = 32   // maxMontageColumns is the largest supported number of columns of a contact sheet.
+	maxMontageTile    = 2048 // maxMontageTile is the largest supported tile width and height in pixels.
+	montageSpacing    = 8    // montageSpacing is the distance between tiles in pixels.
+)
+
+// montageTile matches tile sizes such as "256x256".
+var montageTile = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// montageOptions defines the layout of a contact sheet.
+type montageOptions struct {
+	Columns    uint   // Columns is the number of tiles per row.
+	TileWidth  uint   // TileWidth is the maximum width of a tile in pixels.
+	TileHeight uint   // TileHeight is the maximum height of a tile in pixels.
+	Label      string // Label is the label drawn below each tile, or empty for none.
+}
+
+// parseMontageOptions parses the contact sheet URL parameters.
+func parseMontageOptions(query url.Values) (*montageOptions, *apiError) {
+	invalid := func(name string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	opts := &montageOptions{Columns: 4, TileWidth: 256, TileHeight: 256, Label: "{page}"}
+
+	// Parse columns
+	if v := query.Get("columns"); v != "" {
+		c, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (c < 1) || (c > maxMontageColumns) {
+			return nil, invalid("columns", err)
+		}
+
+		opts.Columns = uint(c)
+	}
+
+	// Parse tile size
+	if v := query.Get("tile"); v != "" {
+		m := montageTile.FindStringSubmatch(v)
+		if m == nil {
+			return nil, invalid("tile", nil)
+		}
+
+		w, _ := strconv.ParseUint(m[1], 10, 32)
+		h, _ := strconv.ParseUint(m[2], 10, 32)
+
+		if (w < 1) || (h < 1) || (w > maxMontageTile) || (h > maxMontageTile) {
+			return nil, invalid("tile", nil)
+		}
+
+		opts.TileWidth, opts.TileHeight = uint(w), uint(h)
+	}
+
+	// Parse labels
+	if v := query.Get("label"); v != "" {
+		_, err := expandPlaceholders(v, map[string]any{"page": 1, "total": 1})
+		if (err != nil) || (utf8.RuneCountInString(v) > maxTextLength) {
+			return nil, invalid("label", err)
+		}
+
+		opts.Label = v
+	}
+
+	if query.Get("labels") != "" {
+		labels, aerr := parseBoolQuery(query, "labels")
+		if aerr != nil {
+			return nil, aerr
+		}
+
+		if !labels {
+			opts.Label = ""
+		}
+	}
+
+	return opts, nil
+}
+
+// montageHandler converts a (multi-page) image into a single contact sheet showing all pages.
+func montageHandler(policies []*policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options
+		opts, aerr := parseConvertOptions(r)
+
+		var mo *montageOptions
+		if aerr == nil {
+			mo, aerr = parseMontageOptions(r.URL.Query())
+		}
+
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body
+		in, aerr := readInput(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Read image
+		mw, aerr := readWand(r.Context(), in, opts)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read image", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		defer releaseWand(mw)
+
+		// Enforce page limit
+		pages := int(mw.GetNumberImages())
+
+		if (pol.MaxPages > 0) && (uint(pages) > pol.MaxPages) {
+			slog.ErrorContext(r.Context(), "Page limit exceeded", slog.Int("pages", pages), slog.Uint64("limit", uint64(pol.MaxPages)))
+			renderError(w, r, http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded")
+			return
+		}
+
+		// Assemble contact sheet
+		out, err := montagePages(mw, pages, opts, mo)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to assemble contact sheet", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to assemble contact sheet")
+			return
+		}
+
+		// We're good
+		w.Header().Set("Content-Type", formatMediaTypeMap[opts.Format])
+		w.WriteHeader(http.StatusOK)
+		w.Write(out) //nolint:errcheck
+	}
+}
+
+// montagePages flattens all pages, shrinks them to the tile size, and assembles them into a single contact sheet.
+func montagePages(mw *imagick.MagickWand, pages int, opts convertOptions, mo *montageOptions) ([]byte, error) {
+	// Collect tiles
+	tiles := acquireWand()
+	defer releaseWand(tiles)
+
+	for page := 0; page < pages; page++ {
+		mw.SetIteratorIndex(page)
+
+		tile, err := montageTilePage(mw.GetImage(), page, pages, opts, mo)
+		if err != nil {
+			return nil, fmt.Errorf("prepare tile of page %d: %w", page, err)
+		}
+
+		err = tiles.AddImage(tile)
+		tile.Destroy()
+
+		if err != nil {
+			return nil, fmt.Errorf("add tile: %w", err)
+		}
+	}
+
+	// Assemble sheet, with labels scaled to the tile size
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+
+	dw.SetFontSize(max(8.0, float64(mo.TileWidth)/20.0))
+
+	tiles.ResetIterator()
+
+	sheet := tiles.MontageImage(dw, fmt.Sprintf("%dx", mo.Columns),
+		fmt.Sprintf("%dx%d>+%d+%d", mo.TileWidth, mo.TileHeight, montageSpacing, montageSpacing),
+		imagick.MONTAGE_MODE_UNFRAME, "0x0")
+	defer sheet.Destroy()
+
+	if err := tiles.GetLastError(); err != nil {
+		return nil, fmt.Errorf("montage images: %w", err)
+	}
+
+	// Encode sheet
+	err := sheet.SetImageFormat(opts.Format)
+	if err != nil {
+		return nil, fmt.Errorf("set output format: %w", err)
+	}
+
+	err = sheet.SetImageCompressionQuality(opts.Quality)
+	if err != nil {
+		return nil, fmt.Errorf("set compression quality: %w", err)
+	}
+
+	return sheet.GetImageBlob()
+}
+
+// montageTilePage flattens the page, shrinks it to fit the tile, and labels it. The given wand is destroyed.
+func montageTilePage(
+	mwi *imagick.MagickWand, page, pages int, opts convertOptions, mo *montageOptions,
+) (*imagick.MagickWand, error) {
+	defer mwi.Destroy()
+
+	// Flatten page
+	err := prepareAlpha(mwi, opts)
+	if err != nil {
+		return nil, fmt.Errorf("prepare alpha channel: %w", err)
+	}
+
+	tile := mwi.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+
+	// Shrink page to fit the tile
+	width, height := tile.GetImageWidth(), tile.GetImageHeight()
+	scale := min(float64(mo.TileWidth)/float64(width), float64(mo.TileHeight)/float64(height))
+
+	if scale < 1.0 {
+		err = tile.ThumbnailImage(max(1, uint(float64(width)*scale)), max(1, uint(float64(height)*scale)))
+		if err != nil {
+			tile.Destroy()
+			return nil, fmt.Errorf("shrink page: %w", err)
+		}
+	}
+
+	// Label page
+	if mo.Label != "" {
+		label, _ := expandPlaceholders(mo.Label, map[string]any{"page": page + 1, "total": pages})
+
+		err = tile.SetImageProperty("label", label)
+		if err != nil {
+			tile.Destroy()
+			return nil, fmt.Errorf("set label: %w", err)
+		}
+	}
+
+	return tile, nil
+}
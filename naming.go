@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultEntryName is the template used to name Zip archive entries if none is configured.
+const defaultEntryName = `{{printf "%04d" .Page}}.{{.Ext}}`
+
+// entryNameData defines the page metadata available to entry name templates.
+type entryNameData struct {
+	Basename string // Basename is the original filename of the upload without extension.
+	Page     int    // Page is the zero-based index of the page.
+	Pages    int    // Pages is the total number of pages.
+	Part     int    // Part is the zero-based index of the output image within the page (0 unless pages are split).
+	Half     string // Half is the half of a split page (e.g. "left"), or empty unless pages are split.
+	Size     uint   // Size is the requested width of the rendition, or 0 unless renditions are requested.
+	Format   string // Format is the output format (e.g. "JPEG").
+	Ext      string // Ext is the file extension of the output format (e.g. "jpg").
+	Width    uint   // Width is the width of the output image in pixels.
+	Height   uint   // Height is the height of the output image in pixels.
+	Gray     bool   // Gray is true if the page only contains shades of gray.
+	Bilevel  bool   // Bilevel is true if the page only contains black and white.
+}
+
+// newEntryNameData collects the metadata of the given page.
+func newEntryNameData(mw *imagick.MagickWand, page, pages int, format string) entryNameData {
+	typ := imagick.IdentifyImageType(mw)
+
+	return entryNameData{
+		Page:   page,
+		Pages:  pages,
+		Format: format,
+		Ext:    formatExtensionMap[format],
+		Width:  mw.GetImageWidth(),
+		Height: mw.GetImageHeight(),
+		Gray: (typ == imagick.IMAGE_TYPE_BILEVEL) || (typ == imagick.IMAGE_TYPE_GRAYSCALE) ||
+			(typ == imagick.IMAGE_TYPE_GRAYSCALE_ALPHA),
+		Bilevel: typ == imagick.IMAGE_TYPE_BILEVEL,
+	}
+}
+
+// parseEntryName parses an entry name template. Templates use the syntax of Go's text/template package and are
+// evaluated against entryNameData, e.g. `{{if .Gray}}gray{{else}}color{{end}}/{{.Page}}.{{.Ext}}`.
+func parseEntryName(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultEntryName
+	}
+
+	tmpl, err := template.New("entry-name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// entryName evaluates the template for the given page and returns a clean, relative entry name.
+func entryName(tmpl *template.Template, data entryNameData) (string, error) {
+	var buf bytes.Buffer
+
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("execute template: %w", err)
+	}
+
+	return cleanEntryName(buf.String())
+}
+
+// cleanEntryName turns the given name into a relative entry name that stays within the archive and can be extracted on
+// all common platforms.
+func cleanEntryName(raw string) (string, error) {
+	if strings.HasSuffix(raw, "/") {
+		return "", fmt.Errorf("invalid entry name %q", raw)
+	}
+
+	// Normalize and sanitize all path segments
+	name := norm.NFC.String(strings.ToValidUTF8(strings.ReplaceAll(raw, "\\", "/"), "_"))
+
+	var segments []string
+
+	for _, seg := range strings.Split(path.Clean("/"+name), "/") {
+		if seg = sanitizeSegment(seg); seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+
+	if len(segments) == 0 {
+		return "", fmt.Errorf("invalid entry name %q", raw)
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// sanitizeSegment replaces characters that are not allowed in filenames on common platforms, and removes leading and
+// trailing dots and spaces.
+func sanitizeSegment(seg string) string {
+	seg = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) || strings.ContainsRune(`<>:"|?*`, c) {
+			return '_'
+		}
+
+		return c
+	}, seg)
+
+	return strings.Trim(seg, ". ")
+}
+
+// defaultBasename is used as basename if the original filename of the upload is unknown.
+const defaultBasename = "image"
+
+// uploadBasename returns the original filename without directory and extension. Names that would refer to a directory
+// instead, such as "..", fall back to defaultBasename, since batches use the basename as folder of their output images.
+func uploadBasename(filename string) string {
+	base := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	base = strings.TrimSuffix(base, path.Ext(base))
+
+	if (base == "") || (base == ".") || (base == "..") || strings.Contains(base, "/") {
+		return defaultBasename
+	}
+
+	return base
+}
+
+// filenamePlaceholder matches placeholders of filename templates and text annotations, such as "{page:03d}".
+var filenamePlaceholder = regexp.MustCompile(`\{(\w+)(?::([^}]*))?\}`)
+
+// filenameSpec matches the supported format specifications of integer placeholders.
+var filenameSpec = regexp.MustCompile(`^0?[0-9]{0,2}d$`)
+
+// expandFilenameTemplate expands a filename template such as "{basename}-{page:03d}.{ext}". The placeholders
+// "basename", "format", "ext", and "half" are strings; "page", "pages", "part", "size", "width", and "height" are
+// integers that accept a format specification such as "03d".
+func expandFilenameTemplate(text string, data entryNameData) (string, error) {
+	name, err := expandPlaceholders(text, map[string]any{
+		"basename": data.Basename,
+		"format":   data.Format,
+		"ext":      data.Ext,
+		"page":     data.Page,
+		"pages":    data.Pages,
+		"part":     data.Part,
+		"size":     data.Size,
+		"half":     data.Half,
+		"width":    data.Width,
+		"height":   data.Height,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return cleanEntryName(name)
+}
+
+// expandPlaceholders replaces all placeholders such as "{page}" or "{page:03d}" in the text by the given values.
+// String values do not accept a format specification, integer values accept specifications such as "03d".
+func expandPlaceholders(text string, values map[string]any) (string, error) {
+	var firstErr error
+
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	expanded := filenamePlaceholder.ReplaceAllStringFunc(text, func(m string) string {
+		sub := filenamePlaceholder.FindStringSubmatch(m)
+		key, spec := sub[1], sub[2]
+
+		// Look up value
+		value, ok := values[key]
+		if !ok {
+			fail(fmt.Errorf("unknown placeholder %q", key))
+			return m
+		}
+
+		// Format value
+		if str, ok := value.(string); ok {
+			if spec != "" {
+				fail(fmt.Errorf("placeholder %q does not accept a format", key))
+			}
+
+			return str
+		}
+
+		if spec == "" {
+			spec = "d"
+		}
+
+		if !filenameSpec.MatchString(spec) {
+			fail(fmt.Errorf("invalid format %q of placeholder %q", spec, key))
+			return m
+		}
+
+		return fmt.Sprintf("%"+spec, value)
+	})
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+
+	return expanded, nil
+}
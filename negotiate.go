@@ -0,0 +1,149 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	zipMediaType = "application/zip"   // zipMediaType is the media type of Zip archive responses.
+	tarMediaType = "application/x-tar" // tarMediaType is the media type of tar archive responses.
+)
+
+// mediaRange defines a single media range of the Accept header, with its quality.
+type mediaRange struct {
+	mediaType string  // mediaType is the media type, which may be a wildcard like "image/*" or "*/*".
+	q         float64 // q is the quality of the range, from 0 (not acceptable) to 1.
+}
+
+// parseAccept parses the media ranges of all Accept headers of the request. Malformed ranges are skipped.
+func parseAccept(r *http.Request) []mediaRange {
+	var ranges []mediaRange
+
+	for _, header := range r.Header.Values("Accept") {
+		for _, v := range strings.Split(header, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+
+			mr := mediaRange{mediaType: mediaType, q: 1}
+
+			if v, ok := params["q"]; ok {
+				q, err := strconv.ParseFloat(v, 64)
+				if (err != nil) || !((q >= 0) && (q <= 1)) {
+					continue
+				}
+
+				mr.q = q
+			}
+
+			ranges = append(ranges, mr)
+		}
+	}
+
+	return ranges
+}
+
+// quality returns the quality of the media type according to the most specific matching range, or 0 if none matches.
+func quality(ranges []mediaRange, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, 0
+
+	for _, mr := range ranges {
+		s := 0
+
+		switch mr.mediaType {
+		case mediaType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+
+		if s > specificity {
+			q, specificity = mr.q, s
+		}
+	}
+
+	return q
+}
+
+// negotiate returns the offered media type with the highest quality according to the Accept header, preferring earlier
+// offers on ties, or false if none is acceptable. Requests without Accept header accept the first offer.
+func negotiate(r *http.Request, offers []string) (string, bool) {
+	ranges := parseAccept(r)
+	if len(ranges) == 0 {
+		return offers[0], true
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, offer := range offers {
+		if q := quality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, (best != "")
+}
+
+// negotiateResponse picks the response to a conversion from the Accept header: a Zip or tar archive, JSON, or the
+// output image of a single page. JSON requests are answered with their output images as JSON, other requests with the
+// description of the stored Zip archive. Stored results and single-file outputs are not negotiated.
+func negotiateResponse(r *http.Request, opts *convertOptions, batch bool) *apiError {
+	if opts.Store || opts.singleFile() {
+		return nil
+	}
+
+	offers := []string{zipMediaType, tarMediaType, jsonMediaType}
+	if isJSONRequest(r) {
+		offers = []string{jsonMediaType, zipMediaType, tarMediaType}
+	}
+
+	if !batch {
+		offers = append(offers, formatMediaTypeMap[opts.Format])
+	}
+
+	mediaType, ok := negotiate(r, offers)
+	if !ok {
+		message := "response must be one of " + strings.Join(offers, ", ")
+		return newAPIError(http.StatusNotAcceptable, errorCodeNotAcceptable, message, nil)
+	}
+
+	opts.Response = mediaType
+	opts.Store = (mediaType == jsonMediaType) && !isJSONRequest(r)
+
+	return nil
+}
+
+// isImageResponse returns true if the output image of a single page was negotiated as response.
+func (o convertOptions) isImageResponse() bool {
+	return strings.HasPrefix(o.Response, "image/")
+}
+
+// checkImageResponse fails if the output image of a single page was negotiated as response, but there is not exactly
+// one output image.
+func checkImageResponse(opts convertOptions, results int) *apiError {
+	if opts.isImageResponse() && (results != 1) {
+		return newAPIError(http.StatusNotAcceptable, errorCodeNotAcceptable, opts.Response+" requires a single output image", nil)
+	}
+
+	return nil
+}
+
+// renderImage responds with the output image of a single page, which must be the only output image.
+func renderImage(w http.ResponseWriter, r *http.Request, results []pageResult, opts convertOptions) {
+	if aerr := checkImageResponse(opts, len(results)); aerr != nil {
+		renderAPIError(w, r, aerr)
+		return
+	}
+
+	setChecksumHeaders(w, results[0].out)
+	w.Header().Set("Content-Type", formatMediaTypeMap[results[0].data.Format])
+	w.WriteHeader(http.StatusOK)
+	w.Write(results[0].out) //nolint:errcheck
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ocrMode defines the output of text recognition.
+type ocrMode string
+
+const (
+	ocrModePDF  ocrMode = "PDF"  // ocrModePDF produces a searchable PDF with an invisible text layer.
+	ocrModeHOCR ocrMode = "HOCR" // ocrModeHOCR adds an hOCR document per page to the Zip archive.
+	ocrModeText ocrMode = "TEXT" // ocrModeText adds the plain text per page to the Zip archive.
+)
+
+// ocrModeExtensionMap defines the file extensions of the text recognized per page.
+var ocrModeExtensionMap = map[ocrMode]string{
+	ocrModeHOCR: "hocr",
+	ocrModeText: "txt",
+}
+
+// ocrLanguages matches Tesseract language lists such as "eng+deu".
+var ocrLanguages = regexp.MustCompile(`^[a-z][a-z_]{2,31}(\+[a-z][a-z_]{2,31}){0,7}$`)
+
+// ocrOptions defines the options of text recognition.
+type ocrOptions struct {
+	Mode      ocrMode `json:"mode"`      // Mode is the output of text recognition.
+	Languages string  `json:"languages"` // Languages are the Tesseract languages, e.g. "eng+deu".
+}
+
+// ocrEngine defines the Tesseract installation used for text recognition.
+type ocrEngine struct {
+	path string // path is the path of the Tesseract executable.
+}
+
+// detectOCR looks up the Tesseract executable. It returns nil if Tesseract is disabled or not installed.
+func detectOCR(name string) *ocrEngine {
+	if name == "" {
+		return nil
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		slog.Warn("Text recognition not available", slog.String("tesseract", name), slog.Any("error", err))
+		return nil
+	}
+
+	slog.Info("Text recognition available", slog.String("tesseract", path))
+
+	return &ocrEngine{path: path}
+}
+
+// parseOCROptions parses the text recognition URL parameters. It returns nil if text recognition is not requested. Text
+// is recognized in the converted pages, so it cannot be combined with assembling pages into other documents.
+func parseOCROptions(query url.Values, opts convertOptions) (*ocrOptions, *apiError) {
+	invalid := func(message string) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, message, nil)
+	}
+
+	// Parse mode
+	var mode ocrMode
+
+	switch v := strings.ToUpper(query.Get("ocr")); v {
+	case "", "FALSE":
+		return nil, nil
+	case "TRUE", string(ocrModePDF):
+		mode = ocrModePDF
+	case string(ocrModeHOCR), string(ocrModeText):
+		mode = ocrMode(v)
+	default:
+		return nil, invalid("invalid ocr parameter")
+	}
+
+	if (opts.Animate != nil) || opts.PDFA || (len(opts.Sizes) > 0) {
+		return nil, invalid("ocr cannot be combined with animate, PDF/A, or sizes")
+	}
+
+	if (mode == ocrModePDF) && (len(opts.Formats) > 0) {
+		return nil, invalid("searchable PDF requires a single format")
+	}
+
+	// Parse languages
+	languages := "eng"
+
+	if v := query.Get("ocr-lang"); v != "" {
+		if !ocrLanguages.MatchString(v) {
+			return nil, invalid("invalid ocr-lang parameter")
+		}
+
+		languages = v
+	}
+
+	return &ocrOptions{Mode: mode, Languages: languages}, nil
+}
+
+// checkOCR fails if text recognition is requested, but Tesseract is not installed.
+func checkOCR(opts *ocrOptions, engine *ocrEngine) *apiError {
+	if (opts != nil) && (engine == nil) {
+		return newAPIError(http.StatusNotImplemented, errorCodeOCRUnavailable, "text recognition is not available", nil)
+	}
+
+	return nil
+}
+
+// recognizeText recognizes the text of the converted pages if requested. Searchable PDFs are responded with directly,
+// otherwise the text is attached to the results. It returns false if a response has been written.
+func recognizeText(w http.ResponseWriter, r *http.Request, engine *ocrEngine, results []pageResult, opts convertOptions) bool {
+	if opts.OCR == nil {
+		return true
+	}
+
+	if opts.OCR.Mode == ocrModePDF {
+		renderSearchablePDF(w, r, engine, results, opts)
+		return false
+	}
+
+	err := recognizePages(r.Context(), engine, results, opts)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to recognize text", slog.Any("error", err))
+		renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to recognize text")
+
+		return false
+	}
+
+	return true
+}
+
+// recognizePages recognizes the text of all pages of the first output format, using a bounded number of processes.
+func recognizePages(ctx context.Context, engine *ocrEngine, results []pageResult, opts convertOptions) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	sem := make(chan struct{}, pageWorkers())
+
+	for i := range results {
+		if results[i].data.Format != opts.Format {
+			continue
+		}
+
+		sem <- struct{}{}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			text, err := runCommand(ctx, engine.path, ocrArgs("stdin", "stdout", opts.OCR), results[i].out)
+			if err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if firstErr == nil {
+					firstErr = fmt.Errorf("recognize page %d: %w", results[i].data.Page, err)
+				}
+
+				return
+			}
+
+			results[i].text = text
+		}()
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// renderSearchablePDF assembles the converted pages into a PDF with an invisible text layer and responds with it.
+func renderSearchablePDF(w http.ResponseWriter, r *http.Request, engine *ocrEngine, results []pageResult, opts convertOptions) {
+	out, err := assembleSearchablePDF(r.Context(), engine, results, opts.OCR)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to assemble searchable PDF", slog.Any("error", err))
+		renderError(w, r, http.StatusInternalServerError, errorCodeEncodeFailed, "failed to assemble searchable PDF")
+		return
+	}
+
+	setChecksumHeaders(w, out)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out) //nolint:errcheck
+}
+
+// assembleSearchablePDF has Tesseract recognize the text of all pages, in order, and assemble them into a single PDF.
+func assembleSearchablePDF(ctx context.Context, engine *ocrEngine, results []pageResult, opts *ocrOptions) ([]byte, error) {
+	// Write pages and list
+	dir, err := os.MkdirTemp("", "magick-server-ocr-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	var list strings.Builder
+
+	for i, res := range results {
+		name := filepath.Join(dir, fmt.Sprintf("%04d.%s", i, res.data.Ext))
+
+		err := os.WriteFile(name, res.out, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("write page: %w", err)
+		}
+
+		list.WriteString(name + "\n")
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "pages.txt"), []byte(list.String()), 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("write page list: %w", err)
+	}
+
+	// Recognize text, Tesseract appends the extension to the output base
+	_, err = runCommand(ctx, engine.path, ocrArgs(filepath.Join(dir, "pages.txt"), filepath.Join(dir, "out"), opts), nil)
+	if err != nil {
+		return nil, fmt.Errorf("recognize pages: %w", err)
+	}
+
+	out, err := os.ReadFile(filepath.Join(dir, "out.pdf"))
+	if err != nil {
+		return nil, fmt.Errorf("read searchable PDF: %w", err)
+	}
+
+	return out, nil
+}
+
+// ocrArgs returns the Tesseract arguments producing the output of the given mode.
+func ocrArgs(in, out string, opts *ocrOptions) []string {
+	args := []string{in, out, "-l", opts.Languages}
+
+	switch opts.Mode {
+	case ocrModePDF:
+		args = append(args, "pdf")
+	case ocrModeHOCR:
+		args = append(args, "hocr")
+	case ocrModeText:
+	}
+
+	return args
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	formatPDFA      = "PDFA" // formatPDFA assembles all pages into a single PDF/A-2b document.
+	pdfaFrameFormat = "JPEG" // pdfaFrameFormat is the format pages are encoded in before assembly.
+)
+
+// pdfaDefinition is the PostScript prologue that makes Ghostscript embed the sRGB output intent required by PDF/A.
+const pdfaDefinition = `%%!
+/ICCProfile (%s) def
+[/_objdef {icc_PDFA} /type /stream /OBJ pdfmark
+[{icc_PDFA} << /N 3 >> /PUT pdfmark
+[{icc_PDFA} ICCProfile (r) file /PUT pdfmark
+[/_objdef {OutputIntent_PDFA} /type /dict /OBJ pdfmark
+[{OutputIntent_PDFA} <<
+  /Type /OutputIntent
+  /S /GTS_PDFA1
+  /DestOutputProfile {icc_PDFA}
+  /OutputConditionIdentifier (sRGB)
+>> /PUT pdfmark
+[{Catalog} << /OutputIntents [ {OutputIntent_PDFA} ] >> /PUT pdfmark
+`
+
+// errGhostscriptUnavailable is returned by assemblePDFA while the circuit breaker of Ghostscript is open.
+var errGhostscriptUnavailable = errors.New("circuit breaker of Ghostscript is open")
+
+// renderPDFA assembles the converted pages into a PDF/A document and responds with it.
+func renderPDFA(w http.ResponseWriter, r *http.Request, results []pageResult, density float64) {
+	out, err := assemblePDFA(r.Context(), results, density)
+	if errors.Is(err, errGhostscriptUnavailable) {
+		renderError(w, r, http.StatusServiceUnavailable, errorCodeCircuitOpen, "Ghostscript unavailable")
+		return
+	}
+
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to assemble PDF/A document", slog.Any("error", err))
+		renderError(w, r, http.StatusInternalServerError, errorCodeEncodeFailed, "failed to assemble PDF/A document")
+		return
+	}
+
+	setChecksumHeaders(w, out)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out) //nolint:errcheck
+}
+
+// assemblePDFA assembles the converted pages, in order, into a PDF document, and has Ghostscript turn it into a
+// PDF/A-2b document with an embedded sRGB output intent.
+func assemblePDFA(ctx context.Context, results []pageResult, density float64) ([]byte, error) {
+	// Assemble plain PDF
+	pdf, err := assemblePDF(results, density)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write input files
+	dir, err := os.MkdirTemp("", "magick-server-pdfa-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	profile := config().GetString("pdfa-icc-profile")
+	definition := fmt.Sprintf(pdfaDefinition, escapePostScript(profile))
+
+	err = os.WriteFile(filepath.Join(dir, "pdfa.ps"), []byte(definition), 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("write definition: %w", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "in.pdf"), pdf, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("write PDF: %w", err)
+	}
+
+	// Convert to PDF/A, failing fast while Ghostscript keeps failing
+	if !ghostscriptBreaker.allow() {
+		return nil, errGhostscriptUnavailable
+	}
+
+	_, err = runCommand(ctx, config().GetString("ghostscript"), []string{
+		"-dPDFA=2", "-dBATCH", "-dNOPAUSE", "-dQUIET", "-dSAFER",
+		"-dPDFACompatibilityPolicy=1",
+		"-sColorConversionStrategy=RGB",
+		"-sDEVICE=pdfwrite",
+		"--permit-file-read=" + profile,
+		"-sOutputFile=" + filepath.Join(dir, "out.pdf"),
+		filepath.Join(dir, "pdfa.ps"),
+		filepath.Join(dir, "in.pdf"),
+	}, nil)
+
+	ghostscriptBreaker.record(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("convert to PDF/A: %w", err)
+	}
+
+	out, err := os.ReadFile(filepath.Join(dir, "out.pdf"))
+	if err != nil {
+		return nil, fmt.Errorf("read PDF/A: %w", err)
+	}
+
+	return out, nil
+}
+
+// assemblePDF assembles the converted pages, in order, into a single PDF document with the given density.
+func assemblePDF(results []pageResult, density float64) ([]byte, error) {
+	mw := acquireWand()
+	defer releaseWand(mw)
+
+	for _, res := range results {
+		err := mw.ReadImageBlob(res.out)
+		if err != nil {
+			return nil, fmt.Errorf("read page: %w", err)
+		}
+
+		// Keep page size of degraded pages
+		d := density
+		if res.degraded != nil {
+			d = res.degraded.Density
+		}
+
+		err = mw.SetImageUnits(imagick.RESOLUTION_PIXELS_PER_INCH)
+		if err != nil {
+			return nil, fmt.Errorf("set page units: %w", err)
+		}
+
+		err = mw.SetImageResolution(d, d)
+		if err != nil {
+			return nil, fmt.Errorf("set page density: %w", err)
+		}
+	}
+
+	mw.ResetIterator()
+
+	err := mw.SetFormat("PDF")
+	if err != nil {
+		return nil, fmt.Errorf("set document format: %w", err)
+	}
+
+	return mw.GetImagesBlob()
+}
+
+// escapePostScript escapes the given string for use in a PostScript string literal.
+func escapePostScript(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// pageInfo defines the position of a page within the document.
+type pageInfo struct {
+	index      int                    // index is the zero-based index of the page.
+	count      int                    // count is the total number of pages.
+	colorspace imagick.ColorspaceType // colorspace is the colorspace of the source page.
+}
+
+// pageOperation defines a single step of the conversion of a flattened page. Operations only see the magick wand, the
+// conversion options, and the position of the page, so they can be tested in isolation (see the testsupport package).
+type pageOperation struct {
+	name  string                                                               // name describes the operation.
+	apply func(mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error // apply performs the operation.
+}
+
+// pageOperations defines all operations applied to a page, in order.
+var pageOperations = []pageOperation{
+	{
+		name: "mirror page",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			return mirrorPage(mw, opts.Flip, opts.Flop)
+		},
+	},
+	{
+		name: "rotate page",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error {
+			if opts.Rotate == nil {
+				return nil
+			}
+
+			return rotatePage(mw, opts.Rotate.pageAngle(pi), rotateBackground(opts))
+		},
+	},
+	{
+		name: "crop image",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Crop == nil {
+				return nil
+			}
+
+			return applyCropOptions(mw, opts.Crop)
+		},
+	},
+	{
+		name: "rotate image",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			return forceLayout(mw, opts.Layout)
+		},
+	},
+	{
+		name: "filter image",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Filter == nil {
+				return nil
+			}
+
+			return applyFilterOptions(mw, opts.Filter)
+		},
+	},
+	{
+		name: "adjust image",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Adjust == nil {
+				return nil
+			}
+
+			return applyAdjustOptions(mw, opts.Adjust)
+		},
+	},
+	{
+		name: "convert tone",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Tone == nil {
+				return nil
+			}
+
+			return applyToneOptions(mw, opts.Tone)
+		},
+	},
+	{
+		name: "apply watermark",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Watermark == nil {
+				return nil
+			}
+
+			return applyWatermark(mw, opts.Watermark)
+		},
+	},
+	{
+		name: "annotate text",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error {
+			if opts.Text == nil {
+				return nil
+			}
+
+			return applyTextOptions(mw, opts.Text, pi)
+		},
+	},
+	{
+		name: "apply ICC profile",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Profile == nil {
+				return nil
+			}
+
+			return applyProfile(mw, opts.Profile)
+		},
+	},
+	{
+		name: "restore colorspace",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error {
+			if !opts.KeepColorspace || (opts.Tone != nil) || (opts.Profile != nil) {
+				return nil
+			}
+
+			return restoreColorspace(mw, pi.colorspace)
+		},
+	},
+	{
+		name: "strip metadata",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			return applyMetadataMode(mw, opts.Metadata)
+		},
+	},
+	{
+		name: "write metadata fields",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if opts.Fields == nil {
+				return nil
+			}
+
+			return writeFields(mw, opts.Fields)
+		},
+	},
+}
+
+// encodeOperations defines all operations preparing a processed page for encoding, in order. They are applied once per
+// output format, with opts.Format set to the format being encoded.
+var encodeOperations = []pageOperation{
+	{
+		name: "set compression quality",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			return mw.SetImageCompressionQuality(opts.Quality)
+		},
+	},
+	{
+		name: "set output format",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			return mw.SetImageFormat(opts.Format)
+		},
+	},
+	{
+		name: "set JPEG options",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if (opts.Format != "JPEG") || (opts.JPEG == nil) {
+				return nil
+			}
+
+			return applyJPEGOptions(mw, opts.JPEG)
+		},
+	},
+	{
+		name: "set PNG options",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if (opts.Format != "PNG") || (opts.PNG == nil) {
+				return nil
+			}
+
+			return applyPNGOptions(mw, opts.PNG)
+		},
+	},
+	{
+		name: "set JPEG XL options",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if (opts.Format != "JXL") || (opts.JXL == nil) {
+				return nil
+			}
+
+			return applyJXLOptions(mw, opts.JXL)
+		},
+	},
+	{
+		name: "set JPEG 2000 options",
+		apply: func(mw *imagick.MagickWand, opts convertOptions, _ pageInfo) error {
+			if ((opts.Format != "JP2") && (opts.Format != "J2K")) || (opts.JP2 == nil) {
+				return nil
+			}
+
+			return applyJP2Options(mw, opts.JP2)
+		},
+	},
+}
+
+// applyPageOperations applies all page operations to the given flattened page.
+func applyPageOperations(mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error {
+	return applyOperations(pageOperations, mw, opts, pi)
+}
+
+// applyOperations applies the given operations to the page.
+func applyOperations(ops []pageOperation, mw *imagick.MagickWand, opts convertOptions, pi pageInfo) error {
+	for _, op := range ops {
+		err := op.apply(mw, opts, pi)
+		if err != nil {
+			return newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to "+op.name, err)
+		}
+	}
+
+	return nil
+}
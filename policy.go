@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// policyRule defines a request policy as read from the configuration.
+type policyRule struct {
+	Name     string            `mapstructure:"name"`      // Name is used to refer to the rule in logs.
+	When     string            `mapstructure:"when"`      // When is the condition that has to hold for the rule to apply.
+	Deny     bool              `mapstructure:"deny"`      // Deny rejects matching requests.
+	Set      map[string]string `mapstructure:"set"`       // Set forces request parameters to the given values.
+	MaxPages uint              `mapstructure:"max-pages"` // MaxPages limits the number of pages of matching requests.
+}
+
+// policyOperator defines a comparison operator of a policy condition.
+type policyOperator string
+
+const (
+	policyOperatorEqual        policyOperator = "=="     // policyOperatorEqual matches equal values.
+	policyOperatorNotEqual     policyOperator = "!="     // policyOperatorNotEqual matches different values.
+	policyOperatorLess         policyOperator = "<"      // policyOperatorLess matches smaller numbers.
+	policyOperatorLessEqual    policyOperator = "<="     // policyOperatorLessEqual matches smaller or equal numbers.
+	policyOperatorGreater      policyOperator = ">"      // policyOperatorGreater matches larger numbers.
+	policyOperatorGreaterEqual policyOperator = ">="     // policyOperatorGreaterEqual matches larger or equal numbers.
+	policyOperatorIn           policyOperator = "in"     // policyOperatorIn matches values contained in a list.
+	policyOperatorNotIn        policyOperator = "not in" // policyOperatorNotIn matches values not contained in a list.
+)
+
+// policyCondition defines a single comparison of a request value against one or more operands.
+type policyCondition struct {
+	subject  string
+	operator policyOperator
+	operands []string
+}
+
+// policy defines a compiled request policy.
+type policy struct {
+	rule       policyRule
+	conditions []policyCondition
+}
+
+// policyResult defines the outcome of evaluating all policies against a request.
+type policyResult struct {
+	Denied   string // Denied is the name of the rule that denied the request, if any.
+	MaxPages uint   // MaxPages is the lowest page limit of all matching rules, or 0 if unlimited.
+}
+
+// compilePolicies compiles the given rules, in order.
+func compilePolicies(rules []policyRule) ([]*policy, error) {
+	policies := make([]*policy, 0, len(rules))
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i)
+		}
+
+		conditions, err := parsePolicyConditions(rule.When)
+		if err != nil {
+			return nil, fmt.Errorf("parse condition of policy %s: %w", rule.Name, err)
+		}
+
+		policies = append(policies, &policy{rule: rule, conditions: conditions})
+	}
+
+	return policies, nil
+}
+
+// parsePolicyConditions parses a condition string such as `density > 600 && header.X-Tenant in [a, b]`. An empty string
+// yields no conditions, which means the rule always applies.
+func parsePolicyConditions(when string) ([]policyCondition, error) {
+	var conditions []policyCondition
+
+	for _, clause := range strings.Split(when, "&&") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			if strings.TrimSpace(when) != "" {
+				return nil, fmt.Errorf("empty clause in %q", when)
+			}
+
+			continue
+		}
+
+		c, err := parsePolicyCondition(clause)
+		if err != nil {
+			return nil, err
+		}
+
+		conditions = append(conditions, c)
+	}
+
+	return conditions, nil
+}
+
+// parsePolicyCondition parses a single clause of a condition string.
+func parsePolicyCondition(clause string) (policyCondition, error) {
+	// Operators are ordered such that longer operators are matched first
+	operators := []policyOperator{
+		policyOperatorNotIn, policyOperatorIn,
+		policyOperatorEqual, policyOperatorNotEqual, policyOperatorLessEqual, policyOperatorGreaterEqual,
+		policyOperatorLess, policyOperatorGreater,
+	}
+
+	for _, op := range operators {
+		sep := string(op)
+		if (op == policyOperatorIn) || (op == policyOperatorNotIn) {
+			sep = " " + sep + " "
+		}
+
+		subject, operand, ok := strings.Cut(clause, sep)
+		if !ok {
+			continue
+		}
+
+		subject = strings.TrimSpace(subject)
+		operand = strings.TrimSpace(operand)
+
+		if subject == "" || operand == "" {
+			return policyCondition{}, fmt.Errorf("incomplete clause %q", clause)
+		}
+
+		// List operands
+		if (op == policyOperatorIn) || (op == policyOperatorNotIn) {
+			if !strings.HasPrefix(operand, "[") || !strings.HasSuffix(operand, "]") {
+				return policyCondition{}, fmt.Errorf("expected list in clause %q", clause)
+			}
+
+			var operands []string
+			for _, v := range strings.Split(operand[1:len(operand)-1], ",") {
+				operands = append(operands, strings.TrimSpace(v))
+			}
+
+			return policyCondition{subject: subject, operator: op, operands: operands}, nil
+		}
+
+		// Numeric operands
+		if (op != policyOperatorEqual) && (op != policyOperatorNotEqual) {
+			if _, err := strconv.ParseFloat(operand, 64); err != nil {
+				return policyCondition{}, fmt.Errorf("expected number in clause %q", clause)
+			}
+		}
+
+		return policyCondition{subject: subject, operator: op, operands: []string{operand}}, nil
+	}
+
+	return policyCondition{}, fmt.Errorf("missing operator in clause %q", clause)
+}
+
+// value returns the request value the condition is tested against. Subjects prefixed with "header." refer to request
+// headers, all other subjects refer to URL parameters.
+func (c policyCondition) value(r *http.Request, query url.Values) string {
+	if name, ok := strings.CutPrefix(c.subject, "header."); ok {
+		return r.Header.Get(name)
+	}
+
+	return query.Get(c.subject)
+}
+
+// matches returns true if the condition holds for the given request.
+func (c policyCondition) matches(r *http.Request, query url.Values) bool {
+	v := c.value(r, query)
+
+	switch c.operator {
+	case policyOperatorEqual:
+		return strings.EqualFold(v, c.operands[0])
+
+	case policyOperatorNotEqual:
+		return !strings.EqualFold(v, c.operands[0])
+
+	case policyOperatorIn, policyOperatorNotIn:
+		found := false
+
+		for _, o := range c.operands {
+			if strings.EqualFold(v, o) {
+				found = true
+				break
+			}
+		}
+
+		return found == (c.operator == policyOperatorIn)
+
+	case policyOperatorLess, policyOperatorLessEqual, policyOperatorGreater, policyOperatorGreaterEqual:
+		a, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+
+		b, _ := strconv.ParseFloat(c.operands[0], 64)
+
+		switch c.operator { //nolint:exhaustive
+		case policyOperatorLess:
+			return a < b
+		case policyOperatorLessEqual:
+			return a <= b
+		case policyOperatorGreater:
+			return a > b
+		default:
+			return a >= b
+		}
+	}
+
+	return false
+}
+
+// evaluatePolicies applies all matching policies to the request, in order. Forced parameters are written back into the
+// request URL, so later rules and the handler itself observe them. The page limit of the key policy applies as well.
+func evaluatePolicies(policies []*policy, r *http.Request) policyResult {
+	var res policyResult
+
+	query := r.URL.Query()
+
+	for _, p := range policies {
+		// Check all conditions
+		matched := true
+
+		for _, c := range p.conditions {
+			if !c.matches(r, query) {
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		// Apply rule
+		if p.rule.Deny {
+			res.Denied = p.rule.Name
+			return res
+		}
+
+		for k, v := range p.rule.Set {
+			query.Set(k, v)
+		}
+
+		if (p.rule.MaxPages > 0) && ((res.MaxPages == 0) || (p.rule.MaxPages < res.MaxPages)) {
+			res.MaxPages = p.rule.MaxPages
+		}
+	}
+
+	r.URL.RawQuery = query.Encode()
+
+	// Apply page limit of key policy
+	kp := contextKeyPolicy(r.Context())
+
+	if (kp != nil) && (kp.MaxPages > 0) && ((res.MaxPages == 0) || (kp.MaxPages < res.MaxPages)) {
+		res.MaxPages = kp.MaxPages
+	}
+
+	return res
+}
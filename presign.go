@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crissyfield/magick-server/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+const (
+	presignExpiresParam   = "expires"   // presignExpiresParam carries the expiry of a presigned URL in Unix seconds.
+	presignSignatureParam = "signature" // presignSignatureParam carries the hex-encoded HMAC-SHA256 of a presigned URL.
+)
+
+// presignedKey is the context key of the flag set on requests with a valid presigned URL.
+type presignedKey struct{}
+
+// signedURLResponse defines the response carrying a presigned download URL.
+type signedURLResponse struct {
+	URL       string    `json:"url"`        // URL is the presigned download URL.
+	ExpiresAt time.Time `json:"expires_at"` // ExpiresAt is the time the URL expires.
+}
+
+// signURL returns a download URL of the result that needs no credentials until it expires. URLs signed by the backend,
+// e.g. presigned object storage URLs, are preferred, so downloads bypass the server. Otherwise, the path of the result
+// is signed with --result-url-secret. It returns ErrNotSupported if neither is possible.
+func (s *resultStore) signURL(ctx context.Context, id string) (signedURLResponse, error) {
+	expires := time.Now().Add(s.urlTTL).Truncate(time.Second)
+
+	u, err := s.store.SignURL(ctx, id, http.MethodGet, s.urlTTL)
+	if (err != nil) && !errors.Is(err, storage.ErrNotSupported) {
+		return signedURLResponse{}, fmt.Errorf("sign URL: %w", err)
+	}
+
+	if (err == nil) && (strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")) {
+		return signedURLResponse{URL: u, ExpiresAt: expires.UTC()}, nil
+	}
+
+	if len(s.secret) == 0 {
+		return signedURLResponse{}, storage.ErrNotSupported
+	}
+
+	ts := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set(presignExpiresParam, ts)
+	q.Set(presignSignatureParam, hex.EncodeToString(s.signPath(resultPath(id), ts)))
+
+	return signedURLResponse{URL: resultPath(id) + "?" + q.Encode(), ExpiresAt: expires.UTC()}, nil
+}
+
+// signPath returns the HMAC-SHA256 signature of a GET request of the path until the expiry, separated by newlines.
+func (s *resultStore) signPath(path, expires string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(http.MethodGet + "\n" + path + "\n" + expires)) //nolint:errcheck
+
+	return mac.Sum(nil)
+}
+
+// checkPresigned verifies the presigned URL of the request.
+func (s *resultStore) checkPresigned(r *http.Request, now time.Time) *apiError {
+	invalid := func(message string) *apiError {
+		return newAPIError(http.StatusUnauthorized, errorCodeSignatureInvalid, message, nil)
+	}
+
+	if len(s.secret) == 0 {
+		return invalid("presigned URLs are not enabled")
+	}
+
+	ts := r.URL.Query().Get(presignExpiresParam)
+
+	expires, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return invalid("invalid presigned URL expiry")
+	}
+
+	if !now.Before(time.Unix(expires, 0)) {
+		return invalid("presigned URL expired")
+	}
+
+	got, err := hex.DecodeString(r.URL.Query().Get(presignSignatureParam))
+	if (err != nil) || !hmac.Equal(got, s.signPath(r.URL.Path, ts)) {
+		return invalid("invalid presigned URL")
+	}
+
+	return nil
+}
+
+// presigned is a middleware that lets requests with a valid presigned URL through without any other credentials, so
+// results can be handed to third parties. All other requests must pass the given signer, if any.
+func (s *resultStore) presigned(sig *signer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		signed := next
+		if sig != nil {
+			signed = sig.verify(next)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !r.URL.Query().Has(presignSignatureParam) {
+				signed.ServeHTTP(w, r)
+				return
+			}
+
+			if aerr := s.checkPresigned(r, time.Now()); aerr != nil {
+				slog.ErrorContext(r.Context(), "Request rejected by presigned URL", slog.Any("error", aerr))
+				rejectEarly(w, r, aerr)
+
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), presignedKey{}, true)))
+		})
+	}
+}
+
+// isPresigned returns true if the request carries a valid presigned URL.
+func isPresigned(ctx context.Context) bool {
+	ok, _ := ctx.Value(presignedKey{}).(bool)
+	return ok
+}
+
+// signResultHandler responds with a fresh presigned download URL of a stored result. Results stored by other clients
+// are not found, and presigned URLs do not grant the right to sign new ones.
+func signResultHandler(store *resultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		obj, err := store.store.Get(r.Context(), id)
+		if (err == nil) && (obj.Metadata[resultOwnerMetadata] != clientKey(r.Context())) {
+			obj.Close() //nolint:errcheck
+			err = storage.ErrNotFound
+		}
+
+		if errors.Is(err, storage.ErrNotFound) {
+			renderError(w, r, http.StatusNotFound, errorCodeResultNotFound, "result not found")
+			return
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read result", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to read result")
+
+			return
+		}
+
+		obj.Close() //nolint:errcheck
+
+		// Sign URL
+		res, err := store.signURL(r.Context(), id)
+		if errors.Is(err, storage.ErrNotSupported) {
+			renderError(w, r, http.StatusNotImplemented, errorCodeStoreUnavailable, "presigned URLs are not enabled")
+			return
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to sign result URL", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to sign result URL")
+
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, res)
+	}
+}
+
+// resultPath returns the path the result with the given ID is downloaded from.
+func resultPath(id string) string {
+	return "/results/" + id
+}
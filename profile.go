@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// profilePart is the name of the multipart part that may supply the target ICC profile.
+const profilePart = "icc"
+
+// profileHeaderSize is the size of the header of ICC profiles.
+const profileHeaderSize = 128
+
+// profileName matches the names of configured ICC profiles, e.g. "fogra39".
+var profileName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// cmykFormats defines the output formats that can hold CMYK images.
+var cmykFormats = map[string]bool{
+	"JPEG": true,
+	"TIFF": true,
+}
+
+// profileOptions defines the target ICC profile of the output images.
+type profileOptions struct {
+	Name       string `json:"name"`       // Name is the name of the configured profile, or "upload" if supplied.
+	Colorspace string `json:"colorspace"` // Colorspace is the data colorspace of the profile, e.g. "CMYK".
+
+	data []byte // data is the ICC profile.
+}
+
+// readProfiles reads the configured ICC profiles, by name.
+func readProfiles(paths map[string]string) (map[string][]byte, error) {
+	profiles := make(map[string][]byte, len(paths))
+
+	for name, path := range paths {
+		name = strings.ToLower(name)
+		if !profileName.MatchString(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read profile %q: %w", name, err)
+		}
+
+		if profileColorspace(data) == "" {
+			return nil, fmt.Errorf("profile %q is not an ICC profile", name)
+		}
+
+		profiles[name] = data
+	}
+
+	return profiles, nil
+}
+
+// profileColorspace returns the data colorspace of the ICC profile (e.g. "RGB" or "CMYK"), or empty if the data is not
+// an ICC profile.
+func profileColorspace(data []byte) string {
+	if (len(data) < profileHeaderSize) || !bytes.Equal(data[36:40], []byte("acsp")) {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data[16:20]))
+}
+
+// parseProfileOptions parses the name of the target ICC profile. It returns nil if the parameter is not set. The
+// profile itself is attached once the request body has been read.
+func parseProfileOptions(query url.Values) (*profileOptions, *apiError) {
+	v := strings.ToLower(query.Get("profile"))
+	if v == "" {
+		return nil, nil
+	}
+
+	if !profileName.MatchString(v) {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid profile parameter", nil)
+	}
+
+	return &profileOptions{Name: v}, nil
+}
+
+// attachProfile attaches the target ICC profile to the options. A profile supplied as multipart part takes precedence
+// over a configured one selected by name.
+func attachProfile(opts *convertOptions, in *input, configured map[string][]byte) *apiError {
+	invalid := func(message string) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, message, nil)
+	}
+
+	// Pick profile
+	if part, ok := in.parts[profilePart]; ok {
+		opts.Profile = &profileOptions{Name: "upload", data: part}
+	} else if opts.Profile != nil {
+		if opts.Profile.data, ok = configured[opts.Profile.Name]; !ok {
+			return invalid("unknown profile")
+		}
+	}
+
+	if opts.Profile == nil {
+		return nil
+	}
+
+	// Check profile
+	opts.Profile.Colorspace = profileColorspace(opts.Profile.data)
+	if opts.Profile.Colorspace == "" {
+		return invalid("invalid ICC profile")
+	}
+
+	if opts.Profile.Colorspace == "CMYK" {
+		for _, f := range opts.outputFormats() {
+			if !cmykFormats[f] {
+				return invalid("CMYK profile requires JPEG or TIFF output")
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseKeepColorspace parses whether the colorspace of the source pages is retained. This is only supported if all
+// output formats can hold CMYK images.
+func parseKeepColorspace(r *http.Request, formats []string) (bool, *apiError) {
+	keep, aerr := parseBoolParam(r, "keep-colorspace")
+	if (aerr != nil) || !keep {
+		return false, aerr
+	}
+
+	for _, f := range formats {
+		if !cmykFormats[f] {
+			return false, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "keep-colorspace requires JPEG or TIFF output", nil)
+		}
+	}
+
+	return true, nil
+}
+
+// restoreColorspace transforms the page back into the colorspace of the source page, if flattening or any operation
+// changed it.
+func restoreColorspace(mw *imagick.MagickWand, colorspace imagick.ColorspaceType) error {
+	if (colorspace == imagick.COLORSPACE_UNDEFINED) || (mw.GetImageColorspace() == colorspace) {
+		return nil
+	}
+
+	err := mw.TransformImageColorspace(colorspace)
+	if err != nil {
+		return fmt.Errorf("transform colorspace: %w", err)
+	}
+
+	return nil
+}
+
+// applyProfile converts the page to the target ICC profile and embeds it. Pages without an embedded profile are
+// transformed into the colorspace of the profile first, since ImageMagick only assigns the first profile of a page.
+func applyProfile(mw *imagick.MagickWand, opts *profileOptions) error {
+	if len(mw.GetImageProfile("icc")) == 0 {
+		colorspace := imagick.COLORSPACE_SRGB
+
+		switch opts.Colorspace {
+		case "CMYK":
+			colorspace = imagick.COLORSPACE_CMYK
+		case "GRAY":
+			colorspace = imagick.COLORSPACE_GRAY
+		}
+
+		err := mw.TransformImageColorspace(colorspace)
+		if err != nil {
+			return fmt.Errorf("transform colorspace: %w", err)
+		}
+	}
+
+	err := mw.ProfileImage("icc", opts.data)
+	if err != nil {
+		return fmt.Errorf("apply profile: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rawExtensions defines the file extensions of RAW camera files. Most of them are TIFF-based and cannot be told apart
+// from TIFF images by their signature.
+var rawExtensions = map[string]bool{
+	"arw": true,
+	"cr2": true,
+	"dng": true,
+	"nef": true,
+}
+
+// rawWhiteBalanceArgs defines the decoder arguments of all supported white balances.
+var rawWhiteBalanceArgs = map[string][]string{
+	"CAMERA":   {"-w"},
+	"AUTO":     {"-a"},
+	"DAYLIGHT": {},
+}
+
+// rawColorspaceArgs defines the decoder arguments of all supported output colorspaces.
+var rawColorspaceArgs = map[string][]string{
+	"RAW":      {"-o", "0"},
+	"SRGB":     {"-o", "1"},
+	"ADOBE":    {"-o", "2"},
+	"WIDE":     {"-o", "3"},
+	"PROPHOTO": {"-o", "4"},
+	"XYZ":      {"-o", "5"},
+}
+
+// rawOptions defines how RAW camera files are developed.
+type rawOptions struct {
+	WhiteBalance string `json:"white_balance"` // WhiteBalance is either "CAMERA", "AUTO", or "DAYLIGHT".
+	Colorspace   string `json:"colorspace"`    // Colorspace is the output colorspace, e.g. "SRGB" or "ADOBE".
+}
+
+// parseRAWOptions parses the development options of RAW camera files. It returns nil if no option is set, in which
+// case the defaults of decodeRAW apply.
+func parseRAWOptions(query url.Values) (*rawOptions, *apiError) {
+	wb, cs := strings.ToUpper(query.Get("raw-white-balance")), strings.ToUpper(query.Get("raw-colorspace"))
+	if (wb == "") && (cs == "") {
+		return nil, nil
+	}
+
+	opts := &rawOptions{WhiteBalance: "CAMERA", Colorspace: "SRGB"}
+
+	if wb != "" {
+		if _, ok := rawWhiteBalanceArgs[wb]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid raw-white-balance parameter", nil)
+		}
+
+		opts.WhiteBalance = wb
+	}
+
+	if cs != "" {
+		if _, ok := rawColorspaceArgs[cs]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid raw-colorspace parameter", nil)
+		}
+
+		opts.Colorspace = cs
+	}
+
+	return opts, nil
+}
+
+// isRAW returns true if the input is a RAW camera file that should be developed by the configured decoder.
+func isRAW(in *input) bool {
+	if config().GetString("raw-decoder") == "" {
+		return false
+	}
+
+	if sniffFormat(in.data[:min(len(in.data), sniffLength)]) == "CR2" {
+		return true
+	}
+
+	return rawExtensions[strings.ToLower(strings.TrimPrefix(path.Ext(in.filename), "."))]
+}
+
+// decodeRAW develops the RAW camera file into a 16-bit TIFF image using the configured dcraw-compatible decoder. The
+// decoder only reads files, so the input is written to a temporary file first.
+func decodeRAW(ctx context.Context, data []byte, opts *rawOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &rawOptions{WhiteBalance: "CAMERA", Colorspace: "SRGB"}
+	}
+
+	// Write input
+	dir, err := os.MkdirTemp("", "magick-server-raw-")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	defer os.RemoveAll(dir) //nolint:errcheck
+
+	name := filepath.Join(dir, "in.raw")
+
+	err = os.WriteFile(name, data, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("write RAW file: %w", err)
+	}
+
+	// Develop image onto standard output
+	args := []string{"-c", "-T", "-6"}
+	args = append(args, rawWhiteBalanceArgs[opts.WhiteBalance]...)
+	args = append(args, rawColorspaceArgs[opts.Colorspace]...)
+
+	out, err := runCommand(ctx, config().GetString("raw-decoder"), append(args, name), nil)
+	if err != nil {
+		return nil, fmt.Errorf("develop RAW file: %w", err)
+	}
+
+	return out, nil
+}
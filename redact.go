@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// redactedValue replaces sensitive values in logs and error responses.
+const redactedValue = "[REDACTED]"
+
+// defaultRedactKeys defines the log attribute keys and query parameter keys that are redacted by default, including
+// those carrying the secrets of presigned URLs of S3 ("X-Amz-*"), Google Cloud Storage ("X-Goog-*"), and Azure ("sig").
+var defaultRedactKeys = []string{
+	"password", "secret", "token", "access-token", "refresh-token", "client-secret", "authorization", "api-key",
+	"apikey", "signature", "credential", "sig", "x-amz-signature", "x-amz-credential", "x-amz-security-token",
+	"x-goog-signature", "x-goog-credential",
+}
+
+// queryParameter matches key-value pairs of URL queries (and similar) embedded in strings, e.g. the signature of a
+// presigned URL in an error message.
+var queryParameter = regexp.MustCompile(`(^|[?&;\s])([^\s?&;=#"']+)=([^\s&;#"']*)`)
+
+// secretsKey is the context key of the per-request secrets.
+type secretsKey struct{}
+
+// secrets defines a set of sensitive values collected while handling a request.
+type secrets struct {
+	mu     sync.Mutex
+	values []string
+}
+
+// withSecrets is a middleware that attaches an empty set of secrets to the request context.
+func withSecrets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), secretsKey{}, &secrets{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// addSecret registers a sensitive value of the current request, which will be redacted from all further log records
+// and error responses of that request.
+func addSecret(ctx context.Context, value string) {
+	s, ok := ctx.Value(secretsKey{}).(*secrets)
+	if !ok || (value == "") {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = append(s.values, value)
+}
+
+// contextSecrets returns the sensitive values of the current request.
+func contextSecrets(ctx context.Context) []string {
+	s, ok := ctx.Value(secretsKey{}).(*secrets)
+	if !ok {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.values...)
+}
+
+// redactString replaces all occurrences of the given secrets in a string.
+func redactString(str string, values []string) string {
+	for _, v := range values {
+		str = strings.ReplaceAll(str, v, redactedValue)
+	}
+
+	return str
+}
+
+// redactQuery masks the values of all key-value pairs in a string whose key is sensitive.
+func redactQuery(str string, sensitive func(string) bool) string {
+	if !strings.Contains(str, "=") {
+		return str
+	}
+
+	return queryParameter.ReplaceAllStringFunc(str, func(m string) string {
+		sub := queryParameter.FindStringSubmatch(m)
+		if (sub[3] == "") || !sensitive(sub[2]) {
+			return m
+		}
+
+		return sub[1] + sub[2] + "=" + redactedValue
+	})
+}
+
+// normalizeRedactKey normalizes attribute keys, so "api_key", "API-Key", and "api-key" are treated alike.
+func normalizeRedactKey(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// isSensitiveParam returns true if the query parameter key is one of the keys redacted from logs. Keys are compared
+// after normalization, but not as substrings, so e.g. "design" is not mistaken for "sig".
+func isSensitiveParam(key string) bool {
+	key = normalizeRedactKey(key)
+
+	return slices.ContainsFunc(config().GetStringSlice("log-redact-keys"), func(k string) bool {
+		return normalizeRedactKey(k) == key
+	})
+}
+
+// redactHandler is a slog handler that redacts attributes with sensitive keys, query parameters with sensitive keys
+// embedded in strings (e.g. URLs), and all sensitive values registered for the current request.
+type redactHandler struct {
+	slog.Handler
+	keys map[string]bool
+}
+
+// newRedactHandler creates a new redacting handler wrapping the given handler.
+func newRedactHandler(h slog.Handler, keys []string) redactHandler {
+	m := map[string]bool{}
+	for _, k := range keys {
+		m[normalizeRedactKey(k)] = true
+	}
+
+	return redactHandler{Handler: h, keys: m}
+}
+
+// Handle redacts the record and passes it on.
+func (h redactHandler) Handle(ctx context.Context, rec slog.Record) error {
+	values := contextSecrets(ctx)
+
+	nrec := slog.NewRecord(rec.Time, rec.Level, h.redactValue(rec.Message, values), rec.PC)
+
+	rec.Attrs(func(a slog.Attr) bool {
+		nrec.AddAttrs(h.redactAttr(a, values))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, nrec)
+}
+
+// WithAttrs returns a new handler with the given (redacted) attributes.
+func (h redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redactAttr(a, nil))
+	}
+
+	return redactHandler{Handler: h.Handler.WithAttrs(redacted), keys: h.keys}
+}
+
+// WithGroup returns a new handler with the given group.
+func (h redactHandler) WithGroup(name string) slog.Handler {
+	return redactHandler{Handler: h.Handler.WithGroup(name), keys: h.keys}
+}
+
+// redactAttr redacts a single attribute, descending into groups.
+func (h redactHandler) redactAttr(a slog.Attr, values []string) slog.Attr {
+	if h.keys[normalizeRedactKey(a.Key)] {
+		return slog.String(a.Key, redactedValue)
+	}
+
+	v := a.Value.Resolve()
+
+	switch v.Kind() { //nolint:exhaustive
+	case slog.KindGroup:
+		group := v.Group()
+
+		attrs := make([]any, 0, len(group))
+		for _, ga := range group {
+			attrs = append(attrs, h.redactAttr(ga, values))
+		}
+
+		return slog.Group(a.Key, attrs...)
+
+	case slog.KindString:
+		return slog.String(a.Key, h.redactValue(v.String(), values))
+
+	case slog.KindAny:
+		if str := fmt.Sprint(v.Any()); h.redactValue(str, values) != str {
+			return slog.String(a.Key, h.redactValue(str, values))
+		}
+	}
+
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactValue redacts the given secrets and all query parameters with sensitive keys from a string.
+func (h redactHandler) redactValue(str string, values []string) string {
+	return redactQuery(redactString(str, values), h.sensitive)
+}
+
+// sensitive returns true if the query parameter key is one of the redacted keys, see isSensitiveParam.
+func (h redactHandler) sensitive(key string) bool {
+	return h.keys[normalizeRedactKey(key)]
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// currentConfig is the configuration snapshot requests are handled with. Snapshots are never modified once published,
+// but replaced as a whole when the configuration is reloaded.
+var currentConfig atomic.Pointer[viper.Viper]
+
+// config returns the configuration snapshot requests are handled with, or the global configuration as set up from the
+// command line until the server publishes its first snapshot.
+func config() *viper.Viper {
+	if v := currentConfig.Load(); v != nil {
+		return v
+	}
+
+	return viper.GetViper()
+}
+
+// loadConfig reads a new configuration snapshot from the given command line flags, the environment, and the given
+// configuration file, if any.
+func loadConfig(flags *pflag.FlagSet, file string) (*viper.Viper, error) {
+	v := viper.New()
+
+	err := bindConfig(v, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if file != "" {
+		v.SetConfigFile(file)
+
+		err = v.ReadInConfig()
+		if err != nil {
+			return nil, fmt.Errorf("read configuration file: %w", err)
+		}
+	}
+
+	return v, nil
+}
+
+// serverState defines the state of the server that is kept when the configuration is reloaded.
+type serverState struct {
+	limiter  *limiter          // limiter bounds concurrent conversions, if concurrency is limited.
+	metrics  *metrics          // metrics are the metrics of the public endpoints.
+	meter    *usageMeter       // meter accounts usage by client key and tenant.
+	audit    *auditLog         // audit is the audit log, if enabled.
+	sessions *sessionCache     // sessions are the cached editing sessions, if enabled.
+	usage    *keyUsage         // usage is the usage of client keys, which daily quotas apply to.
+	life     *lifecycle        // life tracks readiness and the conversions in flight.
+	replays  *idempotencyCache // replays are the responses kept for idempotent retries, if enabled.
+	results  *resultStore      // results are the stored results, if enabled.
+	uploads  *uploadStore      // uploads are the resumable uploads, if enabled.
+}
+
+// routerConfig defines everything the router is built from that is read from the configuration, and can therefore
+// change when it is reloaded.
+type routerConfig struct {
+	addresses     *addressFilter     // addresses are the allowed and denied client address ranges, if any.
+	policies      []*policy          // policies are the request policies.
+	keys          *keyPolicies       // keys are the key policies, if any.
+	entryNameTmpl *template.Template // entryNameTmpl names Zip archive entries.
+	watermark     []byte             // watermark is the watermark image, if any.
+	profiles      map[string][]byte  // profiles are the selectable ICC profiles, by name.
+	engine        *ocrEngine         // engine recognizes text, if available.
+	images        imageEngine        // images converts images with the selected image engine.
+}
+
+// readRouterConfig reads and checks everything the router is built from out of the given configuration snapshot,
+// accounting key quotas to the given usage.
+func readRouterConfig(v *viper.Viper, usage *keyUsage) (*routerConfig, error) {
+	cfg := &routerConfig{}
+
+	// Compile request and key policies
+	var err error
+
+	cfg.policies, cfg.keys, err = readPolicies(v, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse entry name template
+	cfg.entryNameTmpl, err = parseEntryName(v.GetString("entry-name"))
+	if err != nil {
+		return nil, fmt.Errorf("parse entry name template: %w", err)
+	}
+
+	// Check Zip method
+	_, err = parseZipMethod(v.GetString("zip-method"))
+	if err != nil {
+		return nil, fmt.Errorf("parse Zip method: %w", err)
+	}
+
+	// Check page budget ladder
+	_, err = parseBudgetLadder(v.GetStringSlice("page-budget-ladder"))
+	if err != nil {
+		return nil, fmt.Errorf("parse page budget ladder: %w", err)
+	}
+
+	// Read watermark image
+	if path := v.GetString("watermark"); path != "" {
+		cfg.watermark, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read watermark image: %w", err)
+		}
+	}
+
+	// Read ICC profiles
+	cfg.profiles, err = readProfiles(v.GetStringMapString("icc-profiles"))
+	if err != nil {
+		return nil, fmt.Errorf("read ICC profiles: %w", err)
+	}
+
+	// Select image engine
+	cfg.images, err = newImageEngine(v.GetString("engine"), v.GetString("vips"))
+	if err != nil {
+		return nil, fmt.Errorf("select image engine: %w", err)
+	}
+
+	// Detect text recognition
+	cfg.engine = detectOCR(v.GetString("tesseract"))
+
+	// Parse address ranges
+	cfg.addresses, err = newAddressFilter(v.GetStringSlice("allow-cidrs"), v.GetStringSlice("deny-cidrs"))
+	if err != nil {
+		return nil, fmt.Errorf("parse address ranges: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// switchHandler defines a handler that passes requests on to a handler that can be replaced at any time. Requests in
+// flight are finished by the handler they were passed to.
+type switchHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+// newSwitchHandler creates a new switch handler passing requests on to the given handler.
+func newSwitchHandler(h http.Handler) *switchHandler {
+	s := &switchHandler{}
+	s.current.Store(&h)
+
+	return s
+}
+
+// swap replaces the handler requests are passed on to.
+func (s *switchHandler) swap(h http.Handler) {
+	s.current.Store(&h)
+}
+
+// ServeHTTP passes the request on to the current handler.
+func (s *switchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.current.Load()).ServeHTTP(w, r)
+}
+
+// watchReload reloads the configuration when the server receives SIGHUP, or, with --watch-config, when the
+// configuration file changes.
+func watchReload(handler *switchHandler, state *serverState, flags *pflag.FlagSet) {
+	var mu sync.Mutex
+
+	file := viper.ConfigFileUsed()
+
+	reloadConfig := func(reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		err := reload(handler, state, flags, file)
+		if err != nil {
+			slog.Error("Failed to reload configuration, keeping previous one",
+				slog.String("reason", reason), slog.Any("error", err))
+
+			return
+		}
+
+		slog.Info("Reloaded configuration", slog.String("reason", reason), slog.String("file", file))
+	}
+
+	// Reload on signal
+	go func() {
+		for range notifyReload() {
+			reloadConfig("signal")
+		}
+	}()
+
+	// Reload on file change, watched by a separate instance, since the published snapshots must not change
+	if config().GetBool("watch-config") && (file != "") {
+		watcher := viper.New()
+		watcher.SetConfigFile(file)
+
+		watcher.OnConfigChange(func(fsnotify.Event) {
+			reloadConfig("file change")
+		})
+
+		watcher.WatchConfig()
+	}
+}
+
+// reload reads the configuration file into a new snapshot, and replaces the router by one built from it. The snapshot
+// is only published once it has been checked, so if the new configuration is invalid, the previous one stays in effect.
+func reload(handler *switchHandler, state *serverState, flags *pflag.FlagSet, file string) error {
+	v, err := loadConfig(flags, file)
+	if err != nil {
+		return err
+	}
+
+	// Parse log level
+	var level slog.Level
+
+	err = level.UnmarshalText([]byte(v.GetString("log-level")))
+	if err != nil {
+		return fmt.Errorf("parse log level: %w", err)
+	}
+
+	// Check concurrency limits
+	err = checkLimiterReload(state.limiter, config(), v)
+	if err != nil {
+		return err
+	}
+
+	// Rebuild router
+	cfg, err := readRouterConfig(v, state.usage)
+	if err != nil {
+		return err
+	}
+
+	currentConfig.Store(v)
+	logLevel.Set(level)
+
+	if state.limiter != nil {
+		state.limiter.resize(v.GetInt("max-concurrent"), v.GetInt("max-queued"), v.GetDuration("queue-timeout"))
+	}
+
+	handler.swap(newRouter(state, cfg))
+
+	return nil
+}
+
+// checkLimiterReload fails if the new configuration would enable or disable concurrency limits, or change the memory
+// limit, which both require a restart. All other limits of the limiter can be changed in place.
+func checkLimiterReload(lim *limiter, prev *viper.Viper, next *viper.Viper) error {
+	if (lim != nil) != (next.GetInt("max-concurrent") > 0) {
+		return errors.New("enabling or disabling max-concurrent requires a restart")
+	}
+
+	if prev.GetUint64("max-rss") != next.GetUint64("max-rss") {
+		return errors.New("changing max-rss requires a restart")
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	maxRenditions    = 8     // maxRenditions is the largest supported number of renditions per page.
+	maxRenditionSize = 10000 // maxRenditionSize is the largest supported rendition width in pixels.
+)
+
+// parseSizes parses the rendition widths given as a comma-separated list, e.g. "200,800,1600". It returns nil if the
+// parameter is not set. Renditions cannot be assembled into an animation or a PDF/A document.
+func parseSizes(query url.Values) ([]uint, *apiError) {
+	v := query.Get("sizes")
+	if v == "" {
+		return nil, nil
+	}
+
+	invalid := newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid sizes parameter", nil)
+
+	if (query.Get("animate") != "") || strings.EqualFold(query.Get("format"), formatPDFA) {
+		return nil, invalid
+	}
+
+	items := strings.Split(v, ",")
+	if len(items) > maxRenditions {
+		return nil, invalid
+	}
+
+	seen := map[uint]bool{}
+	sizes := make([]uint, 0, len(items))
+
+	for _, item := range items {
+		s, err := strconv.ParseUint(strings.TrimSpace(item), 10, 64)
+		if (err != nil) || (s < 1) || (s > maxRenditionSize) || seen[uint(s)] {
+			return nil, invalid
+		}
+
+		seen[uint(s)] = true
+		sizes = append(sizes, uint(s))
+	}
+
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	return sizes, nil
+}
+
+// parseFormats parses the output formats given as a comma-separated list, e.g. "JPEG,WEBP". It returns the first format,
+// and all formats if more than one is given.
+func parseFormats(v string) (string, []string, *apiError) {
+	invalid := newAPIError(http.StatusBadRequest, errorCodeInvalidFormat, "invalid output format", nil)
+
+	seen := map[string]bool{}
+	formats := []string{}
+
+	for _, item := range strings.Split(v, ",") {
+		f := strings.ToUpper(strings.TrimSpace(item))
+		if _, ok := formatExtensionMap[f]; !ok || seen[f] {
+			return "", nil, invalid
+		}
+
+		if !outputFormatAvailable(f) {
+			return "", nil, newAPIError(http.StatusBadRequest, errorCodeInvalidFormat, "output format not supported by ImageMagick", nil)
+		}
+
+		seen[f] = true
+		formats = append(formats, f)
+	}
+
+	if len(formats) == 1 {
+		return formats[0], nil, nil
+	}
+
+	return formats[0], formats, nil
+}
+
+// outputFormats returns all output formats, in order.
+func (o convertOptions) outputFormats() []string {
+	if len(o.Formats) > 0 {
+		return o.Formats
+	}
+
+	return []string{o.Format}
+}
+
+// alphaFormat returns the first output format that cannot hold an alpha channel, or the first output format if all can.
+// Transparency is only kept if it can be kept in every output format.
+func (o convertOptions) alphaFormat() string {
+	for _, f := range o.outputFormats() {
+		if !formatCapabilityMap[f].Alpha {
+			return f
+		}
+	}
+
+	return o.Format
+}
+
+// encodeRenditions encodes the processed page once per output format, or once per output format and requested width.
+// Renditions are resized to the requested width, keeping the aspect ratio, but never enlarged. The page is decoded and
+// processed only once for all renditions.
+func encodeRenditions(mw *imagick.MagickWand, page, pages int, opts convertOptions) ([]pageResult, error) {
+	if len(opts.Sizes) == 0 {
+		return encodeFormats(mw, page, pages, opts, 0)
+	}
+
+	var results []pageResult
+
+	for _, size := range opts.Sizes {
+		res, err := encodeRendition(mw, page, pages, opts, size)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res...)
+	}
+
+	return results, nil
+}
+
+// encodeRendition encodes a copy of the page resized to the given width, once per output format.
+func encodeRendition(mw *imagick.MagickWand, page, pages int, opts convertOptions, size uint) ([]pageResult, error) {
+	mwr := mw.Clone()
+	defer mwr.Destroy()
+
+	// Resize page
+	width, height := mwr.GetImageWidth(), mwr.GetImageHeight()
+
+	if width > size {
+		err := imagick.ResizeImage(mwr, size, max(1, uint(float64(height)*float64(size)/float64(width))), imagick.FILTER_LANCZOS)
+		if err != nil {
+			return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to resize image", err)
+		}
+	}
+
+	// Encode page
+	return encodeFormats(mwr, page, pages, opts, size)
+}
+
+// encodeFormats encodes the page once per output format. All but the last format are encoded from a copy, so the
+// format-specific options do not leak into other formats.
+func encodeFormats(mw *imagick.MagickWand, page, pages int, opts convertOptions, size uint) ([]pageResult, error) {
+	formats := opts.outputFormats()
+	results := make([]pageResult, 0, len(formats))
+
+	for i, format := range formats {
+		mwf := mw
+		if i < len(formats)-1 {
+			mwf = mw.Clone()
+		}
+
+		res, err := encodeFormat(mwf, page, pages, opts, format)
+		if mwf != mw {
+			mwf.Destroy()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res.data.Size = size
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// encodeFormat encodes the page in the given output format.
+func encodeFormat(mw *imagick.MagickWand, page, pages int, opts convertOptions, format string) (pageResult, error) {
+	opts.Format = format
+
+	// Prepare encoding
+	err := applyOperations(encodeOperations, mw, opts, pageInfo{index: page, count: pages})
+	if err != nil {
+		return pageResult{}, err
+	}
+
+	// Encode page
+	out, err := mw.GetImageBlob()
+	if err != nil {
+		return pageResult{}, newAPIError(http.StatusInternalServerError, errorCodeEncodeFailed,
+			fmt.Sprintf("failed to encode %s image", format), err)
+	}
+
+	return pageResult{out: out, data: newEntryNameData(mw, page, pages, format)}, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// requestIDHeader is the header used to accept and return request IDs.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of an accepted request ID.
+const maxRequestIDLength = 128
+
+// requestID is a middleware that accepts a request ID from the client or generates a new one. The request ID is stored
+// in the request context (using the same key as chi's middleware, so middleware.GetReqID keeps working) and returned as
+// response header.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID returns true if the client-supplied request ID is safe to be logged and echoed.
+func validRequestID(id string) bool {
+	if (id == "") || (len(id) > maxRequestIDLength) {
+		return false
+	}
+
+	for _, c := range id {
+		if (c < 0x21) || (c > 0x7e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID generates a new random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b) //nolint:errcheck
+
+	return hex.EncodeToString(b)
+}
+
+// contextHandler is a slog handler that adds the request ID, client certificate, and signature key found in the
+// context to every log record.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request ID, client certificate, and signature key to the record and passes it on.
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := middleware.GetReqID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+
+	if cn := clientCN(ctx); cn != "" {
+		rec.AddAttrs(slog.String("client_cn", cn))
+	}
+
+	if key := signatureKey(ctx); key != "" {
+		rec.AddAttrs(slog.String("signature_key", key))
+	}
+
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs returns a new handler with the given attributes.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup returns a new handler with the given group.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
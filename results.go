@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crissyfield/magick-server/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// resultSweepInterval is the interval at which expired results are removed.
+const resultSweepInterval = time.Minute
+
+// resultContentType is the media type of stored results.
+const resultContentType = zipMediaType
+
+// resultOwnerMetadata is the metadata key of the client key a result was stored by.
+const resultOwnerMetadata = "owner"
+
+// resultResponse defines the response describing a stored result.
+type resultResponse struct {
+	ID        string    `json:"id"`                   // ID identifies the result.
+	URL       string    `json:"url"`                  // URL is the path the result is downloaded from.
+	Size      int64     `json:"size"`                 // Size is the size of the result in bytes.
+	ExpiresAt time.Time `json:"expires_at"`           // ExpiresAt is the time the result expires.
+	SHA256    string    `json:"sha256"`               // SHA256 is the hex-encoded SHA-256 digest of the result.
+	SignedURL string    `json:"signed_url,omitempty"` // SignedURL is a download URL that needs no credentials, if enabled.
+	Manifest  *manifest `json:"manifest,omitempty"`   // Manifest lists the content of the result.
+}
+
+// resultStore defines the storage of Zip archives that are downloaded later instead of being sent in the response, so
+// clients can resume interrupted downloads of large archives.
+type resultStore struct {
+	store  storage.Storage // store is the storage backend results are kept in.
+	ttl    time.Duration   // ttl is the time after which a result expires.
+	secret []byte          // secret signs presigned URLs, if they are enabled.
+	urlTTL time.Duration   // urlTTL is the time after which a presigned URL expires.
+}
+
+// newResultStore opens the storage backend of the given URL, and removes expired results in the background if the
+// backend supports it. Presigned URLs are signed with the given secret, unless the backend signs them itself. It
+// returns nil if results are not stored.
+func newResultStore(rawURL string, ttl time.Duration, secret string, urlTTL time.Duration) (*resultStore, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	store, err := storage.Open(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("open result storage: %w", err)
+	}
+
+	if sw, ok := store.(storage.Sweeper); ok {
+		go func() {
+			for range time.Tick(resultSweepInterval) {
+				err := sw.Sweep(context.Background())
+				if err != nil {
+					slog.Warn("Failed to remove expired results", slog.Any("error", err))
+				}
+			}
+		}()
+	}
+
+	return &resultStore{store: store, ttl: ttl, secret: []byte(secret), urlTTL: urlTTL}, nil
+}
+
+// put stores the archive under a new random ID, owned by the client of the context, and describes the stored result,
+// including a presigned URL if enabled.
+func (s *resultStore) put(ctx context.Context, archive []byte) (resultResponse, error) {
+	id := newRequestID()
+
+	err := s.store.Put(ctx, id, bytes.NewReader(archive), storage.PutOptions{
+		ContentType: resultContentType,
+		TTL:         s.ttl,
+		Metadata:    map[string]string{resultOwnerMetadata: clientKey(ctx)},
+	})
+	if err != nil {
+		return resultResponse{}, fmt.Errorf("store result: %w", err)
+	}
+
+	res := resultResponse{
+		ID:        id,
+		URL:       resultPath(id),
+		Size:      int64(len(archive)),
+		ExpiresAt: time.Now().Add(s.ttl).UTC(),
+		SHA256:    sha256Hex(archive),
+	}
+
+	signed, err := s.signURL(ctx, id)
+
+	switch {
+	case errors.Is(err, storage.ErrNotSupported):
+	case err != nil:
+		return resultResponse{}, err
+	default:
+		res.SignedURL = signed.URL
+	}
+
+	return res, nil
+}
+
+// renderArchive responds with the archive, as Zip or tar archive as negotiated, or stores it and responds with its
+// description, including the manifest, if it is to be stored.
+func renderArchive(
+	w http.ResponseWriter, r *http.Request, archive []byte, man *manifest, store *resultStore, opts convertOptions,
+) {
+	if !opts.Store {
+		contentType := zipMediaType
+		if opts.Response == tarMediaType {
+			contentType = tarMediaType
+		}
+
+		setChecksumHeaders(w, archive)
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive) //nolint:errcheck
+
+		return
+	}
+
+	res, err := store.put(r.Context(), archive)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store result", slog.Any("error", err))
+		renderError(w, r, http.StatusInternalServerError, errorCodeArchiveFailed, "failed to store result")
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Stored result", slog.String("result", res.ID), slog.Int64("size", res.Size))
+
+	res.Manifest = man
+
+	w.Header().Set("Location", res.URL)
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, res)
+}
+
+// checkStore returns an error if results are to be stored, but no result storage is configured.
+func checkStore(stored bool, store *resultStore) *apiError {
+	if stored && (store == nil) {
+		return newAPIError(http.StatusNotImplemented, errorCodeStoreUnavailable, "result storage is not configured", nil)
+	}
+
+	return nil
+}
+
+// ownsResult returns true if the client of the context stored the result, or the request carries a valid presigned URL.
+func ownsResult(ctx context.Context, obj *storage.Object) bool {
+	return isPresigned(ctx) || (obj.Metadata[resultOwnerMetadata] == clientKey(ctx))
+}
+
+// getResultHandler responds with a stored result. Range requests are honored if the backend can seek the result, so
+// interrupted downloads can be resumed. Results stored by other clients are not found, unless the URL is presigned.
+func getResultHandler(store *resultStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		obj, err := store.store.Get(r.Context(), id)
+		if (err == nil) && !ownsResult(r.Context(), obj) {
+			obj.Close() //nolint:errcheck
+			err = storage.ErrNotFound
+		}
+
+		if errors.Is(err, storage.ErrNotFound) {
+			renderError(w, r, http.StatusNotFound, errorCodeResultNotFound, "result not found")
+			return
+		}
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read result", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to read result")
+
+			return
+		}
+
+		defer obj.Close() //nolint:errcheck
+
+		// Results never change, so their ID identifies their content
+		w.Header().Set("Content-Type", obj.ContentType)
+		w.Header().Set("ETag", strconv.Quote(id))
+
+		if rs, ok := obj.ReadCloser.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, "", time.Time{}, rs)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+		w.WriteHeader(http.StatusOK)
+
+		io.Copy(w, obj) //nolint:errcheck
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// transientExceptions defines the ImageMagick exceptions that are likely to succeed when retried: a delegate such as
+// Ghostscript failed, or the pixel cache ran out of resources, e.g. because the temporary disk was full.
+var transientExceptions = []string{"ERROR_DELEGATE", "ERROR_CACHE", "FATAL_ERROR_DELEGATE", "FATAL_ERROR_CACHE"}
+
+// transientMessages defines messages of other ImageMagick exceptions that are likely to succeed when retried.
+var transientMessages = []string{
+	"no space left on device",
+	"unable to create temporary file",
+	"memory allocation failed",
+	"time limit exceeded",
+}
+
+// isTransient returns true if the ImageMagick error is likely to succeed when retried, as opposed to permanent errors
+// such as corrupt inputs.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+
+	for _, e := range transientExceptions {
+		if strings.HasPrefix(msg, e+":") {
+			return true
+		}
+	}
+
+	msg = strings.ToLower(msg)
+
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryTransient calls fn until it succeeds or fails permanently, retrying transient failures up to --transient-retries
+// times. The delay between attempts starts at --transient-backoff and doubles with every attempt. It returns the error
+// of the last attempt.
+func retryTransient(ctx context.Context, name string, fn func() error) error {
+	retries, backoff := config().GetInt("transient-retries"), config().GetDuration("transient-backoff")
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !isTransient(err) || (attempt >= retries) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "Retrying after transient failure",
+			slog.String("operation", name), slog.Int("attempt", attempt+1), slog.Any("error", err))
+
+		t := time.NewTimer(backoff << attempt)
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// rotateOptions defines the rotation of pages by arbitrary angles.
+type rotateOptions struct {
+	Angle      float64         `json:"angle,omitempty"`      // Angle is the clockwise rotation of all pages in degrees.
+	Pages      map[int]float64 `json:"pages,omitempty"`      // Pages are rotations of individual (one-based) pages.
+	Background string          `json:"background,omitempty"` // Background is the color of areas uncovered by rotations.
+}
+
+// parseRotateOptions parses the rotation URL parameters. It returns nil if no rotation is set. Transparent backgrounds
+// are only allowed for output formats that can hold an alpha channel.
+func parseRotateOptions(query url.Values, format string) (*rotateOptions, *apiError) {
+	opts := &rotateOptions{}
+
+	// Parse angle
+	if v := query.Get("rotate"); v != "" {
+		angle, err := parseAngle(v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid rotate parameter", err)
+		}
+
+		opts.Angle = angle
+	}
+
+	// Parse per-page rotations
+	if v := query.Get("rotations"); v != "" {
+		pages, err := parseRotations(v)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid rotations parameter", err)
+		}
+
+		opts.Pages = pages
+	}
+
+	if (opts.Angle == 0) && (len(opts.Pages) == 0) {
+		return nil, nil
+	}
+
+	// Parse background color
+	if v := strings.ToLower(query.Get("rotate-background")); v != "" {
+		if v == backgroundTransparent {
+			if !formatCapabilityMap[format].Alpha {
+				return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "transparent background requires alpha", nil)
+			}
+		} else if !backgroundColor.MatchString(v) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid rotate-background parameter", nil)
+		}
+
+		opts.Background = v
+	}
+
+	return opts, nil
+}
+
+// parseAngle parses an angle in degrees and normalizes it to [0, 360).
+func parseAngle(v string) (float64, error) {
+	angle, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse angle: %w", err)
+	}
+
+	if math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return 0, fmt.Errorf("invalid angle %q", v)
+	}
+
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+
+	return angle, nil
+}
+
+// parseRotations parses per-page rotations given as "PAGE:ANGLE,...", e.g. "1:90,3:180", with one-based page numbers.
+func parseRotations(v string) (map[int]float64, error) {
+	pages := map[int]float64{}
+
+	for _, item := range strings.Split(v, ",") {
+		p, a, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid rotation %q", item)
+		}
+
+		page, err := strconv.Atoi(strings.TrimSpace(p))
+		if (err != nil) || (page < 1) {
+			return nil, fmt.Errorf("invalid page of rotation %q", item)
+		}
+
+		if _, ok := pages[page]; ok {
+			return nil, fmt.Errorf("duplicate rotation of page %d", page)
+		}
+
+		angle, err := parseAngle(a)
+		if err != nil {
+			return nil, err
+		}
+
+		pages[page] = angle
+	}
+
+	return pages, nil
+}
+
+// pageAngle returns the rotation of the given page: its own rotation if set, and the rotation of all pages otherwise.
+func (o *rotateOptions) pageAngle(pi pageInfo) float64 {
+	if angle, ok := o.Pages[pi.index+1]; ok {
+		return angle
+	}
+
+	return o.Angle
+}
+
+// rotateBackground returns the color of areas uncovered by the rotation: the rotation background if set, otherwise
+// the flattening background, otherwise transparent if transparency is kept, and white in all other cases.
+func rotateBackground(opts convertOptions) string {
+	switch {
+	case opts.Rotate.Background != "":
+		return opts.Rotate.Background
+	case opts.Background != "":
+		return opts.Background
+	case opts.Alpha == alphaModeKeep:
+		return backgroundTransparent
+	}
+
+	return backgroundDefault
+}
+
+// rotatePage rotates the page clockwise by the given angle, filling uncovered areas with the given color.
+func rotatePage(mw *imagick.MagickWand, angle float64, color string) error {
+	if angle == 0 {
+		return nil
+	}
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	if !pw.SetColor(color) {
+		return fmt.Errorf("invalid color %q", color)
+	}
+
+	err := mw.RotateImage(pw, angle)
+	if err != nil {
+		return fmt.Errorf("rotate image: %w", err)
+	}
+
+	// Reset virtual canvas, which is shifted by rotations
+	return mw.SetImagePage(mw.GetImageWidth(), mw.GetImageHeight(), 0, 0)
+}
+
+// mirrorPage mirrors the page vertically (flip) and horizontally (flop).
+func mirrorPage(mw *imagick.MagickWand, flip, flop bool) error {
+	if flip {
+		err := mw.FlipImage()
+		if err != nil {
+			return fmt.Errorf("flip image: %w", err)
+		}
+	}
+
+	if flop {
+		err := mw.FlopImage()
+		if err != nil {
+			return fmt.Errorf("flop image: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// residentMemory returns the resident memory of the process in bytes, which is only supported on Linux.
+func residentMemory() (uint64, error) {
+	return 0, errors.New("resident memory only supported on Linux")
+}
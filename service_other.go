@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// waitForTermination blocks until the user or the system asks the server to terminate. The returned function must be
+// called once the server has shut down.
+func waitForTermination() func() {
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+
+	<-done
+
+	return func() {}
+}
+
+// notifyReload returns a channel that receives SIGHUP, which asks the server to reload its configuration.
+func notifyReload() <-chan os.Signal {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	return reload
+}
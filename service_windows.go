@@ -0,0 +1,185 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the server is registered with at the Windows service control manager.
+const serviceName = "magick-server"
+
+// CmdService defines the command to manage the Windows service.
+var CmdService = &cobra.Command{
+	Use:               "service",
+	Short:             "Manage the Windows service",
+	Args:              cobra.NoArgs,
+	PersistentPreRunE: func(_ *cobra.Command, _ []string) error { return nil },
+}
+
+// CmdServiceInstall defines the command to install the Windows service.
+var CmdServiceInstall = &cobra.Command{
+	Use:   "install [-- server flags]",
+	Short: "Install the server as a Windows service",
+	Long: "Install the server as a Windows service that is started automatically. All arguments after \"--\" are " +
+		"passed to the server when the service is started.",
+	Args: cobra.ArbitraryArgs,
+	RunE: runServiceInstall,
+}
+
+// CmdServiceUninstall defines the command to uninstall the Windows service.
+var CmdServiceUninstall = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Uninstall the Windows service",
+	Args:  cobra.NoArgs,
+	RunE:  runServiceUninstall,
+}
+
+// Initialize command options
+func init() {
+	CmdService.AddCommand(CmdServiceInstall, CmdServiceUninstall)
+	CmdMain.AddCommand(CmdService)
+}
+
+// runServiceInstall is called when the service install command is used.
+func runServiceInstall(_ *cobra.Command, args []string) error {
+	// Locate executable
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate executable: %w", err)
+	}
+
+	// Connect to service control manager
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %w", err)
+	}
+
+	defer m.Disconnect() //nolint:errcheck
+
+	// Create service
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Magick Server",
+		Description: "A simple API server to convert (multi-page) images using ImageMagick.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+
+	defer s.Close() //nolint:errcheck
+
+	return nil
+}
+
+// runServiceUninstall is called when the service uninstall command is used.
+func runServiceUninstall(_ *cobra.Command, _ []string) error {
+	// Connect to service control manager
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %w", err)
+	}
+
+	defer m.Disconnect() //nolint:errcheck
+
+	// Delete service
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("open service: %w", err)
+	}
+
+	defer s.Close() //nolint:errcheck
+
+	err = s.Delete()
+	if err != nil {
+		return fmt.Errorf("delete service: %w", err)
+	}
+
+	return nil
+}
+
+// serviceHandler handles requests of the Windows service control manager.
+type serviceHandler struct {
+	stop    chan struct{} // stop is closed when the service control manager asks the server to stop.
+	stopped chan struct{} // stopped is closed once the server has shut down.
+}
+
+// Execute reports the state of the service to the service control manager and waits for a stop request.
+func (h *serviceHandler) Execute(_ []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for c := range req {
+		switch c.Cmd { //nolint:exhaustive
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+
+		case svc.Stop, svc.Shutdown:
+			wait := config().GetDuration("shutdown-timeout")
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32(wait.Milliseconds())}
+
+			close(h.stop)
+			<-h.stopped
+
+			return false, 0
+		}
+	}
+
+	return false, 0
+}
+
+// waitForTermination blocks until the user or the system asks the server to terminate. When running as a Windows
+// service, termination is requested by the service control manager. The returned function must be called once the
+// server has shut down.
+func waitForTermination() func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		slog.Error("Failed to detect Windows service", slog.Any("error", err))
+		os.Exit(1) //nolint:revive
+	}
+
+	if !isService {
+		// Wait for console termination
+		done := make(chan os.Signal, 1)
+		signal.Notify(done, os.Interrupt, syscall.SIGTERM)
+
+		<-done
+
+		return func() {}
+	}
+
+	// Wait for service termination
+	h := &serviceHandler{stop: make(chan struct{}), stopped: make(chan struct{})}
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		err := svc.Run(serviceName, h)
+		if err != nil {
+			slog.Error("Failed to run Windows service", slog.Any("error", err))
+			os.Exit(1) //nolint:revive
+		}
+	}()
+
+	<-h.stop
+
+	return func() {
+		close(h.stopped)
+		<-exited
+	}
+}
+
+// notifyReload returns a channel that never receives, since Windows has no SIGHUP. Use --watch-config to reload the
+// configuration instead.
+func notifyReload() <-chan os.Signal {
+	return nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/crissyfield/magick-server/imagick"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// session defines a decoded document kept in memory for successive operations.
+type session struct {
+	mu      sync.Mutex          // mu serializes access to the magick wand.
+	id      string              // id identifies the session.
+	mw      *imagick.MagickWand // mw holds the decoded document, or nil once the session is destroyed.
+	in      *input              // in holds the filename and additional parts of the upload, without the image.
+	density float64             // density is the density the document was decoded at.
+	pages   int                 // pages is the number of pages of the document.
+	expires time.Time           // expires is the time the session expires unless it is used again.
+	elem    *list.Element       // elem is the position of the session in the cache's usage list.
+}
+
+// sessionResponse defines the response describing a session.
+type sessionResponse struct {
+	ID        string    `json:"id"`         // ID identifies the session.
+	Pages     int       `json:"pages"`      // Pages is the number of pages of the document.
+	Density   float64   `json:"density"`    // Density is the density the document was decoded at.
+	ExpiresAt time.Time `json:"expires_at"` // ExpiresAt is the time the session expires unless it is used again.
+}
+
+// destroy releases the magick wand, waiting for any running operation to finish.
+func (s *session) destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mw != nil {
+		releaseWand(s.mw)
+		s.mw = nil
+	}
+}
+
+// sessionCache defines a bounded cache of sessions. If the cache is full, the least recently used session is evicted,
+// and sessions expire if they are not used within the time-to-live.
+type sessionCache struct {
+	mu          sync.Mutex
+	sessions    map[string]*session // sessions are all cached sessions, by ID.
+	usage       *list.List          // usage orders sessions from most to least recently used.
+	maxSessions int                 // maxSessions is the maximum number of sessions.
+	ttl         time.Duration       // ttl is the idle time after which a session expires.
+}
+
+// newSessionCache creates a new session cache. It returns nil if sessions are disabled.
+func newSessionCache(maxSessions int, ttl time.Duration) *sessionCache {
+	if maxSessions <= 0 {
+		return nil
+	}
+
+	return &sessionCache{sessions: map[string]*session{}, usage: list.New(), maxSessions: maxSessions, ttl: ttl}
+}
+
+// add adds a new session to the cache, evicting expired and least recently used sessions as needed.
+func (c *sessionCache) add(s *session) {
+	var evicted []*session
+
+	c.mu.Lock()
+
+	now := time.Now()
+
+	// Evict expired sessions, then least recently used ones
+	for e := c.usage.Back(); e != nil; {
+		prev := e.Prev()
+
+		es, _ := e.Value.(*session)
+		if (len(c.sessions) >= c.maxSessions) || !now.Before(es.expires) {
+			c.unlink(es)
+			evicted = append(evicted, es)
+		}
+
+		e = prev
+	}
+
+	// Add session
+	s.expires = now.Add(c.ttl)
+	s.elem = c.usage.PushFront(s)
+	c.sessions[s.id] = s
+
+	c.mu.Unlock()
+
+	// Destroy evicted sessions outside the lock, since they may still be in use
+	for _, es := range evicted {
+		es.destroy()
+	}
+}
+
+// get returns the session with the given ID, or nil if it does not exist or has expired. The session's expiry is
+// extended and it becomes the most recently used one.
+func (c *sessionCache) get(id string) *session {
+	c.mu.Lock()
+
+	s, ok := c.sessions[id]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	if !now.Before(s.expires) {
+		c.unlink(s)
+		c.mu.Unlock()
+		s.destroy()
+
+		return nil
+	}
+
+	s.expires = now.Add(c.ttl)
+	c.usage.MoveToFront(s.elem)
+
+	c.mu.Unlock()
+
+	return s
+}
+
+// remove removes and destroys the session with the given ID. It returns false if the session does not exist.
+func (c *sessionCache) remove(id string) bool {
+	c.mu.Lock()
+
+	s, ok := c.sessions[id]
+	if ok {
+		c.unlink(s)
+	}
+
+	c.mu.Unlock()
+
+	if ok {
+		s.destroy()
+	}
+
+	return ok
+}
+
+// unlink removes the session from the cache. The caller must hold the lock.
+func (c *sessionCache) unlink(s *session) {
+	c.usage.Remove(s.elem)
+	delete(c.sessions, s.id)
+}
+
+// describe describes the given session.
+func (c *sessionCache) describe(s *session) sessionResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sessionResponse{ID: s.id, Pages: s.pages, Density: s.density, ExpiresAt: s.expires.UTC()}
+}
+
+// sessionNotFound responds that the requested session does not exist.
+func sessionNotFound(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, errorCodeSessionNotFound, "session not found")
+}
+
+// createSessionHandler decodes an uploaded (multi-page) image and keeps it in the session cache.
+func createSessionHandler(cache *sessionCache, policies []*policy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check headers
+		if aerr := checkHeaders(r); aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by headers", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Apply request policies
+		pol := evaluatePolicies(policies, r)
+		if pol.Denied != "" {
+			slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+			rejectEarly(w, r, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil))
+			return
+		}
+
+		// Parse options
+		opts, aerr := parseConvertOptions(r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Read request body
+		in, aerr := readInput(w, r)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read request body", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Read image
+		mw, aerr := readWand(r.Context(), in, opts)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to read image", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Enforce page limit
+		pages := int(mw.GetNumberImages())
+
+		if (pol.MaxPages > 0) && (uint(pages) > pol.MaxPages) {
+			releaseWand(mw)
+			slog.ErrorContext(r.Context(), "Page limit exceeded", slog.Int("pages", pages), slog.Uint64("limit", uint64(pol.MaxPages)))
+			renderError(w, r, http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded")
+			return
+		}
+
+		// Cache session
+		s := &session{
+			id:      newRequestID(),
+			mw:      mw,
+			in:      &input{filename: in.filename, parts: in.parts},
+			density: opts.Density,
+			pages:   pages,
+		}
+
+		cache.add(s)
+
+		slog.InfoContext(r.Context(), "Created session", slog.String("session", s.id), slog.Int("pages", pages))
+
+		// We're good
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, cache.describe(s))
+	}
+}
+
+// getSessionHandler describes an existing session.
+func getSessionHandler(cache *sessionCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := cache.get(chi.URLParam(r, "id"))
+		if s == nil {
+			sessionNotFound(w, r)
+			return
+		}
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, cache.describe(s))
+	}
+}
+
+// deleteSessionHandler removes a session before it expires.
+func deleteSessionHandler(cache *sessionCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cache.remove(chi.URLParam(r, "id")) {
+			sessionNotFound(w, r)
+			return
+		}
+
+		render.NoContent(w, r)
+	}
+}
+
+// parseSessionOptions parses the conversion options of an operation on the given session, after applying the request
+// policies to the operation. The page limit of the policies applies to all pages of the session. The density is fixed
+// when the session is created and cannot be changed afterwards.
+func parseSessionOptions(
+	r *http.Request, s *session, policies []*policy, watermark []byte, profiles map[string][]byte,
+) (convertOptions, *apiError) {
+	pol := evaluatePolicies(policies, r)
+	if pol.Denied != "" {
+		slog.ErrorContext(r.Context(), "Request denied by policy", slog.String("policy", pol.Denied))
+		return convertOptions{}, newAPIError(http.StatusForbidden, errorCodePolicyDenied, "request denied by policy", nil)
+	}
+
+	if (pol.MaxPages > 0) && (uint(s.pages) > pol.MaxPages) {
+		slog.ErrorContext(r.Context(), "Page limit exceeded", slog.Int("pages", s.pages), slog.Uint64("limit", uint64(pol.MaxPages)))
+		return convertOptions{}, newAPIError(http.StatusUnprocessableEntity, errorCodePageLimitExceeded, "page limit exceeded", nil)
+	}
+
+	opts, aerr := parseConvertOptions(r)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	opts.Density = s.density
+
+	aerr = attachWatermark(r, &opts, s.in, watermark)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	aerr = attachProfile(&opts, s.in, profiles)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	aerr = attachFields(&opts, s.in)
+	if aerr != nil {
+		return opts, aerr
+	}
+
+	return opts, nil
+}
+
+// previewSessionHandler converts a single page of a session and responds with the output image.
+func previewSessionHandler(
+	cache *sessionCache, policies []*policy, watermark []byte, profiles map[string][]byte,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := cache.get(chi.URLParam(r, "id"))
+		if s == nil {
+			sessionNotFound(w, r)
+			return
+		}
+
+		// Parse options and page
+		opts, aerr := parseSessionOptions(r, s, policies, watermark, profiles)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		page, err := strconv.Atoi(chi.URLParam(r, "page"))
+		if (err != nil) || (page < 0) || (page >= s.pages) {
+			renderError(w, r, http.StatusNotFound, errorCodeNotFound, "page not found")
+			return
+		}
+
+		part := 0
+
+		if v := r.URL.Query().Get("part"); v != "" {
+			part, err = strconv.Atoi(v)
+			if (err != nil) || (part < 0) || (part > 1) || ((part > 0) && (opts.Split == nil)) {
+				renderError(w, r, http.StatusBadRequest, errorCodeInvalidParameter, "invalid part parameter")
+				return
+			}
+		}
+
+		// Pull page into its own magick wand
+		s.mu.Lock()
+
+		if s.mw == nil {
+			s.mu.Unlock()
+			sessionNotFound(w, r)
+
+			return
+		}
+
+		s.mw.SetIteratorIndex(page)
+		mwi := s.mw.GetImage()
+
+		s.mu.Unlock()
+
+		defer mwi.Destroy()
+
+		// Convert page
+		cpu := measureCPU(r.Context())
+		results, err := convertSourcePage(r.Context(), mwi, page, s.pages, opts)
+		cpu()
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to convert page", slog.Any("error", err))
+			renderAPIError(w, r, pagesError(err))
+			return
+		}
+
+		// Pick first rendition of the requested half
+		var res pageResult
+
+		for _, r := range results {
+			if r.data.Part == part {
+				res = r
+				break
+			}
+		}
+
+		// We're good
+		w.Header().Set("Content-Type", formatMediaTypeMap[opts.Format])
+		w.WriteHeader(http.StatusOK)
+		w.Write(res.out) //nolint:errcheck
+	}
+}
+
+// renderSessionHandler converts all pages of a session into a Zip archive, which is stored in the given result storage
+// instead of being sent if requested.
+func renderSessionHandler(
+	cache *sessionCache, policies []*policy, entryNameTmpl *template.Template, watermark []byte, profiles map[string][]byte,
+	engine *ocrEngine, store *resultStore,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := cache.get(chi.URLParam(r, "id"))
+		if s == nil {
+			sessionNotFound(w, r)
+			return
+		}
+
+		// Parse options, and negotiate response
+		w.Header().Add("Vary", "Accept")
+
+		opts, aerr := parseSessionOptions(r, s, policies, watermark, profiles)
+		if aerr == nil {
+			aerr = checkOCR(opts.OCR, engine)
+		}
+
+		if aerr == nil {
+			aerr = negotiateResponse(r, &opts, false)
+		}
+
+		if aerr == nil {
+			aerr = checkStore(opts.Store, store)
+		}
+
+		if aerr == nil {
+			aerr = checkArchivePassword(opts)
+		}
+
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to parse options", slog.Any("error", aerr))
+			renderAPIError(w, r, aerr)
+			return
+		}
+
+		// Convert all pages
+		s.mu.Lock()
+
+		if s.mw == nil {
+			s.mu.Unlock()
+			sessionNotFound(w, r)
+
+			return
+		}
+
+		results, err := convertPages(r.Context(), s.mw, s.pages, opts)
+
+		s.mu.Unlock()
+
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to convert pages", slog.Any("error", err))
+			renderAPIError(w, r, pagesError(err))
+			return
+		}
+
+		// Assemble animation or PDF/A document
+		if opts.Animate != nil {
+			renderAnimation(w, r, results, opts.Animate)
+			return
+		}
+
+		if opts.PDFA {
+			renderPDFA(w, r, results, opts.Density)
+			return
+		}
+
+		// Recognize text
+		if !recognizeText(w, r, engine, results, opts) {
+			return
+		}
+
+		// We're good
+		renderResults(w, r, results, nil, s.in, opts, entryNameTmpl, store)
+	}
+}
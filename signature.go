@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureHeader          = "X-Signature"           // signatureHeader carries the hex-encoded HMAC-SHA256 signature.
+	signatureKeyHeader       = "X-Signature-Key"       // signatureKeyHeader carries the ID of the signing secret.
+	signatureTimestampHeader = "X-Signature-Timestamp" // signatureTimestampHeader carries the signing time in Unix seconds.
+)
+
+// signatureKeyKey is the context key of the ID of the secret a request was signed with.
+type signatureKeyKey struct{}
+
+// signer defines the verification of HMAC-SHA256 signed requests.
+type signer struct {
+	secrets map[string][]byte // secrets are the shared secrets, by key ID.
+	skew    time.Duration     // skew is the maximum difference between the signing time and now.
+}
+
+// newSigner returns a signer for the given shared secrets, or nil if there are none, in which case requests are not
+// required to be signed.
+func newSigner(secrets map[string]string, skew time.Duration) *signer {
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	s := &signer{secrets: make(map[string][]byte, len(secrets)), skew: skew}
+
+	for id, secret := range secrets {
+		s.secrets[id] = []byte(secret)
+	}
+
+	return s
+}
+
+// verify is a middleware that rejects requests that are not signed with one of the shared secrets. The signature covers
+// the method, the request URI, the signing time, and the digest of the body, which is verified while the body is read.
+func (s *signer) verify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, aerr := s.check(r, time.Now())
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Request rejected by signature", slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+			return
+		}
+
+		// Verify body while reading
+		dr, err := newDigestReader(r.Body, r.Header.Get(contentDigestHeader))
+		if err != nil {
+			rejectEarly(w, r, newAPIError(http.StatusUnauthorized, errorCodeSignatureInvalid, "invalid content digest", err))
+			return
+		}
+
+		r.Body = dr
+
+		logAccess(r.Context(), slog.String("signature_key", id))
+
+		ctx := context.WithValue(r.Context(), signatureKeyKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// check verifies the signature headers of the request, and returns the ID of the secret the request was signed with.
+func (s *signer) check(r *http.Request, now time.Time) (string, *apiError) {
+	invalid := func(message string) *apiError {
+		return newAPIError(http.StatusUnauthorized, errorCodeSignatureInvalid, message, nil)
+	}
+
+	id, signature := r.Header.Get(signatureKeyHeader), r.Header.Get(signatureHeader)
+	if (id == "") || (signature == "") {
+		return "", invalid("missing signature")
+	}
+
+	// Check signing time
+	ts, err := strconv.ParseInt(r.Header.Get(signatureTimestampHeader), 10, 64)
+	if err != nil {
+		return "", invalid("invalid signature timestamp")
+	}
+
+	if d := now.Sub(time.Unix(ts, 0)); (d > s.skew) || (d < -s.skew) {
+		return "", invalid("signature expired")
+	}
+
+	// Check signature
+	secret, ok := s.secrets[id]
+	if !ok {
+		return "", invalid("unknown signature key")
+	}
+
+	got, err := hex.DecodeString(signature)
+	if (err != nil) || !hmac.Equal(got, signRequest(secret, r)) {
+		return "", invalid("invalid signature")
+	}
+
+	return id, nil
+}
+
+// signRequest returns the HMAC-SHA256 signature of the request: the method, the request URI, the signing time, and the
+// digest of the body, separated by newlines.
+func signRequest(secret []byte, r *http.Request) []byte {
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(strings.Join([]string{ //nolint:errcheck
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(signatureTimestampHeader),
+		strings.ToLower(r.Header.Get(contentDigestHeader)),
+	}, "\n")))
+
+	return mac.Sum(nil)
+}
+
+// signatureKey returns the ID of the secret the request was signed with, or empty if it was not signed.
+func signatureKey(ctx context.Context) string {
+	id, _ := ctx.Value(signatureKeyKey{}).(string)
+	return id
+}
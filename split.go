@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// splitDirection defines the direction of the line pages are split along.
+type splitDirection string
+
+const (
+	splitDirectionVertical   splitDirection = "VERTICAL"   // splitDirectionVertical splits into left and right halves.
+	splitDirectionHorizontal splitDirection = "HORIZONTAL" // splitDirectionHorizontal splits into top and bottom halves.
+)
+
+// splitHalvesMap defines the names of both halves of a split page, in order.
+var splitHalvesMap = map[splitDirection][2]string{
+	splitDirectionVertical:   {"left", "right"},
+	splitDirectionHorizontal: {"top", "bottom"},
+}
+
+const (
+	gutterSearchRange = 0.15 // gutterSearchRange is the distance from the center searched for the gutter, relative.
+	gutterSmoothing   = 5    // gutterSmoothing is the number of neighboring lines averaged when searching the gutter.
+)
+
+// splitOptions defines how double-page scans are split into two output images.
+type splitOptions struct {
+	Direction splitDirection `json:"direction"`        // Direction is the direction of the split line.
+	Gutter    bool           `json:"gutter,omitempty"` // Gutter splits at the detected gutter instead of the center.
+}
+
+// parseSplitOptions parses the split URL parameters. It returns nil if pages are not split.
+func parseSplitOptions(query url.Values) (*splitOptions, *apiError) {
+	v := query.Get("split")
+	if v == "" {
+		return nil, nil
+	}
+
+	// Parse direction
+	opts := &splitOptions{Direction: splitDirection(strings.ToUpper(v))}
+
+	if _, ok := splitHalvesMap[opts.Direction]; !ok {
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid split parameter", nil)
+	}
+
+	// Parse gutter detection
+	switch strings.ToLower(query.Get("split-gutter")) {
+	case "", "center":
+	case "auto":
+		opts.Gutter = true
+	default:
+		return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid split-gutter parameter", nil)
+	}
+
+	return opts, nil
+}
+
+// splitPage splits the page into two new magick wands, which have to be destroyed by the caller.
+func splitPage(mw *imagick.MagickWand, opts *splitOptions) ([]*imagick.MagickWand, error) {
+	width, height := mw.GetImageWidth(), mw.GetImageHeight()
+
+	// Find split line
+	length := width
+	if opts.Direction == splitDirectionHorizontal {
+		length = height
+	}
+
+	if length < 2 {
+		return nil, errors.New("page too small to split")
+	}
+
+	at := length / 2
+
+	if opts.Gutter {
+		var err error
+
+		at, err = findGutter(mw, opts.Direction)
+		if err != nil {
+			return nil, fmt.Errorf("find gutter: %w", err)
+		}
+	}
+
+	// Crop both halves
+	regions := [2][4]uint{{0, 0, at, height}, {at, 0, width - at, height}}
+	if opts.Direction == splitDirectionHorizontal {
+		regions = [2][4]uint{{0, 0, width, at}, {0, at, width, height - at}}
+	}
+
+	halves := make([]*imagick.MagickWand, 0, len(regions))
+
+	for _, r := range regions {
+		mwh := mw.Clone()
+		halves = append(halves, mwh)
+
+		err := mwh.CropImage(r[2], r[3], int(r[0]), int(r[1]))
+		if err == nil {
+			err = mwh.SetImagePage(r[2], r[3], 0, 0)
+		}
+
+		if err != nil {
+			for _, h := range halves {
+				h.Destroy()
+			}
+
+			return nil, fmt.Errorf("crop half: %w", err)
+		}
+	}
+
+	return halves, nil
+}
+
+// findGutter returns the position of the gutter between both pages of a spread, searched near the center. The gutter
+// is the line whose (smoothed) mean intensity deviates most from the search range's average, which finds both the dark
+// shadow of a binding and the bright gap between two pages.
+func findGutter(mw *imagick.MagickWand, direction splitDirection) (uint, error) {
+	width, height := int(mw.GetImageWidth()), int(mw.GetImageHeight())
+
+	pixels, err := mw.ExportImagePixels(0, 0, uint(width), uint(height), "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		return 0, fmt.Errorf("export pixels: %w", err)
+	}
+
+	intensities, ok := pixels.([]byte)
+	if !ok || (len(intensities) != width*height) {
+		return 0, errors.New("unexpected pixel data")
+	}
+
+	// Compute mean intensity of every line across the split direction
+	length, span := width, height
+	if direction == splitDirectionHorizontal {
+		length, span = height, width
+	}
+
+	means := make([]float64, length)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := x
+			if direction == splitDirectionHorizontal {
+				i = y
+			}
+
+			means[i] += float64(intensities[y*width+x])
+		}
+	}
+
+	for i := range means {
+		means[i] /= float64(span)
+	}
+
+	// Search line deviating most from the average around the center
+	lo := max(1, int(float64(length)*(0.5-gutterSearchRange)))
+	hi := min(length-1, int(float64(length)*(0.5+gutterSearchRange)))
+
+	var avg float64
+	for i := lo; i < hi; i++ {
+		avg += means[i]
+	}
+
+	avg /= float64(max(1, hi-lo))
+
+	best, bestScore := length/2, -1.0
+
+	for i := lo; i < hi; i++ {
+		var sum float64
+
+		n := 0
+
+		for j := max(0, i-gutterSmoothing/2); j <= min(length-1, i+gutterSmoothing/2); j++ {
+			sum += means[j]
+			n++
+		}
+
+		if score := math.Abs(sum/float64(n) - avg); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return uint(best), nil
+}
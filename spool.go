@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// errSpill is returned if data could not be spilled to a temporary file, e.g. because the disk is full.
+var errSpill = errors.New("spill to temporary file")
+
+// spool defines a buffer that holds up to --spill-threshold bytes in memory, and spills everything beyond to a
+// temporary file, so large inputs and outputs need not be held in memory.
+type spool struct {
+	threshold int64        // threshold is the size beyond which data is spilled, or 0 if it is never spilled.
+	buf       bytes.Buffer // buf holds the data until it is spilled.
+	file      *os.File     // file is the temporary file holding the data once it is spilled.
+}
+
+// newSpool creates a new, empty spool.
+func newSpool() *spool {
+	return &spool{threshold: config().GetInt64("spill-threshold")}
+}
+
+// Write writes the data to memory, or to the temporary file once the threshold is exceeded.
+func (s *spool) Write(p []byte) (int, error) {
+	if (s.file == nil) && ((s.threshold <= 0) || (int64(s.buf.Len()+len(p)) <= s.threshold)) {
+		return s.buf.Write(p)
+	}
+
+	if s.file == nil {
+		f, err := os.CreateTemp(config().GetString("spill-dir"), "magick-server-*")
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errSpill, err)
+		}
+
+		s.file = f
+
+		_, err = s.buf.WriteTo(f)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", errSpill, err)
+		}
+	}
+
+	n, err := s.file.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", errSpill, err)
+	}
+
+	return n, nil
+}
+
+// finish returns all data written, and the path of the temporary file if it was spilled. Spilled data is mapped from
+// the file instead of being read back into memory. The mapping is released, and the file removed, once the context is
+// done, so the data must not be used beyond the request.
+func (s *spool) finish(ctx context.Context) ([]byte, string, error) {
+	if s.file == nil {
+		return s.buf.Bytes(), "", nil
+	}
+
+	path := s.file.Name()
+
+	data, unmap, err := mapFile(s.file)
+	s.file.Close() //nolint:errcheck
+
+	if err != nil {
+		os.Remove(path) //nolint:errcheck
+		return nil, "", fmt.Errorf("%w: %w", errSpill, err)
+	}
+
+	slog.DebugContext(ctx, "Spilled data to temporary file", slog.String("path", path), slog.Int("size", len(data)))
+
+	context.AfterFunc(ctx, func() {
+		unmap()
+		os.Remove(path) //nolint:errcheck
+	})
+
+	return data, path, nil
+}
+
+// discard removes the temporary file, if any, after a failed write.
+func (s *spool) discard() {
+	if s.file != nil {
+		s.file.Close()           //nolint:errcheck
+		os.Remove(s.file.Name()) //nolint:errcheck
+	}
+}
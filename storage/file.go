@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	objectPrefix = "object-" // objectPrefix is the prefix of the files holding the content of objects.
+	metaPrefix   = "meta-"   // metaPrefix is the prefix of the files holding the metadata of objects.
+)
+
+// Initialize backend
+func init() {
+	Register("file", func(u *url.URL) (Storage, error) {
+		return NewFile(u.Path)
+	})
+}
+
+// fileMeta defines the metadata of an object stored in a file, which is kept in a file of its own.
+type fileMeta struct {
+	ContentType string    `json:"content_type,omitempty"` // ContentType is the media type of the object.
+	Expires     time.Time `json:"expires"`                // Expires is the time the object expires, or zero if it never expires.
+
+	Metadata map[string]string `json:"metadata,omitempty"` // Metadata is the metadata the object was stored with.
+}
+
+// File is a storage that keeps every object in a file of a directory, e.g. on a volume shared by all instances.
+// Objects are written to a temporary file first and then renamed, so readers never see partial objects.
+type File struct {
+	dir string
+	now func() time.Time
+}
+
+// NewFile creates a new storage in the given directory, which is created if needed.
+func NewFile(dir string) (*File, error) {
+	if dir == "" {
+		return nil, errors.New("storage: file backend needs a directory, e.g. file:///var/lib/magick-server/results")
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+
+	return &File{dir: dir, now: time.Now}, nil
+}
+
+// Get returns the object with the given key. The object can be seeked, e.g. to serve range requests.
+func (f *File) Get(_ context.Context, key string) (*Object, error) {
+	meta, err := f.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.expired(meta) {
+		f.remove(key)
+		return nil, ErrNotFound
+	}
+
+	file, err := os.Open(f.path(objectPrefix, key))
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, fmt.Errorf("open object: %w", err)
+	}
+
+	st, err := file.Stat()
+	if err != nil {
+		file.Close() //nolint:errcheck
+		return nil, fmt.Errorf("stat object: %w", err)
+	}
+
+	return &Object{
+		ReadCloser:  file,
+		ContentType: meta.ContentType,
+		Size:        st.Size(),
+		Expires:     meta.Expires,
+		Metadata:    meta.Metadata,
+	}, nil
+}
+
+// Put stores an object under the given key.
+func (f *File) Put(_ context.Context, key string, r io.Reader, opts PutOptions) error {
+	meta := fileMeta{ContentType: opts.ContentType, Metadata: opts.Metadata}
+	if opts.TTL > 0 {
+		meta.Expires = f.now().Add(opts.TTL)
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+
+	// Metadata is written first, so an object is never found without it
+	err = f.write(f.path(metaPrefix, key), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+
+	err = f.write(f.path(objectPrefix, key), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("write object: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the object with the given key.
+func (f *File) Delete(_ context.Context, key string) error {
+	for _, p := range []string{f.path(objectPrefix, key), f.path(metaPrefix, key)} {
+		err := os.Remove(p)
+		if (err != nil) && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("remove object: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SignURL returns ErrNotSupported, since files are only reachable through the server.
+func (*File) SignURL(_ context.Context, _ string, _ string, _ time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
+
+// Sweep removes all expired objects.
+func (f *File) Sweep(_ context.Context) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return fmt.Errorf("read directory: %w", err)
+	}
+
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), metaPrefix)
+		if !ok {
+			continue
+		}
+
+		key, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+
+		if meta, err := f.readMeta(key); (err == nil) && f.expired(meta) {
+			f.remove(key)
+		}
+	}
+
+	return nil
+}
+
+// path returns the path of the file with the given prefix of the object with the given key. Keys are escaped and
+// prefixed, so they cannot leave the directory.
+func (f *File) path(prefix, key string) string {
+	return filepath.Join(f.dir, prefix+url.PathEscape(key))
+}
+
+// readMeta reads the metadata of the object with the given key.
+func (f *File) readMeta(key string) (fileMeta, error) {
+	var meta fileMeta
+
+	data, err := os.ReadFile(f.path(metaPrefix, key))
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return meta, ErrNotFound
+	case err != nil:
+		return meta, fmt.Errorf("read metadata: %w", err)
+	}
+
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("decode metadata: %w", err)
+	}
+
+	return meta, nil
+}
+
+// write writes a file through a temporary file in the same directory, which is renamed once it is complete.
+func (f *File) write(path string, fn func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	err = fn(tmp)
+	if err != nil {
+		tmp.Close() //nolint:errcheck
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// remove removes the object with the given key, ignoring errors.
+func (f *File) remove(key string) {
+	os.Remove(f.path(objectPrefix, key)) //nolint:errcheck
+	os.Remove(f.path(metaPrefix, key))   //nolint:errcheck
+}
+
+// expired returns true if the object has expired.
+func (f *File) expired(meta fileMeta) bool {
+	return !meta.Expires.IsZero() && !f.now().Before(meta.Expires)
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Initialize backend
+func init() {
+	Register("memory", func(_ *url.URL) (Storage, error) {
+		return NewMemory(), nil
+	})
+}
+
+// memoryObject defines an object held in memory.
+type memoryObject struct {
+	data        []byte    // data is the content of the object.
+	contentType string    // contentType is the media type of the object.
+	expires     time.Time // expires is the time the object expires, or zero if it never expires.
+
+	metadata map[string]string // metadata is the metadata the object was stored with.
+}
+
+// memoryReader defines a reader of an object held in memory, which can be seeked.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+// Close does nothing.
+func (memoryReader) Close() error {
+	return nil
+}
+
+// Memory is a storage that holds all objects in memory. It is meant for tests and single-instance deployments, since
+// objects are lost on restart.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+	now     func() time.Time
+}
+
+// NewMemory creates a new, empty in-memory storage.
+func NewMemory() *Memory {
+	return &Memory{objects: map[string]memoryObject{}, now: time.Now}
+}
+
+// Get returns the object with the given key.
+func (m *Memory) Get(_ context.Context, key string) (*Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok || m.expired(obj) {
+		delete(m.objects, key)
+		return nil, ErrNotFound
+	}
+
+	return &Object{
+		ReadCloser:  memoryReader{Reader: bytes.NewReader(obj.data)},
+		ContentType: obj.contentType,
+		Size:        int64(len(obj.data)),
+		Expires:     obj.expires,
+		Metadata:    obj.metadata,
+	}, nil
+}
+
+// Put stores an object under the given key. Expired objects are removed along the way.
+func (m *Memory) Put(_ context.Context, key string, r io.Reader, opts PutOptions) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read object: %w", err)
+	}
+
+	m.Sweep(context.Background()) //nolint:errcheck
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Store object
+	obj := memoryObject{data: data, contentType: opts.ContentType, metadata: maps.Clone(opts.Metadata)}
+	if opts.TTL > 0 {
+		obj.expires = m.now().Add(opts.TTL)
+	}
+
+	m.objects[key] = obj
+
+	return nil
+}
+
+// Delete removes the object with the given key.
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+
+	return nil
+}
+
+// SignURL returns a "memory://" URL of the object. The URL carries method and expiry for inspection in tests, but
+// grants no access by itself, since objects in memory are only reachable through the server.
+func (m *Memory) SignURL(_ context.Context, key string, method string, expires time.Duration) (string, error) {
+	q := url.Values{}
+	q.Set("method", method)
+	q.Set("expires", strconv.FormatInt(m.now().Add(expires).Unix(), 10))
+
+	u := url.URL{Scheme: "memory", Path: "/" + key, RawQuery: q.Encode()}
+
+	return u.String(), nil
+}
+
+// Sweep removes all expired objects.
+func (m *Memory) Sweep(_ context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, obj := range m.objects {
+		if m.expired(obj) {
+			delete(m.objects, k)
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of objects that have not expired.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+
+	for _, obj := range m.objects {
+		if !m.expired(obj) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// expired returns true if the object has expired.
+func (m *Memory) expired(obj memoryObject) bool {
+	return !obj.expires.IsZero() && !m.now().Before(obj.expires)
+}
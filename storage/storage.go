@@ -0,0 +1,117 @@
+// Package storage defines the interface of the object storage used for cached, queued, and finished conversions, and
+// a registry of backends. Backends are registered by URL scheme, so third-party backends can be added by importing a
+// package that calls Register in its init function, much like database/sql drivers.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned if an object does not exist (or has expired).
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrNotSupported is returned if a backend does not support an operation, e.g. signing URLs.
+var ErrNotSupported = errors.New("storage: operation not supported")
+
+// PutOptions defines the options of storing an object.
+type PutOptions struct {
+	ContentType string        // ContentType is the media type of the object.
+	TTL         time.Duration // TTL is the time after which the object expires, or zero if it never expires.
+
+	Metadata map[string]string // Metadata is kept along with the object, e.g. as user-defined metadata of object storage.
+}
+
+// Object defines a stored object.
+type Object struct {
+	io.ReadCloser
+
+	ContentType string    // ContentType is the media type of the object.
+	Size        int64     // Size is the size of the object in bytes.
+	Expires     time.Time // Expires is the time the object expires, or zero if it never expires.
+
+	Metadata map[string]string // Metadata is the metadata the object was stored with, if any.
+}
+
+// Storage defines an object storage. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the object with the given key. The caller must close the object. It returns ErrNotFound if the object
+	// does not exist.
+	Get(ctx context.Context, key string) (*Object, error)
+
+	// Put stores an object under the given key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error
+
+	// Delete removes the object with the given key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// SignURL returns a URL that grants access to the object with the given key using the given HTTP method, until it
+	// expires. It returns ErrNotSupported if the backend cannot sign URLs.
+	SignURL(ctx context.Context, key string, method string, expires time.Duration) (string, error)
+}
+
+// Sweeper is implemented by backends that can remove all expired objects at once. Backends that do not implement it
+// are expected to expire objects by themselves, e.g. through lifecycle rules of object storage.
+type Sweeper interface {
+	// Sweep removes all expired objects.
+	Sweep(ctx context.Context) error
+}
+
+// OpenFunc opens a storage backend configured by the given URL.
+type OpenFunc func(u *url.URL) (Storage, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]OpenFunc{}
+)
+
+// Register makes a storage backend available under the given URL scheme. It panics if the scheme is registered twice.
+func Register(scheme string, open OpenFunc) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, ok := backends[scheme]; ok {
+		panic("storage: backend registered twice for scheme " + scheme)
+	}
+
+	backends[scheme] = open
+}
+
+// Schemes returns the URL schemes of all registered backends, sorted.
+func Schemes() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	schemes := make([]string, 0, len(backends))
+	for s := range backends {
+		schemes = append(schemes, s)
+	}
+
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open opens the storage backend configured by the given URL, e.g. "memory://".
+func Open(rawURL string) (Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse storage URL: %w", err)
+	}
+
+	backendsMu.RLock()
+	open, ok := backends[u.Scheme]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q", u.Scheme)
+	}
+
+	return open(u)
+}
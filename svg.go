@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+const (
+	svgUserDensity = 96.0  // svgUserDensity is the density at which one SVG user unit is one pixel.
+	maxSVGSize     = 20000 // maxSVGSize is the largest supported width or height of rasterized SVGs in pixels.
+)
+
+const (
+	svgNamespace      = "http://www.w3.org/2000/svg"           // svgNamespace is the namespace of SVG elements.
+	xincludeNamespace = "http://www.w3.org/2001/XInclude"      // xincludeNamespace is the namespace of XInclude elements.
+	xmlNamespace      = "http://www.w3.org/XML/1998/namespace" // xmlNamespace is the namespace bound to the xml prefix.
+)
+
+// errNotSVG is returned if an XML input is not an SVG document.
+var errNotSVG = errors.New("XML input is not an SVG document")
+
+var (
+	// svgCSSURL matches references to other resources within CSS, e.g. in fill="url(...)" or style attributes.
+	svgCSSURL = regexp.MustCompile(`(?i)url\(\s*["']?([^"')]*)["']?\s*\)`)
+
+	// svgCSSImport matches CSS imports of external stylesheets.
+	svgCSSImport = regexp.MustCompile(`(?i)@import[^;]*;?`)
+
+	// svgCSSEscape matches CSS escapes: up to six hex digits followed by an optional whitespace, or any other character.
+	svgCSSEscape = regexp.MustCompile(`\\(?:([0-9a-fA-F]{1,6})(?:\r\n|[ \t\r\n\f])?|([^0-9a-fA-F]))`)
+
+	// svgLocalRef matches references that never leave the document: fragments and embedded raster images.
+	svgLocalRef = regexp.MustCompile(`(?i)^\s*(#|data:image/(png|jpeg|gif|webp)[;,])`)
+)
+
+// svgOptions defines the size SVG inputs are rasterized at.
+type svgOptions struct {
+	Width  uint `json:"width,omitempty"`  // Width is the width to fit the rasterized SVG into, in pixels.
+	Height uint `json:"height,omitempty"` // Height is the height to fit the rasterized SVG into, in pixels.
+}
+
+// parseSVGOptions parses the rasterization size of SVG inputs. It returns nil if no size is given.
+func parseSVGOptions(query url.Values) (*svgOptions, *apiError) {
+	parse := func(name string) (uint, *apiError) {
+		v := query.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+
+		s, err := strconv.ParseUint(v, 10, 64)
+		if (err != nil) || (s < 1) || (s > maxSVGSize) {
+			return 0, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+		}
+
+		return uint(s), nil
+	}
+
+	width, aerr := parse("svg-width")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	height, aerr := parse("svg-height")
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	if (width == 0) && (height == 0) {
+		return nil, nil
+	}
+
+	return &svgOptions{Width: width, Height: height}, nil
+}
+
+// sanitizeSVG rewrites the SVG token by token, keeping only what cannot refer to external resources, so rendering it can
+// neither read local files nor make requests to other hosts. Document type declarations (and thus entities),
+// processing instructions (and thus external stylesheets), comments, and XInclude elements are dropped, as are all "href"
+// and "src" attributes of any namespace other than fragments and embedded raster images, and all CSS imports and URLs
+// other than those. Inputs that are not well-formed SVG documents are rejected.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Entity = xml.HTMLEntity
+
+	var (
+		out   bytes.Buffer
+		scope []map[string]string // scope holds the namespace bindings of all open elements, innermost last.
+		names []xml.Name          // names holds the raw names of all open elements, innermost last.
+		skip  int                 // skip is the depth within a dropped element, or 0.
+		root  bool                // root is set once the root element has been seen.
+	)
+
+	resolve := func(prefix string) string {
+		if prefix == "xml" {
+			return xmlNamespace
+		}
+
+		for i := len(scope) - 1; i >= 0; i-- {
+			if ns, ok := scope[i][prefix]; ok {
+				return ns
+			}
+		}
+
+		return ""
+	}
+
+	for {
+		tok, err := dec.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("parse SVG: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root && (len(names) == 0) {
+				return nil, errors.New("parse SVG: multiple root elements")
+			}
+
+			bindings := map[string]string{}
+
+			for _, a := range t.Attr {
+				switch {
+				case (a.Name.Space == "") && (a.Name.Local == "xmlns"):
+					bindings[""] = a.Value
+				case a.Name.Space == "xmlns":
+					bindings[a.Name.Local] = a.Value
+				}
+			}
+
+			scope = append(scope, bindings)
+			names = append(names, t.Name)
+
+			ns := resolve(t.Name.Space)
+
+			if !root {
+				if !strings.EqualFold(t.Name.Local, "svg") || ((ns != "") && (ns != svgNamespace)) {
+					return nil, errNotSVG
+				}
+
+				root = true
+			}
+
+			if (skip > 0) || (ns == xincludeNamespace) {
+				skip++
+				continue
+			}
+
+			writeSVGStart(&out, t, resolve)
+
+		case xml.EndElement:
+			if (len(names) == 0) || (names[len(names)-1] != t.Name) {
+				return nil, errors.New("parse SVG: mismatched end element")
+			}
+
+			scope, names = scope[:len(scope)-1], names[:len(names)-1]
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+
+			out.WriteString("</" + rawName(t.Name) + ">")
+
+		case xml.CharData:
+			if (skip == 0) && (len(names) > 0) {
+				xml.EscapeText(&out, sanitizeCSS(t)) //nolint:errcheck
+			}
+		}
+	}
+
+	if !root || (len(names) > 0) {
+		return nil, errors.New("parse SVG: incomplete document")
+	}
+
+	return out.Bytes(), nil
+}
+
+// writeSVGStart writes the start element, dropping references to external resources from its attributes.
+func writeSVGStart(out *bytes.Buffer, t xml.StartElement, resolve func(prefix string) string) {
+	out.WriteString("<" + rawName(t.Name))
+
+	for _, a := range t.Attr {
+		local := strings.ToLower(a.Name.Local)
+
+		// Drop links of any namespace, and the base they are resolved against
+		if (a.Name.Space != "xmlns") && ((local == "href") || (local == "src")) && !svgLocalRef.MatchString(a.Value) {
+			continue
+		}
+
+		if (resolve(a.Name.Space) == xmlNamespace) && (local == "base") {
+			continue
+		}
+
+		out.WriteString(" " + rawName(a.Name) + `="`)
+		xml.EscapeText(out, sanitizeCSS([]byte(a.Value))) //nolint:errcheck
+		out.WriteString(`"`)
+	}
+
+	out.WriteString(">")
+}
+
+// sanitizeCSS removes CSS imports, and replaces CSS URLs other than fragments and embedded raster images with "none".
+// It applies to style elements and attributes, and to presentation attributes such as fill="url(...)". Data whose CSS
+// escapes hide imports or URLs (e.g. "\75 rl(...)" or "@\69mport") is unescaped first, and stripped of all remaining
+// backslashes, so the renderer sees exactly what has been sanitized.
+func sanitizeCSS(data []byte) []byte {
+	if bytes.IndexByte(data, '\\') >= 0 {
+		if unescaped := unescapeCSS(data); svgCSSImport.Match(unescaped) || svgCSSURL.Match(unescaped) {
+			data = bytes.ReplaceAll(unescaped, []byte{'\\'}, nil)
+		}
+	}
+
+	data = svgCSSImport.ReplaceAll(data, nil)
+
+	return svgCSSURL.ReplaceAllFunc(data, func(m []byte) []byte {
+		if sub := svgCSSURL.FindSubmatch(m); svgLocalRef.Match(sub[1]) {
+			return m
+		}
+
+		return []byte("none")
+	})
+}
+
+// unescapeCSS replaces all CSS escapes with the characters they stand for. Escaped newlines are removed, and escapes
+// of zero or of invalid code points stand for the replacement character, as in CSS.
+func unescapeCSS(data []byte) []byte {
+	return svgCSSEscape.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := svgCSSEscape.FindSubmatch(m)
+
+		switch {
+		case (len(sub[1]) == 0) && strings.ContainsRune("\n\r\f", rune(sub[2][0])):
+			return nil
+		case len(sub[1]) == 0:
+			return sub[2]
+		}
+
+		r, _ := strconv.ParseUint(string(sub[1]), 16, 32)
+		if (r == 0) || (r > unicode.MaxRune) {
+			r = unicode.ReplacementChar
+		}
+
+		return utf8.AppendRune(nil, rune(r))
+	})
+}
+
+// rawName returns the name as written in the document, with its prefix if any.
+func rawName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
+
+// prepareSVG sanitizes the SVG, selects the configured renderer, and returns the density that fits the rasterized SVG
+// into the requested size. The natural size is determined by pinging the SVG, which parses but does not render it.
+func prepareSVG(mw *imagick.MagickWand, data []byte, opts convertOptions) ([]byte, float64, error) {
+	data, err := sanitizeSVG(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	renderer := config().GetString("svg-renderer") + ":"
+
+	err = mw.SetFilename(renderer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("set renderer: %w", err)
+	}
+
+	if opts.SVG == nil {
+		return data, opts.Density, nil
+	}
+
+	// Determine natural size
+	mwp := acquireWand()
+	defer releaseWand(mwp)
+
+	err = mwp.SetResolution(svgUserDensity, svgUserDensity)
+	if err == nil {
+		err = mwp.SetFilename(renderer)
+	}
+
+	if err == nil {
+		err = mwp.PingImageBlob(data)
+	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("ping SVG: %w", err)
+	}
+
+	width, height := mwp.GetImageWidth(), mwp.GetImageHeight()
+	if (width == 0) || (height == 0) {
+		return nil, 0, errors.New("SVG has no size")
+	}
+
+	// Fit into requested size
+	scale := 0.0
+
+	if opts.SVG.Width > 0 {
+		scale = float64(opts.SVG.Width) / float64(width)
+	}
+
+	if hs := float64(opts.SVG.Height) / float64(height); (opts.SVG.Height > 0) && ((scale == 0) || (hs < scale)) {
+		scale = hs
+	}
+
+	return data, svgUserDensity * scale, nil
+}
+
+// isSVG returns true if the input is to be treated as an SVG document: if it sniffs as SVG, or if it sniffs as nothing
+// else but mentions an SVG element anywhere, since ImageMagick would decode it as SVG regardless. Such inputs are all
+// sanitized, and rejected unless they are well-formed SVG documents.
+func isSVG(data []byte) bool {
+	switch sniffFormat(data[:min(len(data), sniffLength)]) {
+	case "SVG":
+		return true
+	case "":
+		return hasSVGElement(data)
+	}
+
+	return false
+}
+
+// isXMLText returns true if the data starts like an XML document, i.e. with markup after an optional byte order mark and
+// whitespace.
+func isXMLText(data []byte) bool {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	return (len(data) > 0) && (data[0] == '<')
+}
+
+// hasSVGElement returns true if the data contains the start of an SVG element, in any case.
+func hasSVGElement(data []byte) bool {
+	for {
+		i := bytes.IndexByte(data, '<')
+		if i < 0 {
+			return false
+		}
+
+		data = data[i+1:]
+		if (len(data) >= 3) && bytes.EqualFold(data[:3], []byte("svg")) {
+			return true
+		}
+	}
+}
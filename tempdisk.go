@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// tempDiskInterval is the interval at which the usage of the temporary directory is measured.
+const tempDiskInterval = 5 * time.Second
+
+// tempFilePrefix is the prefix of temporary files written by ImageMagick, its delegates, and the server itself.
+const tempFilePrefix = "magick-"
+
+// tempDiskQuota defines the quota of the temporary directory of ImageMagick. ImageMagick itself only accounts for its
+// pixel cache, while delegates such as Ghostscript write temporary files as well, so the usage of the directory is
+// measured, and conversions are rejected while it exceeds the quota.
+type tempDiskQuota struct {
+	dir   string       // dir is the temporary directory.
+	quota int64        // quota is the maximum size of all temporary files, or 0 if it is unlimited.
+	usage atomic.Int64 // usage is the size of all temporary files, as last measured.
+	full  atomic.Bool  // full is true while the usage exceeds the quota.
+}
+
+// tempDisk is the quota of the temporary directory of ImageMagick.
+var tempDisk = &tempDiskQuota{}
+
+// magickTempDir returns the temporary directory of ImageMagick.
+func magickTempDir() string {
+	if dir := os.Getenv("MAGICK_TEMPORARY_PATH"); dir != "" {
+		return dir
+	}
+
+	return os.TempDir()
+}
+
+// prepareTempDir creates the given temporary directory, if any, and points ImageMagick (and its delegates) at it. It
+// must be called before ImageMagick is initialized.
+func prepareTempDir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("resolve temporary directory: %w", err)
+	}
+
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("create temporary directory: %w", err)
+	}
+
+	for _, k := range []string{"MAGICK_TEMPORARY_PATH", "TMPDIR"} {
+		err := os.Setenv(k, dir)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// start limits the pixel cache of ImageMagick to the quota, if any, and measures the usage of the temporary directory
+// in the background. It must be called after ImageMagick is initialized.
+func (q *tempDiskQuota) start(quota int64) {
+	q.dir, q.quota = magickTempDir(), quota
+
+	if (quota > 0) && !imagick.SetResourceLimit(imagick.RESOURCE_DISK, uint64(quota)) {
+		slog.Warn("Failed to limit ImageMagick disk resource", slog.Int64("quota", quota))
+	}
+
+	q.measure()
+
+	go func() {
+		for range time.Tick(tempDiskInterval) {
+			q.measure()
+		}
+	}()
+}
+
+// measure measures the usage of the temporary directory, including the per-request directories of the server, and
+// flags it as full while it exceeds the quota.
+func (q *tempDiskQuota) measure() {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		slog.Warn("Failed to measure temporary directory", slog.String("dir", q.dir), slog.Any("error", err))
+		return
+	}
+
+	var usage int64
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), tempFilePrefix) {
+			continue
+		}
+
+		// Per-request directories, e.g. of Ghostscript or Tesseract, are summed up as a whole
+		if e.IsDir() {
+			usage += treeSize(filepath.Join(q.dir, e.Name()))
+			continue
+		}
+
+		// Files may be removed while the directory is read
+		if info, err := e.Info(); (err == nil) && info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+	}
+
+	q.usage.Store(usage)
+
+	full := (q.quota > 0) && (usage >= q.quota)
+	if q.full.Swap(full) != full {
+		if full {
+			slog.Error("Temporary disk quota exceeded", slog.Int64("usage", usage), slog.Int64("quota", q.quota))
+		} else {
+			slog.Info("Temporary disk usage back below quota", slog.Int64("usage", usage), slog.Int64("quota", q.quota))
+		}
+	}
+}
+
+// treeSize returns the size of all regular files below the given directory. Files and directories removed while the
+// tree is walked are skipped.
+func treeSize(dir string) int64 {
+	var size int64
+
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error { //nolint:errcheck
+		if (err != nil) || !d.Type().IsRegular() {
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
+
+// admit returns an error if the temporary directory is full, so conversions fail before filling it up any further.
+func (q *tempDiskQuota) admit() *apiError {
+	if !q.full.Load() {
+		return nil
+	}
+
+	return newAPIError(http.StatusInsufficientStorage, errorCodeTempDiskFull, "temporary disk quota exceeded", nil)
+}
+
+// isDiskExhausted returns true if the ImageMagick error was caused by an exhausted disk resource or a full disk.
+func isDiskExhausted(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	return strings.Contains(msg, "cache resources exhausted") || strings.Contains(msg, "no space left on device")
+}
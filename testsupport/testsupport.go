@@ -0,0 +1,248 @@
+// Package testsupport provides tiny sample inputs and helpers to write table-driven tests of conversion operations
+// against golden images, with a perceptual tolerance that absorbs differences between ImageMagick builds.
+//
+// A typical test of a page operation looks like this:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(testsupport.Main(m))
+//	}
+//
+//	func TestGray(t *testing.T) {
+//		testsupport.Run(t, []testsupport.Case{
+//			{Name: "gray-png", Fixture: "page.png", Apply: func(mw *imagick.MagickWand) error {
+//				return applyToneOptions(mw, &toneOptions{Gray: true})
+//			}},
+//		})
+//	}
+//
+// Golden images are kept in "testdata/golden" and (re-)written by running the tests with -update-golden.
+package testsupport
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// DefaultTolerance is the maximum distortion between an image and its golden image, if none is given.
+const DefaultTolerance = 0.01
+
+// DefaultDensity is the density used to read fixtures, if none is given.
+const DefaultDensity = 72.0
+
+// goldenDir is the directory golden images are kept in, relative to the package under test.
+const goldenDir = "testdata/golden"
+
+// fixtures holds the sample inputs.
+//
+//go:embed fixtures
+var fixtures embed.FS
+
+// update makes AssertGolden write golden images instead of comparing against them.
+var update = flag.Bool("update-golden", false, "write golden images instead of comparing against them")
+
+// Main initializes ImageMagick, runs the tests, and terminates ImageMagick. It is meant to be called from TestMain.
+func Main(m *testing.M) int {
+	imagick.Initialize()
+	defer imagick.Terminate()
+
+	return m.Run()
+}
+
+// Fixtures returns the names of all sample inputs: "page.png" (16x16 RGBA with a transparent quadrant), "pages.tiff"
+// (two 16x16 grayscale gradients), and "pages.pdf" (two 1x1 inch pages with a colored rectangle each).
+func Fixtures() []string {
+	entries, _ := fixtures.ReadDir("fixtures")
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+// Fixture returns the contents of the sample input with the given name.
+func Fixture(tb testing.TB, name string) []byte {
+	tb.Helper()
+
+	data, err := fixtures.ReadFile("fixtures/" + name)
+	if err != nil {
+		tb.Fatalf("read fixture %q: %v", name, err)
+	}
+
+	return data
+}
+
+// ReadFixture reads the sample input with the given name into a new magick wand, rendered at the given density (or
+// DefaultDensity if zero). The wand is destroyed when the test finishes.
+func ReadFixture(tb testing.TB, name string, density float64) *imagick.MagickWand {
+	tb.Helper()
+
+	if density == 0 {
+		density = DefaultDensity
+	}
+
+	mw := imagick.NewMagickWand()
+	tb.Cleanup(mw.Destroy)
+
+	err := mw.SetResolution(density, density)
+	if err != nil {
+		tb.Fatalf("set density: %v", err)
+	}
+
+	err = mw.ReadImageBlob(Fixture(tb, name))
+	if err != nil {
+		tb.Fatalf("read fixture %q: %v", name, err)
+	}
+
+	return mw
+}
+
+// Case defines a case of a table-driven test of an operation.
+type Case struct {
+	Name      string                             // Name names the subtest.
+	Fixture   string                             // Fixture is the name of the sample input.
+	Density   float64                            // Density is the density the fixture is read with.
+	Page      int                                // Page is the zero-based page of the fixture to operate on.
+	Apply     func(mw *imagick.MagickWand) error // Apply performs the operation under test.
+	Golden    string                             // Golden names the golden image (defaults to Name).
+	Tolerance float64                            // Tolerance is the maximum distortion (defaults to DefaultTolerance).
+	WantErr   bool                               // WantErr expects Apply to fail, in which case no image is compared.
+}
+
+// Run runs every case as a subtest: it reads the page of the fixture, applies the operation, and compares the result
+// against the golden image.
+func Run(t *testing.T, cases []Case) {
+	t.Helper()
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			// Pull page into its own magick wand
+			mw := ReadFixture(t, c.Fixture, c.Density)
+			mw.SetIteratorIndex(c.Page)
+
+			page := mw.GetImage()
+			t.Cleanup(page.Destroy)
+
+			// Apply operation
+			err := c.Apply(page)
+			if c.WantErr {
+				if err == nil {
+					t.Fatal("expected operation to fail")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("apply operation: %v", err)
+			}
+
+			// Compare against golden image
+			golden := c.Golden
+			if golden == "" {
+				golden = c.Name
+			}
+
+			tolerance := c.Tolerance
+			if tolerance == 0 {
+				tolerance = DefaultTolerance
+			}
+
+			AssertGolden(t, page, golden, tolerance)
+		})
+	}
+}
+
+// AssertGolden fails the test if the distortion between the image and the golden image with the given name exceeds
+// the tolerance. With -update-golden, the golden image is written instead.
+func AssertGolden(tb testing.TB, mw *imagick.MagickWand, name string, tolerance float64) {
+	tb.Helper()
+
+	path := filepath.Join(goldenDir, name+".png")
+
+	// Write golden image
+	if *update {
+		err := writeGolden(mw, path)
+		if err != nil {
+			tb.Fatalf("write golden image: %v", err)
+		}
+
+		return
+	}
+
+	// Read golden image
+	golden := imagick.NewMagickWand()
+	defer golden.Destroy()
+
+	err := golden.ReadImage(path)
+	if err != nil {
+		tb.Fatalf("read golden image (run with -update-golden to create it): %v", err)
+	}
+
+	// Compare
+	d, err := Distortion(mw, golden)
+	if err != nil {
+		tb.Fatalf("compare with golden image %q: %v", path, err)
+	}
+
+	if d > tolerance {
+		tb.Errorf("image differs from golden image %q: distortion %.4f exceeds tolerance %.4f", path, d, tolerance)
+	}
+}
+
+// Distortion returns the perceptual distortion between two images, from 0 (identical) to 1. It is the normalized
+// root mean squared error in the CIE Lab colorspace, which is closer to perceived differences than errors in RGB.
+func Distortion(a, b *imagick.MagickWand) (float64, error) {
+	// Check dimensions
+	if (a.GetImageWidth() != b.GetImageWidth()) || (a.GetImageHeight() != b.GetImageHeight()) {
+		return 0, fmt.Errorf("dimensions differ: %dx%d vs. %dx%d",
+			a.GetImageWidth(), a.GetImageHeight(), b.GetImageWidth(), b.GetImageHeight())
+	}
+
+	// Convert both images to Lab
+	la, lb := a.Clone(), b.Clone()
+	defer la.Destroy()
+	defer lb.Destroy()
+
+	for _, mw := range []*imagick.MagickWand{la, lb} {
+		err := mw.TransformImageColorspace(imagick.COLORSPACE_LAB)
+		if err != nil {
+			return 0, fmt.Errorf("convert to Lab: %w", err)
+		}
+	}
+
+	// Compare
+	diff, distortion := la.CompareImages(lb, imagick.METRIC_ROOT_MEAN_SQUARED_ERROR)
+	if diff == nil {
+		return 0, fmt.Errorf("compare images: %w", la.GetLastError())
+	}
+
+	diff.Destroy()
+
+	return distortion, nil
+}
+
+// writeGolden writes the image as a PNG golden image.
+func writeGolden(mw *imagick.MagickWand, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+
+	out := mw.Clone()
+	defer out.Destroy()
+
+	err = out.SetImageFormat("PNG")
+	if err != nil {
+		return fmt.Errorf("set format: %w", err)
+	}
+
+	return out.WriteImage(path)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// maxTextLength is the maximum length of text annotations in characters.
+const maxTextLength = 256
+
+// fontName matches the supported font names. Paths are not allowed, so clients cannot make ImageMagick read files.
+var fontName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _-]*$`)
+
+// textOptions defines the text annotation drawn onto each page.
+type textOptions struct {
+	Content string  `json:"content"`        // Content is the text, with "{page}", "{total}", and "{date}" placeholders.
+	Font    string  `json:"font,omitempty"` // Font is the name of the font, or empty for the default font.
+	Size    float64 `json:"size"`           // Size is the font size in points.
+	Color   string  `json:"color"`          // Color is the text color as "#RRGGBB".
+	Gravity string  `json:"gravity"`        // Gravity is the position of the text on the page.
+	Margin  float64 `json:"margin"`         // Margin is the distance to the page edges in points.
+	Start   int     `json:"start"`          // Start is the number of the first page.
+	Date    string  `json:"date"`           // Date is the date of the conversion as "YYYY-MM-DD".
+}
+
+// parseTextOptions parses the text annotation URL parameters. It returns nil if no text is set.
+func parseTextOptions(query url.Values) (*textOptions, *apiError) {
+	invalid := func(name string, err error) *apiError {
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid "+name+" parameter", err)
+	}
+
+	v := query.Get("text")
+	if v == "" {
+		return nil, nil
+	}
+
+	opts := &textOptions{
+		Content: v,
+		Size:    10.0,
+		Color:   "#000000",
+		Gravity: "southeast",
+		Margin:  18.0,
+		Start:   1,
+		Date:    time.Now().Format(time.DateOnly),
+	}
+
+	// Check content
+	_, err := expandTextPlaceholders(opts, pageInfo{})
+	if (err != nil) || (utf8.RuneCountInString(v) > maxTextLength) {
+		return nil, invalid("text", err)
+	}
+
+	// Parse font
+	if v := query.Get("text-font"); v != "" {
+		if !fontName.MatchString(v) {
+			return nil, invalid("text-font", nil)
+		}
+
+		opts.Font = v
+	}
+
+	// Parse font size and margin
+	for name, f := range map[string]*float64{"text-size": &opts.Size, "text-margin": &opts.Margin} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if (err != nil) || !((n >= 0) && (n <= 1000)) {
+				return nil, invalid(name, err)
+			}
+
+			*f = n
+		}
+	}
+
+	// Parse color
+	if v := strings.ToLower(query.Get("text-color")); v != "" {
+		if !backgroundColor.MatchString(v) {
+			return nil, invalid("text-color", nil)
+		}
+
+		opts.Color = v
+	}
+
+	// Parse gravity
+	if v := query.Get("text-gravity"); v != "" {
+		v = normalizeGravity(v)
+		if _, ok := gravityMap[v]; !ok {
+			return nil, invalid("text-gravity", nil)
+		}
+
+		opts.Gravity = v
+	}
+
+	// Parse number of first page
+	if v := query.Get("text-start"); v != "" {
+		n, err := strconv.Atoi(v)
+		if (err != nil) || (n < 0) {
+			return nil, invalid("text-start", err)
+		}
+
+		opts.Start = n
+	}
+
+	return opts, nil
+}
+
+// expandTextPlaceholders expands the placeholders of the text content for the given page.
+func expandTextPlaceholders(opts *textOptions, pi pageInfo) (string, error) {
+	return expandPlaceholders(opts.Content, map[string]any{
+		"page":  opts.Start + pi.index,
+		"total": pi.count,
+		"date":  opts.Date,
+	})
+}
+
+// applyTextOptions draws the text annotation onto the page. Font size and margin are scaled by the page resolution, so
+// they keep their physical size regardless of the density.
+func applyTextOptions(mw *imagick.MagickWand, opts *textOptions, pi pageInfo) error {
+	// Expand text
+	text, err := expandTextPlaceholders(opts, pi)
+	if err != nil {
+		return fmt.Errorf("expand text: %w", err)
+	}
+
+	// Determine scale
+	scale := 1.0
+
+	if x, _, err := mw.GetImageResolution(); (err == nil) && (x > 0) {
+		scale = x / 72.0
+	}
+
+	// Set up drawing
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+
+	if !pw.SetColor(opts.Color) {
+		return fmt.Errorf("invalid color %q", opts.Color)
+	}
+
+	if opts.Font != "" {
+		err = dw.SetFont(opts.Font)
+		if err != nil {
+			return fmt.Errorf("set font: %w", err)
+		}
+	}
+
+	dw.SetFillColor(pw)
+	dw.SetFontSize(opts.Size * scale)
+	dw.SetGravity(gravityMap[opts.Gravity])
+	dw.SetTextAntialias(true)
+
+	// Draw text
+	margin := opts.Margin * scale
+
+	err = mw.AnnotateImage(dw, margin, margin, 0, text)
+	if err != nil {
+		return fmt.Errorf("annotate image: %w", err)
+	}
+
+	return nil
+}
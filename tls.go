@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// clientCNKey is the context key of the common name of the verified client certificate.
+type clientCNKey struct{}
+
+// newTLSConfig returns the TLS configuration of the server, or nil if TLS is not configured. If a client CA is given,
+// every client has to present a certificate issued by it.
+func newTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, caFile := config().GetString("tls-cert"), config().GetString("tls-key"), config().GetString("tls-client-ca")
+
+	if (certFile == "") && (keyFile == "") {
+		if caFile != "" {
+			return nil, errors.New("client CA requires server certificate and key")
+		}
+
+		return nil, nil
+	}
+
+	// Read server certificate
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read server certificate: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	// Read client CA
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client CA contains no certificates")
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return cfg, nil
+}
+
+// clientIdentity is a middleware that stores the common name of the verified client certificate in the request
+// context, so it is added to every log record of the request.
+func clientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.TLS == nil) || (len(r.TLS.VerifiedChains) == 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), clientCNKey{}, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientCN returns the common name of the verified client certificate stored in the context, or empty if there is none.
+func clientCN(ctx context.Context) string {
+	cn, _ := ctx.Value(clientCNKey{}).(string)
+	return cn
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// thresholdAuto selects the threshold of bitonal conversions adaptively using Otsu's method.
+const thresholdAuto = "auto"
+
+// toneOptions defines the grayscale and bitonal conversion options.
+type toneOptions struct {
+	Gray      bool   `json:"gray,omitempty"`      // Gray converts the page to grayscale.
+	Threshold string `json:"threshold,omitempty"` // Threshold converts the page to black and white ("auto" or 0-100).
+}
+
+// parseToneOptions parses the grayscale and bitonal URL parameters. It returns nil if none of them are set.
+func parseToneOptions(query url.Values) (*toneOptions, *apiError) {
+	opts := &toneOptions{}
+	set := false
+
+	// Parse colorspace
+	if v := query.Get("colorspace"); v != "" {
+		if !strings.EqualFold(v, "gray") {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid colorspace parameter", nil)
+		}
+
+		opts.Gray = true
+		set = true
+	}
+
+	// Parse threshold
+	if v := strings.ToLower(query.Get("threshold")); v != "" {
+		if v != thresholdAuto {
+			t, err := strconv.ParseFloat(v, 64)
+			if (err != nil) || !((t >= 0) && (t <= 100)) {
+				return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid threshold parameter", err)
+			}
+		}
+
+		opts.Gray = true
+		opts.Threshold = v
+		set = true
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// applyToneOptions converts the image to grayscale and, if a threshold is set, to black and white.
+func applyToneOptions(mw *imagick.MagickWand, opts *toneOptions) error {
+	// Convert to grayscale
+	if opts.Gray {
+		err := mw.TransformImageColorspace(imagick.COLORSPACE_GRAY)
+		if err != nil {
+			return fmt.Errorf("convert to grayscale: %w", err)
+		}
+	}
+
+	if opts.Threshold == "" {
+		return nil
+	}
+
+	// Determine threshold in percent
+	var percent float64
+
+	if opts.Threshold == thresholdAuto {
+		t, err := otsuThreshold(mw)
+		if err != nil {
+			return fmt.Errorf("compute threshold: %w", err)
+		}
+
+		percent = float64(t) * 100.0 / 255.0
+	} else {
+		percent, _ = strconv.ParseFloat(opts.Threshold, 64)
+	}
+
+	// Apply threshold
+	_, quantumRange := imagick.GetQuantumRange()
+
+	err := mw.ThresholdImage(float64(quantumRange) * percent / 100.0)
+	if err != nil {
+		return fmt.Errorf("apply threshold: %w", err)
+	}
+
+	err = mw.SetImageType(imagick.IMAGE_TYPE_BILEVEL)
+	if err != nil {
+		return fmt.Errorf("set image type: %w", err)
+	}
+
+	return nil
+}
+
+// otsuThreshold computes the 8-bit intensity that best separates the foreground from the background of the image,
+// using Otsu's method of maximizing the variance between both classes.
+func otsuThreshold(mw *imagick.MagickWand) (int, error) {
+	// Compute histogram of intensities
+	pixels, err := mw.ExportImagePixels(0, 0, mw.GetImageWidth(), mw.GetImageHeight(), "I", imagick.PIXEL_CHAR)
+	if err != nil {
+		return 0, fmt.Errorf("export pixels: %w", err)
+	}
+
+	intensities, ok := pixels.([]byte)
+	if !ok || (len(intensities) == 0) {
+		return 0, errors.New("unexpected pixel data")
+	}
+
+	var histogram [256]float64
+	for _, i := range intensities {
+		histogram[i]++
+	}
+
+	// Find threshold with maximum between-class variance
+	var sum float64
+	for i, n := range histogram {
+		sum += float64(i) * n
+	}
+
+	var (
+		total     = float64(len(intensities))
+		sumB      float64
+		weightB   float64
+		best      int
+		bestScore float64
+	)
+
+	for t, n := range histogram {
+		weightB += n
+		if weightB == 0 {
+			continue
+		}
+
+		weightF := total - weightB
+		if weightF == 0 {
+			break
+		}
+
+		sumB += float64(t) * n
+
+		meanB := sumB / weightB
+		meanF := (sum - sumB) / weightF
+
+		if score := weightB * weightF * (meanB - meanF) * (meanB - meanF); score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+
+	return best, nil
+}
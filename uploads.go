@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// tusVersion is the version of the tus resumable upload protocol that is supported.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the supported extensions of the tus protocol.
+const tusExtensions = "creation,expiration,termination"
+
+const (
+	tusResumableHeader   = "Tus-Resumable"   // tusResumableHeader carries the protocol version of a request or response.
+	uploadOffsetHeader   = "Upload-Offset"   // uploadOffsetHeader carries the number of bytes received so far.
+	uploadLengthHeader   = "Upload-Length"   // uploadLengthHeader carries the size of the whole upload.
+	uploadMetadataHeader = "Upload-Metadata" // uploadMetadataHeader carries base64-encoded key-value pairs.
+	uploadExpiresHeader  = "Upload-Expires"  // uploadExpiresHeader carries the time the upload expires.
+)
+
+// uploadContentType is the media type of the bodies of PATCH requests.
+const uploadContentType = "application/offset+octet-stream"
+
+// uploadFilePrefix is the prefix of the files holding uploads.
+const uploadFilePrefix = "upload-"
+
+// uploadSweepInterval is the interval at which expired uploads are removed.
+const uploadSweepInterval = time.Minute
+
+// upload defines a resumable upload, whose data is appended to a file in chunks.
+type upload struct {
+	mu       sync.Mutex // mu serializes writes to the upload.
+	id       string     // id identifies the upload.
+	path     string     // path is the file holding the data received so far.
+	length   int64      // length is the size of the whole upload.
+	offset   int64      // offset is the number of bytes received so far.
+	filename string     // filename is the original filename of the upload, if given.
+	expires  time.Time  // expires is the time the upload expires.
+}
+
+// uploadStore defines the resumable uploads of this instance. Their data is kept in files of a directory, while their
+// state is kept in memory, so uploads do not survive restarts.
+type uploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]*upload // uploads are all uploads, by ID.
+	dir     string             // dir is the directory holding the files of the uploads.
+	maxSize int64              // maxSize is the maximum size of an upload, or 0 if it is unlimited.
+	ttl     time.Duration      // ttl is the time after which an upload expires.
+}
+
+// uploadKey is the context key of the upload a conversion reads its input from.
+type uploadKey struct{}
+
+// newUploadStore creates a new store of resumable uploads in the given directory, which is created if needed, and
+// removes expired uploads in the background. Files left over by earlier runs are removed. It returns nil if resumable
+// uploads are disabled.
+func newUploadStore(dir string, maxSize int64, ttl time.Duration) (*uploadStore, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("create upload directory: %w", err)
+	}
+
+	stale, err := filepath.Glob(filepath.Join(dir, uploadFilePrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("list upload directory: %w", err)
+	}
+
+	for _, p := range stale {
+		os.Remove(p) //nolint:errcheck
+	}
+
+	s := &uploadStore{uploads: map[string]*upload{}, dir: dir, maxSize: maxSize, ttl: ttl}
+
+	go func() {
+		for range time.Tick(uploadSweepInterval) {
+			s.sweep()
+		}
+	}()
+
+	return s, nil
+}
+
+// create creates a new, empty upload of the given size.
+func (s *uploadStore) create(length int64, filename string) (*upload, error) {
+	u := &upload{id: newRequestID(), length: length, filename: filename, expires: time.Now().Add(s.ttl)}
+	u.path = filepath.Join(s.dir, uploadFilePrefix+u.id)
+
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("create upload file: %w", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(u.path) //nolint:errcheck
+		return nil, fmt.Errorf("close upload file: %w", err)
+	}
+
+	s.mu.Lock()
+	s.uploads[u.id] = u
+	s.mu.Unlock()
+
+	return u, nil
+}
+
+// get returns the upload with the given ID, or nil if it does not exist or has expired.
+func (s *uploadStore) get(id string) *upload {
+	s.mu.Lock()
+	u, ok := s.uploads[id]
+	s.mu.Unlock()
+
+	if !ok || !time.Now().Before(u.expires) {
+		return nil
+	}
+
+	return u
+}
+
+// remove removes the upload with the given ID. It returns false if the upload does not exist.
+func (s *uploadStore) remove(id string) bool {
+	s.mu.Lock()
+
+	u, ok := s.uploads[id]
+	if ok {
+		delete(s.uploads, id)
+	}
+
+	s.mu.Unlock()
+
+	if ok {
+		os.Remove(u.path) //nolint:errcheck
+	}
+
+	return ok
+}
+
+// sweep removes all expired uploads.
+func (s *uploadStore) sweep() {
+	var expired []string
+
+	s.mu.Lock()
+
+	now := time.Now()
+
+	for id, u := range s.uploads {
+		if !now.Before(u.expires) {
+			expired = append(expired, id)
+		}
+	}
+
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		s.remove(id)
+	}
+}
+
+// state returns the number of bytes received so far, and whether the upload is complete.
+func (u *upload) state() (int64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.offset, u.offset == u.length
+}
+
+// write appends the body to the upload, which must have received exactly the given number of bytes so far. Everything
+// written is kept if the body ends prematurely, so the client can resume from the new offset, except if the body does
+// not match its digest.
+func (u *upload) write(offset int64, body io.Reader) (int64, *apiError) {
+	if !u.mu.TryLock() {
+		return 0, newAPIError(http.StatusConflict, errorCodeOffsetMismatch, "upload is being written", nil)
+	}
+
+	defer u.mu.Unlock()
+
+	if offset != u.offset {
+		return u.offset, newAPIError(http.StatusConflict, errorCodeOffsetMismatch, "upload offset does not match", nil)
+	}
+
+	f, err := os.OpenFile(u.path, os.O_WRONLY, 0)
+	if err != nil {
+		return u.offset, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to open upload", err)
+	}
+
+	defer f.Close() //nolint:errcheck
+
+	// Bodies may be shorter than the rest of the upload, but must not exceed it. One more byte is read, so the end of
+	// bodies of the exact size is read as well, which verifies their digest.
+	remaining := u.length - u.offset
+
+	n, err := io.Copy(io.NewOffsetWriter(f, u.offset), io.LimitReader(body, remaining+1))
+
+	switch {
+	case errors.Is(err, errDigestMismatch):
+		f.Truncate(u.offset) //nolint:errcheck
+		return u.offset, bodyReadError(err)
+	case n > remaining:
+		f.Truncate(u.offset) //nolint:errcheck
+		return u.offset, newAPIError(http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "chunk exceeds upload", nil)
+	}
+
+	u.offset += n
+
+	if err != nil {
+		return u.offset, bodyReadError(err)
+	}
+
+	return u.offset, nil
+}
+
+// input maps the data of the completed upload into memory, as input of a conversion, and checks its first chunk with
+// the given function. The mapping is released once the context is done, while the upload is kept until it expires or
+// is deleted, so it can be converted again.
+func (u *upload) input(ctx context.Context, check func(head []byte) *apiError) (*input, *apiError) {
+	f, err := os.Open(u.path)
+	if err != nil {
+		return nil, newAPIError(http.StatusNotFound, errorCodeUploadNotFound, "upload not found", err)
+	}
+
+	data, unmap, err := mapFile(f)
+	f.Close() //nolint:errcheck
+
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, errorCodeProcessingFailed, "failed to read upload", err)
+	}
+
+	context.AfterFunc(ctx, unmap)
+
+	aerr := check(data[:min(len(data), sniffLength)])
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return &input{data: data, path: u.path, filename: u.filename, parts: map[string][]byte{}}, nil
+}
+
+// attach is a middleware that lets conversions read their input from the completed upload given by the "upload"
+// parameter, instead of from the request body.
+func (s *uploadStore) attach(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("upload")
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := s.get(id)
+		if u == nil {
+			uploadNotFound(w, r)
+			return
+		}
+
+		if _, complete := u.state(); !complete {
+			renderError(w, r, http.StatusConflict, errorCodeUploadIncomplete, "upload is not complete")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadKey{}, u)))
+	})
+}
+
+// contextUpload returns the upload a conversion reads its input from, or nil if it reads the request body.
+func contextUpload(ctx context.Context) *upload {
+	u, _ := ctx.Value(uploadKey{}).(*upload)
+	return u
+}
+
+// tusResumable is a middleware that rejects requests of unsupported versions of the tus protocol, and marks all
+// responses with the supported version.
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(tusResumableHeader, tusVersion)
+
+		if (r.Method != http.MethodOptions) && (r.Header.Get(tusResumableHeader) != tusVersion) {
+			w.Header().Set("Tus-Version", tusVersion)
+			rejectEarly(w, r, newAPIError(http.StatusPreconditionFailed, errorCodeInvalidParameter, "unsupported tus version", nil))
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseUploadMetadata returns the filename of the Upload-Metadata header, a comma-separated list of keys and
+// base64-encoded values. All other keys are ignored.
+func parseUploadMetadata(header string) (string, error) {
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if (key != "filename") && (key != "name") {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("decode %s: %w", key, err)
+		}
+
+		return string(decoded), nil
+	}
+
+	return "", nil
+}
+
+// describeUpload sets the headers describing the upload.
+func describeUpload(w http.ResponseWriter, u *upload, offset int64) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	w.Header().Set(uploadLengthHeader, strconv.FormatInt(u.length, 10))
+	w.Header().Set(uploadExpiresHeader, u.expires.UTC().Format(http.TimeFormat))
+}
+
+// uploadNotFound responds that the requested upload does not exist.
+func uploadNotFound(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, errorCodeUploadNotFound, "upload not found")
+}
+
+// optionsUploadHandler describes the supported version and extensions of the tus protocol.
+func optionsUploadHandler(store *uploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+
+		if store.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(store.maxSize, 10))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// createUploadHandler creates a new, empty upload of the size given by the Upload-Length header.
+func createUploadHandler(store *uploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		length, err := strconv.ParseInt(r.Header.Get(uploadLengthHeader), 10, 64)
+		if (err != nil) || (length < 0) {
+			rejectEarly(w, r, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid upload length", err))
+			return
+		}
+
+		if (store.maxSize > 0) && (length > store.maxSize) {
+			rejectEarly(w, r, newAPIError(http.StatusRequestEntityTooLarge, errorCodeBodyTooLarge, "upload too large", nil))
+			return
+		}
+
+		filename, err := parseUploadMetadata(r.Header.Get(uploadMetadataHeader))
+		if err != nil {
+			rejectEarly(w, r, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid upload metadata", err))
+			return
+		}
+
+		u, err := store.create(length, filename)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to create upload", slog.Any("error", err))
+			renderError(w, r, http.StatusInternalServerError, errorCodeProcessingFailed, "failed to create upload")
+
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Created upload", slog.String("upload", u.id), slog.Int64("length", length))
+
+		describeUpload(w, u, 0)
+		w.Header().Set("Location", "/uploads/"+u.id)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// headUploadHandler describes an existing upload, so clients know where to resume.
+func headUploadHandler(store *uploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := store.get(chi.URLParam(r, "id"))
+		if u == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		offset, _ := u.state()
+
+		describeUpload(w, u, offset)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// patchUploadHandler appends a chunk to an existing upload, starting at the offset given by the Upload-Offset header.
+func patchUploadHandler(store *uploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != uploadContentType {
+			rejectEarly(w, r, newAPIError(http.StatusUnsupportedMediaType, errorCodeUnsupportedMedia, "unsupported content type", nil))
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+		if err != nil {
+			rejectEarly(w, r, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid upload offset", err))
+			return
+		}
+
+		u := store.get(chi.URLParam(r, "id"))
+		if u == nil {
+			w.Header().Set("Connection", "close")
+			uploadNotFound(w, r)
+
+			return
+		}
+
+		// Chunks are bound by the size of request bodies
+		if limit := config().GetInt64("max-body-size"); limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+
+		offset, aerr := u.write(offset, r.Body)
+		if aerr != nil {
+			slog.ErrorContext(r.Context(), "Failed to write upload", slog.String("upload", u.id), slog.Any("error", aerr))
+			rejectEarly(w, r, aerr)
+
+			return
+		}
+
+		if offset == u.length {
+			slog.InfoContext(r.Context(), "Completed upload", slog.String("upload", u.id), slog.Int64("length", u.length))
+		}
+
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+		w.Header().Set(uploadExpiresHeader, u.expires.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteUploadHandler removes an existing upload.
+func deleteUploadHandler(store *uploadStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !store.remove(chi.URLParam(r, "id")) {
+			uploadNotFound(w, r)
+			return
+		}
+
+		render.NoContent(w, r)
+	}
+}
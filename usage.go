@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+)
+
+// usageKey is the context key of the usage of a request.
+type usageKey struct{}
+
+const (
+	maxUsageSubjects = 10_000 // maxUsageSubjects is the maximum number of client keys and tenants accounted separately.
+	maxTenantLength  = 64     // maxTenantLength is the maximum length of tenants accounted separately.
+)
+
+// otherTenant is the tenant usage is accounted to once the tenant header is too long, or there are too many tenants.
+const otherTenant = "*"
+
+// usageCounters defines the resources used by requests.
+type usageCounters struct {
+	Requests   uint64  `json:"requests"`    // Requests is the number of requests.
+	Pages      uint64  `json:"pages"`       // Pages is the number of input pages read.
+	CPUSeconds float64 `json:"cpu_seconds"` // CPUSeconds is the CPU time spent decoding and converting, see measureCPU.
+	BytesIn    uint64  `json:"bytes_in"`    // BytesIn is the number of request body bytes read.
+	BytesOut   uint64  `json:"bytes_out"`   // BytesOut is the number of response body bytes written.
+}
+
+// add adds the counters of another usage.
+func (c *usageCounters) add(o usageCounters) {
+	c.Requests += o.Requests
+	c.Pages += o.Pages
+	c.CPUSeconds += o.CPUSeconds
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+}
+
+// usageEntry defines the usage of a single client key and tenant.
+type usageEntry struct {
+	Key    string `json:"key"`    // Key identifies the client, see clientKey.
+	Tenant string `json:"tenant"` // Tenant is the value of the tenant header.
+
+	usageCounters
+}
+
+// usageReport defines the usage of all client keys and tenants within a period.
+type usageReport struct {
+	From  time.Time    `json:"from"`  // From is the start of the period.
+	To    time.Time    `json:"to"`    // To is the end of the period.
+	Usage []usageEntry `json:"usage"` // Usage is the usage of all client keys and tenants, sorted.
+}
+
+// usageSubject identifies the client key and tenant usage is accounted to.
+type usageSubject struct {
+	key    string
+	tenant string
+}
+
+// requestUsage defines the usage of a single request, which is updated by all page workers.
+type requestUsage struct {
+	pages atomic.Uint64
+	cpu   atomic.Int64
+}
+
+// usageMeter accounts the usage of all requests by client key and tenant. The total since startup is reported by
+// GET /usage, the usage since the last export is periodically exported to the configured sink.
+type usageMeter struct {
+	tenantHeader string // tenantHeader is the request header naming the tenant.
+	sink         string // sink is the URL or file usage is exported to, or empty to disable exports.
+
+	mu         sync.Mutex
+	since      time.Time                       // since is the time accounting started at.
+	exported   time.Time                       // exported is the time of the last export.
+	total      map[usageSubject]*usageCounters // total is the usage since startup.
+	unexported map[usageSubject]*usageCounters // unexported is the usage since the last export.
+}
+
+// newUsageMeter creates a new usage meter. If a sink is given, usage is exported to it in the given interval: either
+// POSTed as JSON to an HTTP(S) URL, or appended as JSON line to a file.
+func newUsageMeter(tenantHeader, sink string, interval time.Duration) *usageMeter {
+	now := time.Now()
+
+	m := &usageMeter{
+		tenantHeader: tenantHeader,
+		sink:         sink,
+		since:        now,
+		exported:     now,
+		total:        map[usageSubject]*usageCounters{},
+		unexported:   map[usageSubject]*usageCounters{},
+	}
+
+	if (sink != "") && (interval > 0) {
+		go func() {
+			for range time.Tick(interval) {
+				m.export(context.Background())
+			}
+		}()
+	}
+
+	return m
+}
+
+// record is a middleware that accounts the usage of the request.
+func (m *usageMeter) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ru := &requestUsage{}
+		body := &countingReader{ReadCloser: r.Body}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		r.Body = body
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), usageKey{}, ru)))
+
+		m.add(usageSubject{key: clientKey(r.Context()), tenant: r.Header.Get(m.tenantHeader)}, usageCounters{
+			Requests:   1,
+			Pages:      ru.pages.Load(),
+			CPUSeconds: time.Duration(ru.cpu.Load()).Seconds(),
+			BytesIn:    body.n.Load(),
+			BytesOut:   uint64(ww.BytesWritten()),
+		})
+	})
+}
+
+// add accounts the usage of a request. Since tenants are named by the client, new tenants are accounted to otherTenant
+// once there are too many client keys and tenants, and so are overly long ones.
+func (m *usageMeter) add(s usageSubject, c usageCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if (len(s.tenant) > maxTenantLength) || ((m.total[s] == nil) && (len(m.total) >= maxUsageSubjects)) {
+		s.tenant = otherTenant
+	}
+
+	for _, counters := range []map[usageSubject]*usageCounters{m.total, m.unexported} {
+		if counters[s] == nil {
+			counters[s] = &usageCounters{}
+		}
+
+		counters[s].add(c)
+	}
+}
+
+// report returns the usage since startup of all client keys accepted by the given function.
+func (m *usageMeter) report(accept func(key string) bool) usageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters := map[usageSubject]*usageCounters{}
+
+	for s, c := range m.total {
+		if accept(s.key) {
+			counters[s] = c
+		}
+	}
+
+	return newUsageReport(m.since, time.Now(), counters)
+}
+
+// export exports the usage since the last export to the sink. If the export fails, the usage is kept for the next one.
+func (m *usageMeter) export(ctx context.Context) {
+	// Take unexported usage
+	m.mu.Lock()
+
+	now := time.Now()
+	report := newUsageReport(m.exported, now, m.unexported)
+	unexported := m.unexported
+
+	m.exported, m.unexported = now, map[usageSubject]*usageCounters{}
+
+	m.mu.Unlock()
+
+	// Export usage
+	err := writeUsageReport(ctx, m.sink, report)
+	if err == nil {
+		slog.Debug("Exported usage", slog.Int("entries", len(report.Usage)))
+		return
+	}
+
+	slog.Warn("Failed to export usage", slog.Any("error", err))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.exported = report.From
+
+	for s, c := range unexported {
+		if m.unexported[s] == nil {
+			m.unexported[s] = &usageCounters{}
+		}
+
+		m.unexported[s].add(*c)
+	}
+}
+
+// flush exports the usage since the last export, if a sink is configured.
+func (m *usageMeter) flush(ctx context.Context) {
+	if m.sink != "" {
+		m.export(ctx)
+	}
+}
+
+// newUsageReport returns a report of the given usage, sorted by client key and tenant.
+func newUsageReport(from, to time.Time, counters map[usageSubject]*usageCounters) usageReport {
+	report := usageReport{From: from, To: to, Usage: make([]usageEntry, 0, len(counters))}
+
+	for s, c := range counters {
+		report.Usage = append(report.Usage, usageEntry{Key: s.key, Tenant: s.tenant, usageCounters: *c})
+	}
+
+	sort.Slice(report.Usage, func(i, j int) bool {
+		a, b := report.Usage[i], report.Usage[j]
+		return (a.Key < b.Key) || ((a.Key == b.Key) && (a.Tenant < b.Tenant))
+	})
+
+	return report
+}
+
+// writeUsageReport writes the report to the sink: it is POSTed to HTTP(S) URLs, and appended to files otherwise.
+func writeUsageReport(ctx context.Context, sink string, report usageReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("encode report: %w", err)
+	}
+
+	// Append to file
+	if !strings.HasPrefix(sink, "http://") && !strings.HasPrefix(sink, "https://") {
+		f, err := os.OpenFile(sink, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("open file: %w", err)
+		}
+
+		defer f.Close() //nolint:errcheck
+
+		_, err = f.Write(append(data, '\n'))
+		if err != nil {
+			return fmt.Errorf("write file: %w", err)
+		}
+
+		return nil
+	}
+
+	// Post to URL
+	return postJSON(ctx, sink, data)
+}
+
+// postJSON posts the JSON document to the URL within 30 seconds, and fails unless the response is successful.
+func postJSON(ctx context.Context, rawURL string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+
+	defer res.Body.Close() //nolint:errcheck
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("post: unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// usageHandler responds with the usage since startup of all client keys and tenants if all is set, as on the admin
+// listener, or else only with the usage of the client key of the request.
+func usageHandler(m *usageMeter, all bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := clientKey(r.Context())
+
+		render.Status(r, http.StatusOK)
+		render.JSON(w, r, m.report(func(k string) bool { return all || (k == key) }))
+	}
+}
+
+// countPages accounts the number of input pages read to the usage of the request.
+func countPages(ctx context.Context, pages uint) {
+	if ru, _ := ctx.Value(usageKey{}).(*requestUsage); ru != nil {
+		ru.pages.Add(uint64(pages))
+	}
+}
+
+// countCPUTime accounts CPU time spent decoding or converting to the usage of the request.
+func countCPUTime(ctx context.Context, d time.Duration) {
+	if ru, _ := ctx.Value(usageKey{}).(*requestUsage); ru != nil {
+		ru.cpu.Add(int64(d))
+	}
+}
+
+// measureCPU locks the calling goroutine to its OS thread, and returns a function that unlocks it again and accounts
+// the CPU time the thread spent in the meantime to the usage of the request. This covers ImageMagick running on that
+// thread, but neither its OpenMP worker threads nor the delegates it runs (e.g. Ghostscript). Commands run by the server
+// itself are accounted by runCommand. Outside Linux, there is no CPU time per thread, and nothing is accounted.
+func measureCPU(ctx context.Context) func() {
+	runtime.LockOSThread()
+
+	before, ok := threadCPUTime()
+
+	return func() {
+		after, ok2 := threadCPUTime()
+		if ok && ok2 {
+			countCPUTime(ctx, after-before)
+		}
+
+		runtime.UnlockOSThread()
+	}
+}
+
+// countingReader defines a reader that counts the bytes read.
+type countingReader struct {
+	io.ReadCloser
+
+	n atomic.Uint64 // n is the number of bytes read so far.
+}
+
+// Read reads from the underlying reader and counts the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(uint64(n))
+
+	return n, err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// wandPool keeps cleared magick wands for reuse, so requests do not allocate a new wand for every input they read.
+// Wands are cached per processor, and wands the pool drops are destroyed by their finalizer.
+var wandPool = sync.Pool{
+	New: func() any {
+		wandsCreated.Add(1)
+		return imagick.NewMagickWand()
+	},
+}
+
+var (
+	wandsCreated  atomic.Uint64 // wandsCreated is the number of wands the pool has allocated.
+	wandsAcquired atomic.Uint64 // wandsAcquired is the number of wands the pool has handed out, new or reused.
+)
+
+// acquireWand returns an empty magick wand from the pool. It must be returned with releaseWand, or destroyed.
+func acquireWand() *imagick.MagickWand {
+	mw, _ := wandPool.Get().(*imagick.MagickWand)
+	wandsAcquired.Add(1)
+
+	return mw
+}
+
+// releaseWand clears the magick wand and returns it to the pool. Clearing drops all images as well as all settings,
+// such as the density or the password, so nothing leaks into the next request.
+func releaseWand(mw *imagick.MagickWand) {
+	mw.Clear()
+	wandPool.Put(mw)
+}
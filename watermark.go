@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/crissyfield/magick-server/imagick"
+)
+
+// watermarkPart is the name of the multipart part that may supply the watermark image.
+const watermarkPart = "watermark"
+
+// watermarkOptions defines how the watermark image is composited onto each page.
+type watermarkOptions struct {
+	Gravity string  `json:"gravity"` // Gravity is the position of the watermark on the page.
+	Opacity float64 `json:"opacity"` // Opacity is the opacity of the watermark, from 0 to 1.
+	Scale   float64 `json:"scale"`   // Scale is the width of the watermark relative to the page width.
+
+	image []byte // image is the encoded watermark image.
+}
+
+// parseWatermarkOptions parses the watermark URL parameters. It returns nil if the watermark is not enabled.
+func parseWatermarkOptions(query url.Values, enabled bool) (*watermarkOptions, *apiError) {
+	opts := &watermarkOptions{Gravity: "center", Opacity: 0.5, Scale: 0.5}
+
+	// Parse gravity
+	if v := query.Get("watermark-gravity"); v != "" {
+		v = normalizeGravity(v)
+		if _, ok := gravityMap[v]; !ok {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid watermark-gravity parameter", nil)
+		}
+
+		opts.Gravity = v
+	}
+
+	// Parse opacity
+	if v := query.Get("watermark-opacity"); v != "" {
+		o, err := strconv.ParseFloat(v, 64)
+		if (err != nil) || !((o >= 0) && (o <= 1)) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid watermark-opacity parameter", err)
+		}
+
+		opts.Opacity = o
+	}
+
+	// Parse scale
+	if v := query.Get("watermark-scale"); v != "" {
+		s, err := strconv.ParseFloat(v, 64)
+		if (err != nil) || !((s > 0) && (s <= 1)) {
+			return nil, newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid watermark-scale parameter", err)
+		}
+
+		opts.Scale = s
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	return opts, nil
+}
+
+// attachWatermark attaches the watermark image to the options. A watermark supplied as multipart part enables the
+// watermark and takes precedence over the configured one.
+func attachWatermark(r *http.Request, opts *convertOptions, in *input, configured []byte) *apiError {
+	// Enable watermark if supplied
+	part, ok := in.parts[watermarkPart]
+	if ok && (opts.Watermark == nil) {
+		opts.Watermark, _ = parseWatermarkOptions(r.URL.Query(), true)
+	}
+
+	if opts.Watermark == nil {
+		return nil
+	}
+
+	// Pick watermark image
+	switch {
+	case ok:
+		opts.Watermark.image = part
+	case len(configured) > 0:
+		opts.Watermark.image = configured
+	default:
+		return newAPIError(http.StatusBadRequest, errorCodeInvalidParameter, "no watermark configured", nil)
+	}
+
+	return nil
+}
+
+// applyWatermark composites the watermark image onto the page.
+func applyWatermark(mw *imagick.MagickWand, opts *watermarkOptions) error {
+	// Read watermark image
+	wm := acquireWand()
+	defer releaseWand(wm)
+
+	err := wm.ReadImageBlob(opts.image)
+	if err != nil {
+		return fmt.Errorf("read watermark: %w", err)
+	}
+
+	// Scale watermark relative to page width
+	width := uint(math.Max(1, math.Round(float64(mw.GetImageWidth())*opts.Scale)))
+	height := uint(math.Max(1, math.Round(float64(wm.GetImageHeight())*float64(width)/float64(wm.GetImageWidth()))))
+
+	err = imagick.ResizeImage(wm, width, height, imagick.FILTER_LANCZOS)
+	if err != nil {
+		return fmt.Errorf("scale watermark: %w", err)
+	}
+
+	// Composite watermark with opacity
+	args := strconv.FormatFloat(opts.Opacity*100.0, 'f', -1, 64)
+
+	for _, w := range []*imagick.MagickWand{mw, wm} {
+		err = w.SetImageArtifact("compose:args", args)
+		if err != nil {
+			return fmt.Errorf("set opacity: %w", err)
+		}
+	}
+
+	err = mw.CompositeImageGravity(wm, imagick.COMPOSITE_OP_DISSOLVE, gravityMap[opts.Gravity])
+	if err != nil {
+		return fmt.Errorf("composite watermark: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	aesExtraID     = 0x9901 // aesExtraID is the ID of the WinZip AES extra field.
+	aesMethod      = 99     // aesMethod is the compression method of WinZip AES encrypted entries.
+	aesVersion     = 51     // aesVersion is the Zip version needed to extract AES encrypted entries.
+	aesSaltLength  = 16     // aesSaltLength is the length of the salt of AES-256.
+	aesKeyLength   = 32     // aesKeyLength is the length of the keys of AES-256.
+	aesVerifierLen = 2      // aesVerifierLen is the length of the password verification value.
+	aesAuthLength  = 10     // aesAuthLength is the length of the authentication code.
+	aesIterations  = 1000   // aesIterations is the number of PBKDF2 iterations of the key derivation.
+)
+
+// encryptEntry compresses the data of a Zip archive entry with the given method, and encrypts it with AES-256 according
+// to the WinZip AE-2 specification, which 7-Zip, WinZip, and most other extraction tools support. It returns the raw
+// entry data and its extra field.
+func encryptEntry(password string, method uint16, data []byte) ([]byte, []byte, error) {
+	// Compress data
+	if method == zip.Deflate {
+		buf := &bytes.Buffer{}
+
+		fw, err := flate.NewWriter(buf, flate.BestSpeed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create compressor: %w", err)
+		}
+
+		_, err = fw.Write(data)
+		if err == nil {
+			err = fw.Close()
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("compress entry: %w", err)
+		}
+
+		data = buf.Bytes()
+	}
+
+	// Derive keys from password and random salt
+	salt := make([]byte, aesSaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate salt: %w", err)
+	}
+
+	keys := pbkdf2SHA1([]byte(password), salt, aesIterations, 2*aesKeyLength+aesVerifierLen)
+	encKey, authKey, verifier := keys[:aesKeyLength], keys[aesKeyLength:2*aesKeyLength], keys[2*aesKeyLength:]
+
+	// Encrypt, then authenticate
+	out := make([]byte, 0, aesSaltLength+aesVerifierLen+len(data)+aesAuthLength)
+	out = append(append(out, salt...), verifier...)
+	start := len(out)
+	out = append(out, data...)
+
+	err = aesCTR(encKey, out[start:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(out[start:]) //nolint:errcheck
+
+	out = append(out, mac.Sum(nil)[:aesAuthLength]...)
+
+	// Describe encryption in extra field: version AE-2, vendor "AE", AES-256, and the actual method
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2)
+	copy(extra[6:], "AE")
+	extra[8] = 3
+	binary.LittleEndian.PutUint16(extra[9:], method)
+
+	return out, extra, nil
+}
+
+// aesCTR encrypts the data in place with AES in counter mode, using the little-endian counter starting at 1 that
+// WinZip AES prescribes, which differs from the big-endian counter of crypto/cipher.
+func aesCTR(key, data []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("create cipher: %w", err)
+	}
+
+	var counter, stream [aes.BlockSize]byte
+
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := range counter {
+			counter[j]++
+			if counter[j] != 0 {
+				break
+			}
+		}
+
+		block.Encrypt(stream[:], counter[:])
+
+		chunk := data[i:min(i+aes.BlockSize, len(data))]
+		subtle.XORBytes(chunk, chunk, stream[:len(chunk)])
+	}
+
+	return nil
+}
+
+// pbkdf2SHA1 derives a key of the given length from the password and the salt with PBKDF2 and HMAC-SHA1.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+
+	var key []byte
+
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)                                      //nolint:errcheck
+		prf.Write(binary.BigEndian.AppendUint32(nil, block)) //nolint:errcheck
+
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u) //nolint:errcheck
+
+			u = prf.Sum(u[:0])
+			subtle.XORBytes(t, t, u)
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
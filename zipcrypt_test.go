@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestPBKDF2SHA1 checks the key derivation against the test vectors of RFC 6070.
+func TestPBKDF2SHA1(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"password", "salt", 16777216, "eefe3d61cd4da4e4e9945b3d6ba2158c2634e984"},
+		{
+			"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038",
+		},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q/%d", tt.password, tt.iterations), func(t *testing.T) {
+			if testing.Short() && (tt.iterations > 4096) {
+				t.Skip("skipped in short mode")
+			}
+
+			got := hex.EncodeToString(pbkdf2SHA1([]byte(tt.password), []byte(tt.salt), tt.iterations, len(tt.want)/2))
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEncryptEntry reads an AE-2 fixture written by libarchive ("bsdtar --options zip:encryption=aes256"), and
+// round-trips entries written by writeEntry through the same reader and, if installed, through bsdtar.
+func TestEncryptEntry(t *testing.T) {
+	const password = "secret"
+
+	t.Run("fixture", func(t *testing.T) {
+		zr, err := zip.OpenReader(filepath.Join("testdata", "ae2.zip"))
+		if err != nil {
+			t.Fatalf("open fixture: %v", err)
+		}
+
+		defer zr.Close() //nolint:errcheck
+
+		got, err := readEncryptedEntry(zr.File[0], password)
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+
+		if want := "Hello, WinZip AES!\n"; string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	})
+
+	data := bytes.Repeat([]byte("magick-server "), 1000)
+
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		t.Run(fmt.Sprintf("method-%d", method), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			zw := zip.NewWriter(buf)
+
+			err := writeEntry(zw, "page.txt", method, data, password)
+			if err == nil {
+				err = zw.Close()
+			}
+
+			if err != nil {
+				t.Fatalf("write archive: %v", err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("open archive: %v", err)
+			}
+
+			got, err := readEncryptedEntry(zr.File[0], password)
+			if err != nil {
+				t.Fatalf("read entry: %v", err)
+			}
+
+			if !bytes.Equal(got, data) {
+				t.Fatal("decrypted entry differs from data")
+			}
+
+			_, err = readEncryptedEntry(zr.File[0], "wrong")
+			if err == nil {
+				t.Fatal("read entry with wrong password")
+			}
+
+			// Extract with libarchive, which implements WinZip AES independently
+			bsdtar, err := exec.LookPath("bsdtar")
+			if err != nil {
+				t.Skip("bsdtar not installed")
+			}
+
+			archive := filepath.Join(t.TempDir(), "pages.zip")
+
+			err = os.WriteFile(archive, buf.Bytes(), 0o600)
+			if err != nil {
+				t.Fatalf("write archive: %v", err)
+			}
+
+			out, err := exec.Command(bsdtar, "--passphrase", password, "-xOf", archive).Output()
+			if err != nil {
+				t.Fatalf("extract with bsdtar: %v", err)
+			}
+
+			if !bytes.Equal(out, data) {
+				t.Fatal("entry extracted by bsdtar differs from data")
+			}
+		})
+	}
+}
+
+// readEncryptedEntry decrypts, authenticates, and decompresses a WinZip AE-2 entry according to the specification.
+func readEncryptedEntry(f *zip.File, password string) ([]byte, error) {
+	// Find AES extra field: version AE-2, vendor "AE", AES-256, and the actual method
+	var extra []byte
+
+	for rest := f.Extra; len(rest) >= 4; {
+		id, size := binary.LittleEndian.Uint16(rest[0:]), int(binary.LittleEndian.Uint16(rest[2:]))
+		if len(rest) < 4+size {
+			break
+		}
+
+		if id == aesExtraID {
+			extra = rest[4 : 4+size]
+		}
+
+		rest = rest[4+size:]
+	}
+
+	if (f.Method != aesMethod) || (f.Flags&0x1 == 0) || (len(extra) != 7) {
+		return nil, errors.New("not an AES encrypted entry")
+	}
+
+	if (binary.LittleEndian.Uint16(extra[0:]) != 2) || (string(extra[2:4]) != "AE") || (extra[4] != 3) {
+		return nil, errors.New("not an AE-2 entry encrypted with AES-256")
+	}
+
+	method := binary.LittleEndian.Uint16(extra[5:])
+
+	// Split raw data into salt, password verification value, encrypted data, and authentication code
+	r, err := f.OpenRaw()
+	if err != nil {
+		return nil, fmt.Errorf("open entry: %w", err)
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read entry: %w", err)
+	}
+
+	if len(raw) < aesSaltLength+aesVerifierLen+aesAuthLength {
+		return nil, errors.New("entry too short")
+	}
+
+	salt, verifier := raw[:aesSaltLength], raw[aesSaltLength:aesSaltLength+aesVerifierLen]
+	data, auth := raw[aesSaltLength+aesVerifierLen:len(raw)-aesAuthLength], raw[len(raw)-aesAuthLength:]
+
+	// Check password and authentication code, then decrypt
+	keys := pbkdf2SHA1([]byte(password), salt, aesIterations, 2*aesKeyLength+aesVerifierLen)
+	if !bytes.Equal(keys[2*aesKeyLength:], verifier) {
+		return nil, errors.New("wrong password")
+	}
+
+	mac := hmac.New(sha1.New, keys[aesKeyLength:2*aesKeyLength])
+	mac.Write(data) //nolint:errcheck
+
+	if !hmac.Equal(mac.Sum(nil)[:aesAuthLength], auth) {
+		return nil, errors.New("authentication failed")
+	}
+
+	err = aesCTR(keys[:aesKeyLength], data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decompress data
+	switch method {
+	case zip.Store:
+		return data, nil
+	case zip.Deflate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	default:
+		return nil, fmt.Errorf("unsupported method %d", method)
+	}
+}